@@ -0,0 +1,169 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "net/http"
+    "sync"
+    "time"
+)
+
+/* ring keeps the last len(items) values added to it */
+type ring[T any] struct {
+    items []T
+    next  int
+    full  bool
+}
+
+func newRing[T any](size int) ring[T] {
+    return ring[T]{items: make([]T, size)}
+}
+
+func (r *ring[T]) add(v T) {
+    if len(r.items) == 0 {
+        return
+    }
+    r.items[r.next] = v
+    if r.next++; r.next == len(r.items) {
+        r.next, r.full = 0, true
+    }
+}
+
+/* all returns a copy of the kept values, oldest first */
+func (r *ring[T]) all() []T {
+    if !r.full {
+        return append([]T(nil), r.items[:r.next]...)
+    }
+    return append(append([]T(nil), r.items[r.next:]...), r.items[:r.next]...)
+}
+
+// AdminError is a recently failed request reported by the admin endpoint.
+type AdminError struct {
+    Time    time.Time `json:"time"`
+    Method  string    `json:"method"`
+    URL     string    `json:"url"`
+    Pattern string    `json:"pattern,omitempty"`
+    Status  int       `json:"status"`
+    Err     string    `json:"error,omitempty"`
+}
+
+type adminStats struct {
+    mux    *Mux
+    mutex  sync.Mutex
+    errors ring[AdminError]
+}
+
+func (s *adminStats) record(oc *Outcome) {
+    if oc.Status < 500 {
+        return
+    }
+    ae := AdminError{
+        Time:    time.Now(),
+        Method:  oc.Request.Method,
+        URL:     s.mux.redaction().url(oc.Request.URL),
+        Pattern: oc.Pattern,
+        Status:  oc.Status,
+    }
+    if oc.Err != nil {
+        ae.Err = oc.Err.Error()
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.errors.add(ae)
+}
+
+type debugToggles struct {
+    Debug        bool `json:"debug"`
+    DebugTimings bool `json:"debug_timings"`
+}
+
+// EnableAdmin registers an introspection API below prefix, e.g. "/_cmux/",
+// serving the route table (routes), recent server errors (errors), route
+// latency percentiles (timings), the debug toggles (debug, which can be
+// changed using PUT), the maintenance mode (maintenance, which can be
+// switched using PUT, see SetMaintenance) and, when debug traces are kept
+// by a RingSink, the recent traces (traces). Every request must be accepted by authorize, which
+// should return an error for requests not allowed to use the API. Such
+// requests are rejected with 403 Forbidden unless the error implements
+// HTTPErrorResponder.
+func (mux *Mux) EnableAdmin(prefix string, authorize func(*http.Request) error) {
+    if authorize == nil {
+        panic("cmux: EnableAdmin requires an authorizer")
+    }
+    stats := &adminStats{mux: mux, errors: newRing[AdminError](100)}
+    mux.After(stats.record)
+    mux.EnableTimingHistograms(true)
+    type Md struct{}
+    g := mux.Group(prefix, drainExempt(), Internal(), Tag("cmux-admin"), authorizer(authorize))
+    g.HandleFunc("/routes", &Md{},
+        Get(func(req *Request[EmptyBody, *Md]) error {
+            return Bypass(mux.Routes())
+        }, nil),
+    )
+    g.HandleFunc("/errors", &Md{},
+        Get(func(req *Request[EmptyBody, *Md]) error {
+            stats.mutex.Lock()
+            defer stats.mutex.Unlock()
+            return Bypass(stats.errors.all())
+        }, nil),
+    )
+    g.HandleFunc("/timings", &Md{},
+        Get(func(req *Request[EmptyBody, *Md]) error {
+            return Bypass(mux.TimingHistograms())
+        }, nil),
+    )
+    g.HandleFunc("/debug", &Md{},
+        Get(func(req *Request[EmptyBody, *Md]) error {
+            return Bypass(debugToggles{
+                Debug:        mux.debugOpts.Load() != nil,
+                DebugTimings: mux.debugTimings.Load(),
+            })
+        }, nil),
+        Put(func(req *Request[debugToggles, *Md]) error {
+            if req.Body.Debug != (mux.debugOpts.Load() != nil) {
+                mux.EnableDebug(req.Body.Debug)
+            }
+            mux.EnableDebugTimings(req.Body.DebugTimings)
+            return Bypass(req.Body)
+        }, nil),
+    )
+    g.HandleFunc("/maintenance", &Md{},
+        Get(func(req *Request[EmptyBody, *Md]) error {
+            enabled, allow := mux.Maintenance()
+            return Bypass(maintenanceState{enabled, allow})
+        }, nil),
+        Put(func(req *Request[maintenanceState, *Md]) error {
+            mux.SetMaintenance(req.Body.Enabled, req.Body.Allow...)
+            return Bypass(req.Body)
+        }, nil),
+    )
+    g.HandleFunc("/traces", &Md{},
+        Get(func(req *Request[EmptyBody, *Md]) error {
+            opts := mux.debugOpts.Load()
+            if opts == nil {
+                return Bypass([]DebugRecord{})
+            }
+            if rs, ok := opts.Sink.(*RingSink); ok {
+                return Bypass(rs.Records())
+            }
+            return HTTPError("debug traces are not kept in memory", http.StatusNotFound)
+        }, nil),
+    )
+}
+
+// authorizer rejects requests not accepted by authorize with 403 Forbidden,
+// unless the error implements HTTPErrorResponder.
+func authorizer(authorize func(*http.Request) error) RouteOption {
+    return func(o *routeOptions) {
+        o.before = append(o.before, func(w http.ResponseWriter, r *http.Request, _ any) error {
+            err := authorize(r)
+            var her HTTPErrorResponder
+            if err == nil || errors.As(err, &her) {
+                return err
+            }
+            return HTTPError("", http.StatusForbidden)
+        })
+    }
+}
@@ -0,0 +1,256 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "log/slog"
+    "net/http"
+    "reflect"
+    "time"
+)
+
+const(
+    defaultAsyncWorkers = 8
+    asyncQueueSize      = 1024 /* jobs beyond this are rejected */
+)
+
+// AsyncConfig configures the handling of async routes, see AsyncWith.
+type AsyncConfig struct {
+    // Retries is how many times a job is retried after the handler
+    // panicked or responded with a 5xx status.
+    Retries int
+    // Backoff is the delay before the first retry, doubling for every
+    // further retry.
+    Backoff time.Duration
+    // Timeout limits the duration of each attempt if positive.
+    Timeout time.Duration
+}
+
+// Async makes the route respond 202 Accepted with a Job as soon as the
+// request has passed the Before functions, and run the handler in the
+// background using the worker pool of the mux. It is short for
+// AsyncWith(AsyncConfig{Retries: 3, Backoff: time.Second}).
+func Async() RouteOption {
+    return AsyncWith(AsyncConfig{Retries: 3, Backoff: time.Second})
+}
+
+// AsyncWith is like Async but configures the retries and timeouts of the
+// jobs. The response of the handler is stored as the result of the job,
+// which can be polled using the job status route, see HandleJobs, whose
+// location is sent in the Location header of the 202 response. Handlers
+// can read the ID of their job using JobID. Panics are recovered and
+// count as failed attempts. Requests are rejected with
+// 503 Service Unavailable when the queue of the worker pool is full.
+func AsyncWith(cfg AsyncConfig) RouteOption {
+    return func(o *routeOptions) {
+        o.async = &cfg
+    }
+}
+
+var jobIDKey = NewKey[string]("job id")
+
+// JobID returns the ID of the job of a request served by an async route,
+// or an empty string for other requests.
+func JobID(r *http.Request) string {
+    id, _ := jobIDKey.Get(RequestValues(r))
+    return id
+}
+
+// SetAsyncWorkers sets the number of workers running the jobs of async
+// routes, which is 8 by default. It must be called before serving
+// requests.
+func (mux *Mux) SetAsyncWorkers(n int) {
+    mux.asyncWorkers = n
+}
+
+/* asyncPool runs the jobs of a mux */
+type asyncPool struct {
+    queue chan *asyncTask
+}
+
+type asyncTask struct {
+    job  Job
+    cfg  AsyncConfig
+    rs   *reqState /* the state of the original request */
+    r    *http.Request /* a copy of the request, detached from its context */
+    raw  []byte
+    md   any /* a copy of the metadata after the Before functions */
+}
+
+func (mux *Mux) asyncPool() *asyncPool {
+    mux.asyncOnce.Do(func() {
+        n := mux.asyncWorkers
+        if n <= 0 {
+            n = defaultAsyncWorkers
+        }
+        mux.async = &asyncPool{queue: make(chan *asyncTask, asyncQueueSize)}
+        for i := 0; i < n; i++ {
+            go func() {
+                for task := range mux.async.queue {
+                    task.run()
+                    mux.inFlight.Add(-1)
+                }
+            }()
+        }
+    })
+    return mux.async
+}
+
+func newJobID() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// enqueueAsync queues the handler of an async route, responding with the
+// job of the request.
+func (rs *reqState) enqueueAsync(w http.ResponseWriter, r *http.Request, mdIf any) error {
+    mux := rs.mux
+    raw, err := rs.readBody(r)
+    if err != nil {
+        return err
+    }
+    now := time.Now()
+    task := &asyncTask{
+        job: Job{ID: newJobID(), Status: JobPending, Created: now},
+        cfg: *rs.mh.opts.async,
+        rs:  rs,
+        /* the job outlives the request */
+        r:   r.Clone(context.WithoutCancel(r.Context())),
+        raw: raw,
+        md:  copyMd(mdIf),
+    }
+    if err := mux.putJob(r.Context(), &task.job); err != nil {
+        return err
+    }
+    job := task.job /* the task is owned by the workers once queued */
+    mux.inFlight.Add(1)
+    select {
+    case mux.asyncPool().queue <- task:
+    default:
+        mux.inFlight.Add(-1)
+        if err := mux.jobs.DeleteJob(r.Context(), job.ID); err != nil {
+            mux.log(r, slog.LevelError, "failed to delete job", slog.String("job", job.ID), slog.Any("error", err))
+        }
+        mux.log(r, slog.LevelWarn, "async queue full, rejecting request")
+        return ErrServiceUnavailable
+    }
+    if mux.jobsPath != "" {
+        w.Header().Set("Location", mux.jobsPath + "/" + job.ID)
+    }
+    return &accepted{job}
+}
+
+/* copyMd copies the metadata, which may be reused once the request is
+ * served. Its slices and maps are copied as well, see copyValue. */
+func copyMd(md any) any {
+    if md == nil {
+        return nil
+    }
+    v := reflect.ValueOf(md)
+    if v.Kind() != reflect.Pointer {
+        return md
+    }
+    c := reflect.New(v.Type().Elem())
+    copyValue(c.Elem(), v.Elem())
+    return c.Interface()
+}
+
+/* accepted responds 202 Accepted with the job of an async request */
+type accepted struct {
+    job Job
+}
+
+func (a *accepted) HTTPError() (int, any) {
+    return http.StatusAccepted, a.job
+}
+
+func (a *accepted) Error() string {
+    return "accepted"
+}
+
+func (t *asyncTask) run() {
+    mux := t.rs.mux
+    backoff := t.cfg.Backoff
+    for attempt := 1; ; attempt++ {
+        t.job.Status = JobRunning
+        t.job.Attempts = attempt
+        t.save()
+        code, body := t.attempt()
+        t.job.Code = code
+        t.job.Result = nil
+        if json.Valid(body) {
+            t.job.Result = body
+        }
+        if code < 500 || attempt > t.cfg.Retries {
+            if code < 400 {
+                t.job.Status = JobSucceeded
+            } else {
+                t.job.Status = JobFailed
+            }
+            t.save()
+            return
+        }
+        mux.log(t.r, slog.LevelWarn, "async job failed, retrying",
+                slog.String("job", t.job.ID), slog.Int("attempt", attempt), slog.Int("status", code))
+        time.Sleep(backoff)
+        backoff *= 2
+    }
+}
+
+/* save stores the job, which is served regardless of the outcome */
+func (t *asyncTask) save() {
+    if err := t.rs.mux.putJob(t.r.Context(), &t.job); err != nil {
+        t.rs.mux.log(t.r, slog.LevelError, "failed to store job", slog.String("job", t.job.ID), slog.Any("error", err))
+    }
+}
+
+/* attempt runs the handler once, returning its status code and body */
+func (t *asyncTask) attempt() (code int, body []byte) {
+    mux, mh := t.rs.mux, t.rs.mh
+    rs := &reqState{
+        mux:     mux,
+        mh:      mh,
+        node:    t.rs.node,
+        roles:   t.rs.roles,
+        tenant:  t.rs.tenant,
+        rawBody: t.raw,
+        start:   time.Now(),
+    }
+    md := copyMd(t.md)
+    rs.md = md
+    defer rs.values.release()
+    jobIDKey.Set(&rs.values, t.job.ID)
+    ctx := context.WithValue(t.r.Context(), reqStateKey{}, rs)
+    if t.cfg.Timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, t.cfg.Timeout)
+        defer cancel()
+    }
+    r := t.r.Clone(ctx)
+    r.Body = io.NopCloser(bytes.NewReader(t.raw))
+    r.ContentLength = int64(len(t.raw))
+    rs.r = r
+    cw := &captureWriter{ResponseWriter: &discardWriter{header: http.Header{}}}
+    defer func() {
+        if p := recover(); p != nil {
+            mux.log(r, slog.LevelError, "async job panicked", slog.String("job", t.job.ID), slog.Any("panic", p))
+            code, body = http.StatusInternalServerError, nil
+        }
+    }()
+    /* handlers may modify the metadata, so each attempt gets a copy */
+    if err := mh.fn(cw, r, md, rs); err != nil {
+        mux.handleErr(cw, r, mh, err)
+    }
+    if cw.status == 0 {
+        return http.StatusOK, cw.body.Bytes()
+    }
+    return cw.status, cw.body.Bytes()
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// AuditEvent records a request served by a route using Audited.
+type AuditEvent struct {
+    Time    time.Time         `json:"time"`
+    Action  string            `json:"action"` /* e.g. "user.delete" */
+    // Actor identifies who made the request, see AuditActor.
+    Actor   string            `json:"actor,omitempty"`
+    Tenant  TenantID          `json:"tenant,omitempty"` /* see SetTenants */
+    Method  string            `json:"method"`
+    Pattern string            `json:"pattern"`
+    Params  map[string]string `json:"params,omitempty"` /* the raw path variables */
+    Status  int               `json:"status"`
+    Success bool              `json:"success"` /* the status is below 400 */
+    // Err is the message of an unexpected error returned by the handler.
+    Err     string            `json:"error,omitempty"`
+}
+
+// AuditSink receives audit events. Implementations must be safe for
+// concurrent use.
+type AuditSink interface {
+    Audit(ev *AuditEvent)
+}
+
+// AuditSinkFunc adapts a function to the AuditSink interface.
+type AuditSinkFunc func(ev *AuditEvent)
+
+func (fn AuditSinkFunc) Audit(ev *AuditEvent) {
+    fn(ev)
+}
+
+// AuditActor is implemented by metadata identifying who makes a request,
+// typically using fields set by the Before function of the mux after
+// authenticating the request, e.g.
+//
+//  func (md *Md) AuditActor() string { return md.User.ID }
+//
+// Requests to routes whose metadata does not implement AuditActor are
+// attributed to the common name of the client certificate, if any.
+type AuditActor interface {
+    AuditActor() string
+}
+
+// Audited makes a route emit an audit event for action, e.g. "user.delete",
+// after every request has been handled, including rejected requests. The
+// events are sent to the sink set using SetAuditSink.
+func Audited(action string) RouteOption {
+    return func(o *routeOptions) {
+        o.audit = action
+    }
+}
+
+// SetAuditSink sets the sink receiving the events of audited routes. Until
+// a sink is set, events are logged at info level using the logger of the
+// mux.
+func (mux *Mux) SetAuditSink(sink AuditSink) {
+    mux.auditSink = sink
+}
+
+func (mux *Mux) audit(w http.ResponseWriter, r *http.Request, mh *MethodHandler, md any, err error) {
+    ev := &AuditEvent{
+        Time:    time.Now(),
+        Action:  mh.opts.audit,
+        Method:  r.Method,
+        Pattern: mh.pattern,
+        Tenant:  Tenant(r),
+        Status:  http.StatusOK,
+    }
+    if a, ok := md.(AuditActor); ok {
+        ev.Actor = a.AuditActor()
+    } else if id := ClientCert(r); id != nil {
+        ev.Actor = id.CommonName
+    }
+    /* the path variables of the match serving the request */
+    if rs := requestState(r.Context()); rs != nil && len(rs.patches) > 0 {
+        ev.Params = make(map[string]string, len(rs.patches))
+        for _, p := range rs.patches {
+            ev.Params[p.Label] = p.Raw
+        }
+    }
+    if rw, ok := w.(*responseWriter); ok && rw.Status() != 0 {
+        ev.Status = rw.Status()
+    }
+    ev.Success = ev.Status < 400
+    if err != nil && !isResponder(err) {
+        ev.Err = err.Error()
+    }
+    if mux.auditSink != nil {
+        mux.auditSink.Audit(ev)
+        return
+    }
+    /* the tenant is included by mux.log, audit records are never sampled */
+    mux.logRecord(r, slog.LevelInfo, "audit", false, slog.String("action", ev.Action),
+            slog.String("actor", ev.Actor), slog.Any("params", ev.Params),
+            slog.Int("status", ev.Status), slog.Bool("success", ev.Success),
+            slog.String("error", ev.Err))
+}
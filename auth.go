@@ -0,0 +1,58 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "net/http"
+)
+
+// BasicAuth requires requests to carry HTTP basic auth credentials accepted
+// by validate. It can be attached to routes or groups. Requests without valid
+// credentials are rejected with ErrUnauthorized and a WWW-Authenticate
+// header, unless validate returns an error implementing HTTPErrorResponder,
+// e.g. HTTPError("", http.StatusForbidden), which is responded instead.
+func BasicAuth(validate func(user, pass string) error) RouteOption {
+    const challenge = `Basic realm="restricted", charset="UTF-8"`
+    return func(o *routeOptions) {
+        o.before = append(o.before, func(w http.ResponseWriter, r *http.Request, _ any) error {
+            user, pass, ok := r.BasicAuth()
+            if !ok {
+                return unauthorized(w, challenge, nil)
+            }
+            if err := validate(user, pass); err != nil {
+                return unauthorized(w, challenge, err)
+            }
+            return nil
+        })
+    }
+}
+
+// APIKey requires requests to carry an API key accepted by validate in the
+// specified header. Failed requests are responded to like for BasicAuth.
+func APIKey(header string, validate func(key string) error) RouteOption {
+    challenge := `APIKey header="` + header + `"`
+    return func(o *routeOptions) {
+        o.before = append(o.before, func(w http.ResponseWriter, r *http.Request, _ any) error {
+            key := r.Header.Get(header)
+            if key == "" {
+                return unauthorized(w, challenge, nil)
+            }
+            if err := validate(key); err != nil {
+                return unauthorized(w, challenge, err)
+            }
+            return nil
+        })
+    }
+}
+
+/* unauthorized maps a failed authentication to a consistent 401 response */
+func unauthorized(w http.ResponseWriter, challenge string, err error) error {
+    var her HTTPErrorResponder
+    if errors.As(err, &her) {
+        return err
+    }
+    w.Header().Set("WWW-Authenticate", challenge)
+    return ErrUnauthorized
+}
@@ -0,0 +1,428 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "log"
+    "net/http"
+    "net/url"
+    "reflect"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "unsafe"
+)
+
+// QueryBinder is implemented by metadata fields binding themselves from
+// the query parameters of a request, such as Page. Binders are called with
+// the field as copied from the metadata template, so the template can carry
+// defaults.
+type QueryBinder interface {
+    BindQuery(q url.Values) error
+}
+
+/* fieldBinder binds a metadata field from the request */
+type fieldBinder struct {
+    index []int
+    name  string /* parameter, header or cookie, unless the field is a QueryBinder */
+    kind  int
+    allow []string /* allowed fields of Sort and Filter */
+    cookieMode int /* for bindCookie */
+    required   bool
+    dflt       *string /* default value of missing parameters */
+    oneof      []string /* allowed values */
+}
+
+const(
+    bindScalar = iota /* from the query */
+    bindCustom /* the field implements QueryBinder */
+    bindSort
+    bindFilter
+    bindCookie
+    bindHeader
+    bindPath /* checks required path variables */
+    bindMatrix
+    bindClientCert /* the field is a *ClientIdentity */
+    bindTenant /* the field is a TenantID */
+)
+
+var(
+    binderCache     sync.Map /* reflect.Type -> []fieldBinder */
+    queryBinderType = reflect.TypeFor[QueryBinder]()
+    sortType        = reflect.TypeFor[Sort]()
+    filterType      = reflect.TypeFor[Filter]()
+)
+
+// bindersOf returns the binders of the metadata struct type t. Fields are
+// bound from the query if tagged e.g. `query:"limit"`, if they implement
+// QueryBinder or if they are of type Sort or Filter, from headers if
+// tagged e.g. `header:"X-Api-Key"` and from cookies if tagged e.g.
+// `cookie:"session_id"`, `cookie:"session_id,signed"` or
+// `cookie:"session_id,encrypted"`. Query, header and cookie tags accept
+// the options required, oneof and default, which must be last, e.g.
+// `query:"page,default=1"` or `query:"status,oneof=active|archived"`.
+// Fields of type *ClientIdentity are bound to the client certificate and
+// fields of type TenantID to the tenant of the request.
+func bindersOf(t reflect.Type) []fieldBinder {
+    if v, ok := binderCache.Load(t); ok {
+        return v.([]fieldBinder)
+    }
+    var binders []fieldBinder
+    for _, f := range reflect.VisibleFields(t) {
+        if !f.IsExported() {
+            continue
+        }
+        if _, ok := fieldOffset(t, f.Index); !ok {
+            /* promoted through an embedded pointer */
+            continue
+        }
+        if reflect.PointerTo(f.Type).Implements(queryBinderType) {
+            binders = append(binders, fieldBinder{index: f.Index, kind: bindCustom})
+            continue
+        }
+        if f.Type == clientIdentityType {
+            binders = append(binders, fieldBinder{index: f.Index, kind: bindClientCert})
+            continue
+        }
+        if f.Type == tenantIDType {
+            binders = append(binders, fieldBinder{index: f.Index, kind: bindTenant})
+            continue
+        }
+        if f.Type == sortType || f.Type == filterType {
+            b := fieldBinder{index: f.Index, kind: bindSort, name: "sort"}
+            if f.Type == filterType {
+                b.kind, b.name = bindFilter, "filter"
+            }
+            if name, _, _ := strings.Cut(f.Tag.Get("query"), ","); name != "" {
+                b.name = name
+            }
+            if allow := f.Tag.Get("allow"); allow != "" {
+                b.allow = strings.Split(allow, ",")
+            }
+            binders = append(binders, b)
+            continue
+        }
+        if name, opts := pathTag(f); opts.required {
+            if name == "" {
+                name = strings.ToLower(f.Name)
+            }
+            binders = append(binders, fieldBinder{index: f.Index, name: name, kind: bindPath, required: true})
+            continue
+        }
+        for _, src := range []struct{tag string; kind int}{
+            {"query", bindScalar}, {"header", bindHeader}, {"cookie", bindCookie}, {"matrix", bindMatrix},
+        } {
+            tag, ok := f.Tag.Lookup(src.tag)
+            if !ok || tag == "-" {
+                continue
+            }
+            b := parseBindTag(f, src.tag, tag)
+            b.index, b.kind = f.Index, src.kind
+            if src.kind == bindHeader {
+                b.name = http.CanonicalHeaderKey(b.name)
+            }
+            binders = append(binders, b)
+            break
+        }
+    }
+    binderCache.Store(t, binders)
+    return binders
+}
+
+/* rawPathVar returns the matched segment of the path variable bound to the
+ * metadata field at index, or "" if the variable was not matched */
+func (rs *reqState) rawPathVar(index []int) string {
+    for _, p := range rs.patches {
+        if slices.Equal(p.Index, index) {
+            return p.Raw
+        }
+    }
+    return ""
+}
+
+// routeBinders returns the binders of a route having the path variables
+// labels, leaving out checks of variables not in its path.
+func routeBinders(binders []fieldBinder, labels []string) []fieldBinder {
+    var rb []fieldBinder
+    for _, b := range binders {
+        if b.kind != bindPath || slices.Contains(labels, b.name) {
+            rb = append(rb, b)
+        }
+    }
+    return rb
+}
+
+/* parseBindTag parses the name and options of a query, header or cookie tag */
+func parseBindTag(f reflect.StructField, source, tag string) fieldBinder {
+    name, opts, _ := strings.Cut(tag, ",")
+    b := fieldBinder{name: name}
+    parse, ok := scalarParser(f.Type)
+    if !ok || (source == "cookie" && f.Type.Kind() == reflect.Slice) {
+        log.Fatalf("unsupported type %s of %s field %s", f.Type, source, f.Name)
+    }
+    for opts != "" {
+        var opt string
+        if strings.HasPrefix(opts, "default=") {
+            /* the default value may contain commas */
+            opt, opts = opts, ""
+        } else {
+            opt, opts, _ = strings.Cut(opts, ",")
+        }
+        switch {
+        case opt == "required":
+            b.required = true
+        case strings.HasPrefix(opt, "default="):
+            dflt := strings.TrimPrefix(opt, "default=")
+            if err := parse(reflect.New(f.Type).Elem(), dflt); err != nil {
+                log.Fatalf("invalid default %q of field %s", dflt, f.Name)
+            }
+            b.dflt = &dflt
+        case strings.HasPrefix(opt, "oneof="):
+            b.oneof = strings.Split(strings.TrimPrefix(opt, "oneof="), "|")
+        case source == "cookie" && opt == "signed":
+            b.cookieMode = cookieSigned
+        case source == "cookie" && opt == "encrypted":
+            b.cookieMode = cookieEncrypted
+        default:
+            log.Fatalf("unknown %s option %s of field %s", source, opt, f.Name)
+        }
+    }
+    if b.dflt != nil && b.oneof != nil && b.checkOneOf(*b.dflt, f.Type) != nil {
+        log.Fatalf("default %q of field %s is not allowed by oneof", *b.dflt, f.Name)
+    }
+    return b
+}
+
+// checkOneOf checks that val, or each comma-separated part of it for slice
+// fields, is one of the values allowed by the oneof option.
+func (b *fieldBinder) checkOneOf(val string, t reflect.Type) error {
+    if b.oneof == nil {
+        return nil
+    }
+    parts := []string{val}
+    if t.Kind() == reflect.Slice {
+        parts = strings.Split(val, ",")
+    }
+    for _, part := range parts {
+        if !slices.Contains(b.oneof, part) {
+            return errNotOneOf(b.oneof)
+        }
+    }
+    return nil
+}
+
+// FieldError describes a request parameter failing to bind to a metadata
+// field. Binding errors are responded to with 400 Bad Request and list the
+// failing parameters in the "fields" detail.
+type FieldError struct {
+    In     string `json:"in"` /* "path", "query", "header", "cookie" or "matrix" */
+    Name   string `json:"name"`
+    Reason string `json:"reason"`
+}
+
+func fieldErrors(errs []FieldError) *Error {
+    return &Error{
+        Status:  http.StatusBadRequest,
+        Code:    "invalid_request",
+        Message: "invalid request parameters",
+        Details: map[string]any{"fields": errs},
+    }
+}
+
+/* bindReason describes why a value failed to parse */
+func bindReason(err error) string {
+    var ne *strconv.NumError
+    if errors.As(err, &ne) {
+        return "invalid value: " + ne.Err.Error()
+    }
+    return err.Error()
+}
+
+/* scalarParser returns a function setting values of type t from strings */
+func scalarParser(t reflect.Type) (func(reflect.Value, string) error, bool) {
+    if parse, ok := pathTypes.Load(t); ok {
+        parse := parse.(func(string) (unsafe.Pointer, error))
+        return func(v reflect.Value, s string) error {
+            p, err := parse(s)
+            if err != nil {
+                return err
+            }
+            v.Set(reflect.NewAt(t, p).Elem())
+            return nil
+        }, true
+    }
+    switch t.Kind() {
+    case reflect.String:
+        return func(v reflect.Value, s string) error {
+            v.SetString(s)
+            return nil
+        }, true
+    case reflect.Bool:
+        return func(v reflect.Value, s string) error {
+            b, err := strconv.ParseBool(s)
+            v.SetBool(b)
+            return err
+        }, true
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return func(v reflect.Value, s string) error {
+            i, err := strconv.ParseInt(s, 10, t.Bits())
+            v.SetInt(i)
+            return err
+        }, true
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return func(v reflect.Value, s string) error {
+            u, err := strconv.ParseUint(s, 10, t.Bits())
+            v.SetUint(u)
+            return err
+        }, true
+    case reflect.Float32, reflect.Float64:
+        return func(v reflect.Value, s string) error {
+            f, err := strconv.ParseFloat(s, t.Bits())
+            v.SetFloat(f)
+            return err
+        }, true
+    case reflect.Pointer:
+        elem, ok := scalarParser(t.Elem())
+        if !ok {
+            return nil, false
+        }
+        return func(v reflect.Value, s string) error {
+            p := reflect.New(t.Elem())
+            if err := elem(p.Elem(), s); err != nil {
+                return err
+            }
+            v.Set(p)
+            return nil
+        }, true
+    case reflect.Slice:
+        elem, ok := scalarParser(t.Elem())
+        if !ok || t.Elem().Kind() == reflect.Slice {
+            return nil, false
+        }
+        return func(v reflect.Value, s string) error {
+            /* comma-separated values are appended to values of repeated parameters */
+            for _, part := range strings.Split(s, ",") {
+                e := reflect.New(t.Elem()).Elem()
+                if err := elem(e, part); err != nil {
+                    return err
+                }
+                v.Set(reflect.Append(v, e))
+            }
+            return nil
+        }, true
+    }
+    return nil, false
+}
+
+func invalidParam(param string, err error) *Error {
+    return &Error{
+        Status:  http.StatusBadRequest,
+        Code:    "invalid_query",
+        Message: "invalid query parameter " + strconv.Quote(param),
+        Details: map[string]any{"param": param},
+        Err:     err,
+    }
+}
+
+// bind binds the metadata md of a request from its query parameters,
+// headers, cookies and matrix parameters.
+func (mux *Mux) bind(r *http.Request, md any, binders []fieldBinder) error {
+    q := r.URL.Query()
+    mv := reflect.ValueOf(md).Elem()
+    var errs []FieldError
+    for _, b := range binders {
+        fv := mv.FieldByIndex(b.index)
+        var values []string
+        var in string
+        switch b.kind {
+        case bindCustom:
+            if err := fv.Addr().Interface().(QueryBinder).BindQuery(q); err != nil {
+                return err
+            }
+            continue
+        case bindSort:
+            if values, ok := q[b.name]; ok {
+                s, err := parseSort(b.name, values, b.allow)
+                if err != nil {
+                    return err
+                }
+                fv.Set(reflect.ValueOf(s))
+            }
+            continue
+        case bindFilter:
+            f, err := parseFilter(b.name, q, b.allow)
+            if err != nil {
+                return err
+            }
+            if f != nil {
+                fv.Set(reflect.ValueOf(f))
+            }
+            continue
+        case bindClientCert:
+            if id := ClientCert(r); id != nil {
+                fv.Set(reflect.ValueOf(id))
+            }
+            continue
+        case bindTenant:
+            fv.Set(reflect.ValueOf(Tenant(r)))
+            continue
+        case bindPath:
+            /* empty segments of required variables are missing, while
+             * e.g. "0" is a value */
+            if rs := requestState(r.Context()); rs == nil || rs.rawPathVar(b.index) == "" {
+                errs = append(errs, FieldError{"path", b.name, "required"})
+            }
+            continue
+        case bindCookie:
+            in = "cookie"
+            if v, ok := mux.cookieValue(r, &b); ok {
+                values = []string{v}
+            }
+        case bindHeader:
+            in = "header"
+            values = r.Header.Values(b.name)
+        case bindMatrix:
+            in = "matrix"
+            if rs := requestState(r.Context()); rs != nil {
+                values = rs.matrix[b.name]
+            }
+        default:
+            in = "query"
+            values = q[b.name]
+        }
+        if len(values) == 0 {
+            if b.dflt != nil {
+                values = []string{*b.dflt}
+            } else {
+                if b.required {
+                    errs = append(errs, FieldError{in, b.name, "required"})
+                }
+                continue
+            }
+        }
+        parse, _ := scalarParser(fv.Type())
+        if fv.Kind() == reflect.Slice {
+            /* do not append to the slice of the metadata template */
+            fv.Set(reflect.Zero(fv.Type()))
+        } else {
+            values = values[:1]
+        }
+        for _, val := range values {
+            err := b.checkOneOf(val, fv.Type())
+            if err == nil {
+                err = parse(fv, val)
+            }
+            if err != nil {
+                errs = append(errs, FieldError{in, b.name, bindReason(err)})
+                break
+            }
+        }
+    }
+    if len(errs) > 0 {
+        return fieldErrors(errs)
+    }
+    return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "io"
+    "log/slog"
+    "net/http"
+)
+
+// LogBodies logs the request and response bodies of a route, each up to
+// maxBytes, at info level once the request is served, e.g. to debug the
+// requests of a partner integration without enabling debug mode. Bodies are
+// redacted using the rules of the mux, see SetRedaction. Truncated bodies
+// cannot be decoded, so they are dropped entirely if they mention a
+// redacted field. Nothing is recorded unless the logger of the mux is
+// enabled for info level.
+func LogBodies(maxBytes int) RouteOption {
+    return func(o *routeOptions) {
+        o.logBodies = maxBytes
+    }
+}
+
+/* bodyLog records the bodies of a request for LogBodies */
+type bodyLog struct {
+    rw           *responseWriter
+    reqBody      []byte
+    reqTruncated bool
+    reqTee       *limitedBuffer /* the request body as read, if not read ahead */
+    maxBytes     int
+    resBody      *limitedBuffer
+}
+
+// startBodyLog starts recording the bodies of a request, reading ahead the
+// request body unless lazy, which records the body as it is read instead,
+// e.g. for requests waiting for 100 Continue.
+func startBodyLog(w http.ResponseWriter, r *http.Request, maxBytes int, lazy bool) *bodyLog {
+    rw, ok := w.(*responseWriter)
+    if !ok {
+        return nil
+    }
+    if lazy {
+        bl := &bodyLog{
+            rw:       rw,
+            reqTee:   &limitedBuffer{limit: maxBytes + 1},
+            maxBytes: maxBytes,
+            resBody:  &limitedBuffer{limit: maxBytes},
+        }
+        r.Body = struct{
+            io.Reader
+            io.Closer
+        }{io.TeeReader(r.Body, bl.reqTee), r.Body}
+        rw.ResponseWriter = &teeWriter{ResponseWriter: rw.ResponseWriter, tee: bl.resBody}
+        return bl
+    }
+    /* peek at the body, leaving it intact for the handler */
+    head, _ := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes) + 1))
+    r.Body = struct{
+        io.Reader
+        io.Closer
+    }{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+    bl := &bodyLog{
+        rw:           rw,
+        reqBody:      head[:min(len(head), maxBytes)],
+        reqTruncated: len(head) > maxBytes,
+        resBody:      &limitedBuffer{limit: maxBytes},
+    }
+    rw.ResponseWriter = &teeWriter{ResponseWriter: rw.ResponseWriter, tee: bl.resBody}
+    return bl
+}
+
+func (bl *bodyLog) finish(mux *Mux, r *http.Request) {
+    red := mux.redaction()
+    if bl.reqTee != nil {
+        b := bl.reqTee.Bytes()
+        bl.reqBody, bl.reqTruncated = b[:min(len(b), bl.maxBytes)], len(b) > bl.maxBytes
+    }
+    resTruncated := bl.rw.bytes > int64(bl.resBody.Len())
+    mux.log(r, slog.LevelInfo, "request bodies",
+            slog.Int("status", bl.rw.Status()),
+            slog.String("request_body", red.body(bl.reqBody)),
+            slog.Bool("request_truncated", bl.reqTruncated),
+            slog.String("response_body", red.body(bl.resBody.Bytes())),
+            slog.Bool("response_truncated", resTruncated))
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// BreakerConfig configures a circuit breaker. The breaker trips when at
+// least MinRequests requests were handled within Window and the share of
+// failed requests reaches ErrorRate. Requests fail if their handler is
+// responded to with a 5xx status or, if SlowThreshold is set, takes longer
+// than SlowThreshold. Requests rejected before reaching the handler, e.g.
+// by MaxConcurrent, are not counted. A tripped breaker responds 503 Service Unavailable until
+// Cooldown has passed, after which a single probe request is let through.
+// The breaker closes again if the probe succeeds.
+type BreakerConfig struct {
+    Window        time.Duration /* default 10s */
+    MinRequests   int           /* default 20 */
+    ErrorRate     float64       /* default 0.5 */
+    SlowThreshold time.Duration
+    Cooldown      time.Duration /* default 5s */
+}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const(
+    BreakerClosed BreakerState = iota
+    BreakerOpen
+    BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+    switch s {
+    case BreakerClosed:
+        return "closed"
+    case BreakerOpen:
+        return "open"
+    case BreakerHalfOpen:
+        return "half-open"
+    }
+    return "unknown"
+}
+
+// ErrCircuitOpen is responded with 503 Service Unavailable while a circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+var errCircuitOpen = &codeResponder{
+    code:  http.StatusServiceUnavailable,
+    error: ErrCircuitOpen,
+    key:   "circuit_open",
+}
+
+type breaker struct {
+    cfg         BreakerConfig
+    mutex       sync.Mutex
+    state       BreakerState
+    windowStart time.Time
+    requests    int
+    failures    int
+    openedAt    time.Time
+    probing     bool
+}
+
+// CircuitBreaker adds a circuit breaker to a route, failing fast while
+// the route keeps failing. The breaker is shared by all routes the option
+// is passed to. Its state is reported by Mux.Routes.
+func CircuitBreaker(cfg BreakerConfig) RouteOption {
+    if cfg.Window <= 0 {
+        cfg.Window = 10 * time.Second
+    }
+    if cfg.MinRequests <= 0 {
+        cfg.MinRequests = 20
+    }
+    if cfg.ErrorRate <= 0 {
+        cfg.ErrorRate = 0.5
+    }
+    if cfg.Cooldown <= 0 {
+        cfg.Cooldown = 5 * time.Second
+    }
+    b := &breaker{cfg: cfg}
+    return func(o *routeOptions) {
+        o.breaker = b
+    }
+}
+
+// State returns the current state of the breaker.
+func (b *breaker) State() BreakerState {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cfg.Cooldown {
+        return BreakerHalfOpen
+    }
+    return b.state
+}
+
+// allow reports whether a request may be handled, and whether it is a probe.
+func (b *breaker) allow() (bool, bool) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    switch b.state {
+    case BreakerClosed:
+        return true, false
+    case BreakerOpen:
+        if time.Since(b.openedAt) < b.cfg.Cooldown {
+            return false, false
+        }
+        b.state = BreakerHalfOpen
+    }
+    if b.probing {
+        return false, false
+    }
+    b.probing = true
+    return true, true
+}
+
+func (b *breaker) record(failed, probe bool) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    now := time.Now()
+    if probe {
+        b.probing = false
+        if failed {
+            b.state, b.openedAt = BreakerOpen, now
+        } else {
+            b.state = BreakerClosed
+            b.windowStart, b.requests, b.failures = now, 0, 0
+        }
+        return
+    }
+    if b.state != BreakerClosed {
+        return
+    }
+    if now.Sub(b.windowStart) > b.cfg.Window {
+        b.windowStart, b.requests, b.failures = now, 0, 0
+    }
+    b.requests++
+    if failed {
+        b.failures++
+    }
+    if b.requests >= b.cfg.MinRequests &&
+       float64(b.failures) >= b.cfg.ErrorRate * float64(b.requests) {
+        b.state, b.openedAt = BreakerOpen, now
+    }
+}
+
+// cancel ends a request not counted by the breaker.
+func (b *breaker) cancel(probe bool) {
+    if !probe {
+        return
+    }
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    b.probing = false
+}
+
+/* breakerCall tracks a request passing through a circuit breaker */
+type breakerCall struct {
+    b       *breaker
+    probe   bool
+    handled bool /* whether the handler was called */
+}
+
+func (rs *reqState) enterBreaker() error {
+    b := rs.mh.opts.breaker
+    if b == nil {
+        return nil
+    }
+    ok, probe := b.allow()
+    if !ok {
+        return errCircuitOpen
+    }
+    rs.breaker = &breakerCall{b: b, probe: probe}
+    return nil
+}
+
+// leave records the result of the request once the response is written.
+func (c *breakerCall) leave(w http.ResponseWriter, start time.Time, failed bool) {
+    if !c.handled {
+        /* responses of the mux itself, e.g. 503 of MaxConcurrent, say
+         * nothing about the health of the route */
+        c.b.cancel(c.probe)
+        return
+    }
+    if rw, ok := w.(*responseWriter); ok && rw.Status() >= 500 {
+        failed = true
+    }
+    if c.b.cfg.SlowThreshold > 0 && time.Since(start) > c.b.cfg.SlowThreshold {
+        failed = true
+    }
+    c.b.record(failed, c.probe)
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "encoding/json"
+    "io"
+    "math/rand/v2"
+    "net/http"
+    "sync"
+)
+
+// Capture is a request and its response recorded in capture mode, see
+// StartCapture. Bodies are encoded as base64 in JSON.
+type Capture struct {
+    Method         string      `json:"method"`
+    URL            string      `json:"url"`
+    Pattern        string      `json:"pattern,omitempty"`
+    Header         http.Header `json:"header,omitempty"`
+    Body           []byte      `json:"body,omitempty"`
+    Status         int         `json:"status"`
+    ResponseHeader http.Header `json:"response_header,omitempty"`
+    ResponseBody   []byte      `json:"response_body,omitempty"`
+}
+
+// maxCaptureBody is the largest body captured, requests with larger
+// bodies are not captured. Neither are requests waiting for 100 Continue
+// whose bodies are not read to the end.
+const maxCaptureBody = 1 << 20
+
+type capturer struct {
+    mutex      sync.Mutex
+    enc        *json.Encoder
+    sampleRate float64
+}
+
+// StartCapture writes a sampled share of the requests served by the mux and
+// their responses to w as JSON lines of Capture values, which can be
+// replayed using cmuxtest.Replay to detect regressions. A sampleRate of 0
+// captures every request. Unlike debug traces, captures are not redacted.
+func (mux *Mux) StartCapture(w io.Writer, sampleRate float64) {
+    mux.capture.Store(&capturer{enc: json.NewEncoder(w), sampleRate: sampleRate})
+}
+
+// StopCapture stops capturing requests.
+func (mux *Mux) StopCapture() {
+    mux.capture.Store(nil)
+}
+
+// ReadCaptures reads the captures written by StartCapture from r.
+func ReadCaptures(r io.Reader) ([]Capture, error) {
+    var captures []Capture
+    dec := json.NewDecoder(r)
+    for {
+        var c Capture
+        if err := dec.Decode(&c); err == io.EOF {
+            return captures, nil
+        } else if err != nil {
+            return captures, err
+        }
+        captures = append(captures, c)
+    }
+}
+
+/* capture records a request while it is served */
+type capture struct {
+    c       *capturer
+    rec     Capture
+    reqTee  *readTee /* the request body as read, if not read ahead */
+    resBody *limitedBuffer
+}
+
+func (mux *Mux) startCapture(w *responseWriter, r *http.Request) *capture {
+    c := mux.capture.Load()
+    if c == nil || (c.sampleRate > 0 && rand.Float64() >= c.sampleRate) || r.Body == nil {
+        return nil
+    }
+    cp := &capture{
+        c:       c,
+        rec:     Capture{
+            Method: r.Method,
+            URL:    r.URL.RequestURI(),
+            Header: r.Header.Clone(),
+        },
+        resBody: &limitedBuffer{limit: maxCaptureBody},
+    }
+    if expectsContinue(r) && r.ContentLength != 0 {
+        /* reading ahead would send 100 Continue before the checks of
+         * ExpectContinue, so record the body as it is read instead */
+        cp.reqTee = &readTee{Reader: r.Body, buf: limitedBuffer{limit: maxCaptureBody + 1}}
+        r.Body = struct{
+            io.Reader
+            io.Closer
+        }{cp.reqTee, r.Body}
+    } else {
+        head, _ := io.ReadAll(io.LimitReader(r.Body, maxCaptureBody + 1))
+        r.Body = struct{
+            io.Reader
+            io.Closer
+        }{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+        if len(head) > maxCaptureBody {
+            return nil
+        }
+        cp.rec.Body = head
+    }
+    w.ResponseWriter = &teeWriter{ResponseWriter: w.ResponseWriter, tee: cp.resBody}
+    return cp
+}
+
+/* readTee records a request body as it is read */
+type readTee struct {
+    io.Reader
+    buf limitedBuffer
+    eof bool /* whether the body has been read to the end */
+}
+
+func (t *readTee) Read(p []byte) (int, error) {
+    n, err := t.Reader.Read(p)
+    t.buf.Write(p[:n])
+    if err == io.EOF {
+        t.eof = true
+    }
+    return n, err
+}
+
+func (cp *capture) finish(rs *reqState, w *responseWriter, r *http.Request, err error) {
+    if t := cp.reqTee; t != nil {
+        if !t.eof || t.buf.Len() > maxCaptureBody {
+            return
+        }
+        cp.rec.Body = t.buf.Bytes()
+    }
+    oc := rs.outcome(w, r, err)
+    cp.rec.Pattern = oc.Pattern
+    cp.rec.Status = oc.Status
+    cp.rec.ResponseHeader = w.Header().Clone()
+    cp.rec.ResponseBody = cp.resBody.Bytes()
+    cp.c.mutex.Lock()
+    defer cp.c.mutex.Unlock()
+    cp.c.enc.Encode(&cp.rec)
+}
@@ -0,0 +1,588 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmuxtest
+import(
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math"
+    "mime"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "reflect"
+    "regexp"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+    "unicode/utf8"
+
+    "github.com/cblach/cmux"
+)
+
+// ConformanceTest checks mux against the OpenAPI 3 document read from spec,
+// which must be JSON encoded. Every operation of the document is requested
+// with path variables, required query and header parameters and a JSON
+// body generated from their schemas, preferring examples, defaults and
+// enumerated values. Operations without a matching route, responses with
+// an undocumented status or Content-Type and JSON bodies not conforming to
+// the documented schema are reported as test errors. Responses without a
+// Content-Type are checked against the documented JSON media type.
+// The prepare functions are called for every request before it is served,
+// e.g. to add credentials.
+func ConformanceTest(t testing.TB, mux *cmux.Mux, spec io.Reader, prepare ...func(*http.Request)) {
+    t.Helper()
+    var doc oaDocument
+    if err := json.NewDecoder(spec).Decode(&doc); err != nil {
+        t.Fatalf("decoding OpenAPI document failed: %v", err)
+    }
+    paths := make([]string, 0, len(doc.Paths))
+    for p := range doc.Paths {
+        paths = append(paths, p)
+    }
+    sort.Strings(paths)
+    for _, p := range paths {
+        item := doc.Paths[p]
+        for _, mo := range item.operations() {
+            c := conformance{t: t, doc: &doc, name: mo.method + " " + p}
+            c.check(mux, mo.method, p, item.Parameters, mo.op, prepare)
+        }
+    }
+}
+
+type oaDocument struct {
+    Paths      map[string]*oaPathItem `json:"paths"`
+    Components struct {
+        Schemas       map[string]*oaSchema      `json:"schemas"`
+        Parameters    map[string]*oaParameter   `json:"parameters"`
+        RequestBodies map[string]*oaRequestBody `json:"requestBodies"`
+        Responses     map[string]*oaResponse    `json:"responses"`
+    } `json:"components"`
+}
+
+type oaPathItem struct {
+    Parameters []*oaParameter `json:"parameters"`
+    Get        *oaOperation   `json:"get"`
+    Put        *oaOperation   `json:"put"`
+    Post       *oaOperation   `json:"post"`
+    Delete     *oaOperation   `json:"delete"`
+    Options    *oaOperation   `json:"options"`
+    Head       *oaOperation   `json:"head"`
+    Patch      *oaOperation   `json:"patch"`
+}
+
+type methodOperation struct {
+    method string
+    op     *oaOperation
+}
+
+func (item *oaPathItem) operations() []methodOperation {
+    var ops []methodOperation
+    for _, mo := range []methodOperation{
+        {"GET", item.Get}, {"PUT", item.Put}, {"POST", item.Post}, {"DELETE", item.Delete},
+        {"OPTIONS", item.Options}, {"HEAD", item.Head}, {"PATCH", item.Patch},
+    } {
+        if mo.op != nil {
+            ops = append(ops, mo)
+        }
+    }
+    return ops
+}
+
+type oaOperation struct {
+    Parameters  []*oaParameter         `json:"parameters"`
+    RequestBody *oaRequestBody         `json:"requestBody"`
+    Responses   map[string]*oaResponse `json:"responses"`
+}
+
+type oaParameter struct {
+    Ref      string    `json:"$ref"`
+    Name     string    `json:"name"`
+    In       string    `json:"in"`
+    Required bool      `json:"required"`
+    Schema   *oaSchema `json:"schema"`
+    Example  any       `json:"example"`
+}
+
+type oaRequestBody struct {
+    Ref     string                  `json:"$ref"`
+    Content map[string]*oaMediaType `json:"content"`
+}
+
+type oaResponse struct {
+    Ref     string                  `json:"$ref"`
+    Content map[string]*oaMediaType `json:"content"`
+}
+
+type oaMediaType struct {
+    Schema  *oaSchema `json:"schema"`
+    Example any       `json:"example"`
+}
+
+type oaSchema struct {
+    Ref                  string               `json:"$ref"`
+    Type                 oaTypes              `json:"type"`
+    Format               string               `json:"format"`
+    Enum                 []any                `json:"enum"`
+    Default              any                  `json:"default"`
+    Example              any                  `json:"example"`
+    Examples             []any                `json:"examples"`
+    Nullable             bool                 `json:"nullable"`
+    ReadOnly             bool                 `json:"readOnly"`
+    Properties           map[string]*oaSchema `json:"properties"`
+    Required             []string             `json:"required"`
+    AdditionalProperties *oaSchema            `json:"additionalProperties"`
+    Items                *oaSchema            `json:"items"`
+    AllOf                []*oaSchema          `json:"allOf"`
+    AnyOf                []*oaSchema          `json:"anyOf"`
+    OneOf                []*oaSchema          `json:"oneOf"`
+    Minimum              *float64             `json:"minimum"`
+    Maximum              *float64             `json:"maximum"`
+    MinLength            *int                 `json:"minLength"`
+    MaxLength            *int                 `json:"maxLength"`
+    MinItems             *int                 `json:"minItems"`
+    MaxItems             *int                 `json:"maxItems"`
+    Pattern              string               `json:"pattern"`
+    /* set for the boolean schemas, e.g. "additionalProperties": false */
+    never                bool
+}
+
+func (s *oaSchema) UnmarshalJSON(data []byte) error {
+    var b bool
+    if json.Unmarshal(data, &b) == nil {
+        *s = oaSchema{never: !b}
+        return nil
+    }
+    type plain oaSchema
+    return json.Unmarshal(data, (*plain)(s))
+}
+
+/* oaTypes is the type of a schema, a string in OpenAPI 3.0 and a string or array in 3.1 */
+type oaTypes []string
+
+func (ts *oaTypes) UnmarshalJSON(data []byte) error {
+    var t string
+    if json.Unmarshal(data, &t) == nil {
+        *ts = oaTypes{t}
+        return nil
+    }
+    return json.Unmarshal(data, (*[]string)(ts))
+}
+
+func (ts oaTypes) has(t string) bool {
+    for _, v := range ts {
+        if v == t {
+            return true
+        }
+    }
+    return false
+}
+
+type conformance struct {
+    t    testing.TB
+    doc  *oaDocument
+    name string
+}
+
+/* resolve returns the component referenced by ref from components */
+func resolve[T any](c *conformance, components map[string]*T, ref, prefix string) *T {
+    name, ok := strings.CutPrefix(ref, prefix)
+    if !ok || components[name] == nil {
+        c.t.Errorf("%s: unsupported or unknown reference %q", c.name, ref)
+        return nil
+    }
+    return components[name]
+}
+
+func (c *conformance) schema(s *oaSchema) *oaSchema {
+    for i := 0; s != nil && s.Ref != ""; i++ {
+        if i == 32 {
+            c.t.Errorf("%s: reference cycle at %q", c.name, s.Ref)
+            return nil
+        }
+        s = resolve(c, c.doc.Components.Schemas, s.Ref, "#/components/schemas/")
+    }
+    return s
+}
+
+// check requests the operation op of the path pattern and checks the
+// response. The parameters of op override the parameters of the path with
+// the same name and location.
+func (c *conformance) check(mux *cmux.Mux, method, pattern string, pathParams []*oaParameter, op *oaOperation,
+                            prepare []func(*http.Request)) {
+    path := pattern
+    query := url.Values{}
+    header := http.Header{}
+    seen := map[[2]string]bool{}
+    for _, p := range append(append([]*oaParameter(nil), op.Parameters...), pathParams...) {
+        if p.Ref != "" {
+            if p = resolve(c, c.doc.Components.Parameters, p.Ref, "#/components/parameters/"); p == nil {
+                return
+            }
+        }
+        if key := [2]string{p.In, p.Name}; seen[key] {
+            continue
+        } else {
+            seen[key] = true
+        }
+        if !p.Required && p.In != "path" {
+            continue
+        }
+        val := p.Example
+        if val == nil {
+            val = c.generate(p.Schema, 0)
+        }
+        s := fmt.Sprint(val)
+        switch p.In {
+        case "path":
+            path = strings.ReplaceAll(path, "{" + p.Name + "}", url.PathEscape(s))
+        case "query":
+            query.Set(p.Name, s)
+        case "header":
+            header.Set(p.Name, s)
+        }
+    }
+    if _, _, ok := mux.Match(method, path); !ok {
+        c.t.Errorf("%s: no route matches %s", c.name, path)
+        return
+    }
+    var body io.Reader
+    rb := op.RequestBody
+    if rb != nil && rb.Ref != "" {
+        rb = resolve(c, c.doc.Components.RequestBodies, rb.Ref, "#/components/requestBodies/")
+    }
+    if rb != nil {
+        if mt := jsonMediaType(rb.Content); mt != nil {
+            val := mt.Example
+            if val == nil {
+                val = c.generate(mt.Schema, 0)
+            }
+            b, err := json.Marshal(val)
+            if err != nil {
+                c.t.Errorf("%s: encoding the generated body failed: %v", c.name, err)
+                return
+            }
+            body = bytes.NewReader(b)
+            header.Set("Content-Type", "application/json")
+        }
+    }
+    if len(query) > 0 {
+        path += "?" + query.Encode()
+    }
+    req := httptest.NewRequest(method, path, body)
+    for k, v := range header {
+        req.Header[k] = v
+    }
+    for _, fn := range prepare {
+        fn(req)
+    }
+    rec := httptest.NewRecorder()
+    mux.ServeHTTP(rec, req)
+    c.checkResponse(op, rec)
+}
+
+func (c *conformance) checkResponse(op *oaOperation, rec *httptest.ResponseRecorder) {
+    code := fmt.Sprint(rec.Code)
+    resp, ok := op.Responses[code]
+    if !ok {
+        resp, ok = op.Responses[code[:1] + "XX"]
+    }
+    if !ok {
+        resp, ok = op.Responses[code[:1] + "xx"]
+    }
+    if !ok {
+        resp, ok = op.Responses["default"]
+    }
+    if !ok {
+        c.t.Errorf("%s: undocumented status %d, body: %s", c.name, rec.Code, rec.Body.Bytes())
+        return
+    }
+    if resp.Ref != "" {
+        if resp = resolve(c, c.doc.Components.Responses, resp.Ref, "#/components/responses/"); resp == nil {
+            return
+        }
+    }
+    if rec.Body.Len() == 0 {
+        return
+    }
+    ctype, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+    mt, ok := resp.Content[ctype]
+    if !ok {
+        mt, ok = resp.Content["*/*"]
+    }
+    if !ok && ctype == "" {
+        /* the mux only sets a Content-Type if configured, see SetDefaultContentType */
+        ctype = "application/json"
+        mt = jsonMediaType(resp.Content)
+        ok = mt != nil
+    }
+    if !ok {
+        c.t.Errorf("%s: undocumented Content-Type %q for status %d", c.name, ctype, rec.Code)
+        return
+    }
+    if mt == nil || mt.Schema == nil || !isJSON(ctype) {
+        return
+    }
+    var v any
+    if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+        c.t.Errorf("%s: decoding the response body failed: %v", c.name, err)
+        return
+    }
+    for _, e := range c.validate(mt.Schema, v, "$") {
+        c.t.Errorf("%s: status %d: %s", c.name, rec.Code, e)
+    }
+}
+
+func isJSON(ctype string) bool {
+    return ctype == "application/json" || strings.HasSuffix(ctype, "+json")
+}
+
+func jsonMediaType(content map[string]*oaMediaType) *oaMediaType {
+    for ctype, mt := range content {
+        if isJSON(ctype) && mt != nil {
+            return mt
+        }
+    }
+    return nil
+}
+
+/* maxDepth bounds the generation of recursive schemas */
+const maxDepth = 8
+
+// generate returns a value conforming to s, preferring its examples,
+// default and enumerated values. Read-only properties are omitted, as the
+// generated values are sent in requests.
+func (c *conformance) generate(s *oaSchema, depth int) any {
+    s = c.schema(s)
+    switch {
+    case s == nil || depth > maxDepth:
+        return nil
+    case s.Example != nil:
+        return s.Example
+    case len(s.Examples) > 0:
+        return s.Examples[0]
+    case s.Default != nil:
+        return s.Default
+    case len(s.Enum) > 0:
+        return s.Enum[0]
+    case len(s.AllOf) > 0:
+        obj := map[string]any{}
+        for _, sub := range s.AllOf {
+            if m, ok := c.generate(sub, depth + 1).(map[string]any); ok {
+                for k, v := range m {
+                    obj[k] = v
+                }
+            }
+        }
+        return obj
+    case len(s.OneOf) > 0:
+        return c.generate(s.OneOf[0], depth + 1)
+    case len(s.AnyOf) > 0:
+        return c.generate(s.AnyOf[0], depth + 1)
+    }
+    switch {
+    case s.Type.has("object") || (len(s.Type) == 0 && s.Properties != nil):
+        obj := map[string]any{}
+        for name, p := range s.Properties {
+            if ps := c.schema(p); ps != nil && !ps.ReadOnly {
+                obj[name] = c.generate(ps, depth + 1)
+            }
+        }
+        return obj
+    case s.Type.has("array"):
+        n := 1
+        if s.MinItems != nil && *s.MinItems > n {
+            n = *s.MinItems
+        }
+        if s.MaxItems != nil && *s.MaxItems < n {
+            n = *s.MaxItems
+        }
+        arr := make([]any, n)
+        for i := range arr {
+            arr[i] = c.generate(s.Items, depth + 1)
+        }
+        return arr
+    case s.Type.has("integer"), s.Type.has("number"):
+        n := 1.0
+        if s.Minimum != nil && *s.Minimum > n {
+            n = math.Ceil(*s.Minimum)
+        }
+        if s.Maximum != nil && *s.Maximum < n {
+            n = math.Floor(*s.Maximum)
+        }
+        return n
+    case s.Type.has("boolean"):
+        return true
+    case s.Type.has("string"):
+        return generateString(s)
+    }
+    return nil
+}
+
+func generateString(s *oaSchema) string {
+    var str string
+    switch s.Format {
+    case "uuid":
+        return "00000000-0000-0000-0000-000000000001"
+    case "date":
+        return "2000-01-01"
+    case "date-time":
+        return "2000-01-01T00:00:00Z"
+    case "email":
+        return "user@example.com"
+    case "uri", "url":
+        return "https://example.com/"
+    default:
+        str = "x"
+    }
+    if s.MinLength != nil && *s.MinLength > len(str) {
+        str += strings.Repeat("x", *s.MinLength - len(str))
+    }
+    if s.MaxLength != nil && *s.MaxLength < len(str) {
+        str = str[:*s.MaxLength]
+    }
+    return str
+}
+
+// validate returns the violations of s by the decoded JSON value v, each
+// prefixed by the location of the violating value, e.g. "$.users[0].name".
+func (c *conformance) validate(s *oaSchema, v any, at string) []string {
+    s = c.schema(s)
+    if s == nil {
+        return nil
+    }
+    if s.never {
+        return []string{at + ": not allowed"}
+    }
+    var errs []string
+    fail := func(format string, args ...any) {
+        errs = append(errs, at + ": " + fmt.Sprintf(format, args...))
+    }
+    if v == nil {
+        if len(s.Type) > 0 && !s.Nullable && !s.Type.has("null") {
+            fail("null is not allowed")
+        }
+        return errs
+    }
+    if len(s.Enum) > 0 && !containsValue(s.Enum, v) {
+        fail("%v is not one of %v", v, s.Enum)
+    }
+    for _, sub := range s.AllOf {
+        errs = append(errs, c.validate(sub, v, at)...)
+    }
+    if len(s.AnyOf) > 0 && c.matching(s.AnyOf, v, at) == 0 {
+        fail("matches none of the anyOf schemas")
+    }
+    if len(s.OneOf) > 0 {
+        if n := c.matching(s.OneOf, v, at); n != 1 {
+            fail("matches %d of the oneOf schemas, expected exactly 1", n)
+        }
+    }
+    switch v := v.(type) {
+    case map[string]any:
+        if len(s.Type) > 0 && !s.Type.has("object") {
+            fail("expected %s, got object", s.Type)
+            break
+        }
+        for _, name := range s.Required {
+            if _, ok := v[name]; !ok {
+                fail("missing required property %q", name)
+            }
+        }
+        names := make([]string, 0, len(v))
+        for name := range v {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            if p, ok := s.Properties[name]; ok {
+                errs = append(errs, c.validate(p, v[name], at + "." + name)...)
+            } else if s.AdditionalProperties != nil {
+                errs = append(errs, c.validate(s.AdditionalProperties, v[name], at + "." + name)...)
+            }
+        }
+    case []any:
+        if len(s.Type) > 0 && !s.Type.has("array") {
+            fail("expected %s, got array", s.Type)
+            break
+        }
+        if s.MinItems != nil && len(v) < *s.MinItems {
+            fail("%d items, expected at least %d", len(v), *s.MinItems)
+        }
+        if s.MaxItems != nil && len(v) > *s.MaxItems {
+            fail("%d items, expected at most %d", len(v), *s.MaxItems)
+        }
+        if s.Items != nil {
+            for i, e := range v {
+                errs = append(errs, c.validate(s.Items, e, fmt.Sprintf("%s[%d]", at, i))...)
+            }
+        }
+    case string:
+        if len(s.Type) > 0 && !s.Type.has("string") {
+            fail("expected %s, got string", s.Type)
+            break
+        }
+        n := utf8.RuneCountInString(v)
+        if s.MinLength != nil && n < *s.MinLength {
+            fail("length %d, expected at least %d", n, *s.MinLength)
+        }
+        if s.MaxLength != nil && n > *s.MaxLength {
+            fail("length %d, expected at most %d", n, *s.MaxLength)
+        }
+        if s.Pattern != "" {
+            if re, err := regexp.Compile(s.Pattern); err == nil && !re.MatchString(v) {
+                fail("%q does not match %q", v, s.Pattern)
+            }
+        }
+        switch s.Format {
+        case "date-time":
+            if _, err := time.Parse(time.RFC3339, v); err != nil {
+                fail("%q is not a date-time", v)
+            }
+        case "date":
+            if _, err := time.Parse(time.DateOnly, v); err != nil {
+                fail("%q is not a date", v)
+            }
+        }
+    case float64:
+        if len(s.Type) > 0 && !s.Type.has("number") && !(s.Type.has("integer") && v == math.Trunc(v)) {
+            fail("expected %s, got %v", s.Type, v)
+            break
+        }
+        if s.Minimum != nil && v < *s.Minimum {
+            fail("%v is less than the minimum %v", v, *s.Minimum)
+        }
+        if s.Maximum != nil && v > *s.Maximum {
+            fail("%v is greater than the maximum %v", v, *s.Maximum)
+        }
+    case bool:
+        if len(s.Type) > 0 && !s.Type.has("boolean") {
+            fail("expected %s, got boolean", s.Type)
+        }
+    }
+    return errs
+}
+
+/* matching returns the number of schemas v conforms to */
+func (c *conformance) matching(schemas []*oaSchema, v any, at string) int {
+    n := 0
+    for _, sub := range schemas {
+        if len(c.validate(sub, v, at)) == 0 {
+            n++
+        }
+    }
+    return n
+}
+
+func containsValue(vals []any, v any) bool {
+    for _, e := range vals {
+        if reflect.DeepEqual(e, v) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmuxtest
+import(
+    "net/http"
+    "strings"
+    "testing"
+
+    "github.com/cblach/cmux"
+)
+
+const conformanceSpec = `{
+    "openapi": "3.0.3",
+    "paths": {
+        "/users/{id}": {
+            "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 7}}],
+            "get": {
+                "responses": {
+                    "200": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+                    "4XX": {"description": "error"}
+                }
+            }
+        },
+        "/users": {
+            "post": {
+                "parameters": [{"name": "X-Tenant", "in": "header", "required": true, "schema": {"type": "string", "enum": ["acme"]}}],
+                "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+                "responses": {
+                    "200": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}}
+                }
+            }
+        }
+    },
+    "components": {
+        "schemas": {
+            "User": {
+                "type": "object",
+                "required": ["id", "name"],
+                "additionalProperties": false,
+                "properties": {
+                    "id": {"type": "integer", "readOnly": true},
+                    "name": {"type": "string", "minLength": 3},
+                    "role": {"type": "string", "enum": ["admin", "user"], "nullable": true}
+                }
+            }
+        }
+    }
+}`
+
+func TestConformanceTest(t *testing.T) {
+    type User struct {
+        ID   int     `json:"id"`
+        Name string  `json:"name"`
+        Role *string `json:"role"`
+    }
+    type Md struct {
+        ID int
+    }
+    newMux := func(role string) *cmux.Mux {
+        m := &cmux.Mux{}
+        m.HandleFunc("/users/{id}", &Md{},
+            cmux.Get(func(req *cmux.Request[cmux.EmptyBody, *Md]) error {
+                if req.Metadata.ID != 7 {
+                    return cmux.HTTPError("", http.StatusNotFound)
+                }
+                return cmux.Bypass(&User{ID: 7, Name: "alice", Role: &role})
+            }, nil),
+        )
+        m.HandleFunc("/users", &struct{}{},
+            cmux.Post(func(req *cmux.Request[User, *struct{}]) error {
+                if req.HTTPReq.Header.Get("X-Tenant") != "acme" || len(req.Body.Name) < 3 {
+                    return cmux.HTTPError("", http.StatusBadRequest)
+                }
+                req.Body.ID = 8
+                return cmux.Bypass(&req.Body)
+            }, nil),
+        )
+        return m
+    }
+    ConformanceTest(t, newMux("admin"), strings.NewReader(conformanceSpec))
+    rt := &recordingT{TB: t}
+    ConformanceTest(rt, newMux("owner"), strings.NewReader(conformanceSpec))
+    if len(rt.errors) != 1 || !strings.Contains(rt.errors[0], "$.role") {
+        t.Errorf("expected one violation of $.role, got %q", rt.errors)
+    }
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+// Package cmuxtest provides helpers for testing cmux based servers.
+package cmuxtest
+import(
+    "bytes"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+
+    "github.com/cblach/cmux"
+)
+
+// Replay serves the captures read from r, as written by Mux.StartCapture,
+// through h and reports every response differing from the captured one in
+// status, Content-Type or body as a test error. JSON bodies are compared
+// semantically, ignoring object keys listed in ignoreFields at any depth,
+// e.g. generated IDs and timestamps.
+func Replay(t testing.TB, h http.Handler, r io.Reader, ignoreFields ...string) {
+    t.Helper()
+    captures, err := cmux.ReadCaptures(r)
+    if err != nil {
+        t.Fatalf("reading captures failed: %v", err)
+    }
+    for _, c := range captures {
+        req := httptest.NewRequest(c.Method, c.URL, bytes.NewReader(c.Body))
+        req.Header = c.Header.Clone()
+        if req.Header == nil {
+            req.Header = http.Header{}
+        }
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        name := c.Method + " " + c.URL
+        if rec.Code != c.Status {
+            t.Errorf("%s: expected status %d, got %d", name, c.Status, rec.Code)
+            continue
+        }
+        expType := http.Header(c.ResponseHeader).Get("Content-Type")
+        if ctype := rec.Header().Get("Content-Type"); ctype != expType {
+            t.Errorf("%s: expected Content-Type %q, got %q", name, expType, ctype)
+            continue
+        }
+        if !sameBody(c.ResponseBody, rec.Body.Bytes(), ignoreFields) {
+            t.Errorf("%s: expected body %s, got %s", name, c.ResponseBody, rec.Body.Bytes())
+        }
+    }
+}
+
+func sameBody(exp, got []byte, ignoreFields []string) bool {
+    var expV, gotV any
+    if json.Unmarshal(exp, &expV) != nil || json.Unmarshal(got, &gotV) != nil {
+        return bytes.Equal(exp, got)
+    }
+    return reflect.DeepEqual(strip(expV, ignoreFields), strip(gotV, ignoreFields))
+}
+
+/* strip removes the ignored object keys from a decoded JSON value */
+func strip(v any, ignoreFields []string) any {
+    switch v := v.(type) {
+    case map[string]any:
+        for _, f := range ignoreFields {
+            delete(v, f)
+        }
+        for k, e := range v {
+            v[k] = strip(e, ignoreFields)
+        }
+    case []any:
+        for i, e := range v {
+            v[i] = strip(e, ignoreFields)
+        }
+    }
+    return v
+}
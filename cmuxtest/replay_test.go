@@ -0,0 +1,69 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmuxtest
+import(
+    "bytes"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/cblach/cmux"
+)
+
+type recordingT struct {
+    testing.TB
+    errors []string
+}
+
+func (t *recordingT) Errorf(format string, args ...any) {
+    t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestReplay(t *testing.T) {
+    type Order struct {
+        Name    string `json:"name"`
+        Created string `json:"created"`
+    }
+    type Md struct {
+        ID string
+    }
+    newMux := func(prefix string) *cmux.Mux {
+        m := &cmux.Mux{}
+        m.HandleFunc("/orders/{id}", &Md{},
+            cmux.Post(func(req *cmux.Request[Order, *Md]) error {
+                return cmux.Bypass(&Order{
+                    Name:    prefix + req.Body.Name + " " + req.Metadata.ID,
+                    Created: time.Now().Format(time.RFC3339Nano),
+                })
+            }, nil),
+        )
+        return m
+    }
+    m := newMux("")
+    var buf bytes.Buffer
+    m.StartCapture(&buf, 0)
+    for _, body := range []string{`{"name":"cake"}`, `{"name":`} {
+        req, err := http.NewRequest("POST", "/orders/7", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        m.ServeHTTP(httptest.NewRecorder(), req)
+    }
+    m.StopCapture()
+    captures := buf.String()
+    if n := strings.Count(captures, "\n"); n != 2 {
+        t.Fatalf("expected 2 captures, got %d", n)
+    }
+    Replay(t, newMux(""), strings.NewReader(captures), "created")
+    rt := &recordingT{TB: t}
+    Replay(rt, newMux("new "), strings.NewReader(captures), "created")
+    if len(rt.errors) != 1 {
+        t.Errorf("expected one regression, got %q", rt.errors)
+    }
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bufio"
+    "context"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+)
+
+// ConnectRequest is passed to CONNECT method handlers instead of Request.
+// CONNECT requests naming only a host and port, as sent to forward
+// proxies, are routed to the path "/".
+type ConnectRequest[M any] struct {
+    // Target is the host and port the client asks to connect to,
+    // e.g. "example.com:443".
+    Target   string
+    Metadata M
+    Context  context.Context
+
+    /* Underlying native golang request / responsewriter: */
+    HTTPReq *http.Request
+    ResponseWriter http.ResponseWriter
+}
+
+// Handle CONNECT HTTP method requests, e.g. for forward proxies and
+// tunneling services.
+func Connect[M any](fn func(*ConnectRequest[M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler(http.MethodConnect, getConnectHandler(fn), data, opts)
+}
+
+func getConnectHandler[M any](fn func(*ConnectRequest[M]) error) handleFnType {
+    return func(w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState) error {
+        req := ConnectRequest[M]{
+            Target:         httpReq.Host,
+            Context:        httpReq.Context(),
+            HTTPReq:        httpReq,
+            ResponseWriter: w,
+        }
+        if md != nil {
+            var ok bool
+            if req.Metadata, ok = md.(M); !ok {
+                return &codeResponder{
+                    code:  http.StatusInternalServerError,
+                    error: errors.New("unexpected metadata type"),
+                }
+            }
+        }
+        return fn(&req)
+    }
+}
+
+// Hijack accepts the CONNECT request, responding 200 to the client, and
+// takes over the connection. The caller is responsible for closing it.
+// Hijacking is only supported for HTTP/1 connections.
+func (req *ConnectRequest[M]) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    conn, brw, err := http.NewResponseController(req.ResponseWriter).Hijack()
+    if err != nil {
+        return nil, nil, err
+    }
+    if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+        conn.Close()
+        return nil, nil, err
+    }
+    return conn, brw, nil
+}
+
+// Tunnel dials the target using dial, or a net.Dialer if nil, and relays
+// data between the client and the target until either side closes its
+// connection. Dial failures are responded to with 502 Bad Gateway.
+func (req *ConnectRequest[M]) Tunnel(dial func(ctx context.Context, network, addr string) (net.Conn, error)) error {
+    if dial == nil {
+        dial = (&net.Dialer{}).DialContext
+    }
+    upstream, err := dial(req.Context, "tcp", req.Target)
+    if err != nil {
+        return &codeResponder{code: http.StatusBadGateway, error: err}
+    }
+    defer upstream.Close()
+    conn, brw, err := req.Hijack()
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    done := make(chan struct{}, 2)
+    go func() {
+        /* data the client sent along with the request is buffered */
+        io.Copy(upstream, brw.Reader)
+        closeWrite(upstream)
+        done <- struct{}{}
+    }()
+    go func() {
+        io.Copy(conn, upstream)
+        closeWrite(conn)
+        done <- struct{}{}
+    }()
+    <-done
+    <-done
+    return nil
+}
+
+func closeWrite(conn net.Conn) {
+    if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+        cw.CloseWrite()
+    } else {
+        conn.Close()
+    }
+}
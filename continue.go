@@ -0,0 +1,57 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "net/http"
+    "strings"
+)
+
+// ExpectContinue makes an upload route evaluate requests by their headers
+// before the client is told to send the body of requests sent with
+// "Expect: 100-continue", so rejected uploads waste no bandwidth. The
+// Before functions, e.g. authentication, the maximum body size, which is
+// rejected with 413 Request Entity Too Large, and the checks run before
+// the body is read, which is when the server sends 100 Continue. Body
+// logging then records the body as read by the handler rather than reading
+// it ahead. Errors returned by the checks are responded to like handler
+// errors, with 417 Expectation Failed for requests expecting 100-continue
+// and 400 Bad Request for other requests unless they implement
+// HTTPErrorResponder, e.g.
+//
+//  cmux.PutStream(Upload, nil, cmux.ExpectContinue(func(r *http.Request) error {
+//      if r.ContentLength > quota.Remaining(r) {
+//          return errors.New("quota exceeded")
+//      }
+//      return nil
+//  }))
+func ExpectContinue(checks ...func(r *http.Request) error) RouteOption {
+    return func(o *routeOptions) {
+        o.expectContinue = true
+        o.continueChecks = append(o.continueChecks, checks...)
+    }
+}
+
+/* expectsContinue reports whether the client waits for 100 Continue before sending the body */
+func expectsContinue(r *http.Request) bool {
+    return strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+/* checkContinue runs the checks of ExpectContinue */
+func (rs *reqState) checkContinue(r *http.Request) error {
+    for _, check := range rs.mh.opts.continueChecks {
+        err := check(r)
+        if err == nil {
+            continue
+        }
+        if isResponder(err) {
+            return err
+        }
+        if expectsContinue(r) {
+            return WrapError(err, http.StatusExpectationFailed)
+        }
+        return WrapError(err, http.StatusBadRequest)
+    }
+    return nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "fmt"
+    "log"
+    "net/http"
+    "reflect"
+    "strings"
+)
+
+/* controllerMethods maps controller method names to routes */
+var controllerMethods = []struct {
+    name   string
+    method string
+    byID   bool /* served at the path followed by "/{id}" */
+}{
+    {"Get", http.MethodGet, false},
+    {"Head", http.MethodHead, false},
+    {"Post", http.MethodPost, false},
+    {"Put", http.MethodPut, false},
+    {"Patch", http.MethodPatch, false},
+    {"Delete", http.MethodDelete, false},
+    {"Options", http.MethodOptions, false},
+    {"GetByID", http.MethodGet, true},
+    {"HeadByID", http.MethodHead, true},
+    {"PostByID", http.MethodPost, true},
+    {"PutByID", http.MethodPut, true},
+    {"PatchByID", http.MethodPatch, true},
+    {"DeleteByID", http.MethodDelete, true},
+}
+
+var(
+    requestLoaderType = reflect.TypeFor[requestLoader]()
+    errorType         = reflect.TypeFor[error]()
+)
+
+/* controllerRoute holds the handlers of a controller served at a path */
+type controllerRoute struct {
+    path     string
+    metadata any
+    mhs      []MethodHandler
+}
+
+// HandleController registers the methods of controller named after HTTP
+// methods, e.g. for
+//
+//  m.HandleController("/users", &UserController{})
+//
+// Get, Post, Put, Patch, Delete, Head and Options handle requests to
+// "/users", while GetByID, PutByID, PatchByID, DeleteByID, HeadByID and
+// PostByID handle requests to "/users/{id}". The methods must have the
+// same signature as the functions passed to Get, Post and so on, i.e.
+// func(*cmux.Request[I, M]) error. Methods handling the same path must use
+// the same metadata type M, which must be a pointer to a struct and
+// for the "/{id}" path must have an id field. The metadata template is
+// the zero value of the struct; use WithMeta to set route constants.
+// Request bodies are optional for GET, HEAD, DELETE and OPTIONS
+// requests, as for GetB and DeleteB. The options apply to all the routes.
+// Other methods of controller are ignored.
+func (mux *Mux) HandleController(path string, controller any, opts ...RouteOption) {
+    for _, cr := range controllerRoutes(path, controller, opts) {
+        mux.HandleFunc(cr.path, cr.metadata, cr.mhs...)
+    }
+}
+
+// HandleController registers the methods of controller at the path
+// prefixed by the group prefix, see Mux.HandleController.
+func (g *Group) HandleController(path string, controller any, opts ...RouteOption) {
+    for _, cr := range controllerRoutes(path, controller, opts) {
+        g.HandleFunc(cr.path, cr.metadata, cr.mhs...)
+    }
+}
+
+func controllerRoutes(path string, controller any, opts []RouteOption) []controllerRoute {
+    cv := reflect.ValueOf(controller)
+    var routes []controllerRoute
+    mdTypes := map[string]reflect.Type{}
+    for _, cm := range controllerMethods {
+        fn := cv.MethodByName(cm.name)
+        if !fn.IsValid() {
+            continue
+        }
+        ft := fn.Type()
+        if ft.NumIn() != 1 || !ft.In(0).Implements(requestLoaderType) ||
+           ft.NumOut() != 1 || ft.Out(0) != errorType {
+            log.Fatalf("method %s of %T must be a func(*cmux.Request[I, M]) error", cm.name, controller)
+        }
+        p := path
+        if cm.byID {
+            p = strings.TrimSuffix(path, "/") + "/{id}"
+        }
+        reqType := ft.In(0)
+        mdType, _ := reqType.Elem().FieldByName("Metadata")
+        if prev, ok := mdTypes[p]; ok && prev != mdType.Type {
+            log.Fatalf("methods of %T for %s use metadata types %v and %v",
+                       controller, p, prev, mdType.Type)
+        }
+        mdTypes[p] = mdType.Type
+        optionalBody := cm.method != http.MethodPost && cm.method != http.MethodPut &&
+                        cm.method != http.MethodPatch
+        mh := newMethodHandler(cm.method, getControllerHandler(fn, reqType, optionalBody), nil, opts)
+        mh.fnName = fmt.Sprintf("%T.%s", controller, cm.name)
+        idx := -1
+        for i := range routes {
+            if routes[i].path == p {
+                idx = i
+            }
+        }
+        if idx < 0 {
+            idx = len(routes)
+            routes = append(routes, controllerRoute{path: p})
+        }
+        routes[idx].mhs = append(routes[idx].mhs, mh)
+    }
+    if len(routes) == 0 {
+        log.Fatalf("%T has no methods handling requests", controller)
+    }
+    for i := range routes {
+        t := mdTypes[routes[i].path]
+        if t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Struct {
+            routes[i].metadata = reflect.New(t.Elem()).Interface()
+        } else if t.Kind() != reflect.Interface {
+            log.Fatalf("metadata of %T must be a pointer to a struct, not %v", controller, t)
+        }
+    }
+    return routes
+}
+
+func getControllerHandler(fn reflect.Value, reqType reflect.Type, optionalBody bool) handleFnType {
+    inputType := reflect.New(reqType.Elem()).Interface().(requestLoader).inputType()
+    return func(w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState) error {
+        req := reflect.New(reqType.Elem())
+        if err := req.Interface().(requestLoader).load(w, httpReq, md, rs, inputType, optionalBody); err != nil {
+            return err
+        }
+        err, _ := fn.Call([]reflect.Value{req})[0].Interface().(error)
+        return err
+    }
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "net/http"
+    "strings"
+)
+
+var(
+    ErrNoCookieSecret = errors.New("cmux: no cookie secret set")
+    ErrInvalidCookie  = errors.New("cmux: invalid cookie")
+)
+
+/* cookieKeys are derived from the secret set using SetCookieSecret */
+type cookieKeys struct {
+    sign []byte
+    aead cipher.AEAD
+}
+
+// SetCookieSecret sets the secret used to sign and encrypt cookies, which
+// should be at least 32 random bytes. Metadata fields tagged e.g.
+// `cookie:"session,signed"` or `cookie:"session,encrypted"` are only
+// bound from cookies written using SetSignedCookie or SetEncryptedCookie
+// with the same secret; other cookies are treated as missing.
+func (mux *Mux) SetCookieSecret(secret []byte) {
+    derive := func(label string) []byte {
+        h := hmac.New(sha256.New, secret)
+        h.Write([]byte(label))
+        return h.Sum(nil)
+    }
+    block, err := aes.NewCipher(derive("cmux cookie encryption"))
+    if err != nil {
+        panic(err)
+    }
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+        panic(err)
+    }
+    mux.cookieKeys = &cookieKeys{sign: derive("cmux cookie signing"), aead: aead}
+}
+
+func (k *cookieKeys) mac(name, value string) []byte {
+    h := hmac.New(sha256.New, k.sign)
+    h.Write([]byte(name + "=" + value))
+    return h.Sum(nil)
+}
+
+// SetSignedCookie sets the cookie c with a signature appended to its value,
+// so the client can read the value but not modify it.
+func (mux *Mux) SetSignedCookie(w http.ResponseWriter, c *http.Cookie) error {
+    if mux.cookieKeys == nil {
+        return ErrNoCookieSecret
+    }
+    signed := *c
+    signed.Value = c.Value + "." + base64.RawURLEncoding.EncodeToString(mux.cookieKeys.mac(c.Name, c.Value))
+    http.SetCookie(w, &signed)
+    return nil
+}
+
+// SetEncryptedCookie sets the cookie c with its value encrypted, so the
+// client can neither read nor modify it.
+func (mux *Mux) SetEncryptedCookie(w http.ResponseWriter, c *http.Cookie) error {
+    if mux.cookieKeys == nil {
+        return ErrNoCookieSecret
+    }
+    aead := mux.cookieKeys.aead
+    nonce := make([]byte, aead.NonceSize(), aead.NonceSize() + len(c.Value) + aead.Overhead())
+    rand.Read(nonce)
+    enc := *c
+    enc.Value = base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(c.Value), []byte(c.Name)))
+    http.SetCookie(w, &enc)
+    return nil
+}
+
+// SignedCookie returns the value of the cookie written using
+// SetSignedCookie, failing with ErrInvalidCookie if it was modified.
+func (mux *Mux) SignedCookie(r *http.Request, name string) (string, error) {
+    c, err := r.Cookie(name)
+    if err != nil {
+        return "", err
+    }
+    return mux.verifyCookie(c)
+}
+
+// EncryptedCookie returns the decrypted value of the cookie written using
+// SetEncryptedCookie, failing with ErrInvalidCookie if it was modified.
+func (mux *Mux) EncryptedCookie(r *http.Request, name string) (string, error) {
+    c, err := r.Cookie(name)
+    if err != nil {
+        return "", err
+    }
+    return mux.decryptCookie(c)
+}
+
+func (mux *Mux) verifyCookie(c *http.Cookie) (string, error) {
+    if mux.cookieKeys == nil {
+        return "", ErrNoCookieSecret
+    }
+    /* values may themselves contain dots */
+    i := strings.LastIndexByte(c.Value, '.')
+    if i < 0 {
+        return "", ErrInvalidCookie
+    }
+    value, sig := c.Value[:i], c.Value[i + 1:]
+    mac, err := base64.RawURLEncoding.DecodeString(sig)
+    if err != nil || !hmac.Equal(mac, mux.cookieKeys.mac(c.Name, value)) {
+        return "", ErrInvalidCookie
+    }
+    return value, nil
+}
+
+func (mux *Mux) decryptCookie(c *http.Cookie) (string, error) {
+    if mux.cookieKeys == nil {
+        return "", ErrNoCookieSecret
+    }
+    aead := mux.cookieKeys.aead
+    b, err := base64.RawURLEncoding.DecodeString(c.Value)
+    if err != nil || len(b) < aead.NonceSize() {
+        return "", ErrInvalidCookie
+    }
+    plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(c.Name))
+    if err != nil {
+        return "", ErrInvalidCookie
+    }
+    return string(plain), nil
+}
+
+const(
+    cookiePlain = iota
+    cookieSigned
+    cookieEncrypted
+)
+
+// cookieValue returns the value of the cookie bound by b, reporting false
+// if the cookie is missing or fails verification.
+func (mux *Mux) cookieValue(r *http.Request, b *fieldBinder) (string, bool) {
+    c, err := r.Cookie(b.name)
+    if err != nil {
+        return "", false
+    }
+    switch b.cookieMode {
+    case cookieSigned:
+        v, err := mux.verifyCookie(c)
+        return v, err == nil
+    case cookieEncrypted:
+        v, err := mux.decryptCookie(c)
+        return v, err == nil
+    }
+    return c.Value, true
+}
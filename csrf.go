@@ -0,0 +1,124 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "mime"
+    "net/http"
+)
+
+// CSRFOptions configures the double-submit cookie CSRF protection enabled
+// by Mux.EnableCSRF. Empty names fall back to the defaults.
+type CSRFOptions struct {
+    CookieName string /* default "csrf_token" */
+    HeaderName string /* default "X-CSRF-Token" */
+    FormField  string /* default "csrf_token" */
+
+    /* cookie attributes */
+    Path     string /* default "/" */
+    Domain   string
+    Secure   bool
+    SameSite http.SameSite /* default http.SameSiteLaxMode */
+}
+
+// EnableCSRF protects all routes accepting unsafe methods (i.e. anything but
+// GET, HEAD, OPTIONS and TRACE) against cross-site request forgery. Such
+// requests must carry the token of the CSRF cookie in either the CSRF header
+// or, for form submissions, the CSRF form field. Otherwise they are rejected
+// with 403 Forbidden before the Before functions run.
+// Tokens are issued using Mux.CSRFToken, and routes can opt out using CSRFExempt.
+func (mux *Mux) EnableCSRF(opts CSRFOptions) {
+    if opts.CookieName == "" {
+        opts.CookieName = "csrf_token"
+    }
+    if opts.HeaderName == "" {
+        opts.HeaderName = "X-CSRF-Token"
+    }
+    if opts.FormField == "" {
+        opts.FormField = "csrf_token"
+    }
+    if opts.Path == "" {
+        opts.Path = "/"
+    }
+    if opts.SameSite == 0 {
+        opts.SameSite = http.SameSiteLaxMode
+    }
+    mux.csrf = &opts
+}
+
+// CSRFExempt disables CSRF verification for a route, e.g. for webhooks
+// authenticated by other means.
+func CSRFExempt() RouteOption {
+    return func(o *routeOptions) {
+        o.csrfExempt = true
+    }
+}
+
+// CSRFToken returns the CSRF token of the request, issuing a new token in
+// the CSRF cookie if the request does not carry one. The token is meant to be
+// embedded in forms or sent back by scripts in the CSRF header.
+func (mux *Mux) CSRFToken(w http.ResponseWriter, r *http.Request) string {
+    opts := mux.csrf
+    if opts == nil {
+        panic("cmux: CSRFToken called without EnableCSRF")
+    }
+    if c, err := r.Cookie(opts.CookieName); err == nil && c.Value != "" {
+        return c.Value
+    }
+    b := make([]byte, 32)
+    rand.Read(b)
+    token := base64.RawURLEncoding.EncodeToString(b)
+    http.SetCookie(w, &http.Cookie{
+        Name:     opts.CookieName,
+        Value:    token,
+        Path:     opts.Path,
+        Domain:   opts.Domain,
+        Secure:   opts.Secure,
+        HttpOnly: true,
+        SameSite: opts.SameSite,
+    })
+    /* make the token visible to CSRFToken calls later in this request */
+    r.AddCookie(&http.Cookie{Name: opts.CookieName, Value: token})
+    return token
+}
+
+var errInvalidCSRF = &codeResponder{
+    code:  http.StatusForbidden,
+    error: errors.New("invalid CSRF token"),
+    key:   "csrf_invalid",
+}
+
+func safeMethod(method string) bool {
+    switch method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+        return true
+    }
+    return false
+}
+
+func (rs *reqState) verifyCSRF(r *http.Request) error {
+    opts := rs.mux.csrf
+    if opts == nil || rs.mh.opts.csrfExempt || safeMethod(r.Method) {
+        return nil
+    }
+    c, err := r.Cookie(opts.CookieName)
+    if err != nil || c.Value == "" {
+        return errInvalidCSRF
+    }
+    token := r.Header.Get(opts.HeaderName)
+    if token == "" {
+        mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+        if mt == "application/x-www-form-urlencoded" || mt == "multipart/form-data" {
+            token = r.FormValue(opts.FormField)
+        }
+    }
+    if subtle.ConstantTimeCompare([]byte(token), []byte(c.Value)) != 1 {
+        return errInvalidCSRF
+    }
+    return nil
+}
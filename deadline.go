@@ -0,0 +1,59 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// ReadTimeout overrides the read deadline of the server for requests of a
+// single route, allowing e.g. large uploads to take longer than the
+// ReadTimeout of the http.Server. The deadline is set to d from when the
+// route is matched, or removed if d is zero.
+func ReadTimeout(d time.Duration) RouteOption {
+    return func(o *routeOptions) {
+        o.readTimeout = &d
+    }
+}
+
+// WriteTimeout overrides the write deadline of the server for requests of
+// a single route, allowing e.g. large downloads or event streams to take
+// longer than the WriteTimeout of the http.Server. The deadline is set to
+// d from when the route is matched, or removed if d is zero. Handlers can
+// extend deadlines further using http.NewResponseController.
+func WriteTimeout(d time.Duration) RouteOption {
+    return func(o *routeOptions) {
+        o.writeTimeout = &d
+    }
+}
+
+/* deadline returns the deadline d from now, or no deadline if d is zero */
+func deadline(d time.Duration) time.Time {
+    if d == 0 {
+        return time.Time{}
+    }
+    return time.Now().Add(d)
+}
+
+// setDeadlines applies the deadlines of the route, which fails for writers
+// not supporting deadlines, e.g. in tests.
+func (rs *reqState) setDeadlines(w http.ResponseWriter, r *http.Request) {
+    opts := &rs.mh.opts
+    if opts.readTimeout == nil && opts.writeTimeout == nil {
+        return
+    }
+    rc := http.NewResponseController(w)
+    if opts.readTimeout != nil {
+        if err := rc.SetReadDeadline(deadline(*opts.readTimeout)); err != nil {
+            rs.mux.log(r, slog.LevelDebug, "failed to set read deadline", slog.Any("error", err))
+        }
+    }
+    if opts.writeTimeout != nil {
+        if err := rc.SetWriteDeadline(deadline(*opts.writeTimeout)); err != nil {
+            rs.mux.log(r, slog.LevelDebug, "failed to set write deadline", slog.Any("error", err))
+        }
+    }
+}
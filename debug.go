@@ -12,11 +12,27 @@ import(
 )
 
 func (mux *Mux) EnableDebugTimings(enable bool) {
-    mux.debugTimings = enable
+    mux.debugTimings.Store(enable)
 }
 
+// EnableDebug traces every request to stderr as JSON lines, redacting
+// credentials using the default DebugOptions. Use SetDebugOptions to
+// configure sampling, redaction and where the traces are sent.
 func (mux *Mux) EnableDebug(enable bool) {
-    mux.debug = enable
+    if enable {
+        mux.SetDebugOptions(DebugOptions{})
+    } else {
+        mux.debugOpts.Store(nil)
+    }
+}
+
+// EnableDebugDecodeErrors makes the mux log the byte offset, field path and
+// a snippet of the body when a JSON request body fails to decode. If expose
+// is true the details are also included in the 400 response, which should
+// only be enabled during development.
+func (mux *Mux) EnableDebugDecodeErrors(enable, expose bool) {
+    mux.decodeErrDetails = enable
+    mux.exposeDecodeErrs = enable && expose
 }
 
 func getFunctionName(mh *MethodHandler) string {
@@ -25,39 +41,43 @@ func getFunctionName(mh *MethodHandler) string {
 }
 
 func (mux *Mux) Print(w io.Writer, indent string) {
-    mux.mutex.RLock()
-    defer mux.mutex.RUnlock()
+    if root := mux.tree.Load(); root != nil {
+        root.print(w, indent)
+    }
+}
+
+func (n *node) print(w io.Writer, indent string) {
     const stdindent = "    "
 
-    keys := make([]string, 0, len(mux.m))
-    for k := range mux.m {
+    keys := make([]string, 0, len(n.m))
+    for k := range n.m {
         keys = append(keys, k)
     }
     sort.Strings(keys)
     for _, k := range keys {
-        v := mux.m[k]
+        v := n.m[k]
         hasMethod := false
         for method, mh := range v.methodHandlers {
             hasMethod = true
             fmt.Fprintln(w, indent + "/" + k + " (" + method +
-                            ")->" + mh.fnName + "()")
+                            ")->" + mh.fnName + "()" + docSuffix(mh))
         }
         if !hasMethod {
             fmt.Fprintln(w, indent + "/" + k)
         }
-        v.Print(w, indent + stdindent)
+        v.print(w, indent + stdindent)
     }
-    for _, v := range mux.matchers {
+    for _, v := range n.matchers {
         hasMethod := false
-        for method, mh := range v.Mux.methodHandlers {
+        for method, mh := range v.Node.methodHandlers {
             hasMethod = true
             fmt.Fprintln(w, indent + "/" + v.Prefix + v.Label+ " (" +
-                            method +  ")->" + mh.fnName + "()")
+                            method +  ")->" + mh.fnName + "()" + docSuffix(mh))
         }
         if !hasMethod {
             fmt.Fprintln(w, indent + "/" + v.Prefix + v.Label)
         }
 
-        v.Mux.Print(w, indent + stdindent)
+        v.Node.print(w, indent + stdindent)
     }
 }
@@ -0,0 +1,321 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "reflect"
+    "strconv"
+    "strings"
+)
+
+// DecodeOptions configures how JSON request bodies are decoded.
+type DecodeOptions struct {
+    // DisallowUnknownFields rejects bodies with object keys that do not
+    // match any field of the destination struct.
+    DisallowUnknownFields bool
+    // UseNumber decodes numbers into interface values as json.Number
+    // rather than float64.
+    UseNumber bool
+    // MaxDepth rejects bodies nesting objects and arrays deeper than
+    // MaxDepth. Zero means no limit.
+    MaxDepth int
+    // StrictEOF rejects bodies with anything but whitespace following
+    // the JSON value.
+    StrictEOF bool
+}
+
+// SetDecodeOptions sets the default options for decoding JSON request bodies.
+func (mux *Mux) SetDecodeOptions(opts DecodeOptions) {
+    mux.decodeOpts = opts
+}
+
+// WithDecodeOptions overrides the decoding options of Mux.SetDecodeOptions
+// for a single route.
+func WithDecodeOptions(opts DecodeOptions) RouteOption {
+    return func(o *routeOptions) {
+        o.decodeOpts = &opts
+    }
+}
+
+func (rs *reqState) decodeOptions() DecodeOptions {
+    if rs.mh.opts.decodeOpts != nil {
+        return *rs.mh.opts.decodeOpts
+    }
+    return rs.mux.decodeOpts
+}
+
+var errTrailingData = errors.New("unexpected data after JSON value")
+
+// decodeBody JSON-decodes the request body into v applying the decoding
+// settings of the mux and the matched route.
+func (rs *reqState) decodeBody(body io.Reader, v any) error {
+    opts := rs.decodeOptions()
+    if do, ok := v.(decodeOptioner); ok {
+        do.setDecodeOptions(opts)
+    }
+    var raw []byte /* the buffered body, if buffered */
+    if opts.MaxDepth > 0 || rs.mux.decodeErrDetails {
+        var err error
+        if raw, err = io.ReadAll(body); err != nil {
+            return &codeResponder{
+                code:  http.StatusBadRequest,
+                error: fmt.Errorf("io.ReadAll failed: %w", err),
+            }
+        }
+        if opts.MaxDepth > 0 {
+            if err := checkJSONDepth(raw, opts.MaxDepth); err != nil {
+                return rs.decodeErr(err, raw)
+            }
+        }
+        body = bytes.NewReader(raw)
+    }
+    dec := json.NewDecoder(body)
+    if rs.mh.opts.safeIntegers.or(rs.mux.safeIntegers) {
+        var rawVal any
+        dec.UseNumber()
+        if err := dec.Decode(&rawVal); err != nil {
+            return rs.decodeErr(err, raw)
+        }
+        if opts.StrictEOF && !atEOF(dec) {
+            return rs.decodeErr(errTrailingData, raw)
+        }
+        var err error
+        if raw, err = json.Marshal(coerceNumericStrings(rawVal, reflectTypeOf(v))); err != nil {
+            return rs.decodeErr(err, raw)
+        }
+        dec = json.NewDecoder(bytes.NewReader(raw))
+    }
+    if opts.DisallowUnknownFields {
+        dec.DisallowUnknownFields()
+    }
+    if opts.UseNumber {
+        dec.UseNumber()
+    }
+    if err := dec.Decode(v); err != nil {
+        return rs.decodeErr(err, raw)
+    }
+    if opts.StrictEOF && !atEOF(dec) {
+        return rs.decodeErr(errTrailingData, raw)
+    }
+    return nil
+}
+
+func atEOF(dec *json.Decoder) bool {
+    _, err := dec.Token()
+    return err == io.EOF
+}
+
+// checkJSONDepth returns an error if objects and arrays in b are nested
+// deeper than maxDepth.
+func checkJSONDepth(b []byte, maxDepth int) error {
+    depth := 0
+    inString, escaped := false, false
+    for _, c := range b {
+        if inString {
+            if escaped {
+                escaped = false
+            } else if c == '\\' {
+                escaped = true
+            } else if c == '"' {
+                inString = false
+            }
+            continue
+        }
+        switch c {
+        case '"':
+            inString = true
+        case '{', '[':
+            if depth++; depth > maxDepth {
+                return fmt.Errorf("JSON nesting exceeds maximum depth of %d", maxDepth)
+            }
+        case '}', ']':
+            depth--
+        }
+    }
+    return nil
+}
+
+// DecodeError describes why a JSON request body could not be decoded. For
+// values of the wrong type Path, Expected and Value tell the client which
+// value to fix, and for unknown fields, see DecodeOptions, Path is the name
+// of the field. The byte offset and a snippet of the body are only
+// collected when enabled with Mux.EnableDebugDecodeErrors.
+type DecodeError struct {
+    Err      error
+    Path     string /* path of the offending field, e.g. "items.1.n", if known */
+    Expected string /* the JSON type expected at Path, e.g. "integer" */
+    // Value is the offending value if the body was buffered, e.g. when
+    // debug decode errors are enabled, and its JSON type otherwise.
+    Value    string
+    Offset   int64  /* byte offset of the error in the body, -1 if unknown */
+    Snippet  string /* part of the body surrounding Offset */
+
+    expose   bool
+}
+
+func (e *DecodeError) Error() string {
+    if e.Expected == "" {
+        return "json decoding failed: " + e.Err.Error()
+    }
+    msg := "json decoding failed: expected " + e.Expected
+    if e.Path != "" {
+        msg += " at " + e.Path
+    }
+    return msg + ", got " + e.Value
+}
+
+func (e *DecodeError) Unwrap() error {
+    return e.Err
+}
+
+func (e *DecodeError) HTTPError() (int, any) {
+    return http.StatusBadRequest, e.body(e.Error())
+}
+
+/* body returns the response body of e with the message msg */
+func (e *DecodeError) body(msg string) any {
+    type fieldError struct {
+        Error    string `json:"error"`
+        Path     string `json:"path,omitempty"`
+        Expected string `json:"expected,omitempty"`
+        Value    string `json:"value,omitempty"`
+    }
+    fe := fieldError{msg, e.Path, e.Expected, e.Value}
+    if !e.expose {
+        return fe
+    }
+    return struct{
+        fieldError
+        Offset  int64  `json:"offset"`
+        Snippet string `json:"snippet,omitempty"`
+    }{fe, e.Offset, e.Snippet}
+}
+
+const(
+    snippetRadius = 24
+    maxValueLen   = 64 /* the maximum length of DecodeError.Value */
+)
+
+func newDecodeError(err error, raw []byte, details bool) *DecodeError {
+    de := &DecodeError{
+        Err:    err,
+        Offset: -1,
+    }
+    var synErr *json.SyntaxError
+    var typeErr *json.UnmarshalTypeError
+    if errors.As(err, &synErr) {
+        de.Offset = synErr.Offset
+    } else if errors.As(err, &typeErr) {
+        de.Offset = typeErr.Offset
+        de.Path = typeErr.Field
+        de.Expected = jsonTypeName(typeErr.Type)
+        de.Value = typeErr.Value
+        if v, ok := jsonValueAt(raw, de.Path); ok {
+            de.Value = v
+        }
+    } else if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+        de.Path, _ = strconv.Unquote(name)
+    }
+    if !details {
+        de.Offset = -1
+    } else if de.Offset >= 0 && raw != nil {
+        start := max(int(de.Offset) - snippetRadius, 0)
+        end := min(int(de.Offset) + snippetRadius, len(raw))
+        if start < end {
+            de.Snippet = string(raw[start:end])
+        }
+    }
+    return de
+}
+
+/* jsonTypeName returns the JSON type decoded into values of type t */
+func jsonTypeName(t reflect.Type) string {
+    if t == nil {
+        return ""
+    }
+    switch t.Kind() {
+    case reflect.Pointer:
+        return jsonTypeName(t.Elem())
+    case reflect.Bool:
+        return "boolean"
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+         reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        return "integer"
+    case reflect.Float32, reflect.Float64:
+        return "number"
+    case reflect.String:
+        return "string"
+    case reflect.Slice:
+        if t.Elem().Kind() == reflect.Uint8 {
+            return "string" /* base64 */
+        }
+        return "array"
+    case reflect.Array:
+        return "array"
+    case reflect.Map, reflect.Struct:
+        return "object"
+    }
+    return t.String()
+}
+
+// jsonValueAt returns the compact JSON encoding of the value at path, as
+// reported by json.UnmarshalTypeError, in the JSON document raw.
+func jsonValueAt(raw []byte, path string) (string, bool) {
+    var v any
+    if raw == nil || json.Unmarshal(raw, &v) != nil {
+        return "", false
+    }
+    if path != "" {
+        for _, key := range strings.Split(path, ".") {
+            switch c := v.(type) {
+            case map[string]any:
+                var ok bool
+                if v, ok = c[key]; !ok {
+                    return "", false
+                }
+            case []any:
+                i, err := strconv.Atoi(key)
+                if err != nil || i < 0 || i >= len(c) {
+                    return "", false
+                }
+                v = c[i]
+            default:
+                return "", false
+            }
+        }
+    }
+    b, err := json.Marshal(v)
+    if err != nil {
+        return "", false
+    }
+    if len(b) > maxValueLen {
+        return string(b[:maxValueLen]) + "...", true
+    }
+    return string(b), true
+}
+
+func (rs *reqState) decodeErr(err error, raw []byte) error {
+    de := newDecodeError(err, raw, rs.mux.decodeErrDetails)
+    red := rs.mux.redaction()
+    if de.Expected != "" && red.field(strings.Split(de.Path, ".")) {
+        de.Value = redacted
+    }
+    de.Snippet = red.snippet(de.Snippet)
+    if !rs.mux.decodeErrDetails {
+        rs.mux.log(rs.r, slog.LevelWarn, "failed to decode request body", slog.Any("error", err))
+        return de
+    }
+    de.expose = rs.mux.exposeDecodeErrs
+    rs.mux.log(rs.r, slog.LevelWarn, "failed to decode request body", slog.Any("error", err),
+               slog.Int64("offset", de.Offset), slog.String("path", de.Path),
+               slog.String("snippet", de.Snippet))
+    return de
+}
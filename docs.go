@@ -0,0 +1,35 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+
+// Doc annotates a route with a one-line summary and a longer description,
+// which are reported by Routes and Print so documentation generators can
+// use them, keeping the documentation next to the registration.
+func Doc(summary, description string) RouteOption {
+    return func(o *routeOptions) {
+        o.summary = summary
+        o.description = description
+    }
+}
+
+// Deprecated marks a route as deprecated. This is reported by Routes and
+// Print, but does not change how the route is served.
+func Deprecated() RouteOption {
+    return func(o *routeOptions) {
+        o.deprecated = true
+    }
+}
+
+/* docSuffix returns the annotations of mh as printed by Print */
+func docSuffix(mh *MethodHandler) string {
+    var s string
+    if mh.opts.deprecated {
+        s += " (deprecated)"
+    }
+    if mh.opts.summary != "" {
+        s += " - " + mh.opts.summary
+    }
+    return s
+}
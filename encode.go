@@ -0,0 +1,439 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "encoding/json"
+    "io"
+    "net/http"
+    "reflect"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// KeyCase selects how the keys of JSON responses are re-cased before
+// being written. KeyCaseNone leaves keys as produced by encoding/json.
+type KeyCase int
+
+const(
+    KeyCaseNone KeyCase = iota
+    KeyCaseSnake /* some_value */
+    KeyCaseCamel /* someValue */
+)
+
+// WithKeyCase re-cases the JSON response keys of a single route.
+// A key case requested through the header set by Mux.SetKeyCaseHeader
+// takes precedence.
+func WithKeyCase(kc KeyCase) RouteOption {
+    return func(o *routeOptions) {
+        o.keyCase = kc
+    }
+}
+
+// SetKeyCase sets the default key casing of all JSON responses.
+func (mux *Mux) SetKeyCase(kc KeyCase) {
+    mux.keyCase = kc
+}
+
+// SetKeyCaseHeader lets clients pick the key casing of JSON responses
+// through the specified request header. Accepted header values are
+// "snake", "snake_case", "camel" and "camelCase". An empty header name
+// disables the feature.
+func (mux *Mux) SetKeyCaseHeader(header string) {
+    mux.keyCaseHeader = header
+}
+
+func parseKeyCase(str string) KeyCase {
+    switch strings.ToLower(strings.TrimSpace(str)) {
+    case "snake", "snake_case":
+        return KeyCaseSnake
+    case "camel", "camelcase":
+        return KeyCaseCamel
+    }
+    return KeyCaseNone
+}
+
+func (mux *Mux) keyCaseFor(r *http.Request, mh *MethodHandler) KeyCase {
+    if mux.keyCaseHeader != "" {
+        if kc := parseKeyCase(r.Header.Get(mux.keyCaseHeader)); kc != KeyCaseNone {
+            return kc
+        }
+    }
+    if mh != nil && mh.opts.keyCase != KeyCaseNone {
+        return mh.opts.keyCase
+    }
+    return mux.keyCase
+}
+
+// toSnakeCase converts e.g. "someValue" and "HTTPServer" to
+// "some_value" and "http_server".
+func toSnakeCase(str string) string {
+    var sb strings.Builder
+    runes := []rune(str)
+    for i, c := range runes {
+        if unicode.IsUpper(c) {
+            if i > 0 && runes[i - 1] != '_' &&
+               (unicode.IsLower(runes[i - 1]) || unicode.IsDigit(runes[i - 1]) ||
+                (i + 1 < len(runes) && unicode.IsLower(runes[i + 1]))) {
+                sb.WriteByte('_')
+            }
+            c = unicode.ToLower(c)
+        }
+        sb.WriteRune(c)
+    }
+    return sb.String()
+}
+
+// toCamelCase converts e.g. "some_value" and "SomeValue" to "someValue",
+// and "ID" and "IDToken" to "id" and "idToken".
+func toCamelCase(str string) string {
+    runes := []rune(str)
+    /* lower-case the leading word, which may be an acronym */
+    for i, c := range runes {
+        if !unicode.IsUpper(c) ||
+           (i > 0 && i + 1 < len(runes) && unicode.IsLower(runes[i + 1])) {
+            break
+        }
+        runes[i] = unicode.ToLower(c)
+    }
+    var sb strings.Builder
+    upper := false
+    for _, c := range runes {
+        if c == '_' {
+            upper = sb.Len() > 0
+            continue
+        }
+        if upper {
+            c = unicode.ToUpper(c)
+        }
+        upper = false
+        sb.WriteRune(c)
+    }
+    return sb.String()
+}
+
+/* JSON rewriting */
+
+// jsonRewriter transforms an encoded JSON document token by token,
+// leaving the order of object keys intact.
+type jsonRewriter struct {
+    key          func(string) string
+    safeIntegers bool /* quote integers beyond ±2^53 */
+    escapeHTML   bool
+}
+
+type jsonFrame struct {
+    obj   bool
+    count int
+    val   reflect.Value /* the Go value encoded as the frame, if known */
+    elem  reflect.Value /* the Go value of the current member, if known */
+}
+
+/* keepKeys reports whether the keys of the frame are map keys, which are
+ * data rather than field names and thus never re-cased */
+func (f *jsonFrame) keepKeys() bool {
+    return f.val.IsValid() && f.val.Kind() == reflect.Map
+}
+
+// jsonIndirect returns the value encoding/json encodes for v, or the zero
+// Value if it is nil or encodes itself.
+func jsonIndirect(v reflect.Value) reflect.Value {
+    for v.IsValid() {
+        t := v.Type()
+        if t == filteredObjectType {
+            return v
+        }
+        if t.Implements(marshalerType) ||
+           (v.CanAddr() && reflect.PointerTo(t).Implements(marshalerType)) {
+            return reflect.Value{}
+        }
+        if v.Kind() != reflect.Pointer && v.Kind() != reflect.Interface {
+            return v
+        }
+        if v.IsNil() {
+            return reflect.Value{}
+        }
+        v = v.Elem()
+    }
+    return v
+}
+
+// jsonMember returns the Go value encoded as the member key of the object v.
+func jsonMember(v reflect.Value, key string) reflect.Value {
+    if !v.IsValid() {
+        return v
+    }
+    if v.Type() == filteredObjectType {
+        for _, m := range v.Interface().(filteredObject) {
+            if m.key == key {
+                return reflect.ValueOf(m.val)
+            }
+        }
+        return reflect.Value{}
+    }
+    switch v.Kind() {
+    case reflect.Map:
+        if kt := v.Type().Key(); kt.Kind() == reflect.String {
+            return v.MapIndex(reflect.ValueOf(key).Convert(kt))
+        }
+    case reflect.Struct:
+        for _, sf := range fieldsOf(v.Type()) {
+            if sf.name == key {
+                fv, _ := v.FieldByIndexErr(sf.index)
+                return fv
+            }
+        }
+    }
+    return reflect.Value{}
+}
+
+// jsonElem returns the Go value encoded as element i of the array v.
+func jsonElem(v reflect.Value, i int) reflect.Value {
+    if v.IsValid() && (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && i < v.Len() {
+        return v.Index(i)
+    }
+    return reflect.Value{}
+}
+
+func (rw *jsonRewriter) active() bool {
+    return rw.key != nil || rw.safeIntegers
+}
+
+// rewrite rewrites src, the encoding of v. The keys of objects encoding
+// maps are left as they are.
+func (rw *jsonRewriter) rewrite(src []byte, v any) ([]byte, error) {
+    dec := json.NewDecoder(bytes.NewReader(src))
+    dec.UseNumber()
+    out := bytes.NewBuffer(make([]byte, 0, len(src)))
+    var stack []jsonFrame
+    root := reflect.ValueOf(v)
+    for {
+        tok, err := dec.Token()
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        isKey, keepKey := false, false
+        /* the Go value encoded as tok if it opens an object or array */
+        cur := root
+        if n := len(stack); n > 0 {
+            top := &stack[n - 1]
+            if d, ok := tok.(json.Delim); !ok || (d != '}' && d != ']') {
+                if top.obj {
+                    isKey = top.count % 2 == 0
+                    if isKey && top.count > 0 {
+                        out.WriteByte(',')
+                    }
+                } else {
+                    if top.count > 0 {
+                        out.WriteByte(',')
+                    }
+                    top.elem = jsonElem(top.val, top.count)
+                }
+                top.count++
+            }
+            if isKey {
+                keepKey = top.keepKeys()
+                if key, ok := tok.(string); ok {
+                    top.elem = jsonMember(top.val, key)
+                }
+            }
+            cur = top.elem
+        } else if out.Len() > 0 {
+            out.WriteByte('\n')
+            root = reflect.Value{}
+            cur = root
+        }
+        switch v := tok.(type) {
+        case json.Delim:
+            out.WriteRune(rune(v))
+            if v == '{' || v == '[' {
+                stack = append(stack, jsonFrame{obj: v == '{', val: jsonIndirect(cur)})
+            } else {
+                stack = stack[:len(stack) - 1]
+            }
+        case string:
+            if isKey && !keepKey && rw.key != nil {
+                v = rw.key(v)
+            }
+            writeJSONString(out, v, rw.escapeHTML)
+            if isKey {
+                out.WriteByte(':')
+            }
+        case json.Number:
+            if rw.safeIntegers && isUnsafeInteger(v) {
+                writeJSONString(out, v.String(), false)
+            } else {
+                out.WriteString(v.String())
+            }
+        case bool:
+            if v {
+                out.WriteString("true")
+            } else {
+                out.WriteString("false")
+            }
+        case nil:
+            out.WriteString("null")
+        }
+    }
+    if bytes.HasSuffix(src, []byte{'\n'}) {
+        out.WriteByte('\n')
+    }
+    return out.Bytes(), nil
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeJSONString writes str quoted and escaped the same way encoding/json does.
+func writeJSONString(buf *bytes.Buffer, str string, escapeHTML bool) {
+    buf.WriteByte('"')
+    for i := 0; i < len(str); {
+        c := str[i]
+        if c < utf8.RuneSelf {
+            switch {
+            case c == '"' || c == '\\':
+                buf.WriteByte('\\')
+                buf.WriteByte(c)
+            case c == '\n':
+                buf.WriteString(`\n`)
+            case c == '\r':
+                buf.WriteString(`\r`)
+            case c == '\t':
+                buf.WriteString(`\t`)
+            case c < 0x20 || (escapeHTML && (c == '<' || c == '>' || c == '&')):
+                buf.WriteString(`\u00`)
+                buf.WriteByte(hexDigits[c >> 4])
+                buf.WriteByte(hexDigits[c & 0xf])
+            default:
+                buf.WriteByte(c)
+            }
+            i++
+            continue
+        }
+        r, size := utf8.DecodeRuneInString(str[i:])
+        switch {
+        case r == utf8.RuneError && size == 1:
+            buf.WriteString(`\ufffd`)
+        case r == '\u2028' || r == '\u2029':
+            buf.WriteString(`\u202`)
+            buf.WriteByte(hexDigits[r & 0xf])
+        default:
+            buf.WriteString(str[i:i + size])
+        }
+        i += size
+    }
+    buf.WriteByte('"')
+}
+
+/* Response encoding */
+
+// Encoder encodes response values. Implementing it allows alternative
+// JSON libraries to be used for encoding responses.
+type Encoder interface {
+    Encode(w io.Writer, v any) error
+}
+
+// EncoderFunc adapts a function to the Encoder interface.
+type EncoderFunc func(w io.Writer, v any) error
+
+func (fn EncoderFunc) Encode(w io.Writer, v any) error {
+    return fn(w, v)
+}
+
+// JSONOptions configures the encoding/json based default encoder.
+type JSONOptions struct {
+    EscapeHTML bool
+    Prefix     string
+    Indent     string
+}
+
+var defaultJSONOptions = JSONOptions{EscapeHTML: true}
+
+// SetJSONOptions configures the default encoder of the mux. By default HTML
+// characters are escaped and no indentation is used.
+func (mux *Mux) SetJSONOptions(opts JSONOptions) {
+    mux.jsonOpts = &opts
+}
+
+// SetEncoder replaces the default encoding/json based encoder of the mux.
+// The JSON options still apply to the key rewriting performed by the mux.
+func (mux *Mux) SetEncoder(enc Encoder) {
+    mux.encoder = enc
+}
+
+func (mux *Mux) jsonOptions() JSONOptions {
+    if mux.jsonOpts != nil {
+        return *mux.jsonOpts
+    }
+    return defaultJSONOptions
+}
+
+func (mux *Mux) encode(w io.Writer, v any, opts JSONOptions) error {
+    if mux.encoder != nil {
+        return mux.encoder.Encode(w, v)
+    }
+    enc := json.NewEncoder(w)
+    enc.SetEscapeHTML(opts.EscapeHTML)
+    enc.SetIndent(opts.Prefix, opts.Indent)
+    return enc.Encode(v)
+}
+
+func (mux *Mux) jsonRewriter(r *http.Request, mh *MethodHandler, opts JSONOptions) jsonRewriter {
+    rw := jsonRewriter{escapeHTML: opts.EscapeHTML}
+    if mh != nil {
+        rw.safeIntegers = mh.opts.safeIntegers.or(mux.safeIntegers)
+    } else {
+        rw.safeIntegers = mux.safeIntegers
+    }
+    switch mux.keyCaseFor(r, mh) {
+    case KeyCaseSnake:
+        rw.key = toSnakeCase
+    case KeyCaseCamel:
+        rw.key = toCamelCase
+    }
+    return rw
+}
+
+// writeJSON JSON-encodes v to w applying the response settings of the mux
+// and the matched route.
+func (mux *Mux) writeJSON(w io.Writer, r *http.Request, mh *MethodHandler, v any) error {
+    opts := mux.jsonOptions()
+    if rw := mux.jsonRewriter(r, mh, opts); !rw.active() {
+        return mux.encode(w, v, opts)
+    }
+    b, err := mux.marshalJSON(r, mh, v)
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(b)
+    return err
+}
+
+// marshalJSON is like writeJSON but returns the encoding of v.
+func (mux *Mux) marshalJSON(r *http.Request, mh *MethodHandler, v any) ([]byte, error) {
+    opts := mux.jsonOptions()
+    rw := mux.jsonRewriter(r, mh, opts)
+    var buf bytes.Buffer
+    if err := mux.encode(&buf, v, opts); err != nil {
+        return nil, err
+    }
+    if !rw.active() {
+        return buf.Bytes(), nil
+    }
+    b, err := rw.rewrite(buf.Bytes(), v)
+    if err != nil {
+        return nil, err
+    }
+    if opts.Prefix != "" || opts.Indent != "" {
+        var indented bytes.Buffer
+        if err := json.Indent(&indented, b, opts.Prefix, opts.Indent); err != nil {
+            return nil, err
+        }
+        b = indented.Bytes()
+    }
+    return b, nil
+}
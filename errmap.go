@@ -0,0 +1,79 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "net/http"
+)
+
+/* errorMapping converts errors matching it to responses */
+type errorMapping struct {
+    match  func(error) (error, bool)
+    status int
+    shape  func(error) any
+}
+
+// MapError makes handlers returning errors matching target, as reported by
+// errors.Is, respond with status. The body is returned by shape, called
+// with the matching error, or if shape is nil the status text in the format
+// of Error. Mappings apply to errors not implementing any of the responder
+// interfaces and are tried in the order they were added, e.g.
+//
+//  m.MapError(sql.ErrNoRows, http.StatusNotFound, nil)
+func (mux *Mux) MapError(target error, status int, shape func(error) any) {
+    mux.errMappings = append(mux.errMappings, errorMapping{
+        match: func(err error) (error, bool) {
+            return err, errors.Is(err, target)
+        },
+        status: status,
+        shape:  shape,
+    })
+}
+
+// MapErrorType is like Mux.MapError but maps errors of type E, as reported
+// by errors.As, passing the matching error to shape, e.g.
+//
+//  cmux.MapErrorType(m, http.StatusUnprocessableEntity, func(err *ValidationError) any {
+//      return err.Fields
+//  })
+func MapErrorType[E error](mux *Mux, status int, shape func(E) any) {
+    var shapeAny func(error) any
+    if shape != nil {
+        shapeAny = func(err error) any {
+            return shape(err.(E))
+        }
+    }
+    mux.errMappings = append(mux.errMappings, errorMapping{
+        match: func(err error) (error, bool) {
+            var target E
+            if errors.As(err, &target) {
+                return target, true
+            }
+            return nil, false
+        },
+        status: status,
+        shape:  shapeAny,
+    })
+}
+
+// mapError returns the status and body of the first mapping matching err.
+func (mux *Mux) mapError(r *http.Request, err error) (int, any, bool) {
+    for _, m := range mux.errMappings {
+        matched, ok := m.match(err)
+        if !ok {
+            continue
+        }
+        if m.shape != nil {
+            return m.status, m.shape(matched), true
+        }
+        e := &Error{Status: m.status}
+        if mux.localizer != nil {
+            return m.status, e.localizedError(mux.translator(r)), true
+        }
+        _, out := e.HTTPError()
+        return m.status, out, true
+    }
+    return 0, nil, false
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "net/http"
+)
+
+// Error is an HTTP error carrying a machine-readable code and details,
+// responded as e.g.
+//
+//  {"error": "user not found", "code": "user_not_found", "details": {"id": 7}}
+//
+// Errors are values; the With methods return modified copies, so the
+// sentinels can be refined per request:
+//
+//  return cmux.ErrNotFound.WithMessage("user not found").WithDetail("id", id)
+//
+// errors.Is reports whether an error was derived from a sentinel using the
+// With methods or Wrap, or matches it by status and code, where errors
+// without a code match any error of the same status.
+type Error struct {
+    Status  int
+    Code    string         /* machine-readable, e.g. "not_found" */
+    Message string         /* defaults to the status text */
+    Details map[string]any
+    Key     string         /* localization key of the message */
+    Err     error          /* the underlying cause, never responded */
+
+    origin  *Error         /* the error the copy was derived from, see Is */
+}
+
+// Sentinels for common statuses.
+var(
+    ErrBadRequest          = &Error{Status: http.StatusBadRequest, Code: "bad_request"}
+    ErrUnauthorized        = &Error{Status: http.StatusUnauthorized, Code: "unauthorized"}
+    ErrForbidden           = &Error{Status: http.StatusForbidden, Code: "forbidden"}
+    ErrNotFound            = &Error{Status: http.StatusNotFound, Code: "not_found"}
+    ErrConflict            = &Error{Status: http.StatusConflict, Code: "conflict"}
+    ErrGone                = &Error{Status: http.StatusGone, Code: "gone"}
+    ErrUnprocessable       = &Error{Status: http.StatusUnprocessableEntity, Code: "unprocessable"}
+    ErrTooManyRequests     = &Error{Status: http.StatusTooManyRequests, Code: "too_many_requests"}
+    ErrInternal            = &Error{Status: http.StatusInternalServerError, Code: "internal"}
+    ErrServiceUnavailable  = &Error{Status: http.StatusServiceUnavailable, Code: "service_unavailable"}
+)
+
+// NewError creates an Error with the specified status, code and message.
+func NewError(status int, code, message string) *Error {
+    return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) message() string {
+    if e.Message != "" {
+        return e.Message
+    }
+    if text := http.StatusText(e.Status); text != "" {
+        return text
+    }
+    return "unknown error"
+}
+
+func (e *Error) Error() string {
+    msg := e.message()
+    if e.Err != nil && e.Err.Error() != msg {
+        return msg + ": " + e.Err.Error()
+    }
+    return msg
+}
+
+func (e *Error) Unwrap() error {
+    return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+    t, ok := target.(*Error)
+    if !ok {
+        return false
+    }
+    for o := e.origin; o != nil; o = o.origin {
+        if o == t {
+            return true
+        }
+    }
+    return t.Status == e.Status && (e.Code == "" || t.Code == e.Code)
+}
+
+/* derive returns a copy of e remembering e as its origin */
+func (e *Error) derive() *Error {
+    c := *e
+    c.origin = e
+    return &c
+}
+
+func (e *Error) HTTPError() (int, any) {
+    return e.Status, struct{
+        Error   string         `json:"error"`
+        Code    string         `json:"code,omitempty"`
+        Details map[string]any `json:"details,omitempty"`
+    }{e.message(), e.Code, e.Details}
+}
+
+// WithMessage returns a copy of e with the specified message.
+func (e *Error) WithMessage(message string) *Error {
+    c := e.derive()
+    c.Message = message
+    return c
+}
+
+// WithCode returns a copy of e with the specified machine-readable code.
+func (e *Error) WithCode(code string) *Error {
+    c := e.derive()
+    c.Code = code
+    return c
+}
+
+// WithDetail returns a copy of e with the detail key set to value.
+func (e *Error) WithDetail(key string, value any) *Error {
+    c := e.derive()
+    c.Details = make(map[string]any, len(e.Details) + 1)
+    for k, v := range e.Details {
+        c.Details[k] = v
+    }
+    c.Details[key] = value
+    return c
+}
+
+// WithKey returns a copy of e with the specified localization key.
+func (e *Error) WithKey(key string) *Error {
+    c := e.derive()
+    c.Key = key
+    return c
+}
+
+// Wrap returns a copy of e wrapping the cause err. The cause is logged
+// but not responded.
+func (e *Error) Wrap(err error) *Error {
+    c := e.derive()
+    c.Err = err
+    return c
+}
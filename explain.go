@@ -0,0 +1,200 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "net/http"
+    "net/url"
+    "reflect"
+    "strings"
+)
+
+// MatchResult explains how the mux routes a request, see Mux.Explain.
+type MatchResult struct {
+    Method   string
+    Path     string
+    // Status is the status the mux responds with if the route is not
+    // matched: 404 Not Found, 405 Method Not Allowed, 400 Bad Request for
+    // invalid or rejected paths, or a redirect of unclean paths, see
+    // SetPathNormalization. It is 0 if matched.
+    Status   int
+    Pattern  string /* the pattern of the matched route, if any */
+    Handler  string /* the name of the handler function, if matched */
+    // Fallback reports whether the path was matched by a route serving a
+    // directory, i.e. a pattern ending with a slash.
+    Fallback bool
+    // Vars holds the captured path variables of the match and their
+    // parsed values.
+    Vars     map[string]any
+    // Attempts lists each candidate considered for each path segment in
+    // the order the mux tried them.
+    Attempts []MatchAttempt
+}
+
+// MatchAttempt is a candidate considered while matching a path segment.
+type MatchAttempt struct {
+    Depth     int    /* index of the path segment */
+    Segment   string
+    Candidate string /* e.g. "users" or "user-{id}" */
+    Accepted  bool
+    Reason    string /* why the candidate was rejected */
+}
+
+type explainVar struct {
+    name  string
+    raw   string /* the matched segment without prefix and suffix */
+    value any
+}
+
+// Explain reports how a request with the specified method and path would
+// be routed without serving it: which route matches, which candidates
+// were tried, the captured variables and why alternatives were rejected.
+func (mux *Mux) Explain(method, path string) MatchResult {
+    res, _, _ := mux.explain(method, path)
+    return res
+}
+
+// Match reports the route a request with the specified method and path
+// would be served by, along with the raw values of the captured path
+// variables. Match has no side effects and is safe to call concurrently
+// with serving, e.g. to fuzz a route table for panics and unexpected
+// fallbacks:
+//
+//  func FuzzRoutes(f *testing.F) {
+//      m := newMux()
+//      f.Fuzz(func(t *testing.T, path string) {
+//          m.Match("GET", path)
+//      })
+//  }
+func (mux *Mux) Match(method, path string) (*RouteInfo, map[string]string, bool) {
+    res, mh, vars := mux.explain(method, path)
+    if res.Status != 0 {
+        return nil, nil, false
+    }
+    ri := routeInfo(mh)
+    raw := make(map[string]string, len(vars))
+    for _, v := range vars {
+        raw[v.name] = v.raw
+    }
+    return &ri, raw, true
+}
+
+func (mux *Mux) explain(method, path string) (MatchResult, *MethodHandler, []explainVar) {
+    res := MatchResult{Method: method, Path: path, Status: http.StatusNotFound}
+    root := mux.tree.Load()
+    if root == nil || path == "" || path[0] != '/' {
+        return res, nil, nil
+    }
+    /* split and clean the path like ServeHTTP */
+    dec, err := url.PathUnescape(path)
+    if err != nil {
+        res.Status = http.StatusBadRequest
+        return res, nil, nil
+    }
+    var matrix url.Values
+    if mux.matrixParams {
+        matrix = url.Values{}
+    }
+    dirs, err := mux.splitPath(&url.URL{Path: dec, RawPath: path}, matrix)
+    if err != nil {
+        res.Status = http.StatusBadRequest
+        return res, nil, nil
+    }
+    dirs, _, status := mux.cleanPath(dirs, method)
+    if status != 0 {
+        res.Status = status
+        return res, nil, nil
+    }
+    match, fallback, vars, fbVars := root.explain(dirs, 0, nil, &res)
+    if match == nil {
+        match, vars = fallback, fbVars
+        res.Fallback = true
+        if match == nil {
+            res.Fallback = false
+            return res, nil, nil
+        }
+    }
+    mh := match.methodHandler(method)
+    if mh == nil {
+        res.Status = http.StatusMethodNotAllowed
+        return res, nil, nil
+    }
+    res.Status = 0
+    res.Pattern = mh.pattern
+    res.Handler = getFunctionName(mh)
+    res.Vars = map[string]any{}
+    for _, v := range vars {
+        res.Vars[v.name] = v.value
+    }
+    return res, mh, vars
+}
+
+/* explain mirrors node.matchDir, recording the attempts */
+func (n *node) explain(dirs []string, depth int, acc []explainVar, res *MatchResult) (*node, *node, []explainVar, []explainVar) {
+    if len(dirs) == 0 {
+        return n, nil, acc, nil
+    }
+    dir := dirs[0]
+    dirs = dirs[1:]
+    attempt := func(candidate string, accepted bool, reason string) {
+        res.Attempts = append(res.Attempts, MatchAttempt{
+            Depth:     depth,
+            Segment:   dir,
+            Candidate: candidate,
+            Accepted:  accepted,
+            Reason:    reason,
+        })
+    }
+    var fallback *node
+    var fbVars []explainVar
+    if nmux, ok := n.m[dir]; ok {
+        attempt(dir, true, "")
+        idx := len(res.Attempts) - 1
+        match, fb, vars, fbv := nmux.explain(dirs, depth + 1, acc, res)
+        if match != nil {
+            return match, nil, vars, nil
+        }
+        fallback, fbVars = fb, fbv
+        res.Attempts[idx].Accepted = false
+        res.Attempts[idx].Reason = "no route below"
+    }
+    for _, matcher := range n.matchers {
+        candidate := matcher.Prefix + "{" + matcher.Label + "}" + matcher.Suffix
+        if !strings.HasPrefix(dir, matcher.Prefix) ||
+           !strings.HasSuffix(dir[len(matcher.Prefix):], matcher.Suffix) {
+            attempt(candidate, false, "prefix or suffix mismatch")
+            continue
+        }
+        src, err := matcher.FieldParser.Fn(dir[len(matcher.Prefix):len(dir) - len(matcher.Suffix)])
+        if err != nil {
+            attempt(candidate, false, "parse error: " + err.Error())
+            continue
+        }
+        t := matcher.FieldParser.Type
+        if t.Kind() == reflect.Pointer {
+            t = t.Elem()
+        }
+        v := explainVar{
+            name:  matcher.Label,
+            raw:   dir[len(matcher.Prefix):len(dir) - len(matcher.Suffix)],
+            value: reflect.NewAt(t, src).Elem().Interface(),
+        }
+        attempt(candidate, true, "")
+        idx := len(res.Attempts) - 1
+        acc2 := append(acc[:len(acc):len(acc)], v)
+        match, fb, vars, fbv := matcher.Node.explain(dirs, depth + 1, acc2, res)
+        if match != nil {
+            return match, nil, vars, nil
+        }
+        res.Attempts[idx].Accepted = false
+        res.Attempts[idx].Reason = "no route below"
+        if fallback == nil {
+            fallback, fbVars = fb, fbv
+        }
+    }
+    if fallback == nil && n.servesDir {
+        return nil, n, acc, append([]explainVar{}, acc...)
+    }
+    return nil, fallback, acc, fbVars
+}
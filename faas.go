@@ -0,0 +1,77 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "errors"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+)
+
+// FunctionHandler returns a handler serving the mux on function platforms
+// passing on plain HTTP requests, such as Google Cloud Functions, with
+// basePath stripped from the paths of the requests, e.g.
+//
+//  functions.HTTP("api", m.FunctionHandler("/api").ServeHTTP)
+//
+// Requests with paths outside of basePath are served unchanged. Bodies are
+// passed through as is, so binary bodies need no encoding.
+func (mux *Mux) FunctionHandler(basePath string) http.Handler {
+    basePath = strings.TrimSuffix(basePath, "/")
+    if basePath == "" {
+        return mux
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mux.ServeHTTP(w, stripBasePath(r, basePath))
+    })
+}
+
+/* stripBasePath returns a shallow copy of r with basePath stripped from its path */
+func stripBasePath(r *http.Request, basePath string) *http.Request {
+    p, ok := strings.CutPrefix(r.URL.Path, basePath)
+    if !ok || p != "" && p[0] != '/' {
+        return r
+    }
+    if p == "" {
+        p = "/"
+    }
+    r2 := new(http.Request)
+    *r2 = *r
+    r2.URL = new(url.URL)
+    *r2.URL = *r.URL
+    r2.URL.Path = p
+    if rp, ok := strings.CutPrefix(r.URL.RawPath, basePath); ok {
+        if rp == "" {
+            rp = "/"
+        }
+        r2.URL.RawPath = rp
+    } else {
+        r2.URL.RawPath = ""
+    }
+    return r2
+}
+
+// ServeAzureFunctions serves the mux as an Azure Functions custom handler
+// until ctx is done, like ListenAndServe, listening on the port set by the
+// Functions host in FUNCTIONS_CUSTOMHANDLER_PORT. The function app must
+// forward HTTP requests to the handler, i.e. set enableForwardingHttpRequest
+// in host.json, and routePrefix, "/api" unless configured otherwise in
+// host.json, is stripped from the paths of the requests:
+//
+//  log.Fatal(m.ServeAzureFunctions(ctx, "/api"))
+//
+// Bodies are forwarded as is, so binary bodies need no encoding.
+func (mux *Mux) ServeAzureFunctions(ctx context.Context, routePrefix string) error {
+    port := os.Getenv("FUNCTIONS_CUSTOMHANDLER_PORT")
+    if port == "" {
+        return errors.New("cmux: FUNCTIONS_CUSTOMHANDLER_PORT is not set")
+    }
+    srv := mux.cleartextServer(net.JoinHostPort("", port))
+    srv.Handler = mux.FunctionHandler(routePrefix)
+    return mux.serveUntilDone(ctx, srv, srv.ListenAndServe)
+}
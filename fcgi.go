@@ -0,0 +1,69 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "errors"
+    "net"
+    "net/http"
+    "net/http/cgi"
+    "net/http/fcgi"
+    "os"
+    "strings"
+)
+
+// ServeFCGI serves the mux over FastCGI on l until ctx is done, e.g. behind
+// nginx or Apache, after which the mux is shut down gracefully like for
+// ListenAndServe. Requests are routed by their path relative to the
+// SCRIPT_NAME set by the web server, i.e. by PATH_INFO, so a mux serving
+// "/users/{id}" mounted at "/app" serves "/app/users/{id}". nginx sets
+// SCRIPT_NAME to the whole path unless fastcgi_split_path_info is used, so
+// it should be set to the mount point or "" along with the fastcgi_params:
+//
+//  location /app/ {
+//      include       fastcgi_params;
+//      fastcgi_param SCRIPT_NAME /app;
+//      fastcgi_pass  unix:/run/app.sock;
+//  }
+func (mux *Mux) ServeFCGI(ctx context.Context, l net.Listener) error {
+    errc := make(chan error, 1)
+    go func() {
+        errc <- fcgi.Serve(l, mux.gatewayHandler(func(r *http.Request, key string) string {
+            return fcgi.ProcessEnv(r)[key]
+        }))
+    }()
+    select {
+    case err := <-errc:
+        return err
+    case <-ctx.Done():
+    }
+    shutdownCtx, cancel := mux.shutdownContext()
+    defer cancel()
+    /* stop accepting connections before draining the requests in flight */
+    l.Close()
+    drainErr := mux.Shutdown(shutdownCtx)
+    if err := <-errc; err != nil && !errors.Is(err, net.ErrClosed) {
+        return err
+    }
+    return drainErr
+}
+
+// ServeCGI serves the single request of a CGI process, routed like for
+// ServeFCGI.
+func (mux *Mux) ServeCGI() error {
+    return cgi.Serve(mux.gatewayHandler(func(_ *http.Request, key string) string {
+        return os.Getenv(key)
+    }))
+}
+
+/* gatewayHandler serves the mux with SCRIPT_NAME stripped from the paths of requests */
+func (mux *Mux) gatewayHandler(env func(r *http.Request, key string) string) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if scriptName := strings.TrimSuffix(env(r, "SCRIPT_NAME"), "/"); scriptName != "" {
+            r = stripBasePath(r, scriptName)
+        }
+        mux.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "log/slog"
+    "net/http"
+)
+
+// FeatureFlags reports whether the feature flag name is enabled for the
+// request r.
+type FeatureFlags interface {
+    Enabled(r *http.Request, name string) bool
+}
+
+// FeatureFlagsFunc is an adapter allowing ordinary functions to be used
+// as FeatureFlags.
+type FeatureFlagsFunc func(r *http.Request, name string) bool
+
+func (f FeatureFlagsFunc) Enabled(r *http.Request, name string) bool {
+    return f(r, name)
+}
+
+// SetFeatureFlags sets the provider consulted by routes using FeatureGate.
+// Without a provider every gated route is disabled.
+func (mux *Mux) SetFeatureFlags(flags FeatureFlags) {
+    mux.flags = flags
+}
+
+type featureGate struct {
+    name   string
+    status int
+}
+
+// FeatureGate only serves requests for which the feature flag name is
+// enabled. Other requests are responded to as if the route did not exist,
+// i.e. with 404 Not Found.
+func FeatureGate(name string) RouteOption {
+    return func(o *routeOptions) {
+        o.gates = append(o.gates, featureGate{name, http.StatusNotFound})
+    }
+}
+
+// FeatureGateForbidden is like FeatureGate but responds to requests for
+// which the feature flag is disabled with 403 Forbidden.
+func FeatureGateForbidden(name string) RouteOption {
+    return func(o *routeOptions) {
+        o.gates = append(o.gates, featureGate{name, http.StatusForbidden})
+    }
+}
+
+// checkGates reports whether the feature gates of the route let r through,
+// responding itself if not.
+func (rs *reqState) checkGates(w http.ResponseWriter, r *http.Request) (bool, error) {
+    mux := rs.mux
+    for _, g := range rs.mh.opts.gates {
+        if mux.flags != nil && mux.flags.Enabled(r, g.name) {
+            continue
+        }
+        mux.log(r, slog.LevelDebug, "feature disabled", slog.String("feature", g.name))
+        if g.status == http.StatusForbidden {
+            return false, ErrForbidden
+        }
+        /* indistinguishable from an unmatched route */
+        http.Error(w, mux.localize(r, statusKey(http.StatusNotFound), "404 page not found"),
+                   http.StatusNotFound)
+        return false, nil
+    }
+    return true, nil
+}
@@ -0,0 +1,418 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "context"
+    "encoding"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "reflect"
+    "slices"
+    "strings"
+    "sync"
+)
+
+type reqStateKey struct{}
+
+/* requestState returns the state of a request served by a mux, if any */
+func requestState(ctx context.Context) *reqState {
+    rs, _ := ctx.Value(reqStateKey{}).(*reqState)
+    return rs
+}
+
+// SetRoles sets the roles of the caller of a request, typically from a
+// Before function after authenticating the caller. Struct fields tagged
+// with cmux_expose are only included in the response if the caller has
+// one of the listed roles, e.g. for
+//
+//  type User struct {
+//      Name  string `json:"name"`
+//      Email string `json:"email" cmux_expose:"admin,self"`
+//  }
+//
+// the email is only responded to callers with the admin or self role.
+func SetRoles(r *http.Request, roles ...string) {
+    if rs := requestState(r.Context()); rs != nil {
+        rs.roles = append(rs.roles, roles...)
+    }
+}
+
+// Roles returns the roles set for the caller of a request using SetRoles.
+func Roles(r *http.Request) []string {
+    if rs := requestState(r.Context()); rs != nil {
+        return rs.roles
+    }
+    return nil
+}
+
+// SparseFieldsets lets clients of a route select the fields of successful
+// responses using the fields query parameter, e.g. ?fields=id,name,owner.name
+// where nested fields are selected using dots. See Mux.EnableSparseFieldsets.
+func SparseFieldsets(enable bool) RouteOption {
+    return func(o *routeOptions) {
+        o.sparseFields = mkOptBool(enable)
+    }
+}
+
+// EnableSparseFieldsets enables the fields query parameter of
+// SparseFieldsets for all routes.
+func (mux *Mux) EnableSparseFieldsets(enable bool) {
+    mux.sparseFields = enable
+}
+
+/* fieldSet is a selection of fields, nil selects all fields */
+type fieldSet map[string]fieldSet
+
+func parseFieldSet(str string) fieldSet {
+    fs := fieldSet{}
+    for _, path := range strings.Split(str, ",") {
+        if path = strings.TrimSpace(path); path == "" {
+            continue
+        }
+        cur := fs
+        names := strings.Split(path, ".")
+        for i, name := range names {
+            next, ok := cur[name]
+            if i == len(names) - 1 {
+                if !ok {
+                    /* select the whole field */
+                    cur[name] = nil
+                }
+                break
+            }
+            if next == nil {
+                if ok {
+                    /* the whole field is already selected */
+                    break
+                }
+                next = fieldSet{}
+                cur[name] = next
+            }
+            cur = next
+        }
+    }
+    return fs
+}
+
+/* fieldFilter decides which struct fields are encoded */
+type fieldFilter struct {
+    roles []string
+}
+
+// filterFields applies the role and sparse fieldset filters to the
+// response body out.
+func (mux *Mux) filterFields(r *http.Request, mh *MethodHandler, code int, out any) any {
+    rs := requestState(r.Context())
+    if rs == nil {
+        return out
+    }
+    ff := fieldFilter{roles: rs.roles}
+    if mh != nil && code < 300 && mh.opts.sparseFields.or(mux.sparseFields) {
+        if fields := r.URL.Query().Get("fields"); fields != "" {
+            return ff.filterValue(reflect.ValueOf(out), parseFieldSet(fields))
+        }
+    }
+    return ff.filter(out)
+}
+
+func (f *fieldFilter) allows(sf *structField) bool {
+    if sf.expose == nil {
+        return true
+    }
+    for _, role := range f.roles {
+        if slices.Contains(sf.expose, role) {
+            return true
+        }
+    }
+    return false
+}
+
+type structField struct {
+    name      string
+    index     []int
+    omitEmpty bool
+    omitZero  bool
+    quoted    bool /* the ,string option */
+    expose    []string /* roles allowed to see the field, nil for all */
+}
+
+var(
+    filterTypes sync.Map /* reflect.Type -> bool, whether the type needs filtering */
+    structFields sync.Map /* reflect.Type -> []structField */
+    marshalerType = reflect.TypeFor[json.Marshaler]()
+    textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+    filteredObjectType = reflect.TypeFor[filteredObject]()
+)
+
+// needsFilter reports whether values of t may contain fields tagged with
+// cmux_expose. Interfaces may hold any value and thus always need filtering.
+func needsFilter(t reflect.Type) bool {
+    if v, ok := filterTypes.Load(t); ok {
+        return v.(bool)
+    }
+    needs, _ := visitFilter(t, map[reflect.Type]bool{})
+    return needs
+}
+
+/* visitFilter computes needsFilter for t, assuming false for the types in
+ * visiting to cut recursive types short. Results depending on such an
+ * assumption are not cached unless t is the type the assumption was made
+ * for, as they may be wrong for t alone. */
+func visitFilter(t reflect.Type, visiting map[reflect.Type]bool) (needs, assumed bool) {
+    if v, ok := filterTypes.Load(t); ok {
+        return v.(bool), false
+    }
+    if visiting[t] {
+        return false, true
+    }
+    visiting[t] = true
+    if !t.Implements(marshalerType) && !t.Implements(textMarshalerType) {
+        switch t.Kind() {
+        case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+            needs, assumed = visitFilter(t.Elem(), visiting)
+        case reflect.Interface:
+            needs = true
+        case reflect.Struct:
+            for i := 0; i < t.NumField() && !needs; i++ {
+                f := t.Field(i)
+                if _, tagged := f.Tag.Lookup("cmux_expose"); tagged {
+                    needs = true
+                } else if f.IsExported() || f.Anonymous {
+                    n, a := visitFilter(f.Type, visiting)
+                    needs, assumed = n, assumed || a
+                }
+            }
+        }
+    }
+    delete(visiting, t)
+    /* a type needing filtering does so regardless of assumptions */
+    if needs || !assumed || len(visiting) == 0 {
+        filterTypes.Store(t, needs)
+        return needs, false
+    }
+    return needs, assumed
+}
+
+// fieldsOf returns the JSON encoded fields of the struct type t following
+// the encoding/json naming rules, inlining embedded structs.
+func fieldsOf(t reflect.Type) []structField {
+    if v, ok := structFields.Load(t); ok {
+        return v.([]structField)
+    }
+    var fields []structField
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        tag := f.Tag.Get("json")
+        if tag == "-" {
+            continue
+        }
+        name, opts, _ := strings.Cut(tag, ",")
+        ft := f.Type
+        if ft.Kind() == reflect.Pointer {
+            ft = ft.Elem()
+        }
+        if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+            for _, ef := range fieldsOf(ft) {
+                ef.index = append([]int{i}, ef.index...)
+                fields = append(fields, ef)
+            }
+            continue
+        }
+        if !f.IsExported() {
+            continue
+        }
+        if name == "" {
+            name = f.Name
+        }
+        sf := structField{
+            name:      name,
+            index:     []int{i},
+            omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+            omitZero:  strings.Contains(","+opts+",", ",omitzero,"),
+        }
+        if strings.Contains(","+opts+",", ",string,") {
+            /* as encoding/json, only quote scalars and pointers to them */
+            qt := f.Type
+            if qt.Name() == "" && qt.Kind() == reflect.Pointer {
+                qt = qt.Elem()
+            }
+            switch qt.Kind() {
+            case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+                 reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+                 reflect.Float32, reflect.Float64, reflect.String:
+                sf.quoted = !f.Type.Implements(marshalerType)
+            }
+        }
+        if expose, ok := f.Tag.Lookup("cmux_expose"); ok {
+            sf.expose = strings.Split(expose, ",")
+        }
+        fields = append(fields, sf)
+    }
+    structFields.Store(t, fields)
+    return fields
+}
+
+/* filteredObject is a JSON object keeping the order of its members */
+type filteredObject []filteredMember
+
+type filteredMember struct {
+    key string
+    val any
+}
+
+func (o filteredObject) MarshalJSON() ([]byte, error) {
+    var buf bytes.Buffer
+    /* HTML escaping is left to the encoder of the response */
+    enc := json.NewEncoder(&buf)
+    enc.SetEscapeHTML(false)
+    buf.WriteByte('{')
+    for i, m := range o {
+        if i > 0 {
+            buf.WriteByte(',')
+        }
+        writeJSONString(&buf, m.key, false)
+        buf.WriteByte(':')
+        if err := enc.Encode(m.val); err != nil {
+            return nil, err
+        }
+        buf.Truncate(buf.Len() - 1) /* trailing newline */
+    }
+    buf.WriteByte('}')
+    return buf.Bytes(), nil
+}
+
+// filter returns v with the fields not allowed by f removed, or v itself
+// if its type has no filtered fields.
+func (f *fieldFilter) filter(v any) any {
+    if v == nil || !needsFilter(reflect.TypeOf(v)) {
+        return v
+    }
+    return f.filterValue(reflect.ValueOf(v), nil)
+}
+
+// filterValue filters v, selecting only the fields of sel if non-nil.
+func (f *fieldFilter) filterValue(v reflect.Value, sel fieldSet) any {
+    if !v.IsValid() {
+        return nil
+    }
+    if sel == nil && !needsFilter(v.Type()) {
+        return v.Interface()
+    }
+    switch v.Kind() {
+    case reflect.Pointer, reflect.Interface:
+        if v.IsNil() {
+            return nil
+        }
+        return f.filterValue(v.Elem(), sel)
+    case reflect.Slice, reflect.Array:
+        if v.Kind() == reflect.Slice && v.IsNil() {
+            return nil
+        }
+        out := make([]any, v.Len())
+        for i := range out {
+            out[i] = f.filterValue(v.Index(i), sel)
+        }
+        return out
+    case reflect.Map:
+        if v.IsNil() {
+            return nil
+        }
+        out := make(map[string]any, v.Len())
+        iter := v.MapRange()
+        for iter.Next() {
+            key := iter.Key()
+            var name string
+            if tm, ok := key.Interface().(encoding.TextMarshaler); ok {
+                b, err := tm.MarshalText()
+                if err != nil {
+                    continue
+                }
+                name = string(b)
+            } else {
+                name = fmt.Sprint(key.Interface())
+            }
+            var child fieldSet
+            if sel != nil {
+                var ok bool
+                if child, ok = sel[name]; !ok {
+                    continue
+                }
+            }
+            out[name] = f.filterValue(iter.Value(), child)
+        }
+        return out
+    case reflect.Struct:
+        var out filteredObject
+        fields := fieldsOf(v.Type())
+        for i := range fields {
+            sf := &fields[i]
+            if !f.allows(sf) {
+                continue
+            }
+            var child fieldSet
+            if sel != nil {
+                var ok bool
+                if child, ok = sel[sf.name]; !ok {
+                    continue
+                }
+            }
+            fv, err := v.FieldByIndexErr(sf.index)
+            if err != nil {
+                /* nil embedded pointer */
+                continue
+            }
+            if sf.omitEmpty && isEmptyValue(fv) || sf.omitZero && isZeroValue(fv) {
+                continue
+            }
+            if sf.quoted {
+                b, err := json.Marshal(fv.Interface())
+                if err != nil || string(b) == "null" {
+                    out = append(out, filteredMember{sf.name, fv.Interface()})
+                } else {
+                    out = append(out, filteredMember{sf.name, string(b)})
+                }
+                continue
+            }
+            out = append(out, filteredMember{sf.name, f.filterValue(fv, child)})
+        }
+        return out
+    }
+    return v.Interface()
+}
+
+type isZeroer interface {
+    IsZero() bool
+}
+
+/* isZeroValue mirrors the omitzero rules of encoding/json */
+func isZeroValue(v reflect.Value) bool {
+    if z, ok := v.Interface().(isZeroer); ok {
+        if v.Kind() == reflect.Pointer && v.IsNil() {
+            return true
+        }
+        return z.IsZero()
+    }
+    if v.CanAddr() {
+        if z, ok := v.Addr().Interface().(isZeroer); ok {
+            return z.IsZero()
+        }
+    }
+    return v.IsZero()
+}
+
+/* isEmptyValue mirrors the omitempty rules of encoding/json */
+func isEmptyValue(v reflect.Value) bool {
+    switch v.Kind() {
+    case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+        return v.Len() == 0
+    case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+         reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+         reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+        return v.IsZero()
+    }
+    return false
+}
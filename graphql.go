@@ -0,0 +1,306 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io"
+    "mime"
+    "net/http"
+    "sync"
+)
+
+// GraphQLRequest is a GraphQL request as sent in the body of POST requests
+// or the query parameters of GET requests.
+type GraphQLRequest struct {
+    Query         string         `json:"query"`
+    OperationName string         `json:"operationName,omitempty"`
+    Variables     map[string]any `json:"variables,omitempty"`
+    Extensions    map[string]any `json:"extensions,omitempty"`
+}
+
+// GraphQLResponse is the result of executing a GraphQL request.
+type GraphQLResponse struct {
+    Data       any            `json:"data,omitempty"`
+    Errors     []GraphQLError `json:"errors,omitempty"`
+    Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+// GraphQLError is an error of a GraphQLResponse.
+type GraphQLError struct {
+    Message    string         `json:"message"`
+    Path       []any          `json:"path,omitempty"`
+    Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+// GraphQLExecutor executes GraphQL requests, typically by wrapping the
+// schema of a GraphQL library. Errors returned by ExecuteGraphQL are
+// responded to like errors returned by handlers, while errors of the
+// execution belong in the Errors of the response.
+type GraphQLExecutor interface {
+    ExecuteGraphQL(ctx context.Context, req *GraphQLRequest) (*GraphQLResponse, error)
+}
+
+// GraphQLExecutorFunc is a function implementing GraphQLExecutor.
+type GraphQLExecutorFunc func(ctx context.Context, req *GraphQLRequest) (*GraphQLResponse, error)
+
+func (fn GraphQLExecutorFunc) ExecuteGraphQL(ctx context.Context, req *GraphQLRequest) (*GraphQLResponse, error) {
+    return fn(ctx, req)
+}
+
+// PersistedQueryStore stores the queries of automatic persisted queries by
+// the hex-encoded SHA-256 hash of the query.
+type PersistedQueryStore interface {
+    PersistedQuery(hash string) (string, bool)
+    PersistQuery(hash, query string)
+}
+
+// GraphQL creates a method handler serving GraphQL requests using exec,
+// e.g.
+//
+//  m.HandleFunc("/graphql", nil, cmux.GraphQL(exec))
+//
+// POST requests carry a JSON-encoded GraphQLRequest, or the query itself
+// with the Content-Type application/graphql. GET requests carry the
+// request in the query, operationName, variables and extensions query
+// parameters, and are not allowed to run mutations.
+//
+// Automatic persisted queries are supported, letting clients send the
+// SHA-256 hash of a query instead of the query itself once the query has
+// been sent along with its hash. The queries are stored by exec if it
+// implements PersistedQueryStore and otherwise in memory.
+//
+// The operation name is available to After hooks using GraphQLOperation,
+// e.g. for labeling metrics.
+func GraphQL(exec GraphQLExecutor, opts ...RouteOption) MethodHandler {
+    store, ok := exec.(PersistedQueryStore)
+    if !ok {
+        store = &memoryQueryStore{queries: map[string]string{}}
+    }
+    mh := newMethodHandler(http.MethodGet, getGraphQLHandler(exec, store), nil, opts)
+    mh.methods = []string{http.MethodGet, http.MethodPost}
+    return mh
+}
+
+var graphQLOperationKey = NewKey[string]("graphql operation")
+
+// GraphQLOperation returns the operation name of a GraphQL request served
+// by a handler created using GraphQL, if any.
+func GraphQLOperation(r *http.Request) string {
+    op, _ := graphQLOperationKey.Get(RequestValues(r))
+    return op
+}
+
+var(
+    errGraphQLQuery = &Error{
+        Status: http.StatusBadRequest, Code: "invalid_request", Message: "missing GraphQL query",
+    }
+    errGraphQLHash = &Error{
+        Status: http.StatusBadRequest, Code: "invalid_request", Message: "persisted query hash does not match the query",
+    }
+    errGraphQLMutation = &Error{
+        Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "mutations require POST requests",
+    }
+)
+
+func getGraphQLHandler(exec GraphQLExecutor, store PersistedQueryStore) handleFnType {
+    return func(w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState) error {
+        var req GraphQLRequest
+        if httpReq.Method == http.MethodGet {
+            if err := graphQLQueryParams(httpReq, &req); err != nil {
+                return err
+            }
+        } else if mt, _, _ := mime.ParseMediaType(httpReq.Header.Get("Content-Type")); mt == "application/graphql" {
+            query, err := io.ReadAll(httpReq.Body)
+            if err != nil {
+                return WrapError(err, http.StatusBadRequest)
+            }
+            req.Query = string(query)
+        } else if err := rs.decodeBody(httpReq.Body, &req); err != nil {
+            return err
+        }
+        if err := persistedQuery(store, &req); err != nil {
+            return err
+        }
+        if req.Query == "" {
+            return errGraphQLQuery
+        }
+        if httpReq.Method == http.MethodGet && graphQLOperationType(req.Query, req.OperationName) == "mutation" {
+            w.Header().Set("Allow", http.MethodPost)
+            return errGraphQLMutation
+        }
+        if req.OperationName != "" {
+            graphQLOperationKey.Set(&rs.values, req.OperationName)
+        }
+        resp, err := exec.ExecuteGraphQL(httpReq.Context(), &req)
+        if err != nil {
+            return err
+        }
+        if resp == nil {
+            return errors.New("GraphQL executor returned no response")
+        }
+        return Bypass(resp)
+    }
+}
+
+/* graphQLQueryParams reads the request of a GET request */
+func graphQLQueryParams(r *http.Request, req *GraphQLRequest) error {
+    q := r.URL.Query()
+    req.Query = q.Get("query")
+    req.OperationName = q.Get("operationName")
+    for name, dst := range map[string]*map[string]any{"variables": &req.Variables, "extensions": &req.Extensions} {
+        if v := q.Get(name); v != "" {
+            if err := json.Unmarshal([]byte(v), dst); err != nil {
+                return fieldErrors([]FieldError{{"query", name, "invalid JSON"}})
+            }
+        }
+    }
+    return nil
+}
+
+// persistedQuery resolves the query of an automatic persisted query,
+// returning the response to send if the query is unknown or the hash
+// does not match the query.
+func persistedQuery(store PersistedQueryStore, req *GraphQLRequest) error {
+    pq, _ := req.Extensions["persistedQuery"].(map[string]any)
+    hash, _ := pq["sha256Hash"].(string)
+    if hash == "" {
+        return nil
+    }
+    if req.Query == "" {
+        var ok bool
+        if req.Query, ok = store.PersistedQuery(hash); !ok {
+            return Bypass(&GraphQLResponse{Errors: []GraphQLError{{
+                Message:    "PersistedQueryNotFound",
+                Extensions: map[string]any{"code": "PERSISTED_QUERY_NOT_FOUND"},
+            }}})
+        }
+        return nil
+    }
+    sum := sha256.Sum256([]byte(req.Query))
+    if hex.EncodeToString(sum[:]) != hash {
+        return errGraphQLHash
+    }
+    store.PersistQuery(hash, req.Query)
+    return nil
+}
+
+/* memoryQueryStore is the default PersistedQueryStore */
+type memoryQueryStore struct {
+    mu      sync.RWMutex
+    queries map[string]string
+}
+
+/* maxPersistedQueries bounds the memory used by memoryQueryStore */
+const maxPersistedQueries = 10000
+
+func (s *memoryQueryStore) PersistedQuery(hash string) (string, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    query, ok := s.queries[hash]
+    return query, ok
+}
+
+func (s *memoryQueryStore) PersistQuery(hash, query string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(s.queries) >= maxPersistedQueries {
+        /* evict an arbitrary query, clients resend unknown queries */
+        for h := range s.queries {
+            delete(s.queries, h)
+            break
+        }
+    }
+    s.queries[hash] = query
+}
+
+// graphQLOperationType returns the type of the operation named name, or
+// of the first operation if name is empty, in the GraphQL document query:
+// "query", "mutation", "subscription" or "" if there is no such operation.
+// Fragment definitions are skipped.
+func graphQLOperationType(query, name string) string {
+    depth := 0
+    fragment := false /* in a fragment definition ahead of its selection set */
+    for i := 0; i < len(query); {
+        c := query[i]
+        switch {
+        case c == '#':
+            for i < len(query) && query[i] != '\n' {
+                i++
+            }
+        case c == '"':
+            i = skipGraphQLString(query, i)
+        case c == '{':
+            if depth == 0 && fragment {
+                fragment = false
+            } else if depth == 0 && name == "" {
+                return "query" /* shorthand query */
+            }
+            depth++
+            i++
+        case c == '}':
+            depth--
+            i++
+        case depth == 0 && isGraphQLNameStart(c):
+            start := i
+            for i < len(query) && isGraphQLName(query[i]) {
+                i++
+            }
+            word := query[start:i]
+            if word == "fragment" {
+                fragment = true
+            }
+            if fragment || word != "query" && word != "mutation" && word != "subscription" {
+                continue
+            }
+            for i < len(query) && (query[i] == ' ' || query[i] == '\t' || query[i] == '\n' || query[i] == '\r' || query[i] == ',') {
+                i++
+            }
+            opStart := i
+            for i < len(query) && isGraphQLName(query[i]) {
+                i++
+            }
+            if name == "" || query[opStart:i] == name {
+                return word
+            }
+        default:
+            i++
+        }
+    }
+    return ""
+}
+
+/* skipGraphQLString returns the index after the string starting at i */
+func skipGraphQLString(s string, i int) int {
+    if len(s) >= i + 3 && s[i:i + 3] == `"""` {
+        for i += 3; i < len(s); i++ {
+            if s[i] == '\\' {
+                i++
+            } else if len(s) >= i + 3 && s[i:i + 3] == `"""` {
+                return i + 3
+            }
+        }
+        return i
+    }
+    for i++; i < len(s); i++ {
+        if s[i] == '\\' {
+            i++
+        } else if s[i] == '"' {
+            return i + 1
+        }
+    }
+    return i
+}
+
+func isGraphQLNameStart(c byte) bool {
+    return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isGraphQLName(c byte) bool {
+    return isGraphQLNameStart(c) || c >= '0' && c <= '9'
+}
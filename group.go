@@ -0,0 +1,53 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "strings"
+)
+
+// Group registers routes below a common path prefix sharing a set of route
+// options, e.g. authentication:
+//
+//  api := m.Group("/api", cmux.BasicAuth(checkUser))
+//  api.HandleFunc("/users/{id}", &Md{}, cmux.Get(GetUser, nil))
+//
+// The options of the group are applied before the options of each route,
+// so Before hooks of the group run first.
+type Group struct {
+    mux    *Mux
+    prefix string
+    opts   []RouteOption
+}
+
+// Group creates a route group for the specified path prefix.
+func (mux *Mux) Group(prefix string, opts ...RouteOption) *Group {
+    return &Group{
+        mux:    mux,
+        prefix: strings.TrimSuffix(prefix, "/"),
+        opts:   opts,
+    }
+}
+
+// Group creates a nested route group inheriting the options of g.
+func (g *Group) Group(prefix string, opts ...RouteOption) *Group {
+    return &Group{
+        mux:    g.mux,
+        prefix: g.prefix + strings.TrimSuffix(prefix, "/"),
+        opts:   append(g.opts[:len(g.opts):len(g.opts)], opts...),
+    }
+}
+
+// HandleFunc registers the method handlers at the path prefixed by the
+// group prefix, see Mux.HandleFunc.
+func (g *Group) HandleFunc(path string, metadata any, mhs ...MethodHandler) {
+    for i := range mhs {
+        mh := &mhs[i]
+        opts := append(g.opts[:len(g.opts):len(g.opts)], mh.optFns...)
+        methods, fnName := mh.methods, mh.fnName
+        *mh = newMethodHandler(mh.method, mh.fn, mh.data, opts)
+        mh.methods, mh.fnName = methods, fnName
+    }
+    g.mux.HandleFunc(g.prefix + path, metadata, mhs...)
+}
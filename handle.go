@@ -5,32 +5,131 @@
 package cmux
 import(
     "context"
-    "encoding/json"
     "errors"
     "fmt"
     "io"
     "net/http"
+    "net/url"
     "reflect"
     "runtime"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
 )
 
 const(
     inputTypeAny = iota
     inputTypeBytes
+    inputTypeStream
 )
 
 // MethodHandlers each handles a specific HTTP Method. They are returned
 // by the functions Delete, Get, Head, Options, Patch, Post, Put, Trace.
 type MethodHandler struct {
     method string
-    fn     func(http.ResponseWriter, *http.Request, any) error
+    methods []string /* registered for each method, see Methods */
+    fn     handleFnType
     data   any
-    mux    *Mux /* the leaf-node mux respponisble for the handler */
+
+    /* per-route settings, see RouteOption: */
+    opts   routeOptions
+    optFns []RouteOption /* the options opts was built from */
+
+    hist   *histogram /* see EnableTimingHistograms */
+
+    /* handlers for the same method selected by header, see MatchHeader */
+    variants []*MethodHandler
+
+    /* the path pattern the handler is registered at, e.g. "/users/{id}" */
+    pattern string
 
     /* for debug purposes: */
     fnName string
 }
 
+// RouteOption configures a single MethodHandler. Options are passed as
+// trailing arguments to the method handler constructors, e.g.
+// cmux.Get(fn, data, cmux.WithKeyCase(cmux.KeyCaseSnake)).
+type RouteOption func(*routeOptions)
+
+type routeOptions struct {
+    keyCase      KeyCase
+    safeIntegers optBool
+    examples     []RouteExample
+    tags         []string
+    decodeOpts   *DecodeOptions
+    maxBodySize  *int64
+    before       []func(http.ResponseWriter, *http.Request, any) error
+    after        []func(*Outcome)
+    csrfExempt   bool
+    verifiers    []BodyVerifier
+    keepRawBody  bool
+    idempotency  *idempotency
+    limiters     []*limiter
+    breaker      *breaker
+    drainExempt  bool
+    sparseFields optBool
+    headers      []headerMatcher
+    gates        []featureGate
+    mirrors      []*mirror
+    canary       float64 /* percentage of requests, see Canary */
+    meta         []routeMeta
+    async        *AsyncConfig
+    retry        *retryPolicy
+    hedge        *hedgePolicy
+    summary      string /* see Doc */
+    description  string
+    deprecated   bool
+    logBodies    int /* see LogBodies */
+    audit        string /* the action, see Audited */
+    data         any /* the data of the method handler, see When */
+    internal     bool /* see Internal */
+    readTimeout  *time.Duration
+    writeTimeout *time.Duration
+    expectContinue bool /* see ExpectContinue */
+    continueChecks []func(*http.Request) error
+    maxResponseSize *int64
+}
+
+/* optBool is a route setting that falls back to a mux-wide default when unset */
+type optBool uint8
+
+const(
+    optUnset optBool = iota
+    optTrue
+    optFalse
+)
+
+func mkOptBool(b bool) optBool {
+    if b {
+        return optTrue
+    }
+    return optFalse
+}
+
+func (o optBool) or(dflt bool) bool {
+    if o == optUnset {
+        return dflt
+    }
+    return o == optTrue
+}
+
+func newMethodHandler(method string, fn handleFnType, data any, opts []RouteOption) MethodHandler {
+    mh := MethodHandler{
+        method: method,
+        fn:     fn,
+        data:   data,
+        optFns: opts,
+        hist:   &histogram{},
+    }
+    mh.opts.data = data
+    for _, opt := range opts {
+        opt(&mh.opts)
+    }
+    return mh
+}
+
 type EmptyBody struct{}
 
 // Request stores incoming request data.
@@ -44,20 +143,61 @@ type Request[T any, M any] struct {
     Metadata M
     Context context.Context
 
+    /* The raw request body, only set for routes using KeepRawBody or VerifyBody */
+    RawBody []byte
+
+    /* Per-request scratch space shared with Before functions and After hooks */
+    Values *Values
+
+    pattern string
+
 
     /* Underlying native golang request / responsewriter: */
     HTTPReq *http.Request
     ResponseWriter http.ResponseWriter
 }
 
-type handleFnType func (w http.ResponseWriter, httpReq *http.Request, md any) error
+// Pattern returns the path pattern of the matched route, e.g.
+// "/users/{id}/orders".
+func (req *Request[T, M]) Pattern() string {
+    return req.pattern
+}
+
+type handleFnType func (w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState) error
+
+/* reqState carries the state of a single request through the mux and the handler */
+type reqState struct {
+    mux   *Mux           /* the mux serving the request */
+    mh    *MethodHandler /* the matched method handler */
+    node  *node          /* the matched node */
+    r     *http.Request  /* the request as received by the mux */
+    roles []string       /* see SetRoles */
+    tenant TenantID      /* see SetTenants */
+    md    any            /* the metadata of the request, see RouteMetadata */
+    patches []mdPatch    /* the path variables of the match */
+    view  routeView      /* the routes served, see PublicHandler */
+    matrix url.Values    /* see EnableMatrixParams */
+    values Values        /* see Request.Values */
+    start time.Time
+
+    /* the raw request body, if it was read ahead of the handler */
+    rawBody []byte
+
+    /* set while capturing the response of an idempotent route */
+    idem    *idempotentCall
+
+    /* set for routes with a circuit breaker */
+    breaker *breakerCall
+}
 
 func getEmptyBodyHandler[I EmptyBody, M any](fn func(*Request[I, M]) error,
                                              data any) handleFnType {
-    return func (w http.ResponseWriter, httpReq *http.Request, md any) error {
+    return func (w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState) error {
         req := Request[I, M]{
             Body:          I{},
             Context:       httpReq.Context(),
+            Values:        &rs.values,
+            pattern:       rs.mh.pattern,
             HTTPReq:       httpReq,
             ResponseWriter: w,
         }
@@ -74,142 +214,219 @@ func getEmptyBodyHandler[I EmptyBody, M any](fn func(*Request[I, M]) error,
     }
 }
 
+/* optionalBody leaves the body zero-valued for requests without a body */
 func getHandler[I any, M any](fn func(*Request[I, M]) error,
-                              data any) handleFnType {
-    var inputType int
-    var input I
-    switch any(input).(type) {
-    case []byte:
-        inputType = inputTypeBytes
+                              data any, optionalBody bool) handleFnType {
+    inputType := (&Request[I, M]{}).inputType()
+    return func(w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState) error {
+        var req Request[I, M]
+        if err := req.load(w, httpReq, md, rs, inputType, optionalBody); err != nil {
+            return err
+        }
+        return fn(&req)
     }
+}
 
-    return func(w http.ResponseWriter, httpReq *http.Request, md any) error {
-        req := Request[I, M]{
-            Context:        httpReq.Context(),
-            HTTPReq:        httpReq,
-            ResponseWriter: w,
-        }
-        if md != nil {
-            var ok bool
-            if req.Metadata, ok = md.(M); !ok {
-                return &codeResponder{
-                    code:  http.StatusInternalServerError,
-                    error: errors.New("unexpected metadata type"),
-                }
+/* requestLoader is implemented by *Request, see HandleController */
+type requestLoader interface {
+    inputType() int
+    load(w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState,
+         inputType int, optionalBody bool) error
+}
+
+func (req *Request[I, M]) inputType() int {
+    if _, ok := any(req.Body).([]byte); ok {
+        return inputTypeBytes
+    }
+    if _, ok := any(&req.Body).(streamBody); ok {
+        return inputTypeStream
+    }
+    return inputTypeAny
+}
+
+/* load initializes req for a request, reading its body */
+func (req *Request[I, M]) load(w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState,
+                               inputType int, optionalBody bool) error {
+    *req = Request[I, M]{
+        Context:        httpReq.Context(),
+        RawBody:        rs.rawBody,
+        Values:         &rs.values,
+        pattern:        rs.mh.pattern,
+        HTTPReq:        httpReq,
+        ResponseWriter: w,
+    }
+    if md != nil {
+        var ok bool
+        if req.Metadata, ok = md.(M); !ok {
+            return &codeResponder{
+                code:  http.StatusInternalServerError,
+                error: errors.New("unexpected metadata type"),
             }
         }
-        if inputType == inputTypeBytes {
-            b, ok := (any(&req.Body)).(*[]byte)
-            if !ok {
-                panic("impossible case")
-            }
-            barr, err := io.ReadAll(httpReq.Body)
-            if err != nil {
-                return &codeResponder{
-                    code:  http.StatusBadRequest,
-                    error: fmt.Errorf("io.ReadAll failed: %w", err),
-                }
-            }
-            *b = barr
-        } else if inputType == inputTypeAny {
-            if err := json.NewDecoder(httpReq.Body).Decode(&req.Body); err != nil {
-                return &codeResponder{
-                    code:  http.StatusBadRequest,
-                    error: fmt.Errorf("json decoding failed: %w", err),
-                }
-            }
-        } else {
+    }
+    if inputType == inputTypeBytes {
+        b, ok := (any(&req.Body)).(*[]byte)
+        if !ok {
             panic("impossible case")
         }
-        return fn(&req)
+        barr, err := io.ReadAll(httpReq.Body)
+        if err != nil {
+            return &codeResponder{
+                code:  http.StatusBadRequest,
+                error: fmt.Errorf("io.ReadAll failed: %w", err),
+            }
+        }
+        *b = barr
+    } else if inputType == inputTypeStream {
+        any(&req.Body).(streamBody).setBody(httpReq.Body)
+    } else if inputType == inputTypeAny {
+        if optionalBody && httpReq.ContentLength == 0 {
+            return nil
+        }
+        if err := rs.decodeBody(httpReq.Body, &req.Body); err != nil {
+            return err
+        }
+    } else {
+        panic("impossible case")
     }
+    return nil
 }
 
 // Handle DELETE HTTP method requests.
-func Delete[I EmptyBody, M any] (fn func(*Request[I, M]) error, data any) MethodHandler {
-    return MethodHandler{
-        method: "DELETE",
-        fn: getEmptyBodyHandler(fn, data),
-        data: data,
-    }
+func Delete[I EmptyBody, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("DELETE", getEmptyBodyHandler(fn, data), data, opts)
+}
+
+// DeleteB handles DELETE HTTP method requests with a request body, which is
+// decoded like the bodies of POST requests. Requests without a body are
+// handled with a zero-valued body.
+func DeleteB[I any, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("DELETE", getHandler(fn, data, true), data, opts)
 }
 
 // Handle GET HTTP method requests.
-func Get[I EmptyBody, M any] (fn func(*Request[I, M]) error, data any) MethodHandler {
-    return MethodHandler{
-        method: "GET",
-        fn:     getEmptyBodyHandler(fn, data),
-        data:    data,
-    }
+func Get[I EmptyBody, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("GET", getEmptyBodyHandler(fn, data), data, opts)
+}
+
+// GetB handles GET HTTP method requests with a request body, e.g. search
+// queries too large for the URL. Requests without a body are handled with
+// a zero-valued body.
+func GetB[I any, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("GET", getHandler(fn, data, true), data, opts)
 }
 
 // Handle HEAD HTTP method requests.
-func Head[I EmptyBody, M any] (fn func(*Request[I, M]) error, data any) MethodHandler {
-    return MethodHandler{
-        method: "HEAD",
-        fn:     getEmptyBodyHandler(fn, data),
-        data:   data,
-    }
+func Head[I EmptyBody, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("HEAD", getEmptyBodyHandler(fn, data), data, opts)
 }
 
 // Handle OPTIONS HTTP method requests.
-func Options[I EmptyBody, M any] (fn func(*Request[I, M]) error, data any) MethodHandler {
-    return MethodHandler{
-        method: "OPTIONS",
-        fn:     getEmptyBodyHandler(fn, data),
-        data:   data,
-    }
+func Options[I EmptyBody, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("OPTIONS", getEmptyBodyHandler(fn, data), data, opts)
 }
 
 // Handle PATCH HTTP method requests.
-func Patch[I any, M any] (fn func(*Request[I, M]) error, data any) MethodHandler {
-    return MethodHandler{
-        method: "PATCH",
-        fn:     getHandler(fn, data),
-        data:   data,
-    }
+func Patch[I any, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("PATCH", getHandler(fn, data, false), data, opts)
 }
 
 // Handle POST HTTP method requests.
-func Post[I any, M any] (fn func(*Request[I, M]) error, data any) MethodHandler {
-    return MethodHandler{
-        method: "POST",
-        fn:     getHandler(fn, data),
-        data:   data,
-    }
+func Post[I any, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("POST", getHandler(fn, data, false), data, opts)
 }
 
 // Handle PUT HTTP method requests.
-func Put[I any, M any] (fn func(*Request[I, M]) error, data any) MethodHandler {
-    return MethodHandler{
-        method: "PUT",
-        fn:     getHandler(fn, data),
-        data:   data,
-    }
+func Put[I any, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("PUT", getHandler(fn, data, false), data, opts)
 }
 
 // Handle TRACE HTTP method requests.
-func Trace[I EmptyBody, M any] (fn func(*Request[I, M]) error, data any) MethodHandler {
-    return MethodHandler{
-        method: "TRACE",
-        fn:     getEmptyBodyHandler(fn, data),
-        data:   data,
+func Trace[I EmptyBody, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("TRACE", getEmptyBodyHandler(fn, data), data, opts)
+}
+
+// Method handles requests of a custom HTTP method, e.g. PURGE or the
+// WebDAV methods PROPFIND and REPORT. The request body is decoded like the
+// bodies of POST requests, or left zero-valued when the request has none.
+// Method panics if method is not a valid method token.
+func Method[I any, M any] (method string, fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    checkMethod(method)
+    return newMethodHandler(method, getHandler(fn, data, true), data, opts)
+}
+
+// Methods handles requests of each of the specified HTTP methods using the
+// same handler, e.g. cmux.Methods([]string{"GET", "HEAD"}, fn, data).
+// The request body is handled like in Method.
+func Methods[I any, M any] (methods []string, fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    if len(methods) == 0 {
+        panic("no methods")
+    }
+    for _, method := range methods {
+        checkMethod(method)
     }
+    mh := newMethodHandler(methods[0], getHandler(fn, data, true), data, opts)
+    mh.methods = slices.Clone(methods)
+    return mh
 }
 
+// anyMethod is the key of handlers registered using Any.
+const anyMethod = "*"
+
+// Any handles requests of every HTTP method not handled by another method
+// handler of the route, e.g. for proxies and legacy endpoints. The method
+// is available through Request.HTTPReq. The request body is handled like
+// in Method.
+func Any[I any, M any] (fn func(*Request[I, M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler(anyMethod, getHandler(fn, data, true), data, opts)
+}
+
+func checkMethod(method string) {
+    if method == "" || strings.IndexFunc(method, func(c rune) bool {
+        return c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+    }) >= 0 {
+        panic("invalid method " + strconv.Quote(method))
+    }
+}
+
+
 // HandleFunc handles requests matching the specified path in the speciified MethodHandlers.
 // The metadata is copied for each new incoming request and can be mutated by the Mux.Before
 // method before being available in the MethodHandler functions.
+// The metadata is snapshotted by HandleFunc, so later changes to it have no effect. The
+// snapshot and the per-request copies include copies of the contents of slices and maps,
+// while the values of pointers and interfaces are shared between requests.
 func (mux *Mux) HandleFunc(path string, metadata any, mhs ...MethodHandler) {
     if reflect.TypeOf(metadata) == methodHandlerType {
         panic("missing metadata argument")
     }
     methodHandlers := map[string]*MethodHandler{}
-    for i, mh := range mhs {
+    for i := 0; i < len(mhs); i++ {
+        if methods := mhs[i].methods; len(methods) > 0 {
+            /* expand method sets into a handler per method */
+            expanded := make([]MethodHandler, len(methods))
+            for j, method := range methods {
+                expanded[j] = mhs[i]
+                expanded[j].method = method
+                expanded[j].methods = nil
+            }
+            mhs = slices.Concat(mhs[:i], expanded, mhs[i + 1:])
+        }
+        mh := mhs[i]
         mh.fnName = runtime.FuncForPC(reflect.ValueOf(mh.fn).Pointer()).Name()
+        mhs[i].pattern = path
+        if prev := methodHandlers[mh.method]; prev != nil {
+            prev.addVariant(&mhs[i])
+            continue
+        }
         methodHandlers[mh.method] = &mhs[i]
     }
     mux.mkRoute(path, metadata, methodHandlers)
+    for _, mh := range mhs {
+        if mh.opts.async != nil && mux.jobsPath == "" {
+            mux.HandleJobs(DefaultJobsPath)
+        }
+    }
 }
 
 func HandleFunc(path string, metadata any, mhs ...MethodHandler) {
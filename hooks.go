@@ -0,0 +1,178 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "net/http"
+    "time"
+)
+
+// BeforeFunc is a typed per-route hook receiving the concrete metadata of
+// the route. Returning a non-nil error stops the request from reaching the
+// handler and is responded to like errors returned by handlers.
+type BeforeFunc[M any] func(w http.ResponseWriter, r *http.Request, md M) error
+
+// Before adds typed hooks to a route. The hooks run in order after the mux
+// Before function and before the handler, e.g.
+//
+//  cmux.Get(GetCity, nil, cmux.Before(requireMayor, loadCity))
+//
+// where requireMayor and loadCity are func(http.ResponseWriter, *http.Request, *Md) error.
+func Before[M any](fns ...BeforeFunc[M]) RouteOption {
+    return func(o *routeOptions) {
+        for _, fn := range fns {
+            o.before = append(o.before, func(w http.ResponseWriter, r *http.Request, md any) error {
+                typedMd, ok := md.(M)
+                if !ok && md != nil {
+                    return &codeResponder{
+                        code:  http.StatusInternalServerError,
+                        error: errors.New("unexpected metadata type"),
+                    }
+                }
+                return fn(w, r, typedMd)
+            })
+        }
+    }
+}
+
+// RoutePattern returns the path pattern of the route matched by a request
+// served by a mux, e.g. "/users/{id}/orders", for use in Before functions
+// and middleware, e.g. to label metrics without keying them on raw paths.
+// It returns an empty string if no route has been matched.
+func RoutePattern(r *http.Request) string {
+    if rs := requestState(r.Context()); rs != nil && rs.mh != nil {
+        return rs.mh.pattern
+    }
+    return ""
+}
+
+// RouteData returns the data passed to the method handler of the route
+// matched by a request served by a mux, e.g. the second argument of Get, if
+// it is of type D. It lets Before functions and middleware decide how to
+// handle a request depending on the route without casting the data, e.g.
+//
+//  if access, ok := cmux.RouteData[Access](r); ok && access.Public {
+//      return nil
+//  }
+func RouteData[D any](r *http.Request) (D, bool) {
+    if rs := requestState(r.Context()); rs != nil && rs.mh != nil {
+        d, ok := rs.mh.data.(D)
+        return d, ok
+    }
+    var zero D
+    return zero, false
+}
+
+// RouteMetadata returns the metadata of a request served by a mux, with
+// the path variables of the request set, if it is of type M, e.g. *Md.
+// The metadata is set once the route has been matched and must not be
+// used after the request has been served.
+func RouteMetadata[M any](r *http.Request) (M, bool) {
+    if rs := requestState(r.Context()); rs != nil && rs.md != nil {
+        md, ok := rs.md.(M)
+        return md, ok
+    }
+    var zero M
+    return zero, false
+}
+
+// When applies route options only to the method handlers whose data is of
+// type D and satisfies cond, deciding when the route is registered rather
+// than for every request, e.g. to cache public routes of a group:
+//
+//  api := m.Group("/api", cmux.When(func(a Access) bool { return a.Public }, cacheOpts...))
+func When[D any](cond func(data D) bool, opts ...RouteOption) RouteOption {
+    return func(o *routeOptions) {
+        if d, ok := o.data.(D); ok && cond(d) {
+            for _, opt := range opts {
+                opt(o)
+            }
+        }
+    }
+}
+
+// Unless applies route options to all method handlers but those whose data
+// is of type D and satisfies skip, e.g. to require authentication for all
+// routes of a group except public ones:
+//
+//  api := m.Group("/api", cmux.Unless(func(a Access) bool { return a.Public }, cmux.BasicAuth(checkUser)))
+func Unless[D any](skip func(data D) bool, opts ...RouteOption) RouteOption {
+    return func(o *routeOptions) {
+        if d, ok := o.data.(D); !ok || !skip(d) {
+            for _, opt := range opts {
+                opt(o)
+            }
+        }
+    }
+}
+
+// Outcome describes how a request was handled.
+type Outcome struct {
+    Request       *http.Request
+    // Pattern is the path pattern of the matched route, e.g. "/users/{id}",
+    // or empty if no route matched.
+    Pattern       string
+    // Variant is "canary" if the request was served by a handler using
+    // Canary and otherwise empty.
+    Variant       string
+    Status        int
+    // Err is the error returned by the handler or a Before function,
+    // which may also be a responder such as the value returned by Bypass.
+    Err           error
+    Duration      time.Duration
+    BytesWritten  int64
+    ClientAborted bool
+}
+
+// After adds hooks to a route that are called after the request has been
+// handled and the response has been written.
+func After(fns ...func(*Outcome)) RouteOption {
+    return func(o *routeOptions) {
+        o.after = append(o.after, fns...)
+    }
+}
+
+// After adds hooks that are called after every request served by the mux,
+// including requests not matching any route, e.g. for audit logging and
+// custom metrics. The hooks are called before the hooks of the route.
+func (mux *Mux) After(fns ...func(*Outcome)) {
+    mux.after = append(mux.after, fns...)
+}
+
+func (rs *reqState) outcome(w http.ResponseWriter, r *http.Request, err error) *Outcome {
+    oc := &Outcome{
+        Request:  r,
+        Err:      err,
+        Duration: time.Since(rs.start),
+    }
+    if rs.mh != nil {
+        oc.Pattern = rs.mh.pattern
+        if rs.mh.opts.canary > 0 {
+            oc.Variant = "canary"
+        }
+    }
+    if rw, ok := w.(*responseWriter); ok {
+        oc.Status = rw.Status()
+        oc.BytesWritten = rw.BytesWritten()
+        oc.ClientAborted = rw.ClientAborted()
+        if oc.Status == 0 {
+            /* net/http responds 200 when nothing is written */
+            oc.Status = http.StatusOK
+        }
+    }
+    return oc
+}
+
+func (rs *reqState) runAfter(w http.ResponseWriter, r *http.Request, err error) {
+    oc := rs.outcome(w, r, err)
+    for _, fn := range rs.mux.after {
+        fn(oc)
+    }
+    if rs.mh != nil {
+        for _, fn := range rs.mh.opts.after {
+            fn(oc)
+        }
+    }
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "log/slog"
+    "net/http"
+)
+
+// HTTP3Server is implemented by HTTP/3 servers, such as the *http3.Server
+// of github.com/quic-go/quic-go, see SetHTTP3Server.
+type HTTP3Server interface {
+    ListenAndServeTLS(certFile, keyFile string) error
+    // SetQUICHeaders sets the Alt-Svc header advertising the server.
+    SetQUICHeaders(hdr http.Header) error
+    Close() error
+}
+
+/* gracefulHTTP3Server is implemented by HTTP/3 servers able to shut down
+ * gracefully, such as the *http3.Server of quic-go */
+type gracefulHTTP3Server interface {
+    Shutdown(ctx context.Context) error
+}
+
+// SetHTTP3Server makes ListenAndServeTLS serve HTTP/3 using srv alongside
+// HTTP/1.1 and HTTP/2, advertising it to clients in the Alt-Svc header of
+// the responses sent over TCP, e.g.
+//
+//  m.SetHTTP3Server(&http3.Server{Addr: ":443", Handler: m})
+//  log.Fatal(m.ListenAndServeTLS(ctx, ":443", "cert.pem", "key.pem"))
+//
+// The handler of srv must be the mux, so requests are routed and errors
+// handled identically regardless of the protocol. srv is closed when the
+// mux is shut down, after the in-flight requests have finished, using its
+// Shutdown method if it has one.
+func (mux *Mux) SetHTTP3Server(srv HTTP3Server) {
+    mux.http3 = srv
+}
+
+/* altSvcHandler serves the mux, advertising HTTP/3 */
+func (mux *Mux) altSvcHandler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.ProtoMajor < 3 {
+            if err := mux.http3.SetQUICHeaders(w.Header()); err != nil {
+                mux.log(r, slog.LevelWarn, "failed to set Alt-Svc header", slog.Any("error", err))
+            }
+        }
+        mux.ServeHTTP(w, r)
+    })
+}
+
+// serveHTTP3 serves HTTPS using srv alongside the HTTP/3 server of the mux
+// until either stops, stopping the other.
+func (mux *Mux) serveHTTP3(srv *http.Server, certFile, keyFile string) error {
+    h3errc, errc := make(chan error, 1), make(chan error, 1)
+    go func() {
+        h3errc <- mux.http3.ListenAndServeTLS(certFile, keyFile)
+    }()
+    go func() {
+        errc <- srv.ListenAndServeTLS(certFile, keyFile)
+    }()
+    select {
+    case err := <-h3errc:
+        srv.Close()
+        <-errc
+        return err
+    case err := <-errc:
+        if err == http.ErrServerClosed {
+            /* shutting down gracefully, let the HTTP/3 requests in flight
+             * finish first */
+            ctx, cancel := mux.shutdownContext()
+            defer cancel()
+            if gs, ok := mux.http3.(gracefulHTTP3Server); ok {
+                if gs.Shutdown(ctx) == nil {
+                    <-h3errc
+                    return err
+                }
+            } else {
+                mux.Shutdown(ctx)
+            }
+        }
+        mux.http3.Close()
+        <-h3errc
+        return err
+    }
+}
@@ -0,0 +1,234 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "errors"
+    "net"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// StoredResponse is a response recorded for an idempotency key.
+type StoredResponse struct {
+    BodyHash [sha256.Size]byte /* hash of the request body */
+    Status   int
+    Header   http.Header
+    Body     []byte
+}
+
+// IdempotencyStore stores the responses of idempotent routes. Implementations
+// must be safe for concurrent use.
+type IdempotencyStore interface {
+    Get(key string) (*StoredResponse, bool)
+    Set(key string, res *StoredResponse, ttl time.Duration)
+}
+
+// MemoryIdempotencyStore is an in-memory IdempotencyStore.
+type MemoryIdempotencyStore struct {
+    mutex   sync.Mutex
+    entries map[string]memoryEntry
+    sets    int
+}
+
+type memoryEntry struct {
+    res     *StoredResponse
+    expires time.Time
+}
+
+// NewMemoryIdempotencyStore creates an empty in-memory IdempotencyStore.
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+    return &MemoryIdempotencyStore{entries: map[string]memoryEntry{}}
+}
+
+func (s *MemoryIdempotencyStore) Get(key string) (*StoredResponse, bool) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    e, ok := s.entries[key]
+    if !ok || time.Now().After(e.expires) {
+        return nil, false
+    }
+    return e.res, true
+}
+
+func (s *MemoryIdempotencyStore) Set(key string, res *StoredResponse, ttl time.Duration) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    now := time.Now()
+    s.entries[key] = memoryEntry{res: res, expires: now.Add(ttl)}
+    /* sweep expired entries now and then */
+    if s.sets++; s.sets % 1024 == 0 {
+        for k, e := range s.entries {
+            if now.After(e.expires) {
+                delete(s.entries, k)
+            }
+        }
+    }
+}
+
+type idempotency struct {
+    store    IdempotencyStore
+    ttl      time.Duration
+    inFlight sync.Map /* keys of requests being handled by this process */
+}
+
+// Idempotent makes retries of a route safe. Requests carrying an
+// Idempotency-Key header are keyed on the header and route, and the first
+// response is stored in store for ttl. Retries with the same key and body
+// are answered with the stored response and an "Idempotent-Replayed: true"
+// header, while retries with a different body are rejected with
+// 422 Unprocessable Entity. Retries arriving while the first request is
+// still being handled are rejected with 409 Conflict. Server errors are not
+// stored, so they can be retried.
+func Idempotent(store IdempotencyStore, ttl time.Duration) RouteOption {
+    idem := &idempotency{store: store, ttl: ttl}
+    return func(o *routeOptions) {
+        o.idempotency = idem
+    }
+}
+
+var(
+    errIdempotencyMismatch = &codeResponder{
+        code:  http.StatusUnprocessableEntity,
+        error: errors.New("idempotency key reused with a different request body"),
+        key:   "idempotency_mismatch",
+    }
+    errIdempotencyInFlight = &codeResponder{
+        code:  http.StatusConflict,
+        error: errors.New("a request with the same idempotency key is in progress"),
+        key:   "idempotency_in_progress",
+    }
+)
+
+/* idempotentCall tracks a request whose response is to be stored */
+type idempotentCall struct {
+    idem *idempotency
+    key  string
+    hash [sha256.Size]byte
+    rec  *captureWriter
+}
+
+// beginIdempotent replays a stored response or starts capturing the
+// response of a request to an idempotent route. It reports whether the
+// response has been replayed.
+func (rs *reqState) beginIdempotent(w http.ResponseWriter, r *http.Request) (bool, error) {
+    idem := rs.mh.opts.idempotency
+    if idem == nil {
+        return false, nil
+    }
+    key := r.Header.Get("Idempotency-Key")
+    if key == "" {
+        return false, nil
+    }
+    raw, err := rs.readBody(r)
+    if err != nil {
+        return false, err
+    }
+    /* keys are scoped to the path rather than the pattern, as the same key
+     * may be sent to e.g. /users/1/charge and /users/2/charge */
+    key = r.Method + " " + r.URL.EscapedPath() + " " + key
+    hash := sha256.Sum256(raw)
+    if res, ok := idem.store.Get(key); ok {
+        return true, replayIdempotent(w, res, hash)
+    }
+    if _, loaded := idem.inFlight.LoadOrStore(key, struct{}{}); loaded {
+        return false, errIdempotencyInFlight
+    }
+    /* a request using the key may have completed since the lookup above,
+     * storing its response before releasing the key */
+    if res, ok := idem.store.Get(key); ok {
+        idem.inFlight.Delete(key)
+        return true, replayIdempotent(w, res, hash)
+    }
+    rw, ok := w.(*responseWriter)
+    if !ok {
+        idem.inFlight.Delete(key)
+        return false, nil
+    }
+    rec := &captureWriter{ResponseWriter: rw.ResponseWriter}
+    rw.ResponseWriter = rec
+    rs.idem = &idempotentCall{idem: idem, key: key, hash: hash, rec: rec}
+    return false, nil
+}
+
+/* replayIdempotent writes the stored response res of a request with the
+ * body hash hash */
+func replayIdempotent(w http.ResponseWriter, res *StoredResponse, hash [sha256.Size]byte) error {
+    if res.BodyHash != hash {
+        return errIdempotencyMismatch
+    }
+    h := w.Header()
+    for k, v := range res.Header {
+        h[k] = v
+    }
+    h.Set("Idempotent-Replayed", "true")
+    w.WriteHeader(res.Status)
+    w.Write(res.Body)
+    return nil
+}
+
+// finish stores the captured response unless it failed.
+func (c *idempotentCall) finish(w http.ResponseWriter) {
+    status := c.rec.status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    if c.rec.hijacked || clientAborted(w) || status >= 500 {
+        return
+    }
+    c.idem.store.Set(c.key, &StoredResponse{
+        BodyHash: c.hash,
+        Status:   status,
+        Header:   c.rec.header,
+        Body:     c.rec.body.Bytes(),
+    }, c.idem.ttl)
+}
+
+// release allows new requests using the key of c, also if the handler panicked.
+func (c *idempotentCall) release() {
+    c.idem.inFlight.Delete(c.key)
+}
+
+// captureWriter records a response while passing it through.
+type captureWriter struct {
+    http.ResponseWriter
+    status   int
+    header   http.Header
+    body     bytes.Buffer
+    hijacked bool
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+    if code >= 200 && cw.status == 0 {
+        cw.status = code
+        cw.header = cw.ResponseWriter.Header().Clone()
+    }
+    cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+    if cw.status == 0 {
+        cw.WriteHeader(http.StatusOK)
+    }
+    cw.body.Write(b)
+    return cw.ResponseWriter.Write(b)
+}
+
+func (cw *captureWriter) Flush() {
+    http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    /* hijacked connections are not stored */
+    cw.hijacked = true
+    return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+    return cw.ResponseWriter
+}
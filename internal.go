@@ -0,0 +1,88 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "net/http"
+)
+
+/* routeView is the partition of the routes served by a handler of the mux */
+type routeView uint8
+
+const(
+    viewAll routeView = iota
+    viewPublic
+    viewInternal
+)
+
+// Internal marks a route as internal, e.g. health, metrics and debug
+// endpoints, so it is only served by the handler returned by
+// InternalHandler and by the mux itself, never by PublicHandler. The
+// endpoints registered by EnableAdmin, EnablePprof and EnableExpvar are
+// internal.
+func Internal() RouteOption {
+    return func(o *routeOptions) {
+        o.internal = true
+    }
+}
+
+// PublicHandler returns a view of the mux serving only the routes not
+// marked as Internal, responding to requests for internal routes as if
+// they were not registered. The mux itself serves all routes.
+func (mux *Mux) PublicHandler() http.Handler {
+    return &muxView{mux, viewPublic}
+}
+
+// InternalHandler returns a view of the mux serving only the routes marked
+// as Internal, e.g. to serve them on a port not exposed externally.
+func (mux *Mux) InternalHandler() http.Handler {
+    return &muxView{mux, viewInternal}
+}
+
+type muxView struct {
+    mux  *Mux
+    view routeView
+}
+
+func (v *muxView) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    v.mux.serve(w, r, v.view)
+}
+
+/* serves reports whether a route is part of the view */
+func (v routeView) serves(mh *MethodHandler) bool {
+    return v == viewAll || mh.opts.internal == (v == viewInternal)
+}
+
+// ListenAndServeSplit is like ListenAndServe but serves the public routes
+// on publicAddr and the internal routes on internalAddr, see Internal. Both
+// servers are shut down once ctx is done or either of them fails.
+func (mux *Mux) ListenAndServeSplit(ctx context.Context, publicAddr, internalAddr string) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    pub, internal := mux.cleartextServer(publicAddr), mux.cleartextServer(internalAddr)
+    pub.Handler, internal.Handler = mux.PublicHandler(), mux.InternalHandler()
+    errc := make(chan error, 2)
+    for _, srv := range []*http.Server{pub, internal} {
+        go func() {
+            errc <- mux.serveUntilDone(ctx, srv, srv.ListenAndServe)
+        }()
+    }
+    err := <-errc
+    cancel()
+    if err2 := <-errc; err == nil {
+        err = err2
+    }
+    return err
+}
+
+/* inView reports whether n has a method handler in the view */
+func (n *node) inView(v routeView) bool {
+    for _, mh := range n.methodHandlers {
+        if v.serves(mh) {
+            return true
+        }
+    }
+    return false
+}
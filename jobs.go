@@ -0,0 +1,168 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+)
+
+// DefaultJobsPath is the path of the job status route registered along
+// with the first async route unless HandleJobs has been called.
+const DefaultJobsPath = "/jobs"
+
+/* jobRetention is how long the memory job store keeps finished jobs */
+const jobRetention = time.Hour
+
+// JobStatus is the status of a Job.
+type JobStatus string
+
+const(
+    JobPending   JobStatus = "pending"
+    JobRunning   JobStatus = "running"
+    JobSucceeded JobStatus = "succeeded"
+    JobFailed    JobStatus = "failed"
+)
+
+// Done reports whether the job has finished.
+func (s JobStatus) Done() bool {
+    return s == JobSucceeded || s == JobFailed
+}
+
+// Job describes a request served by an async route.
+type Job struct {
+    ID       string    `json:"id"`
+    Status   JobStatus `json:"status"`
+    Attempts int       `json:"attempts"`
+    // Code is the status code the handler responded with.
+    Code     int       `json:"code,omitempty"`
+    // Result is the JSON body the handler responded with, if any.
+    Result   json.RawMessage `json:"result,omitempty"`
+    Created  time.Time `json:"created"`
+    Updated  time.Time `json:"updated"`
+}
+
+// JobResult decodes the result of a succeeded job, e.g. for clients
+// polling the job status route:
+//
+//  report, err := cmux.JobResult[Report](job)
+//
+// Jobs which have not succeeded yield an error.
+func JobResult[T any](job Job) (T, error) {
+    var v T
+    if job.Status != JobSucceeded {
+        return v, fmt.Errorf("job %s is %s", job.ID, job.Status)
+    }
+    if len(job.Result) == 0 {
+        return v, nil
+    }
+    err := json.Unmarshal(job.Result, &v)
+    return v, err
+}
+
+// JobStore stores the jobs of async routes, e.g. in a database shared by
+// several instances, see SetJobStore. Jobs are stored whenever their status
+// changes.
+type JobStore interface {
+    // PutJob creates or replaces the job with the ID of job.
+    PutJob(ctx context.Context, job Job) error
+    // GetJob returns the job of the specified ID, or ErrNotFound if there
+    // is no such job. Other errors are responded to like errors returned
+    // by handlers.
+    GetJob(ctx context.Context, id string) (Job, error)
+    // DeleteJob deletes the job of the specified ID.
+    DeleteJob(ctx context.Context, id string) error
+}
+
+// SetJobStore sets the store of the jobs of async routes. By default jobs
+// are kept in memory until an hour after they finished. It must be called
+// before serving requests.
+func (mux *Mux) SetJobStore(store JobStore) {
+    mux.jobs = store
+}
+
+// HandleJobs registers the job status route at path followed by "/{id}",
+// responding with the Job of the specified ID. The route is registered at
+// DefaultJobsPath, i.e. GET /jobs/{id}, along with the first async route
+// unless HandleJobs has been called before, e.g. to use another path or
+// route options:
+//
+//  m.HandleJobs("/api/jobs", cmux.BasicAuth(checkUser))
+//
+// Jobs which have not finished are responded to with a Retry-After header.
+func (mux *Mux) HandleJobs(path string, opts ...RouteOption) {
+    type jobMd struct {
+        ID string `cmux:"id"`
+    }
+    path = strings.TrimSuffix(path, "/")
+    if mux.jobs == nil {
+        mux.jobs = &memoryJobStore{}
+    }
+    mux.HandleFunc(path + "/{id}", &jobMd{},
+        Get(func(req *Request[EmptyBody, *jobMd]) error {
+            job, err := mux.jobs.GetJob(req.Context, req.Metadata.ID)
+            if err != nil {
+                return err
+            }
+            if !job.Status.Done() {
+                req.ResponseWriter.Header().Set("Retry-After", "1")
+            }
+            return Bypass(job)
+        }, nil, opts...),
+    )
+    mux.jobsPath = path
+}
+
+/* putJob stores job, updating its modification time */
+func (mux *Mux) putJob(ctx context.Context, job *Job) error {
+    job.Updated = time.Now()
+    return mux.jobs.PutJob(ctx, *job)
+}
+
+/* memoryJobStore is the default JobStore */
+type memoryJobStore struct {
+    mu    sync.Mutex
+    jobs  map[string]Job
+    swept time.Time
+}
+
+func (s *memoryJobStore) GetJob(ctx context.Context, id string) (Job, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    job, ok := s.jobs[id]
+    if !ok {
+        return Job{}, ErrNotFound
+    }
+    return job, nil
+}
+
+func (s *memoryJobStore) PutJob(ctx context.Context, job Job) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.jobs == nil {
+        s.jobs = map[string]Job{}
+    }
+    s.jobs[job.ID] = job
+    if time.Since(s.swept) > jobRetention / 10 {
+        /* forget finished jobs past their retention */
+        for id, j := range s.jobs {
+            if j.Status.Done() && time.Since(j.Updated) > jobRetention {
+                delete(s.jobs, id)
+            }
+        }
+        s.swept = time.Now()
+    }
+    return nil
+}
+
+func (s *memoryJobStore) DeleteJob(ctx context.Context, id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.jobs, id)
+    return nil
+}
@@ -0,0 +1,385 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "reflect"
+    "strconv"
+    "strings"
+)
+
+// MergePatch is a request body holding a JSON Merge Patch (RFC 7386) of a
+// T, e.g.
+//
+//  cmux.Patch(func(req *cmux.Request[cmux.MergePatch[User], *Md]) error {
+//      user := loadUser(req.Metadata.ID)
+//      if err := req.Body.Apply(user); err != nil {
+//          return err
+//      }
+//      ...
+//  }, nil)
+//
+// Decoding fails if the patch is not an object or sets fields of T to
+// values of the wrong type.
+type MergePatch[T any] struct {
+    doc map[string]any
+}
+
+func (p *MergePatch[T]) UnmarshalJSON(b []byte) error {
+    var doc map[string]any
+    if err := json.Unmarshal(b, &doc); err != nil {
+        return err
+    }
+    if doc == nil {
+        return errors.New("merge patch must be an object")
+    }
+    /* check the types of the set fields */
+    var t T
+    if err := fromJSONValue(mergePatch(nil, doc), &t); err != nil {
+        return err
+    }
+    p.doc = doc
+    return nil
+}
+
+func (p MergePatch[T]) MarshalJSON() ([]byte, error) {
+    return json.Marshal(p.doc)
+}
+
+// Apply merges the patch into target. Fields set to null are reset to
+// their zero value, while fields without a JSON form, e.g. those tagged
+// json:"-", are left as is.
+func (p *MergePatch[T]) Apply(target *T) error {
+    doc, err := toJSONValue(target)
+    if err != nil {
+        return err
+    }
+    return fromJSONValue(mergePatch(doc, p.doc), target)
+}
+
+/* mergePatch implements the MergePatch algorithm of RFC 7386 */
+func mergePatch(target any, patch any) any {
+    po, ok := patch.(map[string]any)
+    if !ok {
+        return patch
+    }
+    to, ok := target.(map[string]any)
+    if !ok {
+        to = map[string]any{}
+    }
+    for k, v := range po {
+        if v == nil {
+            delete(to, k)
+        } else {
+            to[k] = mergePatch(to[k], v)
+        }
+    }
+    return to
+}
+
+// PatchOp is an operation of a JSONPatch.
+type PatchOp struct {
+    Op    string          `json:"op"`
+    Path  string          `json:"path"`
+    From  string          `json:"from,omitempty"`
+    Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch is a request body holding a JSON Patch (RFC 6902), i.e. a list
+// of add, remove, replace, move, copy and test operations. Decoding fails
+// if an operation is malformed.
+type JSONPatch []PatchOp
+
+func (p *JSONPatch) UnmarshalJSON(b []byte) error {
+    var ops []PatchOp
+    if err := json.Unmarshal(b, &ops); err != nil {
+        return err
+    }
+    if ops == nil {
+        return errors.New("json patch must be an array")
+    }
+    for i, op := range ops {
+        if err := op.validate(); err != nil {
+            return fmt.Errorf("operation %d: %w", i, err)
+        }
+    }
+    *p = ops
+    return nil
+}
+
+func (op *PatchOp) validate() error {
+    switch op.Op {
+    case "add", "replace", "test":
+        if op.Value == nil {
+            return fmt.Errorf("missing value for %q", op.Op)
+        }
+    case "move", "copy":
+        if _, err := pointerTokens(op.From); err != nil {
+            return err
+        }
+    case "remove":
+    default:
+        return fmt.Errorf("unknown op %q", op.Op)
+    }
+    _, err := pointerTokens(op.Path)
+    return err
+}
+
+// Apply applies the operations to target, which must be a pointer to a
+// value encodable as JSON. Operations not applicable to the current value,
+// e.g. failed tests or missing paths, result in 409 Conflict errors, and
+// leave target unmodified.
+func (p JSONPatch) Apply(target any) error {
+    doc, err := toJSONValue(target)
+    if err != nil {
+        return err
+    }
+    for i, op := range p {
+        if doc, err = op.apply(doc); err != nil {
+            return ErrConflict.WithMessage(fmt.Sprintf("operation %d (%s %s): %v", i, op.Op, op.Path, err))
+        }
+    }
+    return fromJSONValue(doc, target)
+}
+
+func (op *PatchOp) apply(doc any) (any, error) {
+    path, err := pointerTokens(op.Path)
+    if err != nil {
+        return nil, err
+    }
+    var value any
+    if op.Value != nil {
+        if err := json.Unmarshal(op.Value, &value); err != nil {
+            return nil, err
+        }
+    }
+    switch op.Op {
+    case "add":
+        return addPath(doc, path, value)
+    case "remove":
+        doc, _, err = removePath(doc, path)
+        return doc, err
+    case "replace":
+        if doc, _, err = removePath(doc, path); err != nil {
+            return nil, err
+        }
+        return addPath(doc, path, value)
+    case "move", "copy":
+        from, _ := pointerTokens(op.From)
+        if op.Op == "move" {
+            if op.Path == op.From {
+                return doc, nil
+            }
+            if strings.HasPrefix(op.Path, op.From + "/") {
+                return nil, errors.New("cannot move a value into itself")
+            }
+            if doc, value, err = removePath(doc, from); err != nil {
+                return nil, err
+            }
+        } else {
+            if value, err = getPath(doc, from); err != nil {
+                return nil, err
+            }
+            /* copies must not share maps and slices */
+            b, _ := json.Marshal(value)
+            json.Unmarshal(b, &value)
+        }
+        return addPath(doc, path, value)
+    case "test":
+        cur, err := getPath(doc, path)
+        if err != nil {
+            return nil, err
+        }
+        if !reflect.DeepEqual(cur, value) {
+            return nil, errors.New("test failed")
+        }
+        return doc, nil
+    }
+    return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+/* pointerTokens splits a JSON pointer (RFC 6901) into unescaped tokens */
+func pointerTokens(p string) ([]string, error) {
+    if p == "" {
+        return nil, nil
+    }
+    if p[0] != '/' {
+        return nil, fmt.Errorf("invalid JSON pointer %q", p)
+    }
+    toks := strings.Split(p[1:], "/")
+    for i, t := range toks {
+        toks[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+    }
+    return toks, nil
+}
+
+func arrayIndex(tok string, n int, appendable bool) (int, error) {
+    if appendable && tok == "-" {
+        return n, nil
+    }
+    idx, err := strconv.Atoi(tok)
+    if err != nil || idx < 0 || (tok != "0" && tok[0] == '0') {
+        return 0, fmt.Errorf("invalid array index %q", tok)
+    }
+    if idx > n || (idx == n && !appendable) {
+        return 0, fmt.Errorf("array index %d out of bounds", idx)
+    }
+    return idx, nil
+}
+
+func getPath(doc any, toks []string) (any, error) {
+    for _, tok := range toks {
+        switch d := doc.(type) {
+        case map[string]any:
+            v, ok := d[tok]
+            if !ok {
+                return nil, fmt.Errorf("path %q not found", tok)
+            }
+            doc = v
+        case []any:
+            idx, err := arrayIndex(tok, len(d), false)
+            if err != nil {
+                return nil, err
+            }
+            doc = d[idx]
+        default:
+            return nil, fmt.Errorf("path %q not found", tok)
+        }
+    }
+    return doc, nil
+}
+
+/* addPath returns doc with v added at toks */
+func addPath(doc any, toks []string, v any) (any, error) {
+    if len(toks) == 0 {
+        return v, nil
+    }
+    tok, last := toks[0], len(toks) == 1
+    switch d := doc.(type) {
+    case map[string]any:
+        if last {
+            d[tok] = v
+            return d, nil
+        }
+        child, ok := d[tok]
+        if !ok {
+            return nil, fmt.Errorf("path %q not found", tok)
+        }
+        nc, err := addPath(child, toks[1:], v)
+        d[tok] = nc
+        return d, err
+    case []any:
+        idx, err := arrayIndex(tok, len(d), last)
+        if err != nil {
+            return nil, err
+        }
+        if last {
+            d = append(d, nil)
+            copy(d[idx + 1:], d[idx:])
+            d[idx] = v
+            return d, nil
+        }
+        nc, err := addPath(d[idx], toks[1:], v)
+        d[idx] = nc
+        return d, err
+    }
+    return nil, fmt.Errorf("path %q not found", tok)
+}
+
+/* removePath returns doc without the value at toks, and the value */
+func removePath(doc any, toks []string) (any, any, error) {
+    if len(toks) == 0 {
+        return nil, doc, nil
+    }
+    tok, last := toks[0], len(toks) == 1
+    switch d := doc.(type) {
+    case map[string]any:
+        child, ok := d[tok]
+        if !ok {
+            return nil, nil, fmt.Errorf("path %q not found", tok)
+        }
+        if last {
+            delete(d, tok)
+            return d, child, nil
+        }
+        nc, removed, err := removePath(child, toks[1:])
+        d[tok] = nc
+        return d, removed, err
+    case []any:
+        idx, err := arrayIndex(tok, len(d), false)
+        if err != nil {
+            return nil, nil, err
+        }
+        if last {
+            removed := d[idx]
+            return append(d[:idx], d[idx + 1:]...), removed, nil
+        }
+        nc, removed, err := removePath(d[idx], toks[1:])
+        d[idx] = nc
+        return d, removed, err
+    }
+    return nil, nil, fmt.Errorf("path %q not found", tok)
+}
+
+/* toJSONValue converts v to its generic JSON representation */
+func toJSONValue(v any) (any, error) {
+    b, err := json.Marshal(v)
+    if err != nil {
+        return nil, err
+    }
+    var doc any
+    err = json.Unmarshal(b, &doc)
+    return doc, err
+}
+
+// fromJSONValue replaces the value target points to with the generic JSON
+// value doc, leaving it unmodified on failure. Struct fields without a JSON
+// form, i.e. unexported fields and fields tagged json:"-", keep their values.
+func fromJSONValue(doc any, target any) error {
+    b, err := json.Marshal(doc)
+    if err != nil {
+        return err
+    }
+    rv := reflect.ValueOf(target)
+    if rv.Kind() != reflect.Pointer || rv.IsNil() {
+        return errors.New("patch target must be a non-nil pointer")
+    }
+    fresh := reflect.New(rv.Elem().Type())
+    fresh.Elem().Set(rv.Elem())
+    clearJSONFields(fresh.Elem())
+    dec := json.NewDecoder(bytes.NewReader(b))
+    if err := dec.Decode(fresh.Interface()); err != nil {
+        return ErrUnprocessable.WithMessage(err.Error())
+    }
+    rv.Elem().Set(fresh.Elem())
+    return nil
+}
+
+var unmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+
+/* clearJSONFields zeroes the parts of v with a JSON form, so decoding the
+ * patched document does not merge into the old values nor write through
+ * pointers shared with them */
+func clearJSONFields(v reflect.Value) {
+    if v.Kind() != reflect.Struct || reflect.PointerTo(v.Type()).Implements(unmarshalerType) {
+        if v.CanSet() {
+            v.SetZero()
+        }
+        return
+    }
+    for i := 0; i < v.NumField(); i++ {
+        f := v.Type().Field(i)
+        if f.Tag.Get("json") == "-" || !f.IsExported() && !f.Anonymous {
+            continue
+        }
+        /* the fields of embedded unexported structs are still settable */
+        if fv := v.Field(i); fv.CanSet() || fv.Kind() == reflect.Struct {
+            clearJSONFields(fv)
+        }
+    }
+}
@@ -0,0 +1,220 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "log/slog"
+    "net/http"
+    "sync"
+)
+
+// Standard JSON-RPC 2.0 error codes.
+const(
+    JSONRPCParseError     = -32700
+    JSONRPCInvalidRequest = -32600
+    JSONRPCMethodNotFound = -32601
+    JSONRPCInvalidParams  = -32602
+    JSONRPCInternalError  = -32603
+    /* -32000 to -32099 are reserved for implementation-defined errors */
+    JSONRPCServerError    = -32000
+)
+
+// JSONRPCError is a JSON-RPC 2.0 error. Methods can return a *JSONRPCError
+// to respond with a specific code.
+type JSONRPCError struct {
+    Code    int    `json:"code"`
+    Message string `json:"message"`
+    Data    any    `json:"data,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+    return e.Message
+}
+
+// JSONRPC is a set of JSON-RPC 2.0 methods served at a single path, e.g.
+//
+//  rpc := cmux.NewJSONRPC()
+//  cmux.HandleRPC(rpc, "users.get", svc.GetUser)
+//  m.HandleFunc("/rpc", nil, rpc.Handler(cmux.BasicAuth(checkUser)))
+//
+// Batches are served in order, and notifications, i.e. requests without an
+// id, are run without being responded to.
+type JSONRPC struct {
+    mu      sync.RWMutex
+    methods map[string]jsonRPCMethod
+}
+
+type jsonRPCMethod func(ctx context.Context, params json.RawMessage) (any, error)
+
+// NewJSONRPC creates an empty set of JSON-RPC methods.
+func NewJSONRPC() *JSONRPC {
+    return &JSONRPC{methods: map[string]jsonRPCMethod{}}
+}
+
+// HandleRPC registers fn as the JSON-RPC method name of rpc. The params of
+// requests are decoded into P, and requests with params failing to decode
+// are responded to with an invalid params error. Errors other than
+// *JSONRPCError are responded to with the message of *Error errors, and
+// otherwise as internal errors. The context is the context of the HTTP
+// request, so RequestValues and the values set by Before functions are
+// available through it.
+func HandleRPC[P any, R any](rpc *JSONRPC, name string, fn func(ctx context.Context, params P) (R, error)) {
+    rpc.mu.Lock()
+    defer rpc.mu.Unlock()
+    rpc.methods[name] = func(ctx context.Context, raw json.RawMessage) (any, error) {
+        var params P
+        if len(raw) > 0 {
+            if err := json.Unmarshal(raw, &params); err != nil {
+                return nil, &JSONRPCError{Code: JSONRPCInvalidParams, Message: "invalid params", Data: err.Error()}
+            }
+        }
+        return fn(ctx, params)
+    }
+}
+
+// Handler creates the POST method handler serving the methods of rpc. The
+// options apply to every method, e.g. for authentication.
+func (rpc *JSONRPC) Handler(opts ...RouteOption) MethodHandler {
+    mh := newMethodHandler(http.MethodPost, rpc.serve, nil, opts)
+    mh.fnName = "JSONRPC"
+    return mh
+}
+
+type jsonRPCRequest struct {
+    JSONRPC string          `json:"jsonrpc"`
+    Method  string          `json:"method"`
+    Params  json.RawMessage `json:"params"`
+    ID      json.RawMessage `json:"id"`
+}
+
+type jsonRPCResponse struct {
+    JSONRPC string           `json:"jsonrpc"`
+    Result  *json.RawMessage `json:"result,omitempty"`
+    Error   *JSONRPCError    `json:"error,omitempty"`
+    ID      json.RawMessage  `json:"id"`
+}
+
+var jsonRPCNull = json.RawMessage("null")
+
+func (rpc *JSONRPC) serve(w http.ResponseWriter, r *http.Request, md any, rs *reqState) error {
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        return err
+    }
+    body = bytes.TrimSpace(body)
+    var out any
+    if len(body) > 0 && body[0] == '[' {
+        var batch []json.RawMessage
+        if err := json.Unmarshal(body, &batch); err != nil {
+            out = jsonRPCFail(nil, JSONRPCParseError, "parse error")
+        } else if len(batch) == 0 {
+            out = jsonRPCFail(nil, JSONRPCInvalidRequest, "invalid request")
+        } else {
+            var resps []*jsonRPCResponse
+            for _, raw := range batch {
+                if resp := rpc.call(r, rs, raw); resp != nil {
+                    resps = append(resps, resp)
+                }
+            }
+            if len(resps) > 0 {
+                out = resps
+            }
+        }
+    } else if !json.Valid(body) {
+        out = jsonRPCFail(nil, JSONRPCParseError, "parse error")
+    } else if resp := rpc.call(r, rs, body); resp != nil {
+        out = resp
+    }
+    if out == nil {
+        /* only notifications */
+        w.WriteHeader(http.StatusNoContent)
+        return nil
+    }
+    b, err := json.Marshal(out)
+    if err != nil {
+        return err
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(b)
+    return nil
+}
+
+/* call runs a single request, returning nil for notifications */
+func (rpc *JSONRPC) call(r *http.Request, rs *reqState, raw json.RawMessage) *jsonRPCResponse {
+    var req jsonRPCRequest
+    if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" ||
+       !validRPCID(req.ID) || !validRPCParams(req.Params) {
+        return jsonRPCFail(nil, JSONRPCInvalidRequest, "invalid request")
+    }
+    rpc.mu.RLock()
+    method, ok := rpc.methods[req.Method]
+    rpc.mu.RUnlock()
+    var result any
+    var err error
+    if !ok {
+        err = &JSONRPCError{Code: JSONRPCMethodNotFound, Message: "method not found"}
+    } else {
+        result, err = method(r.Context(), req.Params)
+    }
+    if req.ID == nil {
+        return nil
+    }
+    if err != nil {
+        return &jsonRPCResponse{JSONRPC: "2.0", Error: rs.mux.rpcError(r, req.Method, err), ID: req.ID}
+    }
+    b, err := json.Marshal(result)
+    if err != nil {
+        rs.mux.log(r, slog.LevelError, "failed to encode JSON-RPC result",
+                   slog.String("rpc_method", req.Method), slog.Any("error", err))
+        return jsonRPCFail(req.ID, JSONRPCInternalError, "internal error")
+    }
+    res := json.RawMessage(b)
+    return &jsonRPCResponse{JSONRPC: "2.0", Result: &res, ID: req.ID}
+}
+
+func jsonRPCFail(id json.RawMessage, code int, message string) *jsonRPCResponse {
+    if id == nil {
+        id = jsonRPCNull
+    }
+    return &jsonRPCResponse{JSONRPC: "2.0", Error: &JSONRPCError{Code: code, Message: message}, ID: id}
+}
+
+/* rpcError converts an error returned by a method to a JSON-RPC error */
+func (mux *Mux) rpcError(r *http.Request, method string, err error) *JSONRPCError {
+    var rpcErr *JSONRPCError
+    var e *Error
+    if errors.As(err, &rpcErr) {
+        return rpcErr
+    } else if errors.As(err, &e) {
+        re := &JSONRPCError{Code: JSONRPCServerError, Message: e.message()}
+        if e.Code != "" {
+            re.Data = map[string]any{"code": e.Code}
+        }
+        return re
+    }
+    mux.log(r, slog.LevelError, "unexpected error", slog.String("rpc_method", method), slog.Any("error", err))
+    return &JSONRPCError{Code: JSONRPCInternalError, Message: "internal error"}
+}
+
+/* validRPCID reports whether id is absent, a string, a number or null */
+func validRPCID(id json.RawMessage) bool {
+    if id == nil {
+        return true
+    }
+    switch id[0] {
+    case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+        return true
+    }
+    return false
+}
+
+/* validRPCParams reports whether params is absent, an array or an object */
+func validRPCParams(params json.RawMessage) bool {
+    return params == nil || params[0] == '[' || params[0] == '{'
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "net/http"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+// ConcurrencyLimit configures the number of requests handled concurrently.
+// Requests beyond Max wait in a queue of up to Queue requests for at most
+// Timeout. Requests that cannot be queued or time out are shed with
+// 503 Service Unavailable and a Retry-After header.
+type ConcurrencyLimit struct {
+    Max        int
+    Queue      int
+    Timeout    time.Duration
+    RetryAfter time.Duration /* default 1s */
+}
+
+type limiter struct {
+    cfg     ConcurrencyLimit
+    sem     chan struct{}
+    waiting atomic.Int64
+}
+
+func newLimiter(cfg ConcurrencyLimit) *limiter {
+    if cfg.Max <= 0 {
+        panic("cmux: concurrency limit must be positive")
+    }
+    if cfg.RetryAfter <= 0 {
+        cfg.RetryAfter = time.Second
+    }
+    return &limiter{
+        cfg: cfg,
+        sem: make(chan struct{}, cfg.Max),
+    }
+}
+
+// MaxConcurrent limits the number of requests handled concurrently by a
+// route, shedding excess requests without queueing them.
+func MaxConcurrent(n int) RouteOption {
+    return LimitConcurrency(ConcurrencyLimit{Max: n})
+}
+
+// LimitConcurrency limits the number of requests handled concurrently.
+// The limit is shared by all routes the option is passed to, e.g. all
+// routes of a group.
+func LimitConcurrency(cfg ConcurrencyLimit) RouteOption {
+    l := newLimiter(cfg)
+    return func(o *routeOptions) {
+        o.limiters = append(o.limiters, l)
+    }
+}
+
+// SetConcurrencyLimit limits the number of requests handled concurrently
+// by all routes of the mux.
+func (mux *Mux) SetConcurrencyLimit(cfg ConcurrencyLimit) {
+    mux.limiter = newLimiter(cfg)
+}
+
+// ErrOverloaded is wrapped by the errors of requests shed by a concurrency
+// limit, as seen by After hooks.
+var ErrOverloaded = errors.New("server overloaded")
+
+/* overloaded is returned when a request is shed */
+type overloaded struct {
+    retryAfter time.Duration
+}
+
+func (o *overloaded) Error() string {
+    return ErrOverloaded.Error()
+}
+
+func (o *overloaded) Unwrap() error {
+    return ErrOverloaded
+}
+
+func (o *overloaded) HTTPError() (int, any) {
+    return http.StatusServiceUnavailable, struct{Error string `json:"error"`}{o.Error()}
+}
+
+func (o *overloaded) respond(w http.ResponseWriter) error {
+    secs := int((o.retryAfter + time.Second - 1) / time.Second)
+    w.Header().Set("Retry-After", strconv.Itoa(secs))
+    return o
+}
+
+// acquire reserves a slot for a request, returning a non-nil error if the
+// request is shed.
+func (l *limiter) acquire(w http.ResponseWriter, r *http.Request) error {
+    select {
+    case l.sem <- struct{}{}:
+        return nil
+    default:
+    }
+    shed := &overloaded{retryAfter: l.cfg.RetryAfter}
+    if l.waiting.Add(1) > int64(l.cfg.Queue) {
+        l.waiting.Add(-1)
+        return shed.respond(w)
+    }
+    defer l.waiting.Add(-1)
+    var timeout <-chan time.Time
+    if l.cfg.Timeout > 0 {
+        t := time.NewTimer(l.cfg.Timeout)
+        defer t.Stop()
+        timeout = t.C
+    }
+    select {
+    case l.sem <- struct{}{}:
+        return nil
+    case <-timeout:
+    case <-r.Context().Done():
+    }
+    return shed.respond(w)
+}
+
+func (l *limiter) release() {
+    <-l.sem
+}
+
+// limit acquires the mux-wide and route limits of a request, returning a
+// function releasing them.
+func (rs *reqState) limit(w http.ResponseWriter, r *http.Request) (func(), error) {
+    var held []*limiter
+    release := func() {
+        for _, l := range held {
+            l.release()
+        }
+    }
+    limiters := rs.mh.opts.limiters
+    if rs.mux.limiter != nil {
+        limiters = append([]*limiter{rs.mux.limiter}, limiters...)
+    }
+    for _, l := range limiters {
+        if err := l.acquire(w, r); err != nil {
+            release()
+            return nil, err
+        }
+        held = append(held, l)
+    }
+    return release, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Localizer translates a message produced by cmux into the first possible
+// of the languages requested by the client, ordered by preference as
+// listed in the Accept-Language header. key identifies the message, e.g.
+// "decode_failed", the code of an Error or "status.404" for messages
+// without a more specific key. A Localizer returns msg unchanged if it has
+// no translation.
+type Localizer func(langs []string, key, msg string) string
+
+// SetLocalizer makes the error messages responded by the mux pass through
+// localizer, i.e. the messages of Error values, decode failures and other
+// errors produced by cmux as well as the bodies of 404 and 405 responses.
+func (mux *Mux) SetLocalizer(localizer Localizer) {
+    mux.localizer = localizer
+}
+
+// AcceptLanguages returns the language tags of the Accept-Language header
+// of r ordered by preference, excluding "*".
+func AcceptLanguages(r *http.Request) []string {
+    type lang struct {
+        tag string
+        q   float64
+    }
+    var langs []lang
+    for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+        tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        if tag = strings.TrimSpace(tag); tag == "" || tag == "*" {
+            continue
+        }
+        q := 1.0
+        if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+            if f, err := strconv.ParseFloat(v, 64); err == nil {
+                q = f
+            }
+        }
+        if q > 0 {
+            langs = append(langs, lang{tag, q})
+        }
+    }
+    sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+    tags := make([]string, len(langs))
+    for i, l := range langs {
+        tags[i] = l.tag
+    }
+    return tags
+}
+
+func statusKey(code int) string {
+    return "status." + strconv.Itoa(code)
+}
+
+func (mux *Mux) translator(r *http.Request) func(key, msg string) string {
+    langs := AcceptLanguages(r)
+    return func(key, msg string) string {
+        return mux.localizer(langs, key, msg)
+    }
+}
+
+// localize translates msg for r if a localizer is set.
+func (mux *Mux) localize(r *http.Request, key, msg string) string {
+    if mux.localizer == nil {
+        return msg
+    }
+    return mux.translator(r)(key, msg)
+}
+
+/* localizable is implemented by the errors cmux knows how to translate */
+type localizable interface {
+    localizedError(tr func(key, msg string) string) any
+}
+
+func (e *Error) localizedError(tr func(key, msg string) string) any {
+    key := e.Key
+    if key == "" {
+        key = e.Code
+    }
+    if key == "" {
+        key = statusKey(e.Status)
+    }
+    c := *e
+    c.Message = tr(key, e.message())
+    _, out := c.HTTPError()
+    return out
+}
+
+func (r *codeResponder) localizedError(tr func(key, msg string) string) any {
+    key := r.key
+    if key == "" {
+        key = statusKey(r.code)
+    }
+    _, out := r.HTTPError()
+    msg := out.(struct{Error string `json:"error"`}).Error
+    return struct{Error string `json:"error"`}{tr(key, msg)}
+}
+
+func (e *DecodeError) localizedError(tr func(key, msg string) string) any {
+    return e.body(tr("decode_failed", e.Error()))
+}
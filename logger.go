@@ -0,0 +1,133 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "log/slog"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// SetLogger sets the logger of the mux. Unexpected handler errors and
+// failures to write responses are logged at error level, request bodies
+// failing to decode at warn level, aborted requests at info level and route
+// matching at debug level. Nothing is logged unless a logger is set.
+func (mux *Mux) SetLogger(logger *slog.Logger) {
+    mux.logger = logger
+}
+
+func (mux *Mux) logEnabled(ctx context.Context, level slog.Level) bool {
+    return mux.logger != nil && mux.logger.Enabled(ctx, level)
+}
+
+// log logs msg with the method, URL and matched route pattern of r and the
+// specified attributes.
+func (mux *Mux) log(r *http.Request, level slog.Level, msg string, attrs ...slog.Attr) {
+    mux.logRecord(r, level, msg, true, attrs...)
+}
+
+/* logRecord is log, sampling the record only if sample is set */
+func (mux *Mux) logRecord(r *http.Request, level slog.Level, msg string, sample bool, attrs ...slog.Attr) {
+    if !mux.logEnabled(r.Context(), level) {
+        return
+    }
+    pattern := RoutePattern(r)
+    var suppressed int
+    if s := mux.logSampler; s != nil && sample && level >= slog.LevelInfo {
+        var ok bool
+        if ok, suppressed = s.allow(pattern, level, msg); !ok {
+            return
+        }
+    }
+    common := []slog.Attr{
+        slog.String("method", r.Method),
+        slog.String("url", mux.redaction().url(r.URL)),
+    }
+    if pattern != "" {
+        common = append(common, slog.String("pattern", pattern))
+    }
+    if tenant := Tenant(r); tenant != "" {
+        common = append(common, slog.String("tenant", string(tenant)))
+    }
+    if suppressed > 0 {
+        common = append(common, slog.Int("suppressed", suppressed))
+    }
+    attrs = append(common, attrs...)
+    mux.logger.LogAttrs(r.Context(), level, msg, attrs...)
+}
+
+// LogSampling limits how many records with the same message are logged for
+// a route, so clients sending e.g. malformed bodies cannot flood the logs.
+type LogSampling struct {
+    // First is the number of records with the same route, level and
+    // message logged per Interval. Further records are dropped and
+    // counted.
+    First    int
+    // Interval defaults to one second.
+    Interval time.Duration
+}
+
+// SetLogSampling enables sampling of the records at info level and above,
+// see LogSampling. The first record logged after records were dropped
+// reports how many by its "suppressed" attribute. Debug records and audit
+// records are never sampled. The zero LogSampling disables sampling.
+func (mux *Mux) SetLogSampling(sampling LogSampling) {
+    if sampling.First <= 0 {
+        mux.logSampler = nil
+        return
+    }
+    if sampling.Interval <= 0 {
+        sampling.Interval = time.Second
+    }
+    mux.logSampler = &logSampler{
+        LogSampling: sampling,
+        counts:      map[logKey]*logCount{},
+        now:         time.Now,
+    }
+}
+
+type logSampler struct {
+    LogSampling
+    mutex  sync.Mutex
+    counts map[logKey]*logCount
+    now    func() time.Time
+}
+
+type logKey struct {
+    pattern string
+    level   slog.Level
+    msg     string
+}
+
+type logCount struct {
+    start   time.Time /* of the current interval */
+    n       int /* the records of the current interval */
+    dropped int /* the records dropped since the last logged record */
+}
+
+// allow reports whether a record may be logged and, if so, the number of
+// records with the same key dropped since the last one logged.
+func (s *logSampler) allow(pattern string, level slog.Level, msg string) (bool, int) {
+    now := s.now()
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    key := logKey{pattern, level, msg}
+    c := s.counts[key]
+    if c == nil {
+        c = &logCount{start: now}
+        s.counts[key] = c
+    } else if now.Sub(c.start) >= s.Interval {
+        c.start, c.n = now, 0
+    }
+    if c.n >= s.First {
+        c.dropped++
+        return false, 0
+    }
+    c.n++
+    dropped := c.dropped
+    c.dropped = 0
+    return true, dropped
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+/* longPollGrace is added to the write deadline of long-polling requests */
+const longPollGrace = 10 * time.Second
+
+// LongPoll wraps a handler function holding requests until data is
+// available, for clients unable to use server-sent events or WebSockets,
+// e.g.
+//
+//  m.HandleFunc("/events", &Md{}, cmux.Get(cmux.LongPoll(WaitForEvents, 30 * time.Second), nil))
+//
+// fn must return when the context of the request is done, which happens
+// after waitTimeout. Requests timing out, i.e. where fn returns the error
+// of the context, are responded to with 204 No Content. The write deadline
+// of the connection is extended to allow for the wait.
+func LongPoll[I any, M any](fn func(*Request[I, M]) error, waitTimeout time.Duration) func(*Request[I, M]) error {
+    return LongPollHeartbeat(fn, waitTimeout, 0)
+}
+
+// LongPollHeartbeat is like LongPoll but also writes a newline to the
+// response every interval while waiting, keeping proxies from closing idle
+// connections. The newlines are whitespace preceding the JSON response.
+// As the 200 OK status is sent along with the first heartbeat, requests
+// timing out after a heartbeat are responded to with a JSON null instead
+// of 204 No Content, and errors returned after a heartbeat are logged and
+// abort the response. fn must not write to the ResponseWriter itself.
+func LongPollHeartbeat[I any, M any](fn func(*Request[I, M]) error, waitTimeout, interval time.Duration) func(*Request[I, M]) error {
+    return func(req *Request[I, M]) error {
+        w := req.ResponseWriter
+        rc := http.NewResponseController(w)
+        rc.SetWriteDeadline(time.Now().Add(waitTimeout + longPollGrace))
+        parent := req.Context
+        ctx, cancel := context.WithTimeout(parent, waitTimeout)
+        defer cancel()
+        req.Context = ctx
+        req.HTTPReq = req.HTTPReq.WithContext(ctx)
+        if interval <= 0 {
+            return longPollResult(fn(req), parent, ctx, false)
+        }
+        done := make(chan error, 1)
+        go func() {
+            /* fn runs outside of the goroutine of the request, so its
+             * panics are turned into errors */
+            defer func() {
+                if p := recover(); p != nil {
+                    done <- fmt.Errorf("long poll handler panicked: %v", p)
+                }
+            }()
+            done <- fn(req)
+        }()
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        beating := false
+        for {
+            select {
+            case err := <-done:
+                err = longPollResult(err, parent, ctx, beating)
+                if !beating {
+                    return err
+                }
+                return writeAfterHeartbeat(w, req.HTTPReq, err)
+            case <-ticker.C:
+                if !beating {
+                    w.Header().Set("Content-Type", "application/json")
+                    w.WriteHeader(http.StatusOK)
+                    beating = true
+                }
+                w.Write([]byte("\n"))
+                rc.Flush()
+            }
+        }
+    }
+}
+
+/* longPollResult turns the error of a timed out request into a response */
+func longPollResult(err error, parent, ctx context.Context, beating bool) error {
+    if err == nil || parent.Err() != nil || ctx.Err() == nil || !errors.Is(err, ctx.Err()) {
+        return err
+    }
+    if beating {
+        return Bypass(nil)
+    }
+    return NoContent()
+}
+
+// writeAfterHeartbeat writes the body of the response of the handler after
+// the status has been sent with a heartbeat. Errors can no longer be
+// responded to, so they are logged and the response is aborted, letting
+// the client detect the incomplete body.
+func writeAfterHeartbeat(w http.ResponseWriter, r *http.Request, err error) error {
+    rs := requestState(r.Context())
+    if rs == nil {
+        return err
+    }
+    var hr HTTPResponder
+    var out any
+    if errors.As(err, &hr) {
+        out, err = hr.HTTPRespond()
+    }
+    if err == nil {
+        err = rs.mux.writeJSON(w, r, rs.mh, rs.mux.filterFields(r, rs.mh, http.StatusOK, out))
+    }
+    if err != nil {
+        rs.mux.log(r, slog.LevelError, "long poll failed after heartbeat", slog.Any("error", err))
+        panic(http.ErrAbortHandler)
+    }
+    /* the response has been written */
+    return Bypass(nil)
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "math"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// MaintenanceResponse is the response to requests rejected in maintenance
+// mode, see SetMaintenance.
+type MaintenanceResponse struct {
+    // Body is encoded as the JSON body of the response, by default
+    // {"error":"maintenance"}.
+    Body       any
+    // RetryAfter, if positive, is sent in the Retry-After header.
+    RetryAfter time.Duration
+}
+
+type maintenanceState struct {
+    Enabled bool     `json:"enabled"`
+    Allow   []string `json:"allow"`
+}
+
+// SetMaintenance switches maintenance mode on or off. In maintenance mode
+// all routes respond 503 Service Unavailable with the response set using
+// SetMaintenanceResponse, except internal routes, such as the admin API,
+// and the routes matching allowlist. An allowlist entry matches the pattern
+// of a route, e.g. "/users/{id}", or the path of a request, or the paths
+// below it if it ends with a slash, e.g. "/status/". It can be called at
+// any time, e.g. through the maintenance toggle of the admin API.
+func (mux *Mux) SetMaintenance(enable bool, allowlist ...string) {
+    mux.maintenance.Store(&maintenanceState{enable, slices.Clone(allowlist)})
+}
+
+// Maintenance reports whether maintenance mode is on and returns the
+// allowlist, see SetMaintenance.
+func (mux *Mux) Maintenance() (bool, []string) {
+    if s := mux.maintenance.Load(); s != nil {
+        return s.Enabled, slices.Clone(s.Allow)
+    }
+    return false, nil
+}
+
+// SetMaintenanceResponse sets the response to requests rejected in
+// maintenance mode.
+func (mux *Mux) SetMaintenanceResponse(res MaintenanceResponse) {
+    mux.maintenanceRes.Store(&res)
+}
+
+type maintenanceError struct {
+    body any
+}
+
+func (e *maintenanceError) Error() string {
+    return "maintenance"
+}
+
+func (e *maintenanceError) HTTPError() (int, any) {
+    return http.StatusServiceUnavailable, e.body
+}
+
+var defaultMaintenanceBody = struct{Error string `json:"error"`}{"maintenance"}
+
+// checkMaintenance rejects requests to routes not allowed in maintenance
+// mode.
+func (rs *reqState) checkMaintenance(w http.ResponseWriter, r *http.Request) error {
+    s := rs.mux.maintenance.Load()
+    if s == nil || !s.Enabled || rs.mh.opts.internal {
+        return nil
+    }
+    for _, allowed := range s.Allow {
+        if allowed == rs.mh.pattern || allowed == r.URL.Path ||
+           strings.HasSuffix(allowed, "/") && strings.HasPrefix(r.URL.Path, allowed) {
+            return nil
+        }
+    }
+    body := any(defaultMaintenanceBody)
+    if res := rs.mux.maintenanceRes.Load(); res != nil {
+        if res.Body != nil {
+            body = res.Body
+        }
+        if res.RetryAfter > 0 {
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+        }
+    }
+    return &maintenanceError{body}
+}
@@ -0,0 +1,239 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "reflect"
+    "unsafe"
+)
+
+// WithMeta sets the non-zero fields of md on the metadata of the requests
+// served by the method handler, so routes sharing a handler can be
+// configured through the same typed metadata:
+//
+//  m.HandleFunc("/eu/prices", &Md{}, cmux.Get(GetPrices, nil, cmux.WithMeta(&Md{Region: "eu"})))
+//  m.HandleFunc("/us/prices", &Md{}, cmux.Get(GetPrices, nil, cmux.WithMeta(&Md{Region: "us"})))
+//
+// md must point to a struct of the route's metadata type. Its fields are
+// copied when WithMeta is called, so md can be reused afterwards. Path
+// variables take precedence over the fields of md.
+func WithMeta(md any) RouteOption {
+    rv := reflect.ValueOf(md)
+    if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+        panic("WithMeta requires a pointer to a struct")
+    }
+    meta := routeMeta{typ: rv.Type()}
+    v := rv.Elem()
+    for i := 0; i < v.NumField(); i++ {
+        if f := v.Field(i); !f.IsZero() {
+            val := reflect.New(f.Type()).Elem()
+            copyValue(val, reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem())
+            meta.fields = append(meta.fields, metaField{i, val})
+        }
+    }
+    return func(o *routeOptions) {
+        o.meta = append(o.meta, meta)
+    }
+}
+
+/* routeMeta holds the fields set using WithMeta */
+type routeMeta struct {
+    typ    reflect.Type
+    fields []metaField
+}
+
+type metaField struct {
+    index int
+    value reflect.Value
+}
+
+// SetSafeMetadata selects how the metadata of a route is copied for each
+// request. Metadata structs made up of only scalars and strings are by default
+// copied as raw memory with the path variables patched directly into it,
+// whereas structs carrying pointers, slices, maps and other reference types
+// are always copied using reflection. In safe mode, structs containing strings
+// are copied using reflection as well, leaving the fast path to plain-old-data
+// structs only.
+// Building with the cmux_safe_metadata build tag enables safe mode by default.
+func (mux *Mux) SetSafeMetadata(enable bool) {
+    mux.safeMetadata = mkOptBool(enable)
+}
+
+// isPOD reports whether values of type t contain no pointers.
+func isPOD(t reflect.Type) bool {
+    switch t.Kind() {
+    case reflect.Bool,
+         reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+         reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+         reflect.Uintptr, reflect.Float32, reflect.Float64,
+         reflect.Complex64, reflect.Complex128:
+        return true
+    case reflect.Array:
+        return t.Len() == 0 || isPOD(t.Elem())
+    case reflect.Struct:
+        for i := 0; i < t.NumField(); i++ {
+            if !isPOD(t.Field(i).Type) {
+                return false
+            }
+        }
+        return true
+    }
+    return false
+}
+
+// isFlat reports whether values of type t contain no pointers other than
+// the immutable data of strings.
+func isFlat(t reflect.Type) bool {
+    switch t.Kind() {
+    case reflect.String:
+        return true
+    case reflect.Array:
+        return t.Len() == 0 || isFlat(t.Elem())
+    case reflect.Struct:
+        for i := 0; i < t.NumField(); i++ {
+            if !isFlat(t.Field(i).Type) {
+                return false
+            }
+        }
+        return true
+    }
+    return isPOD(t)
+}
+
+// copyMetadata initializes buf as a copy of the route's metadata with the
+// fields set using WithMeta and the path variables in patches applied.
+func (n *node) copyMetadata(buf *mdBuf, meta []routeMeta, patches []mdPatch, safe bool) {
+    if n.metadataPOD || (!safe && n.metadataFlat) {
+        copy(unsafe.Slice((*byte)(buf.ptr), len(n.metadataRaw)), n.metadataRaw)
+        if len(meta) > 0 {
+            setMeta(reflect.NewAt(n.metadataType.Elem(), buf.ptr).Elem(), meta)
+        }
+        for _, patch := range patches {
+            dst := unsafe.Slice((*byte)(unsafe.Add(buf.ptr, patch.Offset)), patch.Size)
+            src := unsafe.Slice((*byte)(patch.Source), patch.Size)
+            copy(dst, src)
+        }
+        return
+    }
+    md := reflect.NewAt(n.metadataType.Elem(), buf.ptr).Elem()
+    if n.metadataMaps {
+        /* do not share slices and maps with the template */
+        copyValue(md, n.metadataValue)
+    } else {
+        md.Set(n.metadataValue)
+    }
+    setMeta(md, meta)
+    for _, patch := range patches {
+        f := md.FieldByIndex(patch.Index)
+        /* allow patching unexported fields */
+        f = reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem()
+        if f.Kind() == reflect.Pointer {
+            ptr := reflect.New(f.Type().Elem())
+            setParsed(ptr.Elem(), patch)
+            f.Set(ptr)
+        } else {
+            setParsed(f, patch)
+        }
+    }
+}
+
+func setMeta(md reflect.Value, meta []routeMeta) {
+    for _, m := range meta {
+        for _, mf := range m.fields {
+            f := md.Field(mf.index)
+            copyValue(reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem(), mf.value)
+        }
+    }
+}
+
+// copyValue sets dst to a copy of src with the contents of slices and
+// maps copied as well, so dst can be mutated without affecting src.
+// Pointers, interfaces, functions and channels are shared, allowing
+// metadata to carry services such as database handles.
+func copyValue(dst, src reflect.Value) {
+    switch src.Kind() {
+    case reflect.Slice:
+        if src.IsNil() {
+            dst.SetZero()
+            return
+        }
+        c := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+        for i := 0; i < src.Len(); i++ {
+            copyValue(c.Index(i), src.Index(i))
+        }
+        dst.Set(c)
+    case reflect.Map:
+        if src.IsNil() {
+            dst.SetZero()
+            return
+        }
+        c := reflect.MakeMapWithSize(src.Type(), src.Len())
+        for it := src.MapRange(); it.Next(); {
+            v := reflect.New(src.Type().Elem()).Elem()
+            copyValue(v, it.Value())
+            c.SetMapIndex(it.Key(), v)
+        }
+        dst.Set(c)
+    case reflect.Array, reflect.Struct:
+        if !hasContainers(src.Type()) {
+            dst.Set(src)
+            return
+        }
+        if !src.CanAddr() {
+            /* e.g. map values, whose fields are not addressable */
+            tmp := reflect.New(src.Type()).Elem()
+            tmp.Set(src)
+            src = tmp
+        }
+        if src.Kind() == reflect.Array {
+            for i := 0; i < src.Len(); i++ {
+                copyValue(dst.Index(i), src.Index(i))
+            }
+            return
+        }
+        for i := 0; i < src.NumField(); i++ {
+            /* allow copying unexported fields */
+            d, f := dst.Field(i), src.Field(i)
+            copyValue(reflect.NewAt(d.Type(), unsafe.Pointer(d.UnsafeAddr())).Elem(),
+                      reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem())
+        }
+    default:
+        dst.Set(src)
+    }
+}
+
+// hasContainers reports whether values of type t contain slices or maps
+// outside of pointers and interfaces.
+func hasContainers(t reflect.Type) bool {
+    switch t.Kind() {
+    case reflect.Slice, reflect.Map:
+        return true
+    case reflect.Array:
+        return t.Len() > 0 && hasContainers(t.Elem())
+    case reflect.Struct:
+        for i := 0; i < t.NumField(); i++ {
+            if hasContainers(t.Field(i).Type) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// setParsed sets f to the value parsed by a pathFieldParser.
+func setParsed(f reflect.Value, patch mdPatch) {
+    src := patch.Source
+    if patch.Custom {
+        f.Set(reflect.NewAt(f.Type(), src).Elem())
+        return
+    }
+    switch f.Kind() {
+    case reflect.String:
+        f.SetString(*(*string)(src))
+    case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8:
+        f.SetInt(*(*int64)(src))
+    case reflect.Uint, reflect.Uint64, reflect.Uint32, reflect.Uint16, reflect.Uint8:
+        f.SetUint(*(*uint64)(src))
+    }
+}
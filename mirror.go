@@ -0,0 +1,105 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "context"
+    "io"
+    "log/slog"
+    "net/http"
+    "strings"
+    "time"
+)
+
+const(
+    mirrorTimeout  = 10 * time.Second
+    mirrorInFlight = 64 /* mirrored requests beyond this are dropped */
+)
+
+type mirror struct {
+    handler http.Handler
+    sem     chan struct{}
+}
+
+// Mirror asynchronously sends a copy of every request served by the route,
+// including its body, to h while the route serves the response, e.g. to
+// compare a new implementation against live traffic. The response of h is
+// discarded and cannot affect the primary response. Mirrored requests are
+// dropped rather than queued when h falls behind.
+func Mirror(h http.Handler) RouteOption {
+    m := &mirror{handler: h, sem: make(chan struct{}, mirrorInFlight)}
+    return func(o *routeOptions) {
+        o.mirrors = append(o.mirrors, m)
+    }
+}
+
+// MirrorTo is like Mirror but sends the copies to the upstream base URL,
+// e.g. "http://staging.internal:8080", keeping the path and query of the
+// request.
+func MirrorTo(upstream string) RouteOption {
+    upstream = strings.TrimSuffix(upstream, "/")
+    return Mirror(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+        req, err := http.NewRequestWithContext(r.Context(), r.Method,
+                                               upstream + r.URL.RequestURI(), r.Body)
+        if err != nil {
+            return
+        }
+        req.Header = r.Header
+        req.ContentLength = r.ContentLength
+        res, err := http.DefaultClient.Do(req)
+        if err != nil {
+            return
+        }
+        io.Copy(io.Discard, res.Body)
+        res.Body.Close()
+    }))
+}
+
+/* discardWriter is the response writer of mirrored requests */
+type discardWriter struct {
+    header http.Header
+}
+
+func (dw *discardWriter) Header() http.Header {
+    return dw.header
+}
+
+func (dw *discardWriter) Write(b []byte) (int, error) {
+    return len(b), nil
+}
+
+func (dw *discardWriter) WriteHeader(int) {}
+
+// mirror dispatches copies of r to the mirrors of the route.
+func (rs *reqState) mirror(r *http.Request) error {
+    raw, err := rs.readBody(r)
+    if err != nil {
+        return err
+    }
+    for _, m := range rs.mh.opts.mirrors {
+        select {
+        case m.sem <- struct{}{}:
+        default:
+            rs.mux.log(r, slog.LevelWarn, "mirror saturated, dropping request")
+            continue
+        }
+        /* the copy must outlive the primary request */
+        ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), mirrorTimeout)
+        req := r.Clone(ctx)
+        req.Body = io.NopCloser(bytes.NewReader(raw))
+        req.ContentLength = int64(len(raw))
+        go func() {
+            defer func() {
+                if p := recover(); p != nil {
+                    rs.mux.log(req, slog.LevelError, "mirror panicked", slog.Any("panic", p))
+                }
+                cancel()
+                <-m.sem
+            }()
+            m.handler.ServeHTTP(&discardWriter{header: http.Header{}}, req)
+        }()
+    }
+    return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+)
+
+// RouteExample is an example response of a route, see Example.
+type RouteExample struct {
+    Code int
+    Body any
+}
+
+// Example annotates a route with an example response, served instead of
+// invoking the handler when mock mode is enabled, see Mux.EnableMockMode.
+// A []byte body is written as is, any other body is JSON-encoded. Routes
+// can have examples for several response codes, the first of which is
+// served unless the request asks for another, see EnableMockMode.
+// The examples are also reported by Routes for documentation generators.
+func Example(code int, body any) RouteOption {
+    return func(o *routeOptions) {
+        o.examples = append(o.examples, RouteExample{Code: code, Body: body})
+    }
+}
+
+// Tag annotates a route with one or more tags.
+func Tag(tags ...string) RouteOption {
+    return func(o *routeOptions) {
+        o.tags = append(o.tags, tags...)
+    }
+}
+
+// EnableMockMode makes routes annotated with examples serve those examples
+// rather than invoking their handlers, letting clients be developed against
+// the route table before the handlers are implemented. If tags are specified
+// only routes with at least one of the tags are mocked.
+// The mux Before function is still called for mocked routes.
+// Requests can select the example of a specific response code using the
+// header "Prefer: code=404", so clients can be tested against error
+// responses as well.
+func (mux *Mux) EnableMockMode(tagFilter ...string) {
+    mux.mockMode = true
+    mux.mockTags = tagFilter
+}
+
+// DisableMockMode makes all routes invoke their handlers again.
+func (mux *Mux) DisableMockMode() {
+    mux.mockMode = false
+    mux.mockTags = nil
+}
+
+func (mux *Mux) mocks(mh *MethodHandler) bool {
+    if !mux.mockMode || len(mh.opts.examples) == 0 {
+        return false
+    }
+    if len(mux.mockTags) == 0 {
+        return true
+    }
+    for _, tag := range mh.opts.tags {
+        if slices.Contains(mux.mockTags, tag) {
+            return true
+        }
+    }
+    return false
+}
+
+func (mux *Mux) serveMock(w http.ResponseWriter, r *http.Request, mh *MethodHandler) {
+    ex := mh.opts.examples[0]
+    if code, ok := preferredCode(r); ok {
+        i := slices.IndexFunc(mh.opts.examples, func(ex RouteExample) bool { return ex.Code == code })
+        if i < 0 {
+            mux.handleErr(w, r, mh, HTTPError("no example for the preferred response code", http.StatusNotFound))
+            return
+        }
+        ex = mh.opts.examples[i]
+    }
+    if ex.Body == nil {
+        w.WriteHeader(ex.Code)
+        return
+    }
+    mux.respond(w, r, mh, ex.Code, ex.Body)
+}
+
+/* preferredCode returns the response code requested using "Prefer: code=..." */
+func preferredCode(r *http.Request) (int, bool) {
+    for _, v := range r.Header.Values("Prefer") {
+        for pref := range strings.SplitSeq(v, ",") {
+            name, val, _ := strings.Cut(strings.TrimSpace(pref), "=")
+            if strings.EqualFold(name, "code") {
+                code, err := strconv.Atoi(strings.Trim(val, `"`))
+                return code, err == nil
+            }
+        }
+    }
+    return 0, false
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "crypto/x509"
+    "net/http"
+    "path"
+    "reflect"
+    "slices"
+)
+
+// ClientIdentity is the identity of the verified TLS client certificate of
+// a request. Metadata fields of type *ClientIdentity are bound to the
+// identity of the request, or nil for requests without a verified client
+// certificate.
+type ClientIdentity struct {
+    CommonName          string   `json:"common_name"`
+    Organizations       []string `json:"organizations,omitempty"`
+    OrganizationalUnits []string `json:"organizational_units,omitempty"`
+    // SANs are the DNS names, URIs, email and IP addresses of the
+    // subject alternative names of the certificate.
+    SANs                []string `json:"sans,omitempty"`
+    Certificate         *x509.Certificate `json:"-"`
+}
+
+var clientIdentityType = reflect.TypeFor[*ClientIdentity]()
+
+// ClientCertPolicy configures the client certificates accepted by
+// RequireClientCert. Patterns are matched using path.Match, e.g.
+// "*.internal.example.com" or "spiffe://example.org/ns/payments/*".
+type ClientCertPolicy struct {
+    // SANs are patterns of which one must match a subject alternative
+    // name of the certificate, if any.
+    SANs []string
+    // OUs are patterns of which one must match an organizational unit of
+    // the certificate, if any.
+    OUs  []string
+}
+
+// ClientCert returns the identity of the verified TLS client certificate
+// of r, or nil if there is none. Client certificates are only verified if
+// the TLS config of the server sets ClientCAs and a ClientAuth of at least
+// tls.VerifyClientCertIfGiven, e.g.
+//
+//  srv := &http.Server{Handler: m, TLSConfig: &tls.Config{
+//      ClientCAs:  pool,
+//      ClientAuth: tls.VerifyClientCertIfGiven,
+//  }}
+func ClientCert(r *http.Request) *ClientIdentity {
+    if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+        return nil
+    }
+    cert := r.TLS.VerifiedChains[0][0]
+    id := &ClientIdentity{
+        CommonName:          cert.Subject.CommonName,
+        Organizations:       cert.Subject.Organization,
+        OrganizationalUnits: cert.Subject.OrganizationalUnit,
+        Certificate:         cert,
+    }
+    id.SANs = append(id.SANs, cert.DNSNames...)
+    for _, u := range cert.URIs {
+        id.SANs = append(id.SANs, u.String())
+    }
+    id.SANs = append(id.SANs, cert.EmailAddresses...)
+    for _, ip := range cert.IPAddresses {
+        id.SANs = append(id.SANs, ip.String())
+    }
+    return id
+}
+
+// RequireClientCert requires requests to carry a verified TLS client
+// certificate matching policy, see ClientCert. It can be attached to routes
+// or groups. Requests without a verified certificate are rejected with
+// ErrUnauthorized, and requests whose certificate does not match policy
+// with ErrForbidden.
+func RequireClientCert(policy ClientCertPolicy) RouteOption {
+    return func(o *routeOptions) {
+        o.before = append(o.before, func(w http.ResponseWriter, r *http.Request, _ any) error {
+            id := ClientCert(r)
+            if id == nil {
+                return ErrUnauthorized
+            }
+            if !matchesAny(policy.SANs, id.SANs) || !matchesAny(policy.OUs, id.OrganizationalUnits) {
+                return ErrForbidden
+            }
+            return nil
+        })
+    }
+}
+
+/* matchesAny reports whether patterns is empty or one of them matches a value */
+func matchesAny(patterns, values []string) bool {
+    if len(patterns) == 0 {
+        return true
+    }
+    return slices.ContainsFunc(values, func(v string) bool {
+        return slices.ContainsFunc(patterns, func(p string) bool {
+            ok, _ := path.Match(p, v)
+            return ok
+        })
+    })
+}
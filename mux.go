@@ -5,17 +5,18 @@
 package cmux
 import(
     "bytes"
-    "encoding/json"
+    "context"
     "errors"
-    "fmt"
     "io"
     "log"
+    "log/slog"
     "net/http"
-    "net/http/httputil"
-    "os"
+    "net/url"
     "reflect"
     "strings"
+    "slices"
     "sync"
+    "sync/atomic"
     "time"
     "unsafe"
 )
@@ -25,25 +26,106 @@ var DefaultMux = &Mux{}
 type Mux struct {
     Before          func(http.ResponseWriter, *http.Request, any, any) error
 
-    parent          *Mux
+    /*
+     * The route tree is immutable once published, registrations copy the
+     * nodes along the registered path and swap in the new root.
+     */
+    tree            atomic.Pointer[node]
+
+    debugTimings    atomic.Bool
+    debugOpts       atomic.Pointer[DebugOptions]
+    capture         atomic.Pointer[capturer]
+    timingHists     atomic.Bool
+    logger          *slog.Logger
+    logSampler      *logSampler /* see SetLogSampling */
+    redact          *Redaction /* see SetRedaction */
+    auditSink       AuditSink
+    tenants         *TenantOptions /* see SetTenants */
+    localizer       Localizer
+    encodedSlashes  EncodedSlashes
+    pathNorm        PathNormalization
+    matrixParams    bool
+    flags           FeatureFlags
+    errMappings     []errorMapping
+    sparseFields    bool
+    poolMetadata    bool
+    safeMetadata    optBool
+    dfltContentType string
+    keyCase         KeyCase
+    keyCaseHeader   string
+    safeIntegers    bool
+    mockMode        bool
+    mockTags        []string
+    versions        []*Version /* see Version */
+    decodeOpts      DecodeOptions
+    decodeErrDetails bool
+    exposeDecodeErrs bool
+    jsonOpts        *JSONOptions
+    encoder         Encoder
+    maxBodySize     int64
+    maxResponseSize int64 /* see SetMaxResponseSize */
+    after           []func(*Outcome)
+    csrf            *CSRFOptions
+    cookieKeys      *cookieKeys
+    urlKey          []byte /* see SetURLSecret */
+    limiter         *limiter /* mux-wide concurrency limit */
+    drainReject     bool
+    maintenance     atomic.Pointer[maintenanceState] /* see SetMaintenance */
+    maintenanceRes  atomic.Pointer[MaintenanceResponse]
+    shutdownTimeout time.Duration
+    http3           HTTP3Server /* see SetHTTP3Server */
+    h2c             bool /* see EnableH2C */
+    asyncWorkers    int
+    asyncOnce       sync.Once
+    async           *asyncPool
+    jobs            JobStore
+    jobsPath        string /* see HandleJobs */
+
+    draining        atomic.Bool
+    inFlight        atomic.Int64
+
+    mutex sync.Mutex /* serializes registrations */
+}
+
+/* node is a path section in the route tree */
+type node struct {
     methodHandlers  map[string]*MethodHandler
 
-    metadata        any
+    metadata        any /* a snapshot of the metadata passed to HandleFunc */
     metadataRaw     []byte
     metadataType     reflect.Type
+    metadataValue   reflect.Value /* the struct metadata points to */
+    metadataPOD     bool /* metadata contains no pointers */
+    metadataFlat    bool /* metadata contains no pointers besides strings */
+    metadataMaps    bool /* metadata contains slices or maps, see copyValue */
+    mdPool          *sync.Pool /* of *mdBuf, see EnableMetadataPooling */
+    binders         []fieldBinder /* metadata fields bound from the request */
 
     servesDir       bool /* Does the handlefunc serve a dir? (i.e. ends with '/') */
-    debugTimings    bool
-    debug           bool
-    dfltContentType string
 
-    /* Directly mapped muxes */
-    m            map[string]*Mux
+    /* Directly mapped nodes */
+    m            map[string]*node
 
-    /* Linearly mapped muxes */
+    /* Linearly mapped nodes */
     matchers    []fmtMatcher
+}
+
+func newNode() *node {
+    return &node{
+        m: map[string]*node{},
+    }
+}
 
-    mutex sync.RWMutex
+// clone returns a shallow copy of n, that can be modified without
+// affecting n.
+func (n *node) clone() *node {
+    c := *n
+    c.m = make(map[string]*node, len(n.m))
+    for k, v := range n.m {
+        c.m[k] = v
+    }
+    c.matchers = append([]fmtMatcher(nil), n.matchers...)
+    return &c
 }
 
 var methodHandlerType = reflect.TypeOf(MethodHandler{})
@@ -51,7 +133,7 @@ var methodHandlerType = reflect.TypeOf(MethodHandler{})
 /* Fmt stuff */
 
 type fmtMatcher struct {
-    Mux      *Mux
+    Node     *node
     Prefix   string
     Suffix   string
     FieldParser pathFieldParser
@@ -64,73 +146,253 @@ type fmtMatcher struct {
 
 /* Actual routing */
 
-func (mux *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (mux *Mux) ServeHTTP(hw http.ResponseWriter, r *http.Request) {
+    mux.serve(hw, r, viewAll)
+}
+
+func (mux *Mux) serve(hw http.ResponseWriter, r *http.Request, view routeView) {
+    rs := reqState{
+        mux:   mux,
+        view:  view,
+        start: time.Now(),
+    }
+    r = r.WithContext(context.WithValue(r.Context(), reqStateKey{}, &rs))
+    rs.r = r
+    mux.inFlight.Add(1)
+    defer mux.inFlight.Add(-1)
+    w := &responseWriter{ResponseWriter: hw}
+    t := mux.startTrace(w, r)
+    cp := mux.startCapture(w, r)
+    err := rs.route(w, r)
+    if rs.mh != nil && mux.timingHists.Load() {
+        rs.mh.hist.observe(time.Since(rs.start))
+    }
+    if t != nil {
+        t.finish(&rs, w, r, err)
+    }
+    if cp != nil {
+        cp.finish(&rs, w, r, err)
+    }
+    if len(mux.after) > 0 || (rs.mh != nil && len(rs.mh.opts.after) > 0) {
+        rs.runAfter(w, r, err)
+    }
+    rs.values.release()
+}
+
+// route matches r against the route tree and serves it, returning the
+// error returned by the handler, if any.
+func (rs *reqState) route(w http.ResponseWriter, r *http.Request) error {
+    mux := rs.mux
     if r.Body == nil {
         r.Body = io.NopCloser(bytes.NewReader([]byte{}))
     }
-    if mux.debug {
-        rawReq, err := httputil.DumpRequest(r, true)
-        if err != nil {
-            fmt.Fprintf(os.Stderr, "Failed to dump request: %s", err.Error())
-        } else {
-            fmt.Fprintf(os.Stderr, "Request = {\n%s\n}\n", string(rawReq))
+    if r.URL.Path == "" && r.Method == http.MethodConnect {
+        /* authority-form CONNECT requests, see ConnectRequest */
+        u := *r.URL
+        u.Path = "/"
+        r.URL = &u
+    }
+    if r.URL.Path == "" || r.URL.Path[0] != '/' {
+        http.NotFound(w, r)
+        return nil
+    }
+    if mux.tenants != nil {
+        if err := rs.resolveTenant(r); err != nil {
+            mux.handleErr(w, r, nil, err)
+            return err
         }
     }
-    if r.URL.Path[0] != '/' {
+    if mux.matrixParams {
+        rs.matrix = url.Values{}
+    }
+    dirs, err := mux.splitPath(r.URL, rs.matrix)
+    if err != nil {
+        mux.log(r, slog.LevelDebug, "invalid path", slog.Any("error", err))
+        http.Error(w, mux.localize(r, "invalid_path", err.Error()), http.StatusBadRequest)
+        return nil
+    }
+    var ok bool
+    if dirs, ok = mux.normalize(w, r, dirs); !ok {
+        return nil
+    }
+    patchBuf := patchPool.Get().(*[]mdPatch)
+    defer func() {
+        clear((*patchBuf)[:cap(*patchBuf)])
+        patchPool.Put(patchBuf)
+    }()
+    root := mux.tree.Load()
+    if root == nil {
         http.NotFound(w, r)
-        return
+        return nil
     }
-    dirs := strings.Split(r.URL.Path, "/")[1:]
-    mux.mutex.RLock()
-    match, fallback, patches := mux.matchDir(dirs)
-    mux.mutex.RUnlock()
+    match, fallback, patches, fbPatches := root.matchDir(dirs, (*patchBuf)[:0])
     if match == nil {
-        match = fallback
+        match, patches = fallback, fbPatches
         if match == nil {
-            http.NotFound(w, r)
-            return
+            mux.log(r, slog.LevelDebug, "no route matched")
+            http.Error(w, mux.localize(r, statusKey(http.StatusNotFound), "404 page not found"),
+                       http.StatusNotFound)
+            return nil
         }
     }
+    if cap(patches) > cap(*patchBuf) {
+        *patchBuf = patches[:0]
+    }
     var mh *MethodHandler
-    if mh = match.methodHandlers[r.Method]; mh == nil {
-        http.Error(w, "", http.StatusMethodNotAllowed)
-        return
+    if rs.view != viewAll && !match.inView(rs.view) {
+        mux.log(r, slog.LevelDebug, "no route matched")
+        http.Error(w, mux.localize(r, statusKey(http.StatusNotFound), "404 page not found"),
+                   http.StatusNotFound)
+        return nil
+    }
+    if mh = match.methodHandler(r.Method); mh == nil || !rs.view.serves(mh) {
+        mux.log(r, slog.LevelDebug, "method not allowed")
+        http.Error(w, mux.localize(r, statusKey(http.StatusMethodNotAllowed), ""),
+                   http.StatusMethodNotAllowed)
+        return nil
+    }
+    if mh = mh.selectVariant(w, r); mh == nil {
+        mux.log(r, slog.LevelDebug, "no handler accepts the request headers")
+        http.Error(w, mux.localize(r, statusKey(http.StatusNotAcceptable), ""),
+                   http.StatusNotAcceptable)
+        return nil
+    }
+    rs.mh = mh
+    mux.log(r, slog.LevelDebug, "route matched")
+    rs.setDeadlines(w, r)
+    if mh.opts.logBodies > 0 && mux.logEnabled(r.Context(), slog.LevelInfo) {
+        if bl := startBodyLog(w, r, mh.opts.logBodies, mh.opts.expectContinue && expectsContinue(r)); bl != nil {
+            defer bl.finish(mux, r)
+        }
     }
     if mux.dfltContentType != "" {
         w.Header().Set("Content-Type", mux.dfltContentType)
     }
     var mdIf any = nil
-    mdRaw := make([]byte, len(match.metadataRaw))
     if match.metadata != nil {
-        copy(mdRaw, match.metadataRaw)
-        mdPtr := unsafe.Pointer(unsafe.SliceData(mdRaw))
-        for _, patch := range patches {
-            dst := unsafe.Slice((*byte)(unsafe.Add(mdPtr, patch.Offset)), patch.Size)
-            src := unsafe.Slice((*byte)(patch.Source), patch.Size)
-            copy(dst, src)
+        var buf *mdBuf
+        if mux.poolMetadata {
+            buf = match.mdPool.Get().(*mdBuf)
+            defer match.mdPool.Put(buf)
+        } else {
+            buf = match.newMdBuf()
+        }
+        match.copyMetadata(buf, mh.opts.meta, patches, mux.safeMetadata.or(defaultSafeMetadata))
+        mdIf = buf.md
+    }
+    completed := false
+    defer func() {
+        if rs.idem != nil {
+            rs.idem.release()
+        }
+        if rs.breaker != nil {
+            /* a panicking handler counts as a failure */
+            rs.breaker.leave(w, rs.start, !completed)
+        }
+    }()
+    rs.node, rs.md, rs.patches = match, mdIf, patches
+    err = rs.serve(w, r, mdIf)
+    if err != nil {
+        mux.handleErr(w, r, mh, err)
+    }
+    if rs.idem != nil {
+        rs.idem.finish(w)
+    }
+    if mh.opts.audit != "" {
+        mux.audit(w, r, mh, mdIf, err)
+    }
+    completed = true
+    return err
+}
+
+// serve runs the Before functions and the handler of the matched route.
+func (rs *reqState) serve(w http.ResponseWriter, r *http.Request, mdIf any) error {
+    mux, mh := rs.mux, rs.mh
+    if len(mh.opts.gates) > 0 {
+        if ok, err := rs.checkGates(w, r); !ok {
+            return err
+        }
+    }
+    if err := rs.checkDraining(w); err != nil {
+        return err
+    }
+    if err := rs.checkMaintenance(w, r); err != nil {
+        return err
+    }
+    if err := rs.enterBreaker(); err != nil {
+        return err
+    }
+    if mux.limiter != nil || len(mh.opts.limiters) > 0 {
+        release, err := rs.limit(w, r)
+        if err != nil {
+            return err
+        }
+        defer release()
+    }
+    /* limit the body before the CSRF check may parse a form from it */
+    if err := rs.limitBody(w, r); err != nil {
+        return err
+    }
+    if err := rs.verifyCSRF(r); err != nil {
+        return err
+    }
+    if binders := rs.node.binders; len(binders) > 0 && mdIf != nil {
+        if err := mux.bind(r, mdIf, binders); err != nil {
+            return err
         }
-        mdIf = reflect.NewAt(match.metadataType.Elem(), mdPtr).Interface()
     }
     if mux.Before != nil {
         if err := mux.Before(w, r, mdIf, mh.data); err != nil {
-            mux.handleErr(w, r, err)
-            return
+            return err
+        }
+    }
+    for _, before := range mh.opts.before {
+        if err := before(w, r, mdIf); err != nil {
+            return err
         }
     }
+    if mux.mocks(mh) {
+        mux.serveMock(w, r, mh)
+        return nil
+    }
     var t0, t1 time.Time
-    if mux.debugTimings { t0 = time.Now() }
-    if err := mh.fn(w, r, mdIf); err != nil {
-        mux.handleErr(w, r, err)
+    debugTimings := mux.debugTimings.Load()
+    if debugTimings { t0 = time.Now() }
+    if err := rs.checkContinue(r); err != nil {
+        return err
     }
-    if mux.debugTimings {
+    if err := rs.verifyBody(r); err != nil {
+        return err
+    }
+    if len(mh.opts.mirrors) > 0 {
+        if err := rs.mirror(r); err != nil {
+            return err
+        }
+    }
+    if replayed, err := rs.beginIdempotent(w, r); replayed || err != nil {
+        return err
+    }
+    if rs.breaker != nil {
+        rs.breaker.handled = true
+    }
+    if mh.opts.async != nil {
+        return rs.enqueueAsync(w, r, mdIf)
+    }
+    err := mh.fn(w, r, mdIf, rs)
+    if debugTimings {
         t1 = time.Now()
-        log.Println(t1.Sub(t0), r.URL.Path)
+        if mux.logger != nil {
+            mux.log(r, slog.LevelDebug, "request timing", slog.Duration("duration", t1.Sub(t0)))
+        } else {
+            /* explicitly enabled, so log to the standard logger */
+            log.Println(t1.Sub(t0), r.URL.Path)
+        }
     }
+    return err
 }
 
 func (mux *Mux) mkRoute(path string, metadata any, methodHandlers map[string]*MethodHandler) {
     mux.mutex.Lock()
-    if mux.m == nil { mux.m = map[string]*Mux{} }
     defer mux.mutex.Unlock()
     if path[0] != '/' { log.Fatalln("path must start with slash", path) }
     dirs := strings.Split(path, "/")[1:]
@@ -140,6 +402,14 @@ func (mux *Mux) mkRoute(path string, metadata any, methodHandlers map[string]*Me
         dirs = dirs[:len(dirs) - 1]
         servesDir = true
     }
+    var root *node
+    if root = mux.tree.Load(); root == nil {
+        root = newNode()
+    } else {
+        root = root.clone()
+    }
+    n := root
+    var labels []string /* the path variables of the route */
     for _, dir := range dirs {
         preBracket, postBracket, found := strings.Cut(dir, "{")
         if strings.Contains(preBracket, "}") {
@@ -163,54 +433,73 @@ func (mux *Mux) mkRoute(path string, metadata any, methodHandlers map[string]*Me
                 log.Fatalf("struct for %s does not contain field %s",
                            path, pathVar)
             }
+            if p.Fn == nil {
+                log.Fatalf("field %s in struct for %s has unsupported type %s",
+                           pathVar, path, p.Type)
+            }
+            labels = append(labels, pathVar)
             matcher := fmtMatcher{
-                Mux: &Mux {
-                    parent: mux,
-                    m: map[string]*Mux{},
-                },
+                Node:   newNode(),
                 Prefix: preBracket,
                 Suffix: rem,
                 FieldParser: p,
                 Label: pathVar,
                 Size:  p.Size,
             }
-            var mIdx int
-            var m fmtMatcher
-            for mIdx, m = range mux.matchers{
-                if m.Prefix == matcher.Prefix &&
-                   m.Suffix == matcher.Suffix &&
-                   m.FieldParser.Type == matcher.FieldParser.Type &&
-                   m.Label == matcher.Label &&
-                   m.Size == matcher.Size {
-                    break
-                }
-            }
-            if mIdx < len(mux.matchers) {
-                mux = mux.matchers[mIdx].Mux
+            mIdx := slices.IndexFunc(n.matchers, func(m fmtMatcher) bool {
+                return m.Prefix == matcher.Prefix &&
+                       m.Suffix == matcher.Suffix &&
+                       m.FieldParser.Type == matcher.FieldParser.Type &&
+                       m.Label == matcher.Label &&
+                       m.Size == matcher.Size
+            })
+            if mIdx >= 0 {
+                n.matchers[mIdx].Node = n.matchers[mIdx].Node.clone()
+                n = n.matchers[mIdx].Node
             } else {
-                mux.matchers = append(mux.matchers, matcher)
-                mux = matcher.Mux
+                n.matchers = append(n.matchers, matcher)
+                n = matcher.Node
             }
         } else {
             /* did not find variable bracket */
             if dir == "" { log.Fatalln("empty dir name not permittede", path) }
-            nmux, ok := mux.m[dir]
-            if !ok {
-                mux.m[dir] = &Mux{
-                    parent: mux,
-                    m: map[string]*Mux{},
-                }
-                mux = mux.m[dir]
-            } else { mux = nmux }
+            if child, ok := n.m[dir]; ok {
+                n.m[dir] = child.clone()
+            } else {
+                n.m[dir] = newNode()
+            }
+            n = n.m[dir]
+        }
+    }
+    n.servesDir = servesDir
+    if n.metadata = metadata; n.metadata != nil {
+        n.metadataType = reflect.TypeOf(n.metadata)
+        /* snapshot the template so later changes by the caller have no effect */
+        rv := reflect.New(n.metadataType.Elem())
+        copyValue(rv.Elem(), reflect.ValueOf(metadata).Elem())
+        n.metadata = rv.Interface()
+        n.metadataRaw = unsafe.Slice((*byte)(rv.UnsafePointer()), n.metadataType.Elem().Size())
+        n.metadataValue = rv.Elem()
+        n.metadataPOD = isPOD(n.metadataType.Elem())
+        n.metadataFlat = isFlat(n.metadataType.Elem())
+        n.metadataMaps = hasContainers(n.metadataType.Elem())
+        n.binders = routeBinders(bindersOf(n.metadataType.Elem()), labels)
+        n.mdPool = &sync.Pool{
+            New: func() any { return n.newMdBuf() },
         }
     }
-    mux.servesDir = servesDir
-    if mux.metadata = metadata; mux.metadata != nil {
-        mux.metadataType = reflect.TypeOf(mux.metadata)
-        rv := reflect.ValueOf(mux.metadata)
-        mux.metadataRaw = unsafe.Slice((*byte)(rv.UnsafePointer()), mux.metadataType.Elem().Size())
+    for _, mh := range methodHandlers {
+        for _, v := range append([]*MethodHandler{mh}, mh.variants...) {
+            for _, m := range v.opts.meta {
+                if m.typ != n.metadataType {
+                    log.Fatalf("WithMeta for %s %s uses %s instead of the metadata type %v",
+                               v.method, path, m.typ, n.metadataType)
+                }
+            }
+        }
     }
-    mux.methodHandlers = methodHandlers
+    n.methodHandlers = methodHandlers
+    mux.tree.Store(root)
 }
 
 // Returning an error that also implements HTTPResponder in a MethodHandler
@@ -229,13 +518,52 @@ type HTTPErrorResponder interface {
     HTTPError()(int, any)
 }
 
-func (mux *Mux) handleErr(w http.ResponseWriter, r *http.Request, err error) {
+// Returning an error that also implements ResponseMarshaler in a MethodHandler
+// function, or an HTTPResponder responding with a ResponseMarshaler, will cause
+// the server to let MarshalResponse write the response instead of JSON-encoding
+// it. This allows handlers to respond with e.g. HTML, CSV or binary payloads.
+// MarshalResponse is responsible for writing the status code and headers.
+type ResponseMarshaler interface {
+    MarshalResponse(w http.ResponseWriter) error
+}
+
+/* requestMarshaler is implemented by responses which also need the request,
+ * such as streams ending when the client goes away. */
+type requestMarshaler interface {
+    marshalRequest(w http.ResponseWriter, r *http.Request) error
+}
+
+func (mux *Mux) handleErr(w http.ResponseWriter, r *http.Request, mh *MethodHandler, err error) {
+    if clientAborted(w) {
+        mux.logClientAbort(r)
+        return
+    }
+    if written(w) {
+        /* the handler wrote the response itself */
+        if !isResponder(err) {
+            mux.log(r, slog.LevelError, "unexpected error after writing the response",
+                    slog.Any("error", err))
+        }
+        return
+    }
     var her HTTPErrorResponder
     var hr HTTPResponder
+    var rm ResponseMarshaler
+    var mbe *http.MaxBytesError
     code := 200
     var out any
-    if errors.As(err, &her) {
+    if errors.As(err, &mbe) {
+        code, out = errBodyTooLarge.HTTPError()
+        if mux.localizer != nil {
+            out = errBodyTooLarge.localizedError(mux.translator(r))
+        }
+    } else if errors.As(err, &rm) {
+        out = rm
+    } else if errors.As(err, &her) {
         code, out = her.HTTPError()
+        if l, ok := her.(localizable); ok && mux.localizer != nil {
+            out = l.localizedError(mux.translator(r))
+        }
     } else if errors.As(err, &hr) {
         out, err = hr.HTTPRespond()
         if err != nil {
@@ -245,39 +573,76 @@ func (mux *Mux) handleErr(w http.ResponseWriter, r *http.Request, err error) {
                 code = http.StatusInternalServerError
                 out = &struct{Error string `json:"error"`}{"internal server error"}
             }
-            log.Printf("Encountered unexpected error at %s: %s", r.URL, err.Error())
+            mux.log(r, slog.LevelError, "unexpected error", slog.Any("error", err))
         }
+    } else if mcode, mout, ok := mux.mapError(r, err); ok {
+        code, out = mcode, mout
     } else {
         code = http.StatusInternalServerError
         out = &struct{Error string `json:"error"`}{"internal server error"}
-        log.Printf("Encountered unexpected error at %s: %s", r.URL, err.Error())
+        mux.log(r, slog.LevelError, "unexpected error", slog.Any("error", err))
     }
-    w.WriteHeader(code)
-    if b, ok := out.([]byte); ok {
-        w.Write(b)
-    } else {
-        json.NewEncoder(w).Encode(out)
-    }
-    if mux.debug {
-        res := http.Response {
-            StatusCode: code,
-            Proto:      "HTTP/1.1",
-            Header:     w.Header(),
+    mux.respond(w, r, mh, code, out)
+}
+
+// respond writes the status code and out as the response.
+func (mux *Mux) respond(w http.ResponseWriter, r *http.Request, mh *MethodHandler, code int, out any) {
+    limit := mux.maxResponseSizeFor(mh)
+    if rm, ok := out.(ResponseMarshaler); ok {
+        if limit > 0 {
+            lw := &limitedResponseWriter{ResponseWriter: w, limit: limit}
+            defer lw.logExceeded(mux, r)
+            w = lw
         }
-        rawRes, err := httputil.DumpResponse(&res, false)
-        if err != nil {
-            fmt.Fprintf(os.Stderr, "Failed to dump request: %s", err.Error())
+        var err error
+        if rqm, ok := rm.(requestMarshaler); ok {
+            err = rqm.marshalRequest(w, r)
         } else {
-            fmt.Fprintf(os.Stderr, "Response = {\n%s", string(rawRes))
+            err = rm.MarshalResponse(w)
+        }
+        if clientAborted(w) || err != nil && err == r.Context().Err() {
+            mux.logClientAbort(r)
+        } else if err != nil && !errors.Is(err, errResponseTooLarge) {
+            mux.log(r, slog.LevelError, "failed to marshal response", slog.Any("error", err))
+        }
+        return
+    }
+    if b, ok := out.([]byte); ok && limit > 0 && int64(len(b)) > limit {
+        mux.log(r, slog.LevelError, "response too large", slog.Int64("limit", limit), slog.Int("status", code))
+        code, out = http.StatusInternalServerError, &struct{Error string `json:"error"`}{"response too large"}
+    }
+    if b, ok := out.([]byte); ok && code == http.StatusOK {
+        /* handles Range, Content-Length and conditional headers */
+        http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+        return
+    }
+    if l, ok := out.(linker); ok && code < 300 {
+        l.links(w, r)
+    }
+    if _, ok := out.([]byte); !ok && limit > 0 && bodyAllowed(code) {
+        /* encode ahead, so oversized responses can still be replaced */
+        var err error
+        if code, out, err = mux.encodeBounded(r, mh, code, out, limit); err != nil {
+            mux.log(r, slog.LevelError, "failed to encode response", slog.Any("error", err))
+            code, out = http.StatusInternalServerError, []byte(`{"error":"internal server error"}` + "\n")
         }
-        json.NewEncoder(os.Stderr).Encode(out)
-        fmt.Fprintf(os.Stderr, "\n}\n")
+    }
+    w.WriteHeader(code)
+    if !bodyAllowed(code) {
+        /* 1xx, 204 and 304 responses never carry a body */
+    } else if b, ok := out.([]byte); ok {
+        w.Write(b)
+    } else if err := mux.writeJSON(w, r, mh, mux.filterFields(r, mh, code, out)); clientAborted(w) {
+        mux.logClientAbort(r)
+    } else if err != nil {
+        mux.log(r, slog.LevelError, "failed to encode response", slog.Any("error", err))
     }
 }
 
 type codeResponder struct{
     code int
     error
+    key  string /* localization key, see Localizer */
 }
 
 func (r *codeResponder) HTTPError() (int, any) {
@@ -292,27 +657,24 @@ func (r *codeResponder) Unwrap() error {
     return r.error
 }
 
-// HTTPError creates an error that when returned in a MethodHandler
-// makes the server reply with the specified error and HTTP code.
+// WrapError creates an error that when returned in a MethodHandler
+// makes the server reply with the message of err and the HTTP code.
+// The returned error is an *Error wrapping err.
 func WrapError(err error, code int) error {
-    if err.Error() == "" {
-        err = errors.New(http.StatusText(code))
-    }
-    return &codeResponder{
-        code: code,
-        error: err,
+    return &Error{
+        Status:  code,
+        Message: err.Error(),
+        Err:     err,
     }
 }
 
 // HTTPError creates an error that when returned in a MethodHandler
 // makes the server reply with the specified error message and HTTP code.
+// The returned error is an *Error, see Error for richer errors.
 func HTTPError(err string, code int) error {
-    if err == "" {
-        err = http.StatusText(code)
-    }
-    return &codeResponder{
-        code: code,
-        error: errors.New(err),
+    return &Error{
+        Status:  code,
+        Message: err,
     }
 }
 
@@ -335,56 +697,94 @@ func (wd BypassingData) Error() string {
     return "whitelisted data not working"
 }
 
+func (mux *Mux) logClientAbort(r *http.Request) {
+    mux.log(r, slog.LevelInfo, "client aborted request")
+}
+
+// isResponder reports whether err is meant to be turned into a response
+// rather than being an unexpected error.
+func isResponder(err error) bool {
+    var her HTTPErrorResponder
+    var hr HTTPResponder
+    var rm ResponseMarshaler
+    return errors.As(err, &her) || errors.As(err, &hr) || errors.As(err, &rm)
+}
+
+type noContent struct{}
+
+// NoContent returns an error that when returned in a MethodHandler makes
+// the server reply with 204 No Content and no body.
+func NoContent() error {
+    return noContent{}
+}
+
+func (noContent) HTTPError() (int, any) {
+    return http.StatusNoContent, nil
+}
+
+func (noContent) Error() string {
+    return "no content"
+}
+
+func bodyAllowed(code int) bool {
+    return code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
 /*
  * Attempt to match a dir
  * If no exact match is found, it will attempt to fallback to a served dir,
  * i.e. a folder served with / at the end, e.g. 'folder/'
+ * Patches of the matched path are appended to acc, whereas fallback patches
+ * are returned in a separate slice, not sharing acc's backing array.
  */
 
-func (mux *Mux) matchDir(dirs []string) (*Mux, *Mux, []mdPatch) {
+func (n *node) matchDir(dirs []string, acc []mdPatch) (*node, *node, []mdPatch, []mdPatch) {
     if len(dirs) == 0 {
-        return mux, nil, []mdPatch{}
+        return n, nil, acc, nil
     }
 
     dir := dirs[0]
     dirs = dirs[1:]
-    var fallback *Mux
+    var fallback *node
     var fbPatches []mdPatch
     /* Check for exact string matches */
-    nmux, ok := mux.m[dir]
+    nmux, ok := n.m[dir]
     if ok {
-        if match, fb, patches := nmux.matchDir(dirs); match != nil {
-            return match, nil, patches
+        if match, fb, patches, fbp := nmux.matchDir(dirs, acc); match != nil {
+            return match, nil, patches, nil
         } else {
             fallback = fb
-            fbPatches = patches
+            fbPatches = fbp
         }
     }
     /* Loop through the parsers, and see if they match */
-    for _, matcher := range mux.matchers {
+    for _, matcher := range n.matchers {
         if !strings.HasPrefix(dir, matcher.Prefix) ||
            !strings.HasSuffix(dir[len(matcher.Prefix):], matcher.Suffix) {
             continue
         }
-        src, err := matcher.FieldParser.Fn(dir[len(matcher.Prefix):len(dir) - len(matcher.Suffix)])
+        raw := dir[len(matcher.Prefix):len(dir) - len(matcher.Suffix)]
+        src, err := matcher.FieldParser.Fn(raw)
         if err != nil { continue }
         patch := mdPatch{
             Offset: matcher.FieldParser.Offset,
             Source: src,
             Size:   matcher.FieldParser.Size,
+            Custom: matcher.FieldParser.Custom,
+            Label:  matcher.Label,
+            Raw:    raw,
+            Index:  matcher.FieldParser.Index,
         }
-        if match, fb, patches := matcher.Mux.matchDir(dirs); match != nil {
-            /* Prepend to argList */
-            patches = append([]mdPatch{patch}, patches...)
-            return match, nil, patches
+        if match, fb, patches, fbp := matcher.Node.matchDir(dirs, append(acc, patch)); match != nil {
+            return match, nil, patches, nil
         } else if fallback == nil {
             fallback = fb
-            fbPatches = append([]mdPatch{patch}, patches...)
+            fbPatches = fbp
         }
     }
 
-    if fallback == nil && mux.servesDir {
-        return nil, mux, []mdPatch{}
+    if fallback == nil && n.servesDir {
+        return nil, n, acc, append([]mdPatch{}, acc...)
     }
-    return nil, fallback, fbPatches
+    return nil, fallback, acc, fbPatches
 }
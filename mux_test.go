@@ -4,17 +4,40 @@
 
 package cmux
 import (
+    "bufio"
     "bytes"
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/hex"
     "encoding/json"
+    "encoding/pem"
     "errors"
     "fmt"
     "io"
+    "log/slog"
     "math"
+    "math/big"
+    "net"
     "net/http"
     "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
     "reflect"
+    "slices"
+    "strconv"
     "strings"
+    "sync"
     "testing"
+    "testing/iotest"
+    "time"
 )
 
 func rBody(r io.Reader) string {
@@ -345,4 +368,5201 @@ func testBefore(t *testing.T) {
         })
     }
 }
-*/
\ No newline at end of file
+*/
+func TestKeyCase(t *testing.T) {
+    type Res struct {
+        SomeValue  string `json:"someValue"`
+        OtherValue string `json:"other_value"`
+        Nested     struct {
+            InnerHTTPValue int
+        } `json:"nested_obj"`
+        ID      int
+        IDToken string
+        Secret  string `cmux_expose:"admin"`
+        /* map keys are data and thus left as they are */
+        Labels map[string]struct{ SomeName string }
+        Extra  any
+    }
+    testKeyCase := func(desc string, mux *Mux, opts []RouteOption, header, expBody string) {
+        t.Run(desc, func(t *testing.T) {
+            type MD struct{}
+            mux.HandleFunc("/", &MD{},
+                Get(func(req *Request[EmptyBody, *MD]) error {
+                    res := Res{SomeValue: "a", OtherValue: "b"}
+                    res.Nested.InnerHTTPValue = 2
+                    res.ID, res.IDToken, res.Secret = 3, "d", "e"
+                    res.Labels = map[string]struct{ SomeName string }{"x_y": {"c"}}
+                    res.Extra = map[string]int{"KeepMe": 1}
+                    return Bypass(res)
+                }, nil, opts...),
+            )
+            req, err := http.NewRequest("GET", "/", nil)
+            if err != nil {
+                t.Errorf("http.NewRequest failed: %v", err)
+                return
+            }
+            if header != "" {
+                req.Header.Set("X-Key-Case", header)
+            }
+            rec := httptest.NewRecorder()
+            mux.ServeHTTP(rec, req)
+            if recvdBody := strings.TrimSpace(rBody(rec.Body)); recvdBody != expBody {
+                t.Errorf("unexpected data, got: %s", recvdBody)
+            }
+        })
+    }
+    testKeyCase("none", &Mux{}, nil, "",
+                `{"someValue":"a","other_value":"b","nested_obj":{"InnerHTTPValue":2},"ID":3,"IDToken":"d",` +
+                `"Labels":{"x_y":{"SomeName":"c"}},"Extra":{"KeepMe":1}}`)
+    testKeyCase("route snake", &Mux{}, []RouteOption{WithKeyCase(KeyCaseSnake)}, "",
+                `{"some_value":"a","other_value":"b","nested_obj":{"inner_http_value":2},"id":3,"id_token":"d",` +
+                `"labels":{"x_y":{"some_name":"c"}},"extra":{"KeepMe":1}}`)
+    camelMux := &Mux{}
+    camelMux.SetKeyCase(KeyCaseCamel)
+    testKeyCase("mux camel", camelMux, nil, "",
+                `{"someValue":"a","otherValue":"b","nestedObj":{"innerHTTPValue":2},"id":3,"idToken":"d",` +
+                `"labels":{"x_y":{"someName":"c"}},"extra":{"KeepMe":1}}`)
+    headerMux := &Mux{}
+    headerMux.SetKeyCaseHeader("X-Key-Case")
+    testKeyCase("header snake", headerMux, []RouteOption{WithKeyCase(KeyCaseCamel)}, "snake_case",
+                `{"some_value":"a","other_value":"b","nested_obj":{"inner_http_value":2},"id":3,"id_token":"d",` +
+                `"labels":{"x_y":{"some_name":"c"}},"extra":{"KeepMe":1}}`)
+}
+
+func TestMetadataPooling(t *testing.T) {
+    type MD struct {
+        Name string
+        ID   int
+    }
+    m := Mux{}
+    m.EnableMetadataPooling(true)
+    m.HandleFunc("/{name}/{id}", &MD{ID: -1},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass(req.Metadata)
+        }, nil),
+    )
+    m.HandleFunc("/{name}/", &MD{ID: -1},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass(req.Metadata)
+        }, nil),
+    )
+    for i, test := range []struct{ path, exp string }{
+        {"/a/1", `{"Name":"a","ID":1}`},
+        {"/b/2", `{"Name":"b","ID":2}`},
+        {"/c/", `{"Name":"c","ID":-1}`},
+        {"/d/x/y", `{"Name":"d","ID":-1}`},
+        {"/e/3", `{"Name":"e","ID":3}`},
+    } {
+        req, err := http.NewRequest("GET", test.path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if recvdBody := strings.TrimSpace(rBody(rec.Body)); recvdBody != test.exp {
+            t.Errorf("request %d: unexpected data, got: %s", i, recvdBody)
+        }
+    }
+}
+
+func TestSafeIntegers(t *testing.T) {
+    type Body struct {
+        ID    int64   `json:"id"`
+        Count uint64  `json:"count"`
+        Ratio float64 `json:"ratio"`
+    }
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/", &MD{},
+        Post(func(req *Request[Body, *MD]) error {
+            return Bypass(req.Body)
+        }, nil, SafeIntegers(true)),
+    )
+    test := func(body, expBody string) {
+        req, err := http.NewRequest("POST", "/", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if recvdBody := strings.TrimSpace(rBody(rec.Body)); recvdBody != expBody {
+            t.Errorf("unexpected data for %s, got: %s", body, recvdBody)
+        }
+    }
+    test(`{"id":"9007199254740993","count":18446744073709551615,"ratio":"1.5"}`,
+         `{"id":"9007199254740993","count":"18446744073709551615","ratio":1.5}`)
+    test(`{"id":-9007199254740992,"count":"12","ratio":1e300}`,
+         `{"id":-9007199254740992,"count":12,"ratio":1e+300}`)
+}
+
+func TestSafeMetadata(t *testing.T) {
+    type Inner struct {
+        Region string
+    }
+    type MD struct {
+        Inner
+        name  string
+        ID    int16
+        Perms map[string]bool
+    }
+    m := Mux{}
+    m.SetSafeMetadata(true)
+    m.HandleFunc("/{region}/{name}/{id}", &MD{Perms: map[string]bool{"read": true}},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            md := req.Metadata
+            if md.Region != "eu" || md.name != "abc" || md.ID != -5 || !md.Perms["read"] {
+                t.Errorf("unexpected metadata %+v", *md)
+            }
+            return nil
+        }, nil),
+    )
+    req, err := http.NewRequest("GET", "/eu/abc/-5", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != 200 {
+        t.Errorf("unexpected response code %d, expected %d", rec.Code, 200)
+    }
+}
+
+func TestMockMode(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/users", &MD{},
+        Get[EmptyBody, *MD](nil, nil,
+            Example(200, []struct{ Name string }{{"alice"}}),
+            Example(403, map[string]string{"error": "forbidden"}),
+            Tag("users"),
+        ),
+        Post(func(req *Request[EmptyBody, *MD]) error {
+            return HTTPError("", http.StatusTeapot)
+        }, nil, Example(201, nil), Tag("admin")),
+    )
+    test := func(method string, expCode int, expBody string, prefer ...string) {
+        req, err := http.NewRequest(method, "/users", strings.NewReader("{}"))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        for _, p := range prefer {
+            req.Header.Add("Prefer", p)
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s: unexpected response code %d, expected %d", method, rec.Code, expCode)
+        }
+        if recvdBody := strings.TrimSpace(rBody(rec.Body)); expBody != "" && recvdBody != expBody {
+            t.Errorf("%s: unexpected data, got: %s", method, recvdBody)
+        }
+    }
+    m.EnableMockMode("users")
+    test("GET", 200, `[{"Name":"alice"}]`)
+    test("GET", 403, `{"error":"forbidden"}`, "respond-async, code=403")
+    test("GET", 404, "", "code=500")
+    test("POST", http.StatusTeapot, "")
+    if routes := m.Routes(); len(routes[0].Examples) != 2 || routes[0].Examples[1].Code != 403 {
+        t.Errorf("unexpected examples %+v", routes[0].Examples)
+    }
+    m.EnableMockMode()
+    test("POST", 201, "")
+    m.DisableMockMode()
+    test("POST", http.StatusTeapot, "")
+}
+
+func TestDoc(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/users", &MD{},
+        Get[EmptyBody, *MD](nil, nil, Doc("List users", "Lists all users."), Tag("users")),
+        Delete[EmptyBody, *MD](nil, nil, Doc("Delete users", ""), Deprecated()),
+    )
+    routes := m.Routes()
+    if len(routes) != 2 {
+        t.Fatalf("expected 2 routes, got %+v", routes)
+    }
+    if ri := routes[0]; ri.Method != "DELETE" || ri.Summary != "Delete users" || !ri.Deprecated {
+        t.Errorf("unexpected route info %+v", ri)
+    }
+    if ri := routes[1]; ri.Summary != "List users" || ri.Description != "Lists all users." ||
+       ri.Deprecated || !slices.Equal(ri.Tags, []string{"users"}) {
+        t.Errorf("unexpected route info %+v", ri)
+    }
+    var buf bytes.Buffer
+    m.Print(&buf, "")
+    if out := buf.String(); !strings.Contains(out, "(deprecated) - Delete users\n") ||
+       !strings.Contains(out, "() - List users\n") {
+        t.Errorf("unexpected Print output:\n%s", out)
+    }
+}
+
+func TestReferenceMetadata(t *testing.T) {
+    type Service struct {
+        Name string
+    }
+    type MD struct {
+        Svc    *Service
+        Perms  map[string]bool
+        Scopes []string
+        ID     *int
+        Name   *string
+    }
+    svc := &Service{"users"}
+    m := Mux{}
+    m.HandleFunc("/{name}/{id}", &MD{Svc: svc, Perms: map[string]bool{"read": true}, Scopes: []string{"a"}},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            md := req.Metadata
+            if md.Svc != svc || !md.Perms["read"] || len(md.Scopes) != 1 ||
+               md.ID == nil || *md.ID != 12 || md.Name == nil || *md.Name != "bob" {
+                t.Errorf("unexpected metadata %+v", *md)
+            }
+            return nil
+        }, nil),
+    )
+    req, err := http.NewRequest("GET", "/bob/12", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != 200 {
+        t.Errorf("unexpected response code %d, expected %d", rec.Code, 200)
+    }
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+    type MD struct {
+        ID int
+    }
+    m := Mux{}
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for i := 0; i < 100; i++ {
+            m.HandleFunc(fmt.Sprintf("/r%d/{id}", i), &MD{},
+                Get(func(req *Request[EmptyBody, *MD]) error {
+                    return nil
+                }, nil),
+            )
+        }
+    }()
+    for i := 0; i < 100; i++ {
+        req, err := http.NewRequest("GET", fmt.Sprintf("/r%d/1", i), nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        m.ServeHTTP(httptest.NewRecorder(), req)
+    }
+    <-done
+    for i := 0; i < 100; i++ {
+        req, err := http.NewRequest("GET", fmt.Sprintf("/r%d/1", i), nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != 200 {
+            t.Errorf("unexpected response code %d, expected %d", rec.Code, 200)
+        }
+    }
+}
+
+func TestDecodeOptions(t *testing.T) {
+    type Body struct {
+        A any `json:"a"`
+    }
+    type MD struct{}
+    m := Mux{}
+    m.SetDecodeOptions(DecodeOptions{DisallowUnknownFields: true, StrictEOF: true, MaxDepth: 2})
+    m.HandleFunc("/", &MD{},
+        Post(func(req *Request[Body, *MD]) error {
+            return nil
+        }, nil),
+        Put(func(req *Request[Body, *MD]) error {
+            if _, ok := req.Body.A.(json.Number); !ok {
+                t.Errorf("expected json.Number, got %T", req.Body.A)
+            }
+            return nil
+        }, nil, WithDecodeOptions(DecodeOptions{UseNumber: true})),
+    )
+    test := func(method, body string, expCode int) {
+        req, err := http.NewRequest(method, "/", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s %s: unexpected response code %d, expected %d", method, body, rec.Code, expCode)
+        }
+    }
+    test("POST", `{"a":[1]} `, 200)
+    test("POST", `{"a":1,"b":2}`, 400)
+    test("POST", `{"a":1} {}`, 400)
+    test("POST", `{"a":[[1]]}`, 400)
+    test("POST", `{"a":"[[[["}`, 200)
+    test("PUT", `{"a":1,"b":[[[2]]]} x`, 200)
+}
+
+func TestPatchable(t *testing.T) {
+    type User struct {
+        Name    string `json:"name"`
+        Age     int    `json:"age"`
+        Address struct {
+            City string `json:"city"`
+        } `json:"address"`
+    }
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/", &MD{},
+        Patch(func(req *Request[Patchable[User], *MD]) error {
+            exp := []string{"address", "address.city", "age"}
+            if !reflect.DeepEqual(req.Body.Fields(), exp) {
+                t.Errorf("unexpected fields %v", req.Body.Fields())
+            }
+            if req.Body.Has("name") || !req.Body.Has("age") || req.Body.Value.Address.City != "x" {
+                t.Errorf("unexpected body %+v", req.Body)
+            }
+            return nil
+        }, nil),
+    )
+    req, err := http.NewRequest("PATCH", "/", strings.NewReader(`{"age":0,"address":{"city":"x"}}`))
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != 200 {
+        t.Errorf("unexpected response code %d, expected %d", rec.Code, 200)
+    }
+
+    /* fields are recorded by their JSON names, and the decoding options of
+     * the route apply */
+    patch := func(req *Request[Patchable[User], *MD]) error {
+        if !reflect.DeepEqual(req.Body.Fields(), []string{"name"}) ||
+           !req.Body.Has("name") || req.Body.Value.Name != "bob" {
+            t.Errorf("unexpected body %+v", req.Body)
+        }
+        return nil
+    }
+    m.HandleFunc("/lax", &MD{}, Patch(patch, nil))
+    m.HandleFunc("/strict", &MD{},
+        Patch(patch, nil, WithDecodeOptions(DecodeOptions{DisallowUnknownFields: true})),
+    )
+    for _, test := range []struct {
+        path    string
+        expCode int
+    }{
+        {"/lax", 200},
+        {"/strict", 400},
+    } {
+        req, err := http.NewRequest("PATCH", test.path, strings.NewReader(`{"Name":"bob","bogus":1}`))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != test.expCode {
+            t.Errorf("%s: unexpected response code %d, expected %d", test.path, rec.Code, test.expCode)
+        }
+    }
+}
+
+func TestDebugDecodeErrors(t *testing.T) {
+    type Body struct {
+        Items []struct {
+            N int `json:"n"`
+        } `json:"items"`
+    }
+    type MD struct{}
+    m := Mux{}
+    m.EnableDebugDecodeErrors(true, true)
+    m.HandleFunc("/", &MD{},
+        Post(func(req *Request[Body, *MD]) error {
+            return nil
+        }, nil),
+    )
+    req, err := http.NewRequest("POST", "/", strings.NewReader(`{"items":[{"n":1},{"n":"x"}]}`))
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    var res struct {
+        Offset  int64  `json:"offset"`
+        Path    string `json:"path"`
+        Value   string `json:"value"`
+        Snippet string `json:"snippet"`
+    }
+    if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+        t.Errorf("json decoding failed: %v", err)
+        return
+    }
+    if rec.Code != 400 || res.Offset != 26 || !strings.HasPrefix(res.Path, "items.") || !strings.Contains(res.Snippet, `"x"`) ||
+       res.Value != `"x"` {
+        t.Errorf("unexpected response %d %+v", rec.Code, res)
+    }
+}
+
+func TestDecodeErrorFields(t *testing.T) {
+    type Body struct {
+        Items []struct {
+            N int `json:"n"`
+        } `json:"items"`
+        Tags map[string]bool `json:"tags"`
+    }
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/", &MD{},
+        Post(func(req *Request[Body, *MD]) error {
+            return nil
+        }, nil, WithDecodeOptions(DecodeOptions{DisallowUnknownFields: true})),
+    )
+    test := func(body, expBody string) {
+        req, err := http.NewRequest("POST", "/", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if got := strings.TrimSpace(rBody(rec.Body)); rec.Code != 400 || got != expBody {
+            t.Errorf("%s: expected 400 %s, got %d %s", body, expBody, rec.Code, got)
+        }
+    }
+    test(`{"items":[{"n":1},{"n":1.5}]}`, `{"error":"json decoding failed: expected integer at items.1.n, got number 1.5",` +
+         `"path":"items.1.n","expected":"integer","value":"number 1.5"}`)
+    test(`{"tags":{"a":"yes"}}`, `{"error":"json decoding failed: expected boolean at tags.a, got string",` +
+         `"path":"tags.a","expected":"boolean","value":"string"}`)
+    test(`{"items":{}}`, `{"error":"json decoding failed: expected array at items, got object",` +
+         `"path":"items","expected":"array","value":"object"}`)
+    test(`{"extra":1}`, `{"error":"json decoding failed: json: unknown field \"extra\"","path":"extra"}`)
+    m.SetDecodeOptions(DecodeOptions{MaxDepth: 8})
+    m.HandleFunc("/buffered", &MD{}, Post(func(req *Request[Body, *MD]) error { return nil }, nil))
+    req, err := http.NewRequest("POST", "/buffered", strings.NewReader(`{"tags":{"a":"yes"}}`))
+    if err != nil {
+        t.Fatalf("http.NewRequest failed: %v", err)
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if got := strings.TrimSpace(rBody(rec.Body)); !strings.Contains(got, `"value":"\"yes\""`) {
+        t.Errorf("expected the offending value of the buffered body, got %s", got)
+    }
+}
+
+func TestJSONOptions(t *testing.T) {
+    test := func(desc string, m *Mux, expBody string) {
+        t.Run(desc, func(t *testing.T) {
+            type MD struct{}
+            m.HandleFunc("/", &MD{},
+                Get(func(req *Request[EmptyBody, *MD]) error {
+                    return Bypass(struct{
+                        AB string `json:"a_b"`
+                    }{"<x>"})
+                }, nil),
+            )
+            req, err := http.NewRequest("GET", "/", nil)
+            if err != nil {
+                t.Errorf("http.NewRequest failed: %v", err)
+                return
+            }
+            rec := httptest.NewRecorder()
+            m.ServeHTTP(rec, req)
+            if recvdBody := rBody(rec.Body); recvdBody != expBody {
+                t.Errorf("unexpected data, got: %q", recvdBody)
+            }
+        })
+    }
+    m := &Mux{}
+    m.SetJSONOptions(JSONOptions{Indent: " "})
+    test("no html escaping", m, "{\n \"a_b\": \"<x>\"\n}\n")
+    m = &Mux{}
+    m.SetJSONOptions(JSONOptions{Indent: " "})
+    m.SetKeyCase(KeyCaseCamel)
+    test("rewritten", m, "{\n \"aB\": \"<x>\"\n}\n")
+    m = &Mux{}
+    m.SetEncoder(EncoderFunc(func(w io.Writer, v any) error {
+        _, err := io.WriteString(w, "custom")
+        return err
+    }))
+    test("custom encoder", m, "custom")
+}
+
+type csvResponse [][]string
+
+func (c csvResponse) MarshalResponse(w http.ResponseWriter) error {
+    w.Header().Set("Content-Type", "text/csv")
+    w.WriteHeader(http.StatusCreated)
+    for _, row := range c {
+        if _, err := io.WriteString(w, strings.Join(row, ",") + "\n"); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (c csvResponse) Error() string {
+    return "response not marshaled"
+}
+
+func TestResponseMarshaler(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return csvResponse{{"a", "b"}, {"1", "2"}}
+        }, nil),
+    )
+    req, err := http.NewRequest("GET", "/", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != http.StatusCreated || rec.Header().Get("Content-Type") != "text/csv" ||
+       rBody(rec.Body) != "a,b\n1,2\n" {
+        t.Errorf("unexpected response %d %v", rec.Code, rec.Header())
+    }
+}
+
+func TestNoContent(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/", &MD{},
+        Delete(func(req *Request[EmptyBody, *MD]) error {
+            return NoContent()
+        }, nil),
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return HTTPError("not modified", http.StatusNotModified)
+        }, nil),
+    )
+    for method, code := range map[string]int{"DELETE": 204, "GET": 304} {
+        req, err := http.NewRequest(method, "/", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != code || rec.Body.Len() != 0 {
+            t.Errorf("%s: unexpected response %d %q", method, rec.Code, rBody(rec.Body))
+        }
+    }
+}
+
+func TestHandlerWrites(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            req.ResponseWriter.WriteHeader(http.StatusAccepted)
+            io.WriteString(req.ResponseWriter, "written")
+            return Bypass("ignored")
+        }, nil),
+    )
+    req, err := http.NewRequest("GET", "/", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != http.StatusAccepted || rBody(rec.Body) != "written" {
+        t.Errorf("unexpected response %d %q", rec.Code, rBody(rec.Body))
+    }
+}
+
+func TestResponseRecorder(t *testing.T) {
+    type MD struct{}
+    var rec ResponseRecorder
+    m := Mux{
+        Before: func(w http.ResponseWriter, r *http.Request, md, data any) error {
+            rec, _ = w.(ResponseRecorder)
+            return nil
+        },
+    }
+    m.HandleFunc("/", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return HTTPError("gone", http.StatusGone)
+        }, nil),
+    )
+    req, err := http.NewRequest("GET", "/", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    hrec := httptest.NewRecorder()
+    m.ServeHTTP(hrec, req)
+    if rec == nil {
+        t.Errorf("writer does not implement ResponseRecorder")
+        return
+    }
+    if rec.Status() != http.StatusGone || rec.BytesWritten() != int64(hrec.Body.Len()) {
+        t.Errorf("unexpected recorded response %d %d", rec.Status(), rec.BytesWritten())
+    }
+    if _, ok := rec.(http.Flusher); !ok {
+        t.Errorf("writer does not implement http.Flusher")
+    }
+}
+
+func TestEarlyHints(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            req.EarlyHints("</app.css>; rel=preload; as=style")
+            if err := req.Push("/app.css"); err != http.ErrNotSupported {
+                t.Errorf("unexpected push result %v", err)
+            }
+            return Bypass("ok")
+        }, nil),
+    )
+    srv := httptest.NewServer(&m)
+    defer srv.Close()
+    res, err := http.Get(srv.URL)
+    if err != nil {
+        t.Errorf("http.Get failed: %v", err)
+        return
+    }
+    defer res.Body.Close()
+    if res.StatusCode != 200 || res.Header.Get("Link") != "</app.css>; rel=preload; as=style" {
+        t.Errorf("unexpected response %d %v", res.StatusCode, res.Header)
+    }
+}
+
+func TestRangeResponse(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass([]byte("0123456789"))
+        }, nil),
+    )
+    test := func(rangeHeader string, expCode int, expBody string) {
+        req, err := http.NewRequest("GET", "/", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        if rangeHeader != "" {
+            req.Header.Set("Range", rangeHeader)
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode || (expCode != 416 && (rBody(rec.Body) != expBody ||
+           rec.Header().Get("Accept-Ranges") != "bytes")) {
+            t.Errorf("%s: unexpected response %d %q %v", rangeHeader, rec.Code, rBody(rec.Body), rec.Header())
+        }
+    }
+    test("", 200, "0123456789")
+    test("bytes=2-4", 206, "234")
+    test("bytes=20-", 416, "")
+}
+
+func TestPostStream(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.SetMaxBodySize(8)
+    m.HandleFunc("/", &MD{},
+        PostStream(func(req *StreamRequest[*MD]) error {
+            if req.ContentType != "text/plain" {
+                t.Errorf("unexpected content type %s", req.ContentType)
+            }
+            b, err := io.ReadAll(req.Body)
+            if err != nil {
+                return err
+            }
+            return Bypass(len(b))
+        }, nil),
+        Put(func(req *Request[string, *MD]) error {
+            return nil
+        }, nil),
+    )
+    test := func(method, body string, chunked bool, expCode int) {
+        req, err := http.NewRequest(method, "/", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        if chunked {
+            req.ContentLength = -1
+        }
+        req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s %q: unexpected response code %d, expected %d", method, body, rec.Code, expCode)
+        }
+    }
+    test("POST", "12345678", false, 200)
+    test("POST", "123456789", false, 413)
+    test("POST", "123456789", true, 413)
+    test("PUT", `"123456789"`, true, 413)
+}
+
+func TestNDJSON(t *testing.T) {
+    type Item struct {
+        N int `json:"n"`
+    }
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/", &MD{},
+        Post(func(req *Request[NDJSON[Item], *MD]) error {
+            return StreamNDJSON(func(yield func(Item) bool) {
+                for item, err := range req.Body.Items() {
+                    if err != nil {
+                        t.Errorf("unexpected error %v", err)
+                        return
+                    }
+                    item.N *= 2
+                    if !yield(item) {
+                        return
+                    }
+                }
+            })
+        }, nil),
+        Put(func(req *Request[NDJSON[Item], *MD]) error {
+            ch := make(chan Item, 2)
+            ch <- Item{1}
+            ch <- Item{2}
+            close(ch)
+            return StreamNDJSONChan(ch)
+        }, nil),
+    )
+    test := func(method, body, expBody string) {
+        req, err := http.NewRequest(method, "/", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != 200 || rBody(rec.Body) != expBody ||
+           rec.Header().Get("Content-Type") != "application/x-ndjson" {
+            t.Errorf("%s: unexpected response %d %q", method, rec.Code, rBody(rec.Body))
+        }
+    }
+    test("POST", "{\"n\":1}\n{\"n\":2}\n\n{\"n\":3}", "{\"n\":2}\n{\"n\":4}\n{\"n\":6}\n")
+    test("PUT", "", "{\"n\":1}\n{\"n\":2}\n")
+
+    /* streams of channels which are never closed end with the request */
+    m.HandleFunc("/open", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            ch := make(chan Item, 1)
+            ch <- Item{1}
+            return StreamNDJSONChan(ch)
+        }, nil),
+    )
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, "GET", "/open", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    done := make(chan struct{})
+    go func() {
+        m.ServeHTTP(rec, req)
+        close(done)
+    }()
+    time.Sleep(10 * time.Millisecond)
+    cancel()
+    select {
+    case <-done:
+        if got := rBody(rec.Body); got != "{\"n\":1}\n" {
+            t.Errorf("unexpected stream %q", got)
+        }
+    case <-time.After(time.Second):
+        t.Errorf("stream not ended with the request")
+    }
+}
+
+type failingWriter struct {
+    *httptest.ResponseRecorder
+    writes int
+}
+
+func (fw *failingWriter) Write(b []byte) (int, error) {
+    fw.writes++
+    return 0, errors.New("broken pipe")
+}
+
+func TestClientAborted(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    var rec ResponseRecorder
+    m.HandleFunc("/", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            rec = req.ResponseWriter.(ResponseRecorder)
+            ch := make(chan int, 3)
+            ch <- 1
+            ch <- 2
+            ch <- 3
+            close(ch)
+            return StreamNDJSONChan(ch)
+        }, nil),
+    )
+    req, err := http.NewRequest("GET", "/", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    fw := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+    m.ServeHTTP(fw, req)
+    if !rec.ClientAborted() || fw.writes != 1 {
+        t.Errorf("expected a single failed write, got %d writes", fw.writes)
+    }
+}
+
+func TestReadFromErrors(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    errSource := errors.New("source failed")
+    m.HandleFunc("/", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            w := req.ResponseWriter
+            /* hide the WriterTo of the reader, so io.Copy uses ReadFrom */
+            src := struct{ io.Reader }{io.MultiReader(strings.NewReader("a"), iotest.ErrReader(errSource))}
+            if _, err := io.Copy(w, src); err != errSource {
+                t.Errorf("expected the source error, got %v", err)
+            }
+            if w.(ResponseRecorder).ClientAborted() {
+                t.Errorf("source error attributed to the client")
+            }
+            _, err := w.Write([]byte("b"))
+            return err
+        }, nil),
+    )
+    req, err := http.NewRequest("GET", "/", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if got := rBody(rec.Body); got != "ab" {
+        t.Errorf("expected ab, got %q", got)
+    }
+    srv := httptest.NewServer(&m)
+    defer srv.Close()
+    res, err := http.Get(srv.URL)
+    if err != nil {
+        t.Fatalf("http.Get failed: %v", err)
+    }
+    defer res.Body.Close()
+    if got := rBody(res.Body); got != "ab" {
+        t.Errorf("expected ab, got %q", got)
+    }
+}
+
+func TestRouteHooks(t *testing.T) {
+    type MD struct {
+        City  string
+        Calls []string
+    }
+    var outcomes []*Outcome
+    requireToken := func(w http.ResponseWriter, r *http.Request, md *MD) error {
+        md.Calls = append(md.Calls, "token")
+        if r.Header.Get("Token") != md.City {
+            return HTTPError("", http.StatusForbidden)
+        }
+        return nil
+    }
+    mark := func(w http.ResponseWriter, r *http.Request, md *MD) error {
+        md.Calls = append(md.Calls, "mark")
+        return nil
+    }
+    m := Mux{}
+    m.HandleFunc("/{city}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass(req.Metadata.Calls)
+        }, nil, Before(requireToken, mark), After(func(oc *Outcome) {
+            outcomes = append(outcomes, oc)
+        })),
+    )
+    test := func(token string, expCode int, expBody string) {
+        req, err := http.NewRequest("GET", "/london", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        req.Header.Set("Token", token)
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode || (expBody != "" && strings.TrimSpace(rBody(rec.Body)) != expBody) {
+            t.Errorf("unexpected response %d %s", rec.Code, rBody(rec.Body))
+        }
+    }
+    test("london", 200, `["token","mark"]`)
+    test("paris", 403, "")
+    if len(outcomes) != 2 || outcomes[0].Status != 200 || outcomes[1].Status != 403 ||
+       outcomes[1].Err == nil || outcomes[0].BytesWritten == 0 {
+        t.Errorf("unexpected outcomes %+v", outcomes)
+    }
+}
+
+func TestMuxAfter(t *testing.T) {
+    type MD struct {
+        ID int
+    }
+    var outcomes []Outcome
+    m := Mux{}
+    m.After(func(oc *Outcome) {
+        outcomes = append(outcomes, *oc)
+    })
+    m.HandleFunc("/users/{id}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return nil
+        }, nil),
+    )
+    for _, path := range []string{"/users/1", "/missing"} {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        m.ServeHTTP(httptest.NewRecorder(), req)
+    }
+    if len(outcomes) != 2 || outcomes[0].Pattern != "/users/{id}" || outcomes[0].Status != 200 ||
+       outcomes[1].Pattern != "" || outcomes[1].Status != 404 {
+        t.Errorf("unexpected outcomes %+v", outcomes)
+    }
+}
+
+func TestCSRF(t *testing.T) {
+    type MD struct{}
+    type Form struct {
+        Name string `json:"name"`
+    }
+    m := Mux{}
+    m.EnableCSRF(CSRFOptions{})
+    var token string
+    m.HandleFunc("/form", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            token = m.CSRFToken(req.ResponseWriter, req.HTTPReq)
+            return nil
+        }, nil),
+        Post(func(req *Request[Form, *MD]) error {
+            return nil
+        }, nil),
+    )
+    m.HandleFunc("/webhook", &MD{},
+        Post(func(req *Request[Form, *MD]) error {
+            return nil
+        }, nil, CSRFExempt()),
+    )
+    req, err := http.NewRequest("GET", "/form", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    cookies := rec.Result().Cookies()
+    if token == "" || len(cookies) != 1 || cookies[0].Value != token {
+        t.Errorf("unexpected CSRF cookies %v for token %q", cookies, token)
+        return
+    }
+    test := func(path, header string, withCookie bool, expCode int) {
+        req, err := http.NewRequest("POST", path, strings.NewReader(`{"name":"x"}`))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        if withCookie {
+            req.AddCookie(cookies[0])
+        }
+        if header != "" {
+            req.Header.Set("X-CSRF-Token", header)
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s: expected %d, got %d %s", path, expCode, rec.Code, rBody(rec.Body))
+        }
+    }
+    test("/form", token, true, 200)
+    test("/form", "", true, 403)
+    test("/form", "wrong", true, 403)
+    test("/form", token, false, 403)
+    test("/webhook", "", false, 200)
+
+    req, err = http.NewRequest("POST", "/form", strings.NewReader("csrf_token=" + token))
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.AddCookie(cookies[0])
+    rec = httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code == 403 {
+        t.Errorf("form field token rejected")
+    }
+
+    /* the form is not parsed past the body size limit of the route */
+    m.HandleFunc("/small", &MD{},
+        Post(func(req *Request[EmptyBody, *MD]) error {
+            return nil
+        }, nil, MaxBodySize(64)),
+    )
+    form := "pad=" + strings.Repeat("x", 64) + "&csrf_token=" + token
+    req, err = http.NewRequest("POST", "/small", io.NopCloser(strings.NewReader(form)))
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.AddCookie(cookies[0])
+    rec = httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != 403 {
+        t.Errorf("form beyond body limit: expected 403, got %d %s", rec.Code, rBody(rec.Body))
+    }
+}
+
+func TestAuth(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    api := m.Group("/api", BasicAuth(func(user, pass string) error {
+        if user == "banned" {
+            return HTTPError("", http.StatusForbidden)
+        }
+        if user != "alice" || pass != "secret" {
+            return errors.New("bad credentials")
+        }
+        return nil
+    }))
+    api.HandleFunc("/users", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return nil
+        }, nil),
+    )
+    m.HandleFunc("/keyed", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return nil
+        }, nil, APIKey("X-API-Key", func(key string) error {
+            if key != "k1" {
+                return errors.New("unknown key")
+            }
+            return nil
+        })),
+    )
+    test := func(path string, setup func(*http.Request), expCode int, expChallenge string) {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        setup(req)
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode || !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), expChallenge) {
+            t.Errorf("%s: unexpected response %d %q", path, rec.Code, rec.Header().Get("WWW-Authenticate"))
+        }
+    }
+    basic := func(user, pass string) func(*http.Request) {
+        return func(r *http.Request) { r.SetBasicAuth(user, pass) }
+    }
+    key := func(k string) func(*http.Request) {
+        return func(r *http.Request) { r.Header.Set("X-API-Key", k) }
+    }
+    test("/api/users", func(*http.Request) {}, 401, "Basic ")
+    test("/api/users", basic("alice", "wrong"), 401, "Basic ")
+    test("/api/users", basic("banned", "x"), 403, "")
+    test("/api/users", basic("alice", "secret"), 200, "")
+    test("/keyed", key(""), 401, "APIKey ")
+    test("/keyed", key("k2"), 401, "APIKey ")
+    test("/keyed", key("k1"), 200, "")
+}
+
+func TestVerifyBody(t *testing.T) {
+    type MD struct{}
+    type Event struct {
+        Kind string `json:"kind"`
+    }
+    secret := []byte("webhook-secret")
+    m := Mux{}
+    var got string
+    m.HandleFunc("/webhook", &MD{},
+        Post(func(req *Request[Event, *MD]) error {
+            got = req.Body.Kind
+            return nil
+        }, nil, VerifyBody(HMACSHA256("X-Hub-Signature-256", "sha256=", secret))),
+    )
+    sign := func(body string) string {
+        mac := hmac.New(sha256.New, secret)
+        mac.Write([]byte(body))
+        return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+    }
+    test := func(body, sig string, expCode int) {
+        req, err := http.NewRequest("POST", "/webhook", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        req.Header.Set("X-Hub-Signature-256", sig)
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("expected %d, got %d %s", expCode, rec.Code, rBody(rec.Body))
+        }
+    }
+    body := `{"kind":"push"}`
+    test(body, sign(body), 200)
+    if got != "push" {
+        t.Errorf("unexpected decoded body %q", got)
+    }
+    test(body, sign(`{"kind":"pull"}`), 403)
+    test(body, "", 403)
+}
+
+func TestKeepRawBody(t *testing.T) {
+    type MD struct{}
+    type Item struct {
+        Name string `json:"name"`
+    }
+    m := Mux{}
+    var raw string
+    var name string
+    m.HandleFunc("/items", &MD{},
+        Post(func(req *Request[Item, *MD]) error {
+            raw, name = string(req.RawBody), req.Body.Name
+            return nil
+        }, nil, KeepRawBody()),
+    )
+    body := `{"name": "cake"}`
+    req, err := http.NewRequest("POST", "/items", strings.NewReader(body))
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != 200 || raw != body || name != "cake" {
+        t.Errorf("unexpected result %d %q %q", rec.Code, raw, name)
+    }
+}
+
+func TestIdempotent(t *testing.T) {
+    type MD struct{}
+    type Order struct {
+        Item string `json:"item"`
+    }
+    m := Mux{}
+    calls := 0
+    m.HandleFunc("/orders", &MD{},
+        Post(func(req *Request[Order, *MD]) error {
+            calls++
+            return Bypass(map[string]any{"id": calls, "item": req.Body.Item})
+        }, nil, Idempotent(NewMemoryIdempotencyStore(), time.Hour)),
+    )
+    test := func(key, body string, expCode int, expBody string, expReplayed bool) {
+        req, err := http.NewRequest("POST", "/orders", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        if key != "" {
+            req.Header.Set("Idempotency-Key", key)
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        replayed := rec.Header().Get("Idempotent-Replayed") == "true"
+        if rec.Code != expCode || replayed != expReplayed ||
+           (expBody != "" && strings.TrimSpace(rBody(rec.Body)) != expBody) {
+            t.Errorf("unexpected response %d %v %s", rec.Code, replayed, rBody(rec.Body))
+        }
+    }
+    test("k1", `{"item":"cake"}`, 200, `{"id":1,"item":"cake"}`, false)
+    test("k1", `{"item":"cake"}`, 200, `{"id":1,"item":"cake"}`, true)
+    test("k1", `{"item":"pie"}`, 422, "", false)
+    test("k2", `{"item":"pie"}`, 200, `{"id":2,"item":"pie"}`, false)
+    test("", `{"item":"pie"}`, 200, `{"id":3,"item":"pie"}`, false)
+    if calls != 3 {
+        t.Errorf("expected 3 handler calls, got %d", calls)
+    }
+
+    /* a request completing between the store lookup and acquiring the key
+     * of another request is replayed by the latter */
+    store := &racingStore{IdempotencyStore: NewMemoryIdempotencyStore()}
+    m.HandleFunc("/racing", &MD{},
+        Post(func(req *Request[Order, *MD]) error {
+            calls++
+            return Bypass(map[string]any{"id": calls, "item": req.Body.Item})
+        }, nil, Idempotent(store, time.Hour)),
+    )
+    serve := func() *httptest.ResponseRecorder {
+        req, err := http.NewRequest("POST", "/racing", strings.NewReader(`{"item":"tea"}`))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return nil
+        }
+        req.Header.Set("Idempotency-Key", "k3")
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        return rec
+    }
+    store.onMiss = func() {
+        store.onMiss = nil
+        serve()
+    }
+    if rec := serve(); rec.Header().Get("Idempotent-Replayed") != "true" ||
+       strings.TrimSpace(rBody(rec.Body)) != `{"id":4,"item":"tea"}` {
+        t.Errorf("expected replayed response, got %d %s", rec.Code, rBody(rec.Body))
+    }
+    if calls != 4 {
+        t.Errorf("expected 4 handler calls, got %d", calls)
+    }
+
+    /* keys are scoped to the path values of a route */
+    m.HandleFunc("/users/{id}/charge", &struct{ ID string }{},
+        Post(func(req *Request[Order, *struct{ ID string }]) error {
+            return Bypass(map[string]any{"charged": req.Metadata.ID})
+        }, nil, Idempotent(NewMemoryIdempotencyStore(), time.Hour)),
+    )
+    for _, id := range []string{"1", "2"} {
+        req, err := http.NewRequest("POST", "/users/" + id + "/charge", strings.NewReader(`{"item":"tea"}`))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        req.Header.Set("Idempotency-Key", "k4")
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Header().Get("Idempotent-Replayed") == "true" ||
+           strings.TrimSpace(rBody(rec.Body)) != `{"charged":"` + id + `"}` {
+            t.Errorf("user %s: unexpected response %d %s", id, rec.Code, rBody(rec.Body))
+        }
+    }
+}
+
+/* racingStore calls onMiss on a store miss */
+type racingStore struct {
+    IdempotencyStore
+    onMiss func()
+}
+
+func (s *racingStore) Get(key string) (*StoredResponse, bool) {
+    res, ok := s.IdempotencyStore.Get(key)
+    if !ok && s.onMiss != nil {
+        s.onMiss()
+    }
+    return res, ok
+}
+
+func TestMaxConcurrent(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    entered := make(chan struct{})
+    unblock := make(chan struct{})
+    m.HandleFunc("/slow", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            entered <- struct{}{}
+            <-unblock
+            return nil
+        }, nil, MaxConcurrent(1)),
+    )
+    serve := func() *httptest.ResponseRecorder {
+        req, err := http.NewRequest("GET", "/slow", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return nil
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        return rec
+    }
+    done := make(chan *httptest.ResponseRecorder)
+    go func() { done <- serve() }()
+    <-entered
+    rec := serve()
+    if rec.Code != 503 || rec.Header().Get("Retry-After") != "1" {
+        t.Errorf("expected 503 with Retry-After, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+    }
+    close(unblock)
+    if rec := <-done; rec.Code != 200 {
+        t.Errorf("expected 200, got %d", rec.Code)
+    }
+    go func() { <-entered }()
+    if rec := serve(); rec.Code != 200 {
+        t.Errorf("expected 200 after release, got %d", rec.Code)
+    }
+}
+
+func TestCircuitBreaker(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    failing := true
+    m.HandleFunc("/flaky", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            if failing {
+                return HTTPError("", http.StatusBadGateway)
+            }
+            return nil
+        }, nil, CircuitBreaker(BreakerConfig{MinRequests: 2, Cooldown: 20 * time.Millisecond})),
+    )
+    serve := func(expCode int) {
+        req, err := http.NewRequest("GET", "/flaky", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("expected %d, got %d", expCode, rec.Code)
+        }
+    }
+    state := func() BreakerState {
+        routes := m.Routes()
+        if len(routes) != 1 || routes[0].Breaker == nil {
+            t.Fatalf("unexpected routes %+v", routes)
+        }
+        return *routes[0].Breaker
+    }
+    serve(502)
+    serve(502)
+    if state() != BreakerOpen {
+        t.Errorf("expected open breaker, got %v", state())
+    }
+    serve(503)
+    time.Sleep(30 * time.Millisecond)
+    if state() != BreakerHalfOpen {
+        t.Errorf("expected half-open breaker, got %v", state())
+    }
+    failing = false
+    serve(200)
+    if state() != BreakerClosed {
+        t.Errorf("expected closed breaker, got %v", state())
+    }
+
+    /* 503 responses of the concurrency limit are not failures */
+    m2 := Mux{}
+    entered := make(chan struct{})
+    unblock := make(chan struct{})
+    m2.HandleFunc("/limited", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            close(entered)
+            <-unblock
+            return nil
+        }, nil, MaxConcurrent(1), CircuitBreaker(BreakerConfig{MinRequests: 2})),
+    )
+    serveLimited := func() int {
+        req, err := http.NewRequest("GET", "/limited", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return 0
+        }
+        rec := httptest.NewRecorder()
+        m2.ServeHTTP(rec, req)
+        return rec.Code
+    }
+    done := make(chan int)
+    go func() { done <- serveLimited() }()
+    <-entered
+    for range 3 {
+        if code := serveLimited(); code != 503 {
+            t.Errorf("expected 503, got %d", code)
+        }
+    }
+    close(unblock)
+    if code := <-done; code != 200 {
+        t.Errorf("expected 200, got %d", code)
+    }
+    if routes := m2.Routes(); len(routes) != 1 || routes[0].Breaker == nil || *routes[0].Breaker != BreakerClosed {
+        t.Errorf("expected closed breaker, got %+v", routes)
+    }
+}
+
+func TestShutdown(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.EnableDrainRejection(true)
+    m.HandleReadiness("/ready")
+    entered := make(chan struct{})
+    unblock := make(chan struct{})
+    m.HandleFunc("/slow", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            close(entered)
+            <-unblock
+            return nil
+        }, nil),
+    )
+    serve := func(path string) *httptest.ResponseRecorder {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return nil
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        return rec
+    }
+    if rec := serve("/ready"); rec.Code != 200 {
+        t.Errorf("expected ready, got %d", rec.Code)
+    }
+    done := make(chan int)
+    go func() { done <- serve("/slow").Code }()
+    <-entered
+    shutdown := make(chan error)
+    go func() { shutdown <- m.Shutdown(context.Background()) }()
+    for !m.Draining() {
+        time.Sleep(time.Millisecond)
+    }
+    if rec := serve("/ready"); rec.Code != 503 || strings.TrimSpace(rBody(rec.Body)) != `{"status":"draining"}` {
+        t.Errorf("expected draining, got %d %s", rec.Code, rBody(rec.Body))
+    }
+    if rec := serve("/slow"); rec.Code != 503 || rec.Header().Get("Connection") != "close" {
+        t.Errorf("expected rejection, got %d", rec.Code)
+    }
+    select {
+    case <-shutdown:
+        t.Errorf("shutdown returned with requests in flight")
+    default:
+    }
+    close(unblock)
+    if code := <-done; code != 200 {
+        t.Errorf("in-flight request failed with %d", code)
+    }
+    if err := <-shutdown; err != nil {
+        t.Errorf("shutdown failed: %v", err)
+    }
+}
+
+func TestServeShutdown(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    entered := make(chan struct{})
+    unblock := make(chan struct{})
+    m.HandleFunc("/slow", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            close(entered)
+            <-unblock
+            return nil
+        }, nil),
+    )
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen failed: %v", err)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    served := make(chan error)
+    go func() { served <- m.Serve(ctx, l) }()
+    done := make(chan int)
+    go func() {
+        res, err := http.Get("http://" + l.Addr().String() + "/slow")
+        if err != nil {
+            t.Errorf("http.Get failed: %v", err)
+            done <- 0
+            return
+        }
+        res.Body.Close()
+        done <- res.StatusCode
+    }()
+    <-entered
+    cancel()
+    /* the listener is closed while the request is still in flight */
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        c, err := net.Dial("tcp", l.Addr().String())
+        if err != nil {
+            break
+        }
+        c.Close()
+        if time.Now().After(deadline) {
+            t.Errorf("listener still accepting connections while draining")
+            break
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    close(unblock)
+    if code := <-done; code != 200 {
+        t.Errorf("in-flight request failed with %d", code)
+    }
+    if err := <-served; err != nil {
+        t.Errorf("serve failed: %v", err)
+    }
+}
+
+func TestDebugTrace(t *testing.T) {
+    type MD struct{}
+    type Login struct {
+        User     string `json:"user"`
+        Password string `json:"password"`
+    }
+    m := Mux{}
+    sink := NewRingSink(2)
+    m.SetDebugOptions(DebugOptions{Sink: sink})
+    m.HandleFunc("/login", &MD{},
+        Post(func(req *Request[Login, *MD]) error {
+            return Bypass(map[string]string{"user": req.Body.User, "token": "t0k3n"})
+        }, nil),
+    )
+    for i := 0; i < 3; i++ {
+        req, err := http.NewRequest("POST", "/login", strings.NewReader(`{"user":"alice","password":"hunter2"}`))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        req.Header.Set("Authorization", "Bearer abc")
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != 200 {
+            t.Errorf("unexpected response %d %s", rec.Code, rBody(rec.Body))
+        }
+    }
+    records := sink.Records()
+    if len(records) != 2 {
+        t.Fatalf("expected 2 records, got %d", len(records))
+    }
+    rec := records[1]
+    if rec.Pattern != "/login" || rec.Status != 200 ||
+       rec.RequestHeader.Get("Authorization") != "[REDACTED]" ||
+       rec.RequestBody != `{"password":"[REDACTED]","user":"alice"}` ||
+       rec.ResponseBody != `{"token":"[REDACTED]","user":"alice"}` {
+        t.Errorf("unexpected record %+v", rec)
+    }
+}
+
+func TestRedaction(t *testing.T) {
+    type MD struct{}
+    type Payment struct {
+        Card struct {
+            Number string `json:"number"`
+            Name   string `json:"name"`
+        } `json:"card"`
+        Pin int `json:"pin"`
+    }
+    m := Mux{}
+    sink := NewRingSink(4)
+    m.SetDebugOptions(DebugOptions{Sink: sink})
+    m.EnableDebugDecodeErrors(true, true)
+    m.SetRedaction(Redaction{AllowHeaders: []string{"Content-Type"}, Fields: []string{"card.number", "pin"}})
+    var buf bytes.Buffer
+    m.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+    m.HandleFunc("/pay", &MD{},
+        Post(func(req *Request[Payment, *MD]) error {
+            return nil
+        }, nil),
+    )
+    serve := func(body string) *httptest.ResponseRecorder {
+        req, err := http.NewRequest("POST", "/pay?token=abc&x=1", strings.NewReader(body))
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("X-Session", "s3cr3t")
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        return rec
+    }
+    serve(`{"card":{"number":"4242","name":"alice"},"pin":1}`)
+    rec := sink.Records()[0]
+    if rec.URL != "/pay?token=[REDACTED]&x=1" || rec.RequestHeader.Get("X-Session") != "[REDACTED]" ||
+       rec.RequestHeader.Get("Content-Type") != "application/json" ||
+       rec.RequestBody != `{"card":{"name":"alice","number":"[REDACTED]"},"pin":"[REDACTED]"}` {
+        t.Errorf("unexpected record %+v", rec)
+    }
+    res := serve(`{"pin":"1234"}`)
+    if body := rBody(res.Body); res.Code != 400 || strings.Contains(body, "1234") {
+        t.Errorf("expected the offending value to be redacted, got %d %s", res.Code, body)
+    }
+    if out := buf.String(); !strings.Contains(out, "token=[REDACTED]") || strings.Contains(out, "1234") {
+        t.Errorf("unexpected log output %q", out)
+    }
+
+    /* bodies cut short by MaxBodySize and forms are redacted too */
+    m = Mux{}
+    sink = NewRingSink(4)
+    m.SetDebugOptions(DebugOptions{Sink: sink, MaxBodySize: 64})
+    m.HandleFunc("/login", &MD{},
+        Post(func(req *Request[struct{ Password, Pad string }, *MD]) error {
+            return nil
+        }, nil),
+    )
+    for _, body := range []string{
+        `{"password":"hunter2","pad":"` + strings.Repeat("x", 200) + `"}`,
+        "pad=x&password=hunter2",
+    } {
+        req, err := http.NewRequest("POST", "/login", strings.NewReader(body))
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        m.ServeHTTP(httptest.NewRecorder(), req)
+    }
+    for i, rec := range sink.Records() {
+        if strings.Contains(rec.RequestBody, "hunter2") {
+            t.Errorf("%d: unredacted request body %q", i, rec.RequestBody)
+        }
+    }
+    if recs := sink.Records(); len(recs) != 2 || recs[1].RequestBody != "pad=x&password=[REDACTED]" {
+        t.Errorf("unexpected records %+v", recs)
+    }
+}
+
+func TestLogBodies(t *testing.T) {
+    type MD struct{}
+    type Login struct {
+        User     string `json:"user"`
+        Password string `json:"password"`
+    }
+    m := Mux{}
+    var buf bytes.Buffer
+    m.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+    m.HandleFunc("/login", &MD{},
+        Post(func(req *Request[Login, *MD]) error {
+            return Bypass(map[string]string{"user": req.Body.User, "greeting": strings.Repeat("hi", 20)})
+        }, nil, LogBodies(64)),
+    )
+    m.HandleFunc("/quiet", &MD{}, Post(func(req *Request[Login, *MD]) error { return nil }, nil))
+    for _, path := range []string{"/login", "/quiet"} {
+        req, err := http.NewRequest("POST", path, strings.NewReader(`{"user":"alice","password":"hunter2"}`))
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != 200 || (path == "/login" && !strings.Contains(rBody(rec.Body), `"user":"alice"`)) {
+            t.Errorf("%s: unexpected response %d", path, rec.Code)
+        }
+    }
+    var rec struct {
+        Msg               string `json:"msg"`
+        Pattern           string `json:"pattern"`
+        RequestBody       string `json:"request_body"`
+        ResponseBody      string `json:"response_body"`
+        ResponseTruncated bool   `json:"response_truncated"`
+    }
+    if n := strings.Count(buf.String(), "\n"); n != 1 {
+        t.Fatalf("expected one record, got %q", buf.String())
+    }
+    if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+        t.Fatalf("json decoding failed: %v", err)
+    }
+    if rec.Msg != "request bodies" || rec.Pattern != "/login" ||
+       rec.RequestBody != `{"password":"[REDACTED]","user":"alice"}` ||
+       !rec.ResponseTruncated || len(rec.ResponseBody) != 64 {
+        t.Errorf("unexpected record %+v", rec)
+    }
+}
+
+type auditMD struct {
+    ID   int
+    Name string
+    User string
+}
+
+func (md *auditMD) AuditActor() string {
+    return md.User
+}
+
+func TestAudited(t *testing.T) {
+    m := Mux{}
+    m.Before = func(w http.ResponseWriter, r *http.Request, md any, data any) error {
+        user := r.Header.Get("X-User")
+        if user == "" {
+            return ErrUnauthorized
+        }
+        md.(*auditMD).User = user
+        return nil
+    }
+    var events []AuditEvent
+    m.SetAuditSink(AuditSinkFunc(func(ev *AuditEvent) {
+        events = append(events, *ev)
+    }))
+    m.HandleFunc("/users/{id}", &auditMD{},
+        Delete(func(req *Request[EmptyBody, *auditMD]) error {
+            if req.Metadata.ID == 2 {
+                return errors.New("boom")
+            }
+            return nil
+        }, nil, Audited("user.delete")),
+        Get(func(req *Request[EmptyBody, *auditMD]) error { return nil }, nil),
+    )
+    m.HandleFunc("/files/{name}", &auditMD{},
+        Delete(func(req *Request[EmptyBody, *auditMD]) error { return nil }, nil, Audited("file.delete")),
+    )
+    serve := func(method, path, user string) {
+        req, err := http.NewRequest(method, path, nil)
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        req.Header.Set("X-User", user)
+        m.ServeHTTP(httptest.NewRecorder(), req)
+    }
+    serve("DELETE", "/users/1", "alice")
+    serve("DELETE", "/users/1", "")
+    serve("DELETE", "/users/2", "bob")
+    serve("GET", "/users/1", "alice")
+    serve("DELETE", "/files/a%2Fb", "alice")
+    if len(events) != 4 {
+        t.Fatalf("expected 4 events, got %+v", events)
+    }
+    if ev := events[0]; ev.Action != "user.delete" || ev.Actor != "alice" || ev.Pattern != "/users/{id}" ||
+       ev.Params["id"] != "1" || ev.Status != 200 || !ev.Success || ev.Err != "" {
+        t.Errorf("unexpected event %+v", ev)
+    }
+    if ev := events[1]; ev.Actor != "" || ev.Status != 401 || ev.Success {
+        t.Errorf("unexpected event %+v", ev)
+    }
+    if ev := events[2]; ev.Actor != "bob" || ev.Status != 500 || ev.Err != "boom" {
+        t.Errorf("unexpected event %+v", ev)
+    }
+    /* the params are those of the match, also for encoded slashes */
+    if ev := events[3]; ev.Pattern != "/files/{name}" || len(ev.Params) != 1 || ev.Params["name"] != "a/b" {
+        t.Errorf("unexpected event %+v", ev)
+    }
+}
+
+func TestTenants(t *testing.T) {
+    type MD struct {
+        Tenant TenantID
+        ID     int
+    }
+    h := func(req *Request[EmptyBody, *MD]) error {
+        if Tenant(req.HTTPReq) != req.Metadata.Tenant {
+            return errors.New("tenant mismatch")
+        }
+        return Bypass(map[string]any{"tenant": req.Metadata.Tenant, "id": req.Metadata.ID})
+    }
+    test := func(m *Mux, host, path, header string, expCode int, expBody string) {
+        req, err := http.NewRequest("GET", "http://" + host + path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        req.Header.Set("X-Tenant", header)
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if got := strings.TrimSpace(rBody(rec.Body)); rec.Code != expCode || (expBody != "" && got != expBody) {
+            t.Errorf("%s%s (%s): expected %d %s, got %d %s", host, path, header, expCode, expBody, rec.Code, got)
+        }
+    }
+    m := &Mux{}
+    m.SetTenants(TenantOptions{Domain: "example.com", Required: true})
+    m.HandleFunc("/users/{id}", &MD{}, Get(h, nil))
+    test(m, "acme.example.com:8080", "/users/1", "", 200, `{"id":1,"tenant":"acme"}`)
+    test(m, "example.com", "/users/1", "", 404, "")
+    test(m, "a.b.example.com", "/users/1", "", 404, "")
+
+    m = &Mux{}
+    m.SetTenants(TenantOptions{Header: "X-Tenant", Validate: func(r *http.Request, tenant TenantID) error {
+        if tenant != "acme" && tenant != "globex" {
+            return ErrForbidden
+        }
+        return nil
+    }})
+    m.HandleFunc("/users/{id}", &MD{}, Get(h, nil, TenantRateLimit(func(tenant TenantID) RateLimit {
+        if tenant == "acme" {
+            return RateLimit{Rate: 0.001, Burst: 2}
+        }
+        return RateLimit{Rate: 0.001, Burst: 1}
+    })))
+    test(m, "example.com", "/users/2", "initech", 403, "")
+    test(m, "example.com", "/users/2", "", 200, `{"id":2,"tenant":""}`)
+    test(m, "example.com", "/users/2", "acme", 200, `{"id":2,"tenant":"acme"}`)
+    test(m, "example.com", "/users/2", "acme", 200, "")
+    test(m, "example.com", "/users/2", "acme", 429, "")
+    test(m, "example.com", "/users/2", "globex", 200, "")
+    test(m, "example.com", "/users/2", "globex", 429, "")
+
+    m = &Mux{}
+    m.SetTenants(TenantOptions{PathPrefix: true})
+    m.HandleFunc("/users/{id}", &MD{}, Get(h, nil))
+    test(m, "example.com", "/acme/users/3", "", 200, `{"id":3,"tenant":"acme"}`)
+    test(m, "example.com", "/users/3", "", 404, "")
+}
+
+func TestSignedURL(t *testing.T) {
+    type MD struct {
+        ID int
+    }
+    h := func(req *Request[EmptyBody, *MD]) error {
+        return Bypass(map[string]any{"id": req.Metadata.ID, "name": req.HTTPReq.URL.Query().Get("name")})
+    }
+    m := &Mux{}
+    m.HandleFunc("/files/{id}", &MD{}, Get(h, nil, RequireSignedURL()), Put(h, nil, RequireSignedURL()))
+    if _, err := m.SignURL("GET", "/files/1", time.Minute); err != ErrNoURLSecret {
+        t.Errorf("expected ErrNoURLSecret, got %v", err)
+    }
+    m.SetURLSecret([]byte("0123456789abcdef0123456789abcdef"))
+    test := func(method, path string, expCode int, expBody string) {
+        req, err := http.NewRequest(method, "http://example.com" + path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if got := strings.TrimSpace(rBody(rec.Body)); rec.Code != expCode || (expBody != "" && got != expBody) {
+            t.Errorf("%s %s: expected %d %s, got %d %s", method, path, expCode, expBody, rec.Code, got)
+        }
+    }
+    signed, err := m.SignURL("GET", "/files/1?name=report.pdf", time.Minute)
+    if err != nil {
+        t.Fatalf("SignURL failed: %v", err)
+    }
+    test("GET", signed, 200, `{"id":1,"name":"report.pdf"}`)
+    test("GET", "/files/1?name=report.pdf", 403, "")
+    test("GET", strings.Replace(signed, "/files/1", "/files/2", 1), 403, "")
+    test("GET", strings.Replace(signed, "report.pdf", "other.pdf", 1), 403, "")
+    test("PUT", signed, 403, "")
+    expired, err := m.SignURL("GET", "/files/1", -time.Minute)
+    if err != nil {
+        t.Fatalf("SignURL failed: %v", err)
+    }
+    test("GET", expired, 403, "")
+}
+
+func TestConditionalOptions(t *testing.T) {
+    type Access struct {
+        Public bool
+    }
+    type MD struct {
+        ID int
+    }
+    h := func(req *Request[EmptyBody, *MD]) error {
+        return Bypass(map[string]any{"id": req.Metadata.ID})
+    }
+    m := &Mux{
+        Before: func(w http.ResponseWriter, r *http.Request, _, _ any) error {
+            md, ok := RouteMetadata[*MD](r)
+            if !ok {
+                return errors.New("no metadata")
+            }
+            if access, _ := RouteData[Access](r); !access.Public && md.ID == 13 {
+                return ErrForbidden
+            }
+            return nil
+        },
+    }
+    auth := BasicAuth(func(user, pass string) error {
+        if user != "admin" || pass != "secret" {
+            return errors.New("invalid credentials")
+        }
+        return nil
+    })
+    api := m.Group("/api", Unless(func(a Access) bool { return a.Public }, auth),
+                   When(func(a Access) bool { return a.Public }, Doc("public", "")))
+    api.HandleFunc("/public/{id}", &MD{}, Get(h, Access{Public: true}))
+    api.HandleFunc("/private/{id}", &MD{}, Get(h, Access{}))
+    api.HandleFunc("/other/{id}", &MD{}, Get(h, nil))
+    test := func(path string, authed bool, expCode int, expBody string) {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        if authed {
+            req.SetBasicAuth("admin", "secret")
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if got := strings.TrimSpace(rBody(rec.Body)); rec.Code != expCode || (expBody != "" && got != expBody) {
+            t.Errorf("%s: expected %d %s, got %d %s", path, expCode, expBody, rec.Code, got)
+        }
+    }
+    test("/api/public/1", false, 200, `{"id":1}`)
+    test("/api/public/13", false, 200, `{"id":13}`)
+    test("/api/private/1", false, 401, "")
+    test("/api/private/1", true, 200, `{"id":1}`)
+    test("/api/private/13", true, 403, "")
+    test("/api/other/1", false, 401, "")
+    for _, ri := range m.Routes() {
+        if exp := map[bool]string{true: "public"}[strings.HasPrefix(ri.Pattern, "/api/public")]; ri.Summary != exp {
+            t.Errorf("%s: expected summary %q, got %q", ri.Pattern, exp, ri.Summary)
+        }
+    }
+}
+
+func TestInternalRoutes(t *testing.T) {
+    type MD struct{}
+    h := func(req *Request[EmptyBody, *MD]) error {
+        return Bypass("ok")
+    }
+    m := &Mux{}
+    m.HandleFunc("/users", &MD{}, Get(h, nil))
+    m.HandleFunc("/metrics", &MD{}, Get(h, nil, Internal()))
+    m.HandleFunc("/jobs", &MD{}, Get(h, nil), Delete(h, nil, Internal()))
+    m.HandleReadiness("/ready", Internal())
+    m.EnableExpvar("/debug/vars", func(r *http.Request) error { return nil })
+    test := func(h http.Handler, method, path string, expCode int) {
+        req, err := http.NewRequest(method, path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s %s: expected %d, got %d", method, path, expCode, rec.Code)
+        }
+    }
+    pub, internal := m.PublicHandler(), m.InternalHandler()
+    for _, path := range []string{"/users", "/metrics", "/ready", "/debug/vars"} {
+        test(m, "GET", path, 200)
+    }
+    test(pub, "GET", "/users", 200)
+    test(pub, "GET", "/metrics", 404)
+    test(pub, "GET", "/ready", 404)
+    test(pub, "GET", "/debug/vars", 404)
+    test(pub, "GET", "/jobs", 200)
+    test(pub, "DELETE", "/jobs", 405)
+    test(internal, "GET", "/users", 404)
+    test(internal, "GET", "/metrics", 200)
+    test(internal, "GET", "/ready", 200)
+    test(internal, "GET", "/debug/vars", 200)
+    test(internal, "GET", "/jobs", 405)
+    test(internal, "DELETE", "/jobs", 200)
+    for _, ri := range m.Routes() {
+        if exp := ri.Pattern != "/users" && (ri.Pattern != "/jobs" || ri.Method == "DELETE"); ri.Internal != exp {
+            t.Errorf("%s %s: expected internal %v", ri.Method, ri.Pattern, exp)
+        }
+    }
+}
+
+func TestAdmin(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.EnableAdmin("/_cmux/", func(r *http.Request) error {
+        if r.Header.Get("Token") != "admin" {
+            return errors.New("not an admin")
+        }
+        return nil
+    })
+    m.HandleFunc("/fail", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return errors.New("boom")
+        }, nil),
+    )
+    serve := func(method, path, token, body string) *httptest.ResponseRecorder {
+        req, err := http.NewRequest(method, path, strings.NewReader(body))
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        req.Header.Set("Token", token)
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        return rec
+    }
+    if rec := serve("GET", "/_cmux/routes", "", ""); rec.Code != 403 {
+        t.Errorf("expected 403, got %d", rec.Code)
+    }
+    serve("GET", "/fail", "", "")
+    var errs []AdminError
+    rec := serve("GET", "/_cmux/errors", "admin", "")
+    if err := json.Unmarshal(rec.Body.Bytes(), &errs); err != nil || len(errs) != 1 ||
+       errs[0].Pattern != "/fail" || errs[0].Status != 500 {
+        t.Errorf("unexpected errors %d %s", rec.Code, rBody(rec.Body))
+    }
+    var timings map[string]TimingStats
+    rec = serve("GET", "/_cmux/timings", "admin", "")
+    if err := json.Unmarshal(rec.Body.Bytes(), &timings); err != nil || timings["GET /fail"].Count != 1 {
+        t.Errorf("unexpected timings %d %s", rec.Code, rBody(rec.Body))
+    }
+    if rec := serve("PUT", "/_cmux/debug", "admin", `{"debug_timings":true}`); rec.Code != 200 || !m.debugTimings.Load() {
+        t.Errorf("failed to toggle debug timings: %d %s", rec.Code, rBody(rec.Body))
+    }
+    var routes []RouteInfo
+    rec = serve("GET", "/_cmux/routes", "admin", "")
+    if err := json.Unmarshal(rec.Body.Bytes(), &routes); err != nil || len(routes) != 9 {
+        t.Errorf("unexpected routes %d %s", rec.Code, rBody(rec.Body))
+    }
+    if rec := serve("PUT", "/_cmux/maintenance", "admin", `{"enabled":true}`); rec.Code != 200 {
+        t.Errorf("failed to switch on maintenance mode: %d %s", rec.Code, rBody(rec.Body))
+    }
+    if rec := serve("GET", "/fail", "", ""); rec.Code != 503 {
+        t.Errorf("expected 503 in maintenance mode, got %d", rec.Code)
+    }
+    if rec := serve("GET", "/_cmux/maintenance", "admin", ""); rec.Code != 200 ||
+       strings.TrimSpace(rBody(rec.Body)) != `{"enabled":true,"allow":null}` {
+        t.Errorf("unexpected maintenance mode %d %s", rec.Code, rBody(rec.Body))
+    }
+}
+
+func TestMaintenance(t *testing.T) {
+    type MD struct {
+        ID int
+    }
+    h := func(req *Request[EmptyBody, *MD]) error {
+        return Bypass("ok")
+    }
+    m := &Mux{}
+    m.HandleFunc("/users/{id}", &MD{}, Get(h, nil))
+    m.HandleFunc("/status/db", &MD{}, Get(h, nil))
+    m.HandleFunc("/metrics", &MD{}, Get(h, nil, Internal()))
+    test := func(path string, expCode int, expRetry, expBody string) {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        got := strings.TrimSpace(rBody(rec.Body))
+        if rec.Code != expCode || rec.Header().Get("Retry-After") != expRetry || (expBody != "" && got != expBody) {
+            t.Errorf("%s: expected %d %q %s, got %d %q %s", path, expCode, expRetry, expBody,
+                     rec.Code, rec.Header().Get("Retry-After"), got)
+        }
+    }
+    test("/users/1", 200, "", `"ok"`)
+    m.SetMaintenance(true, "/status/")
+    test("/users/1", 503, "", `{"error":"maintenance"}`)
+    test("/status/db", 200, "", "")
+    test("/metrics", 200, "", "")
+    m.SetMaintenanceResponse(MaintenanceResponse{
+        Body:       map[string]string{"message": "back soon"},
+        RetryAfter: 90 * time.Second,
+    })
+    m.SetMaintenance(true, "/users/{id}")
+    test("/users/1", 200, "", "")
+    test("/status/db", 503, "90", `{"message":"back soon"}`)
+    if enabled, allow := m.Maintenance(); !enabled || len(allow) != 1 || allow[0] != "/users/{id}" {
+        t.Errorf("unexpected maintenance mode %v %v", enabled, allow)
+    }
+    m.SetMaintenance(false)
+    test("/status/db", 200, "", "")
+}
+
+func TestRouteTimeouts(t *testing.T) {
+    type MD struct{}
+    slow := func(req *Request[EmptyBody, *MD]) error {
+        time.Sleep(150 * time.Millisecond)
+        return Bypass("done")
+    }
+    m := Mux{}
+    m.HandleFunc("/slow", &MD{}, Get(slow, nil))
+    m.HandleFunc("/export", &MD{}, Get(slow, nil, WriteTimeout(time.Second)))
+    m.HandleFunc("/stream", &MD{}, Get(slow, nil, WriteTimeout(0)))
+    srv := httptest.NewUnstartedServer(&m)
+    srv.Config.WriteTimeout = 50 * time.Millisecond
+    srv.Start()
+    defer srv.Close()
+    if resp, err := http.Get(srv.URL + "/slow"); err == nil {
+        resp.Body.Close()
+        t.Errorf("expected the server write timeout to fail /slow, got %d", resp.StatusCode)
+    }
+    for _, path := range []string{"/export", "/stream"} {
+        resp, err := http.Get(srv.URL + path)
+        if err != nil {
+            t.Errorf("GET %s failed: %v", path, err)
+            continue
+        }
+        if body := strings.TrimSpace(rBody(resp.Body)); resp.StatusCode != 200 || body != `"done"` {
+            t.Errorf("%s: expected 200 \"done\", got %d %s", path, resp.StatusCode, body)
+        }
+        resp.Body.Close()
+    }
+}
+
+func TestExpectContinue(t *testing.T) {
+    type MD struct{}
+    upload := func(req *StreamRequest[*MD]) error {
+        b, err := io.ReadAll(req.Body)
+        if err != nil {
+            return err
+        }
+        return Bypass(map[string]int{"size": len(b)})
+    }
+    auth := Before(func(w http.ResponseWriter, r *http.Request, md *MD) error {
+        if r.Header.Get("Token") != "secret" {
+            return ErrUnauthorized
+        }
+        return nil
+    })
+    m := Mux{}
+    var buf bytes.Buffer
+    m.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+    m.HandleFunc("/uploads", &MD{}, PutStream(upload, nil, auth, MaxBodySize(10), LogBodies(64),
+        ExpectContinue(func(r *http.Request) error {
+            if r.Header.Get("Content-Type") != "text/plain" {
+                return errors.New("unsupported content type")
+            }
+            return nil
+        })))
+    req, err := http.NewRequest("PUT", "/uploads", strings.NewReader("hello"))
+    if err != nil {
+        t.Fatalf("http.NewRequest failed: %v", err)
+    }
+    req.Header.Set("Token", "secret")
+    req.Header.Set("Expect", "100-continue")
+    req.Header.Set("Content-Type", "text/plain")
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if got := strings.TrimSpace(rBody(rec.Body)); rec.Code != 200 || got != `{"size":5}` {
+        t.Errorf("expected 200 {\"size\":5}, got %d %s", rec.Code, got)
+    }
+    if !strings.Contains(buf.String(), `"request_body":"hello"`) {
+        t.Errorf("expected the request body to be logged as read, got %s", buf.String())
+    }
+    req.Header.Del("Expect")
+    req.Header.Set("Content-Type", "application/json")
+    rec = httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != 400 {
+        t.Errorf("expected 400 for a failed check without Expect, got %d", rec.Code)
+    }
+
+    /* debug traces and captures must not read ahead of the checks */
+    sink := NewRingSink(8)
+    m.SetDebugOptions(DebugOptions{Sink: sink})
+    var captured lockedBuffer
+    m.StartCapture(&captured, 0)
+    srv := httptest.NewServer(&m)
+    defer srv.Close()
+    send := func(header string, length int) (*bufio.Reader, net.Conn, string) {
+        conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+        if err != nil {
+            t.Fatalf("net.Dial failed: %v", err)
+        }
+        fmt.Fprintf(conn, "PUT /uploads HTTP/1.1\r\nHost: example.com\r\nExpect: 100-continue\r\n" +
+                    "Content-Length: %d\r\n%s\r\n", length, header)
+        br := bufio.NewReader(conn)
+        line, err := br.ReadString('\n')
+        if err != nil {
+            t.Fatalf("reading the status line failed: %v", err)
+        }
+        return br, conn, strings.TrimSpace(line)
+    }
+    for _, c := range []struct{
+        header  string
+        length  int
+        expLine string
+    }{
+        {"Content-Type: text/plain\r\n", 5, "HTTP/1.1 401 Unauthorized"},
+        {"Token: secret\r\nContent-Type: text/plain\r\n", 100, "HTTP/1.1 413 Request Entity Too Large"},
+        {"Token: secret\r\nContent-Type: image/png\r\n", 5, "HTTP/1.1 417 Expectation Failed"},
+    } {
+        _, conn, line := send(c.header, c.length)
+        conn.Close()
+        if line != c.expLine {
+            t.Errorf("%q: expected %q, got %q", c.header, c.expLine, line)
+        }
+    }
+    br, conn, line := send("Token: secret\r\nContent-Type: text/plain\r\n", 5)
+    defer conn.Close()
+    if line != "HTTP/1.1 100 Continue" {
+        t.Fatalf("expected 100 Continue, got %q", line)
+    }
+    if _, err := br.ReadString('\n'); err != nil {
+        t.Fatalf("reading the interim response failed: %v", err)
+    }
+    conn.Write([]byte("hello"))
+    res, err := http.ReadResponse(br, nil)
+    if err != nil {
+        t.Fatalf("http.ReadResponse failed: %v", err)
+    }
+    defer res.Body.Close()
+    if got := strings.TrimSpace(rBody(res.Body)); res.StatusCode != 200 || got != `{"size":5}` {
+        t.Errorf("expected 200 {\"size\":5}, got %d %s", res.StatusCode, got)
+    }
+    /* the trace and capture are recorded after the response */
+    for i := 0; i < 100 && !strings.Contains(captured.String(), `"status":200`); i++ {
+        time.Sleep(time.Millisecond)
+    }
+    records := sink.Records()
+    if len(records) == 0 || records[len(records) - 1].RequestBody != "hello" {
+        t.Errorf("expected the request body to be traced as read, got %+v", records)
+    }
+    captures, err := ReadCaptures(strings.NewReader(captured.String()))
+    if err != nil || len(captures) != 1 || string(captures[0].Body) != "hello" {
+        t.Errorf("expected only the read request body to be captured, got %+v %v", captures, err)
+    }
+}
+
+/* lockedBuffer is a bytes.Buffer safe for concurrent use */
+type lockedBuffer struct {
+    mutex sync.Mutex
+    buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return b.buf.String()
+}
+
+func TestTrailers(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.HandleFunc("/export", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            tr := DeclareTrailers(req.ResponseWriter, "x-record-count", "X-Checksum")
+            return StreamNDJSON(func(yield func(int) bool) {
+                n := 0
+                for i := range 3 {
+                    if !yield(i) {
+                        return
+                    }
+                    n++
+                }
+                tr.Set("X-Record-Count", strconv.Itoa(n))
+                tr.Set("X-Checksum", "abc")
+                tr.Add("X-Undeclared", "1")
+            })
+        }, nil),
+    )
+    srv := httptest.NewServer(&m)
+    defer srv.Close()
+    res, err := http.Get(srv.URL + "/export")
+    if err != nil {
+        t.Fatalf("http.Get failed: %v", err)
+    }
+    defer res.Body.Close()
+    if _, ok := res.Trailer["X-Record-Count"]; !ok {
+        t.Errorf("expected X-Record-Count to be declared, got %v", res.Trailer)
+    }
+    if body := rBody(res.Body); body != "0\n1\n2\n" {
+        t.Errorf("unexpected body %q", body)
+    }
+    if got := res.Trailer.Get("X-Record-Count"); got != "3" {
+        t.Errorf("expected record count 3, got %q", got)
+    }
+    if got := res.Trailer.Get("X-Checksum"); got != "abc" {
+        t.Errorf("expected checksum abc, got %q", got)
+    }
+    if got := res.Trailer.Get("X-Undeclared"); got != "1" {
+        t.Errorf("expected undeclared trailer 1, got %q", got)
+    }
+}
+
+func TestMaxResponseSize(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    var buf bytes.Buffer
+    m.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+    m.SetMaxResponseSize(64)
+    m.HandleFunc("/small", &MD{}, Get(func(req *Request[EmptyBody, *MD]) error {
+        return Bypass(map[string]string{"name": "x"})
+    }, nil))
+    m.HandleFunc("/large", &MD{}, Get(func(req *Request[EmptyBody, *MD]) error {
+        return Bypass(map[string]string{"name": strings.Repeat("x", 100)})
+    }, nil))
+    m.HandleFunc("/bytes", &MD{}, Get(func(req *Request[EmptyBody, *MD]) error {
+        return Bypass([]byte(strings.Repeat("x", 100)))
+    }, nil))
+    m.HandleFunc("/export", &MD{}, Get(func(req *Request[EmptyBody, *MD]) error {
+        return Bypass(map[string]string{"name": strings.Repeat("x", 100)})
+    }, nil, MaxResponseSize(1024)))
+    m.HandleFunc("/stream", &MD{}, Get(func(req *Request[EmptyBody, *MD]) error {
+        return StreamNDJSON(slices.Values([]string{strings.Repeat("a", 40), strings.Repeat("b", 40)}))
+    }, nil))
+    test := func(path string, expCode int, expBody string) {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if got := rBody(rec.Body); rec.Code != expCode || (expBody != "" && strings.TrimSpace(got) != expBody) {
+            t.Errorf("%s: expected %d %s, got %d %s", path, expCode, expBody, rec.Code, got)
+        }
+    }
+    test("/small", 200, `{"name":"x"}`)
+    test("/large", 500, `{"error":"response too large"}`)
+    test("/bytes", 500, `{"error":"response too large"}`)
+    test("/export", 200, "")
+    test("/stream", 200, `"` + strings.Repeat("a", 40) + `"` + "\n" + `"` + strings.Repeat("b", 20))
+    if n := strings.Count(buf.String(), `"msg":"response too large"`); n != 2 {
+        t.Errorf("expected 2 oversized responses to be logged, got %d: %s", n, buf.String())
+    }
+    if !strings.Contains(buf.String(), `"msg":"response truncated"`) {
+        t.Errorf("expected the truncated stream to be logged, got %s", buf.String())
+    }
+}
+
+func TestExplain(t *testing.T) {
+    type MD struct {
+        ID   int
+        Name string
+    }
+    m := Mux{}
+    m.HandleFunc("/users/{id}/posts", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return nil
+        }, nil),
+    )
+    m.HandleFunc("/users/{name}/profile", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return nil
+        }, nil),
+    )
+    res := m.Explain("GET", "/users/alice/profile")
+    if res.Status != 0 || res.Pattern != "/users/{name}/profile" || res.Vars["name"] != "alice" {
+        t.Errorf("unexpected match %+v", res)
+    }
+    rejected := false
+    for _, a := range res.Attempts {
+        if a.Candidate == "{id}" && !a.Accepted && strings.HasPrefix(a.Reason, "parse error") {
+            rejected = true
+        }
+    }
+    if !rejected {
+        t.Errorf("expected {id} to be rejected, got %+v", res.Attempts)
+    }
+    res = m.Explain("GET", "/users/7/posts")
+    if res.Status != 0 || res.Vars["id"] != 7 {
+        t.Errorf("unexpected match %+v", res)
+    }
+    if res := m.Explain("POST", "/users/7/posts"); res.Status != 405 {
+        t.Errorf("expected 405, got %+v", res)
+    }
+    if res := m.Explain("GET", "/users/7/missing"); res.Status != 404 {
+        t.Errorf("expected 404, got %+v", res)
+    }
+
+    /* paths are split and cleaned like by ServeHTTP */
+    m.HandleFunc("/files/{name}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return nil
+        }, nil),
+    )
+    if res := m.Explain("GET", "/files/a%2Fb"); res.Status != 0 || res.Vars["name"] != "a/b" {
+        t.Errorf("unexpected match of encoded slash %+v", res)
+    }
+    if _, vars, ok := m.Match("GET", "/users/x/../7/posts"); !ok || vars["id"] != "7" {
+        t.Errorf("unexpected match of dot segments %v %v", vars, ok)
+    }
+    if res := m.Explain("GET", "/files/%zz"); res.Status != 400 {
+        t.Errorf("expected 400 for invalid escape, got %+v", res)
+    }
+    m.EnableMatrixParams(true)
+    if res := m.Explain("GET", "/files/x;v=1"); res.Status != 0 || res.Vars["name"] != "x" {
+        t.Errorf("unexpected match of matrix params %+v", res)
+    }
+    m.SetPathNormalization(NormalizeRedirect)
+    if res := m.Explain("GET", "/a/../files/x"); res.Status != 301 {
+        t.Errorf("expected redirect, got %+v", res)
+    }
+    m.SetEncodedSlashes(EncodedSlashReject)
+    if res := m.Explain("GET", "/files/a%2Fb"); res.Status != 400 {
+        t.Errorf("expected encoded slash to be rejected, got %+v", res)
+    }
+}
+
+func TestTimingHistograms(t *testing.T) {
+    type MD struct{}
+    m := Mux{}
+    m.EnableTimingHistograms(true)
+    m.HandleFunc("/sleep", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            time.Sleep(2 * time.Millisecond)
+            return nil
+        }, nil),
+    )
+    for i := 0; i < 3; i++ {
+        req, err := http.NewRequest("GET", "/sleep", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        m.ServeHTTP(httptest.NewRecorder(), req)
+    }
+    ts, ok := m.TimingHistograms()["GET /sleep"]
+    if !ok || ts.Count != 3 || ts.P50 < 2 || ts.Mean < 2 {
+        t.Errorf("unexpected timings %+v", ts)
+    }
+    var buf bytes.Buffer
+    m.DumpTimings(&buf)
+    if !strings.HasPrefix(buf.String(), "GET /sleep count=3 ") {
+        t.Errorf("unexpected dump %q", buf.String())
+    }
+}
+
+func TestSetLogger(t *testing.T) {
+    type MD struct{}
+    type Item struct {
+        N int `json:"n"`
+    }
+    m := Mux{}
+    m.HandleFunc("/items", &MD{},
+        Post(func(req *Request[Item, *MD]) error {
+            return errors.New("boom")
+        }, nil),
+    )
+    var buf bytes.Buffer
+    serve := func(body string) {
+        req, err := http.NewRequest("POST", "/items", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        m.ServeHTTP(httptest.NewRecorder(), req)
+    }
+    m.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+    serve(`{"n":"x"}`)
+    serve(`{"n":1}`)
+    out := buf.String()
+    if !strings.Contains(out, "level=WARN msg=\"failed to decode request body\"") ||
+       !strings.Contains(out, "level=ERROR msg=\"unexpected error\"") ||
+       strings.Contains(out, "route matched") {
+        t.Errorf("unexpected log output %q", out)
+    }
+}
+
+func TestLogSampling(t *testing.T) {
+    type MD struct{}
+    type Item struct {
+        N int `json:"n"`
+    }
+    m := Mux{}
+    m.HandleFunc("/items", &MD{}, Post(func(req *Request[Item, *MD]) error { return nil }, nil))
+    var buf bytes.Buffer
+    m.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+    m.SetLogSampling(LogSampling{First: 2, Interval: time.Minute})
+    now := time.Now()
+    m.logSampler.now = func() time.Time { return now }
+    serve := func(n int) {
+        for range n {
+            req, err := http.NewRequest("POST", "/items", strings.NewReader(`{"n":"x"}`))
+            if err != nil {
+                t.Errorf("http.NewRequest failed: %v", err)
+                return
+            }
+            m.ServeHTTP(httptest.NewRecorder(), req)
+        }
+    }
+    serve(5)
+    if out := buf.String(); strings.Count(out, "failed to decode") != 2 || strings.Count(out, "route matched") != 5 {
+        t.Errorf("expected 2 decode failures and every debug record logged, got %q", out)
+    }
+    buf.Reset()
+    now = now.Add(time.Minute)
+    serve(1)
+    if out := buf.String(); strings.Count(out, "failed to decode") != 1 || !strings.Contains(out, "suppressed=3") {
+        t.Errorf("expected the count of suppressed records, got %q", out)
+    }
+
+    /* audit records are never sampled */
+    m.HandleFunc("/audited", &MD{},
+        Delete(func(req *Request[EmptyBody, *MD]) error { return nil }, nil, Audited("item.delete")),
+    )
+    buf.Reset()
+    for range 5 {
+        req, err := http.NewRequest("DELETE", "/audited", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        m.ServeHTTP(httptest.NewRecorder(), req)
+    }
+    if n := strings.Count(buf.String(), "msg=audit"); n != 5 {
+        t.Errorf("expected 5 audit records, got %d", n)
+    }
+}
+
+func TestError(t *testing.T) {
+    type MD struct {
+        ID int
+    }
+    m := Mux{}
+    m.HandleFunc("/users/{id}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return ErrNotFound.WithMessage("user not found").WithDetail("id", req.Metadata.ID)
+        }, nil),
+    )
+    req, err := http.NewRequest("GET", "/users/7", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != 404 || strings.TrimSpace(rBody(rec.Body)) != `{"error":"user not found","code":"not_found","details":{"id":7}}` {
+        t.Errorf("unexpected response %d %s", rec.Code, rBody(rec.Body))
+    }
+    if !errors.Is(ErrNotFound.WithDetail("id", 1), ErrNotFound) || !errors.Is(HTTPError("", 404), ErrNotFound) ||
+       errors.Is(ErrNotFound, ErrForbidden) || errors.Is(NewError(404, "other", ""), ErrNotFound) {
+        t.Errorf("unexpected errors.Is results")
+    }
+    /* refined codes still match the sentinel they were derived from */
+    refined := ErrNotFound.WithCode("user_not_found")
+    if !errors.Is(refined, ErrNotFound) || !errors.Is(refined.WithMessage("user not found"), ErrNotFound) ||
+       !errors.Is(refined.WithMessage("user not found"), refined) || errors.Is(ErrNotFound, refined) ||
+       errors.Is(refined, ErrNotFound.WithCode("other")) {
+        t.Errorf("unexpected errors.Is results of refined codes")
+    }
+    cause := errors.New("db down")
+    if e := WrapError(cause, 503); !errors.Is(e, cause) || e.Error() != "db down" {
+        t.Errorf("unexpected wrapped error %v", e)
+    }
+}
+
+func TestLocalizer(t *testing.T) {
+    type MD struct{}
+    type Item struct {
+        N int `json:"n"`
+    }
+    m := Mux{}
+    m.SetLocalizer(func(langs []string, key, msg string) string {
+        if len(langs) == 0 || langs[0] != "de" {
+            return msg
+        }
+        switch key {
+        case "decode_failed":
+            return "Ungültiger Inhalt"
+        case "not_found":
+            return "Nicht gefunden"
+        case "status.404":
+            return "Seite nicht gefunden"
+        }
+        return msg
+    })
+    m.HandleFunc("/items", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return ErrNotFound
+        }, nil),
+        Post(func(req *Request[Item, *MD]) error {
+            return nil
+        }, nil),
+    )
+    test := func(method, path, lang, body, expBody string) {
+        req, err := http.NewRequest(method, path, strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        req.Header.Set("Accept-Language", lang)
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if got := strings.TrimSpace(rBody(rec.Body)); got != expBody {
+            t.Errorf("%s %s (%s): expected %s, got %s", method, path, lang, expBody, got)
+        }
+    }
+    test("GET", "/items", "en;q=0.5, de", "", `{"error":"Nicht gefunden","code":"not_found"}`)
+    test("GET", "/items", "en", "", `{"error":"Not Found","code":"not_found"}`)
+    test("POST", "/items", "de", `{"n":"x"}`,
+         `{"error":"Ungültiger Inhalt","path":"n","expected":"integer","value":"string"}`)
+    test("GET", "/missing", "de", "", "Seite nicht gefunden")
+}
+
+type validationError struct {
+    Field string
+}
+
+func (e *validationError) Error() string {
+    return "invalid " + e.Field
+}
+
+func TestMapError(t *testing.T) {
+    type MD struct {
+        ID int
+    }
+    errNoRows := errors.New("no rows in result set")
+    m := Mux{}
+    m.MapError(errNoRows, http.StatusNotFound, nil)
+    MapErrorType(&m, http.StatusUnprocessableEntity, func(err *validationError) any {
+        return map[string]string{"field": err.Field}
+    })
+    m.HandleFunc("/items/{id}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            switch req.Metadata.ID {
+            case 1:
+                return fmt.Errorf("loading item: %w", errNoRows)
+            case 2:
+                return fmt.Errorf("checking item: %w", &validationError{"name"})
+            }
+            return errors.New("other")
+        }, nil),
+    )
+    test := func(path string, expCode int, expBody string) {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode || strings.TrimSpace(rBody(rec.Body)) != expBody {
+            t.Errorf("%s: unexpected response %d %s", path, rec.Code, rBody(rec.Body))
+        }
+    }
+    test("/items/1", 404, `{"error":"Not Found"}`)
+    test("/items/2", 422, `{"field":"name"}`)
+    test("/items/3", 500, `{"error":"internal server error"}`)
+}
+
+func TestRoleFiltering(t *testing.T) {
+    type MD struct{}
+    type Audit struct {
+        CreatedBy string `json:"created_by"`
+    }
+    type User struct {
+        Name   string   `json:"name"`
+        Email  string   `json:"email" cmux_expose:"admin,self"`
+        Tokens []string `json:"tokens,omitempty" cmux_expose:"admin"`
+        Audit
+    }
+    m := Mux{}
+    m.HandleFunc("/users", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass([]User{{"alice", "a@x", []string{"t"}, Audit{"root"}}})
+        }, nil, Before(func(w http.ResponseWriter, r *http.Request, md *MD) error {
+            if role := r.Header.Get("Role"); role != "" {
+                SetRoles(r, role)
+            }
+            return nil
+        })),
+    )
+    test := func(role, expBody string) {
+        req, err := http.NewRequest("GET", "/users", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        req.Header.Set("Role", role)
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if got := strings.TrimSpace(rBody(rec.Body)); got != expBody {
+            t.Errorf("role %q: expected %s, got %s", role, expBody, got)
+        }
+    }
+    test("", `[{"name":"alice","created_by":"root"}]`)
+    test("self", `[{"name":"alice","email":"a@x","created_by":"root"}]`)
+    test("admin", `[{"name":"alice","email":"a@x","tokens":["t"],"created_by":"root"}]`)
+
+    /* recursive types are filtered at every depth */
+    type Node struct {
+        Name     string  `json:"name"`
+        Children []*Node `json:"children,omitempty"`
+        Secret   string  `json:"secret,omitempty" cmux_expose:"admin"`
+    }
+    m.HandleFunc("/tree", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass(&Node{"root", []*Node{{"leaf", nil, "s2"}}, "s1"})
+        }, nil),
+    )
+    req, err := http.NewRequest("GET", "/tree", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if got, exp := strings.TrimSpace(rBody(rec.Body)), `{"name":"root","children":[{"name":"leaf"}]}`; got != exp {
+        t.Errorf("tree: expected %s, got %s", exp, got)
+    }
+
+    /* values in interfaces are filtered by their dynamic type, and the
+     * encoding options of filtered types are kept */
+    type Ticket struct {
+        ID     int       `json:"id,string"`
+        Due    time.Time `json:"due,omitzero"`
+        Note   string    `json:"note" cmux_expose:"admin"`
+    }
+    m.HandleFunc("/any", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass(map[string]any{
+                "user":    User{"bob", "b@x", nil, Audit{"root"}},
+                "tickets": []any{Ticket{ID: 7, Note: "n"}},
+            })
+        }, nil),
+    )
+    req, err = http.NewRequest("GET", "/any", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec = httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if got, exp := strings.TrimSpace(rBody(rec.Body)),
+       `{"tickets":[{"id":"7"}],"user":{"name":"bob","created_by":"root"}}`; got != exp {
+        t.Errorf("any: expected %s, got %s", exp, got)
+    }
+}
+
+func TestSparseFieldsets(t *testing.T) {
+    type MD struct{}
+    type Owner struct {
+        Name  string `json:"name"`
+        Email string `json:"email"`
+    }
+    type Repo struct {
+        ID    int    `json:"id"`
+        Name  string `json:"name"`
+        Owner Owner  `json:"owner"`
+        Stars int    `json:"stars"`
+    }
+    m := Mux{}
+    m.HandleFunc("/repos", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass([]Repo{{1, "cmux", Owner{"cb", "cb@x"}, 5}})
+        }, nil, SparseFieldsets(true)),
+    )
+    m.HandleFunc("/missing", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return ErrNotFound
+        }, nil, SparseFieldsets(true)),
+    )
+    test := func(url, expBody string) {
+        req, err := http.NewRequest("GET", url, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if got := strings.TrimSpace(rBody(rec.Body)); got != expBody {
+            t.Errorf("%s: expected %s, got %s", url, expBody, got)
+        }
+    }
+    test("/repos?fields=id,owner.name", `[{"id":1,"owner":{"name":"cb"}}]`)
+    test("/repos?fields=name,owner", `[{"name":"cmux","owner":{"name":"cb","email":"cb@x"}}]`)
+    test("/repos", `[{"id":1,"name":"cmux","owner":{"name":"cb","email":"cb@x"},"stars":5}]`)
+    test("/missing?fields=id", `{"error":"Not Found","code":"not_found"}`)
+}
+
+func TestPagination(t *testing.T) {
+    type MD struct {
+        Page
+        Query string `query:"q"`
+    }
+    items := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+    m := Mux{}
+    m.HandleFunc("/items", &MD{Page: Page{Limit: 3, MaxLimit: 5}},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            p := req.Metadata.Page
+            total := len(items)
+            end := min(p.Offset + p.Limit, total)
+            return &Paginated[int]{
+                Items: items[min(p.Offset, total):end],
+                Total: &total,
+                Page:  p,
+            }
+        }, nil),
+    )
+    test := func(url string, expCode int, expBody string, expLinks []string) {
+        req, err := http.NewRequest("GET", url, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode || (expBody != "" && strings.TrimSpace(rBody(rec.Body)) != expBody) ||
+           !reflect.DeepEqual(rec.Header().Values("Link"), expLinks) {
+            t.Errorf("%s: unexpected response %d %s %v", url, rec.Code, rBody(rec.Body), rec.Header().Values("Link"))
+        }
+    }
+    test("/items", 200, `{"items":[0,1,2],"total":10}`,
+         []string{`</items?limit=3&offset=3>; rel="next"`})
+    test("/items?offset=8&limit=2&q=x", 200, `{"items":[8,9],"total":10}`,
+         []string{`</items?limit=2&offset=6&q=x>; rel="prev"`})
+    test("/items?limit=6", 400, "", nil)
+    test("/items?offset=-1", 400, "", nil)
+}
+
+func TestQueryBinding(t *testing.T) {
+    type MD struct {
+        Q      string   `query:"q"`
+        Tags   []string `query:"tag"`
+        Min    *int     `query:"min"`
+        Strict bool     `query:"strict"`
+    }
+    m := Mux{}
+    var got MD
+    m.HandleFunc("/search", &MD{Tags: []string{"default"}},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            got = *req.Metadata
+            return nil
+        }, nil),
+    )
+    req, err := http.NewRequest("GET", "/search?q=cake&tag=a,b&tag=c&min=3&strict=true", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != 200 || got.Q != "cake" || !reflect.DeepEqual(got.Tags, []string{"a", "b", "c"}) ||
+       got.Min == nil || *got.Min != 3 || !got.Strict {
+        t.Errorf("unexpected binding %d %+v", rec.Code, got)
+    }
+    req, err = http.NewRequest("GET", "/search?min=x", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec = httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != 400 || !reflect.DeepEqual(got.Tags, []string{"a", "b", "c"}) {
+        t.Errorf("unexpected response %d %s", rec.Code, rBody(rec.Body))
+    }
+}
+
+func TestVersion(t *testing.T) {
+    type MD struct {
+        ID int
+    }
+    h := func(name string) func(req *Request[EmptyBody, *MD]) error {
+        return func(req *Request[EmptyBody, *MD]) error {
+            return Bypass(name)
+        }
+    }
+    m := Mux{}
+    v1 := m.Version("v1")
+    v1.HandleFunc("/users/{id}", &MD{}, Get(h("v1"), nil), Delete(h("v1"), nil))
+    v1.HandleFunc("/legacy", &MD{}, Get(h("v1"), nil))
+    v2 := m.Version("v2")
+    v2.HandleFunc("/users/{userid}", &struct{ UserID int }{}, Get(func(req *Request[EmptyBody, *struct{ UserID int }]) error {
+        return Bypass("v2")
+    }, nil))
+    v2.HandleFunc("/legacy", &MD{}, Get(h("v2"), nil))
+    v3 := m.Version("v3")
+    v3.HandleFunc("/users/{id}", &MD{}, Get(h("v3"), nil))
+    if m.Version("v1") != v1 {
+        t.Errorf("expected the existing version group")
+    }
+    since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    v1.Deprecate(Deprecation{Since: since, Sunset: since.AddDate(1, 0, 0), Link: "https://example.com/migrate"})
+    v2.Deprecate(Deprecation{})
+    test := func(path, expBody string, expHeader http.Header) {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if got := strings.TrimSpace(rBody(rec.Body)); rec.Code != 200 || got != expBody {
+            t.Errorf("%s: expected 200 %s, got %d %s", path, expBody, rec.Code, got)
+        }
+        for _, name := range []string{"Deprecation", "Sunset", "Link"} {
+            if got := rec.Header().Get(name); got != expHeader.Get(name) {
+                t.Errorf("%s: expected %s %q, got %q", path, name, expHeader.Get(name), got)
+            }
+        }
+    }
+    test("/v1/users/1", `"v1"`, http.Header{
+        "Deprecation": {"@1704067200"},
+        "Sunset":      {"Wed, 01 Jan 2025 00:00:00 GMT"},
+        "Link":        {`<https://example.com/migrate>; rel="deprecation"`},
+    })
+    test("/v2/users/1", `"v2"`, http.Header{"Deprecation": {"true"}})
+    test("/v3/users/1", `"v3"`, http.Header{})
+    report := m.VersionReport()
+    exp := []VersionedRoute{
+        {Method: "GET", Path: "/legacy", Versions: []string{"v1", "v2"}},
+        {Method: "DELETE", Path: "/users/{id}", Versions: []string{"v1"}},
+    }
+    if !reflect.DeepEqual(report, exp) {
+        t.Errorf("expected report %v, got %v", exp, report)
+    }
+}
+
+func TestSortFilter(t *testing.T) {
+    type MD struct {
+        Sort   Sort   `allow:"created_at,name"`
+        Filter Filter `allow:"status,price"`
+    }
+    m := Mux{}
+    var got MD
+    m.HandleFunc("/orders", &MD{Sort: Sort{{Field: "created_at", Desc: true}}},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            got = *req.Metadata
+            return nil
+        }, nil),
+    )
+    test := func(url string, expCode int) {
+        req, err := http.NewRequest("GET", url, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s: expected %d, got %d %s", url, expCode, rec.Code, rBody(rec.Body))
+        }
+    }
+    test("/orders?sort=-created_at,name&filter[status]=active&filter[price][lt]=100", 200)
+    expSort := Sort{{"created_at", true}, {"name", false}}
+    expFilter := Filter{{"price", "lt", "100"}, {"status", "eq", "active"}}
+    if !reflect.DeepEqual(got.Sort, expSort) || !reflect.DeepEqual(got.Filter, expFilter) {
+        t.Errorf("unexpected binding %+v", got)
+    }
+    if v, ok := got.Filter.Get("status"); !ok || v != "active" {
+        t.Errorf("unexpected status filter %q", v)
+    }
+    test("/orders", 200)
+    if !reflect.DeepEqual(got.Sort, Sort{{"created_at", true}}) || got.Filter != nil {
+        t.Errorf("expected template defaults, got %+v", got)
+    }
+    test("/orders?sort=password", 400)
+    test("/orders?filter[secret]=x", 400)
+    test("/orders?filter[price][regex]=x", 400)
+}
+
+func TestMatchHeader(t *testing.T) {
+    m := Mux{}
+    v1 := func(req *Request[EmptyBody, *struct{}]) error { return Bypass("v1") }
+    v2 := func(req *Request[EmptyBody, *struct{}]) error { return Bypass("v2") }
+    m.HandleFunc("/users", &struct{}{},
+        Get(v2, nil, MatchHeader("Accept", "application/vnd.myapi.v2+json")),
+        Get(v1, nil),
+    )
+    m.HandleFunc("/strict", &struct{}{},
+        Get(v2, nil, MatchHeader("X-Version", "2")),
+    )
+    test := func(path, accept, expBody string, expCode int) {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        if accept != "" {
+            req.Header.Set("Accept", accept)
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        body := strings.TrimSpace(rBody(rec.Body))
+        if rec.Code != expCode || (expBody != "" && body != expBody) {
+            t.Errorf("%s %q: expected %d %s, got %d %s", path, accept, expCode, expBody, rec.Code, body)
+        }
+        if rec.Header().Get("Vary") == "" {
+            t.Errorf("%s: expected Vary header", path)
+        }
+    }
+    test("/users", "application/vnd.myapi.v2+json", `"v2"`, 200)
+    test("/users", "text/html, application/vnd.MyApi.v2+json;q=0.9", `"v2"`, 200)
+    test("/users", "application/json", `"v1"`, 200)
+    test("/users", "", `"v1"`, 200)
+    test("/strict", "", "", 406)
+    if routes := m.Routes(); len(routes) != 3 {
+        t.Errorf("expected 3 routes, got %+v", routes)
+    }
+}
+
+func TestFeatureGate(t *testing.T) {
+    m := Mux{}
+    h := func(req *Request[EmptyBody, *struct{}]) error { return nil }
+    m.HandleFunc("/beta", &struct{}{}, Get(h, nil, FeatureGate("beta")))
+    m.HandleFunc("/admin", &struct{}{}, Get(h, nil, FeatureGateForbidden("admin")))
+    test := func(path, user string, expCode int) {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        req.Header.Set("X-User", user)
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s as %q: expected %d, got %d %s", path, user, expCode, rec.Code, rBody(rec.Body))
+        }
+    }
+    /* without a provider every gate is closed */
+    test("/beta", "alice", 404)
+    m.SetFeatureFlags(FeatureFlagsFunc(func(r *http.Request, name string) bool {
+        return r.Header.Get("X-User") == "alice"
+    }))
+    test("/beta", "alice", 200)
+    test("/beta", "bob", 404)
+    test("/admin", "alice", 200)
+    test("/admin", "bob", 403)
+}
+
+func TestMirror(t *testing.T) {
+    type Body struct {
+        Name string `json:"name"`
+    }
+    mirrored := make(chan string, 1)
+    shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        b, _ := io.ReadAll(r.Body)
+        mirrored <- r.Method + " " + r.URL.RequestURI() + " " + string(b)
+        w.WriteHeader(500)
+    }))
+    defer shadow.Close()
+    m := Mux{}
+    var got string
+    m.HandleFunc("/orders", &struct{}{},
+        Post(func(req *Request[Body, *struct{}]) error {
+            got = req.Body.Name
+            return nil
+        }, nil, MirrorTo(shadow.URL)),
+    )
+    req, err := http.NewRequest("POST", "/orders?x=1", strings.NewReader(`{"name":"cake"}`))
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != 200 || got != "cake" {
+        t.Errorf("expected primary to be served, got %d %q", rec.Code, got)
+    }
+    select {
+    case s := <-mirrored:
+        if s != `POST /orders?x=1 {"name":"cake"}` {
+            t.Errorf("unexpected mirrored request %q", s)
+        }
+    case <-time.After(2 * time.Second):
+        t.Errorf("request was not mirrored")
+    }
+}
+
+func TestCanary(t *testing.T) {
+    m := Mux{}
+    stable := func(req *Request[EmptyBody, *struct{}]) error { return Bypass("stable") }
+    canary := func(req *Request[EmptyBody, *struct{}]) error { return Bypass("canary") }
+    variants := map[string]int{}
+    m.After(func(oc *Outcome) {
+        variants[oc.Variant]++
+    })
+    m.HandleFunc("/users", &struct{}{},
+        Get(stable, nil),
+        Get(canary, nil, Canary(20)),
+    )
+    test := func(force string) string {
+        req, err := http.NewRequest("GET", "/users", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return ""
+        }
+        if force != "" {
+            req.Header.Set("X-Canary", force)
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        return strings.TrimSpace(rBody(rec.Body))
+    }
+    if body := test("true"); body != `"canary"` {
+        t.Errorf("expected forced canary, got %s", body)
+    }
+    if body := test("false"); body != `"stable"` {
+        t.Errorf("expected forced stable, got %s", body)
+    }
+    clear(variants)
+    for range 1000 {
+        test("")
+    }
+    if n := variants["canary"]; n < 100 || n > 300 || variants[""] != 1000 - n {
+        t.Errorf("unexpected split %v", variants)
+    }
+}
+
+func matchTestMux() *Mux {
+    type MD struct {
+        ID   int
+        Name string
+    }
+    m := &Mux{}
+    m.HandleFunc("/users/{id}/posts", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return nil
+        }, nil),
+    )
+    m.HandleFunc("/users/user-{name}.json", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return nil
+        }, nil),
+    )
+    m.HandleFunc("/static/", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return nil
+        }, nil),
+    )
+    return m
+}
+
+func TestMatch(t *testing.T) {
+    m := matchTestMux()
+    ri, vars, ok := m.Match("GET", "/users/007/posts")
+    if !ok || ri.Pattern != "/users/{id}/posts" || vars["id"] != "007" {
+        t.Errorf("unexpected match %+v %v %v", ri, vars, ok)
+    }
+    ri, vars, ok = m.Match("GET", "/users/user-alice.json")
+    if !ok || ri.Pattern != "/users/user-{name}.json" || vars["name"] != "alice" {
+        t.Errorf("unexpected match %+v %v %v", ri, vars, ok)
+    }
+    if ri, _, ok = m.Match("GET", "/static/css/site.css"); !ok || ri.Pattern != "/static/" {
+        t.Errorf("expected fallback match, got %+v", ri)
+    }
+    for _, c := range []struct{method, path string}{
+        {"POST", "/users/7/posts"},
+        {"GET", "/users/x/posts"},
+        {"GET", "users"},
+        {"GET", ""},
+    } {
+        if ri, vars, ok := m.Match(c.method, c.path); ok || ri != nil || vars != nil {
+            t.Errorf("%s %q: expected no match, got %+v", c.method, c.path, ri)
+        }
+    }
+}
+
+func FuzzMatch(f *testing.F) {
+    m := matchTestMux()
+    for _, seed := range []string{"/", "/users/7/posts", "/users/user-.json", "/static//", "//"} {
+        f.Add(seed)
+    }
+    f.Fuzz(func(t *testing.T, path string) {
+        ri, vars, ok := m.Match("GET", path)
+        if ok != (ri != nil) || len(vars) > 1 {
+            t.Errorf("%q: inconsistent match %+v %v", path, ri, vars)
+        }
+    })
+}
+
+func TestPathEncoding(t *testing.T) {
+    type MD struct {
+        City string
+        Name string
+    }
+    m := Mux{}
+    m.HandleFunc("/cities/{city}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass(req.Metadata.City)
+        }, nil),
+    )
+    m.HandleFunc("/files/{name}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass(req.Metadata.Name)
+        }, nil),
+    )
+    m.HandleFunc("/files/a/b", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass("nested")
+        }, nil),
+    )
+    m.HandleFunc("/søg", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass("search")
+        }, nil),
+    )
+    test := func(url, expBody string, expCode int) {
+        req, err := http.NewRequest("GET", url, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        body := strings.TrimSpace(rBody(rec.Body))
+        if rec.Code != expCode || (expBody != "" && body != expBody) {
+            t.Errorf("%s: expected %d %s, got %d %s", url, expCode, expBody, rec.Code, body)
+        }
+    }
+    test("/cities/København", `"København"`, 200)
+    test("/cities/K%C3%B8benhavn", `"København"`, 200)
+    test("/cities/%E4%B8%8A%E6%B5%B7", `"上海"`, 200)
+    test("/s%C3%B8g", `"search"`, 200)
+    test("/files/a%20b", `"a b"`, 200)
+    test("/files/a%2Fb", `"a/b"`, 200)
+    test("/files/a%252Fb", `"a%2Fb"`, 200)
+    test("/files/a/b", `"nested"`, 200)
+    m.SetEncodedSlashes(EncodedSlashSplit)
+    test("/files/a%2Fb", `"nested"`, 200)
+    m.SetEncodedSlashes(EncodedSlashReject)
+    test("/files/a%2Fb", "", 400)
+    test("/files/a%20b", `"a b"`, 200)
+}
+
+func TestPathNormalization(t *testing.T) {
+    type MD struct {
+        Name string
+    }
+    m := Mux{}
+    var seen string
+    m.Before = func(w http.ResponseWriter, r *http.Request, md, data any) error {
+        seen = r.URL.Path
+        if strings.HasPrefix(r.URL.Path, "/admin") {
+            return HTTPError("admins only", 403)
+        }
+        return nil
+    }
+    h := func(req *Request[EmptyBody, *MD]) error { return Bypass(req.Metadata.Name) }
+    m.HandleFunc("/admin", &MD{}, Get(h, nil))
+    m.HandleFunc("/public/{name}", &MD{}, Get(h, nil), Post(func(req *Request[EmptyBody, *MD]) error { return nil }, nil))
+    m.HandleFunc("/dir/", &MD{}, Get(h, nil))
+    test := func(method, url string, expCode int, expLoc string) {
+        req, err := http.NewRequest(method, url, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode || rec.Header().Get("Location") != expLoc {
+            t.Errorf("%s %s: expected %d %q, got %d %q %s", method, url, expCode, expLoc,
+                     rec.Code, rec.Header().Get("Location"), rBody(rec.Body))
+        }
+    }
+    test("GET", "/public/../admin", 403, "")
+    test("GET", "/public/%2E%2E/admin", 403, "")
+    if seen != "/admin" {
+        t.Errorf("expected Before to see the cleaned path, got %q", seen)
+    }
+    test("GET", "/public//./x", 200, "")
+    test("GET", "/dir/a/..", 200, "")
+    if seen != "/dir/" {
+        t.Errorf("expected trailing slash to be kept, got %q", seen)
+    }
+    test("GET", "/../../public/x", 200, "")
+    m.SetPathNormalization(NormalizeRedirect)
+    test("GET", "/public//x?a=1", 301, "/public/x?a=1")
+    test("POST", "/public/./x", 308, "/public/x")
+    test("GET", "/public/x", 200, "")
+    m.SetPathNormalization(NormalizeReject)
+    test("GET", "/public/../admin", 400, "")
+    m.SetPathNormalization(NormalizeOff)
+    test("GET", "/public/../admin", 404, "")
+}
+
+func TestBodyVariants(t *testing.T) {
+    type Query struct {
+        Match string `json:"match"`
+    }
+    m := Mux{}
+    var got string
+    m.HandleFunc("/search", &struct{}{},
+        GetB(func(req *Request[Query, *struct{}]) error {
+            got = req.Body.Match
+            return nil
+        }, nil),
+        DeleteB(func(req *Request[Query, *struct{}]) error {
+            got = "delete " + req.Body.Match
+            return nil
+        }, nil),
+    )
+    test := func(method, body string, expCode int, exp string) {
+        var r io.Reader
+        if body != "" {
+            r = strings.NewReader(body)
+        }
+        req, err := http.NewRequest(method, "/search", r)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        got = ""
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode || got != exp {
+            t.Errorf("%s %s: expected %d %q, got %d %q", method, body, expCode, exp, rec.Code, got)
+        }
+    }
+    test("GET", `{"match":"cake"}`, 200, "cake")
+    test("GET", "", 200, "")
+    test("GET", `{"match":`, 400, "")
+    test("DELETE", `{"match":"cake"}`, 200, "delete cake")
+    test("DELETE", "", 200, "delete ")
+}
+
+func TestCustomMethod(t *testing.T) {
+    type Report struct {
+        Props []string `json:"props"`
+    }
+    m := Mux{}
+    var got string
+    m.HandleFunc("/cache/{key}", &struct{ Key string }{},
+        Method("PURGE", func(req *Request[EmptyBody, *struct{ Key string }]) error {
+            got = "purged " + req.Metadata.Key
+            return nil
+        }, nil),
+        Method("REPORT", func(req *Request[Report, *struct{ Key string }]) error {
+            got = strings.Join(req.Body.Props, ",")
+            return nil
+        }, nil),
+    )
+    test := func(method, body string, expCode int, exp string) {
+        req, err := http.NewRequest(method, "/cache/x", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        got = ""
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode || got != exp {
+            t.Errorf("%s: expected %d %q, got %d %q", method, expCode, exp, rec.Code, got)
+        }
+    }
+    test("PURGE", "", 200, "purged x")
+    test("REPORT", `{"props":["a","b"]}`, 200, "a,b")
+    test("PROPFIND", "", 405, "")
+    defer func() {
+        if recover() == nil {
+            t.Errorf("expected invalid method to panic")
+        }
+    }()
+    Method("BAD METHOD", func(req *Request[EmptyBody, any]) error { return nil }, nil)
+}
+
+func TestConnect(t *testing.T) {
+    echo, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen failed: %v", err)
+    }
+    defer echo.Close()
+    go func() {
+        for {
+            conn, err := echo.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                io.Copy(conn, conn)
+                conn.Close()
+            }()
+        }
+    }()
+    m := Mux{}
+    m.HandleFunc("/", &struct{}{},
+        Connect(func(req *ConnectRequest[*struct{}]) error {
+            if req.Target != echo.Addr().String() && req.Target != "blocked:1" {
+                return HTTPError("forbidden target", 403)
+            }
+            return req.Tunnel(nil)
+        }, nil),
+    )
+    srv := httptest.NewServer(&m)
+    defer srv.Close()
+    connect := func(target string) (string, *bufio.Reader, net.Conn) {
+        conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+        if err != nil {
+            t.Fatalf("net.Dial failed: %v", err)
+        }
+        fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+        br := bufio.NewReader(conn)
+        res, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+        if err != nil {
+            t.Fatalf("http.ReadResponse failed: %v", err)
+        }
+        return res.Status, br, conn
+    }
+    status, br, conn := connect(echo.Addr().String())
+    defer conn.Close()
+    if status != "200 Connection Established" {
+        t.Fatalf("unexpected status %q", status)
+    }
+    fmt.Fprint(conn, "ping\n")
+    if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+        t.Errorf("expected echo, got %q %v", line, err)
+    }
+    status, _, conn2 := connect("example.com:443")
+    defer conn2.Close()
+    if !strings.HasPrefix(status, "403") {
+        t.Errorf("expected 403, got %q", status)
+    }
+    status, _, conn3 := connect("blocked:1")
+    defer conn3.Close()
+    if !strings.HasPrefix(status, "502") {
+        t.Errorf("expected 502, got %q", status)
+    }
+}
+
+func TestPatchDocuments(t *testing.T) {
+    type Address struct {
+        City string `json:"city"`
+        Zip  string `json:"zip,omitempty"`
+    }
+    type User struct {
+        Name    string   `json:"name"`
+        Email   string   `json:"email,omitempty"`
+        Tags    []string `json:"tags"`
+        Address *Address `json:"address,omitempty"`
+        /* fields without a JSON form are kept */
+        PasswordHash string `json:"-"`
+    }
+    orig := User{Name: "alice", Email: "a@example.com", Tags: []string{"a", "b"},
+                 Address: &Address{City: "Aarhus", Zip: "8000"}, PasswordHash: "h"}
+    m := Mux{}
+    var got User
+    m.HandleFunc("/merge", &struct{}{},
+        Patch(func(req *Request[MergePatch[User], *struct{}]) error {
+            got = orig
+            got.Address = &Address{City: orig.Address.City, Zip: orig.Address.Zip}
+            return req.Body.Apply(&got)
+        }, nil),
+    )
+    m.HandleFunc("/json", &struct{}{},
+        Patch(func(req *Request[JSONPatch, *struct{}]) error {
+            got = orig
+            got.Tags = slices.Clone(orig.Tags)
+            return req.Body.Apply(&got)
+        }, nil),
+    )
+    test := func(path, body string, expCode int, exp *User) {
+        req, err := http.NewRequest("PATCH", path, strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        got = User{}
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s %s: expected %d, got %d %s", path, body, expCode, rec.Code, rBody(rec.Body))
+        } else if exp != nil && !reflect.DeepEqual(got, *exp) {
+            t.Errorf("%s %s: expected %+v, got %+v", path, body, *exp, got)
+        }
+    }
+    test("/merge", `{"email":null,"address":{"zip":null},"tags":["c"]}`, 200,
+         &User{Name: "alice", Tags: []string{"c"}, Address: &Address{City: "Aarhus"}, PasswordHash: "h"})
+    test("/merge", `{"name":5}`, 400, nil)
+    test("/merge", `[1]`, 400, nil)
+    test("/json", `[
+        {"op":"test","path":"/name","value":"alice"},
+        {"op":"add","path":"/tags/-","value":"c"},
+        {"op":"remove","path":"/tags/0"},
+        {"op":"replace","path":"/email","value":"b@example.com"},
+        {"op":"copy","from":"/name","path":"/address/city"},
+        {"op":"move","from":"/address/zip","path":"/name"}
+    ]`, 200, &User{Name: "8000", Email: "b@example.com", Tags: []string{"b", "c"},
+                   Address: &Address{City: "alice"}, PasswordHash: "h"})
+    test("/json", `[{"op":"test","path":"/name","value":"bob"}]`, 409, nil)
+    test("/json", `[{"op":"remove","path":"/missing"}]`, 409, nil)
+    test("/json", `[{"op":"add","path":"/tags/5","value":"x"}]`, 409, nil)
+    test("/json", `[{"op":"replace","path":"/name","value":7}]`, 422, nil)
+    test("/json", `[{"op":"frobnicate","path":"/name"}]`, 400, nil)
+    test("/json", `[{"op":"add","path":"name","value":1}]`, 400, nil)
+    test("/json", `[{"op":"add","path":"/name"}]`, 400, nil)
+}
+
+func TestCookieBinding(t *testing.T) {
+    type MD struct {
+        Theme   string `cookie:"theme"`
+        Visits  int    `cookie:"visits"`
+        UserID  *int64 `cookie:"user,signed"`
+        Session string `cookie:"session,encrypted"`
+    }
+    m := Mux{}
+    m.SetCookieSecret([]byte("0123456789abcdef0123456789abcdef"))
+    var got MD
+    m.HandleFunc("/", &MD{Theme: "light"},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            got = *req.Metadata
+            return nil
+        }, nil),
+    )
+    rec := httptest.NewRecorder()
+    if err := m.SetSignedCookie(rec, &http.Cookie{Name: "user", Value: "42"}); err != nil {
+        t.Fatalf("SetSignedCookie failed: %v", err)
+    }
+    if err := m.SetEncryptedCookie(rec, &http.Cookie{Name: "session", Value: "s3cr.et"}); err != nil {
+        t.Fatalf("SetEncryptedCookie failed: %v", err)
+    }
+    cookies := rec.Result().Cookies()
+    if strings.Contains(cookies[1].Value, "s3cr") {
+        t.Errorf("expected encrypted cookie value, got %q", cookies[1].Value)
+    }
+    test := func(expCode int, cookies ...*http.Cookie) {
+        req, err := http.NewRequest("GET", "/", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        for _, c := range cookies {
+            req.AddCookie(c)
+        }
+        got = MD{}
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("expected %d, got %d %s", expCode, rec.Code, rBody(rec.Body))
+        }
+    }
+    test(200, append(cookies, &http.Cookie{Name: "visits", Value: "3"})...)
+    if got.Theme != "light" || got.Visits != 3 || got.UserID == nil || *got.UserID != 42 || got.Session != "s3cr.et" {
+        t.Errorf("unexpected binding %+v", got)
+    }
+    tampered := *cookies[0]
+    tampered.Value = strings.Replace(tampered.Value, "42", "43", 1)
+    test(200, &tampered, &http.Cookie{Name: "session", Value: "garbage"})
+    if got.UserID != nil || got.Session != "" {
+        t.Errorf("expected tampered cookies to be ignored, got %+v", got)
+    }
+    test(400, &http.Cookie{Name: "visits", Value: "many"})
+}
+
+func TestMultiSourceBinding(t *testing.T) {
+    type MD struct {
+        OrgID   int      `path:"org"`
+        ID      string   `query:"id"`
+        Page    int      `query:"page,default=1"`
+        Tags    []string `query:"tag,default=a,b"`
+        APIKey  string   `header:"x-api-key,required"`
+        Trace   *string  `header:"X-Trace-Id"`
+        Session string   `cookie:"session,required"`
+    }
+    m := Mux{}
+    var got MD
+    m.HandleFunc("/orgs/{org}/items", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            got = *req.Metadata
+            return nil
+        }, nil),
+    )
+    test := func(url string, header map[string]string, expCode int) map[string]any {
+        req, err := http.NewRequest("GET", url, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return nil
+        }
+        for k, v := range header {
+            req.Header.Set(k, v)
+        }
+        got = MD{}
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s: expected %d, got %d %s", url, expCode, rec.Code, rBody(rec.Body))
+        }
+        var res map[string]any
+        json.Unmarshal(rec.Body.Bytes(), &res)
+        return res
+    }
+    test("/orgs/7/items?id=x", map[string]string{"X-Api-Key": "k", "Cookie": "session=s"}, 200)
+    if got.OrgID != 7 || got.ID != "x" || got.Page != 1 || !reflect.DeepEqual(got.Tags, []string{"a", "b"}) ||
+       got.APIKey != "k" || got.Trace != nil || got.Session != "s" {
+        t.Errorf("unexpected binding %+v", got)
+    }
+    test("/orgs/7/items?page=3&tag=c", map[string]string{
+        "X-Api-Key": "k", "X-Trace-Id": "t", "Cookie": "session=s",
+    }, 200)
+    if got.Page != 3 || !reflect.DeepEqual(got.Tags, []string{"c"}) || got.Trace == nil || *got.Trace != "t" {
+        t.Errorf("unexpected binding %+v", got)
+    }
+    res := test("/orgs/7/items?page=x", nil, 400)
+    b, _ := json.Marshal(res["details"])
+    exp := `{"fields":[{"in":"query","name":"page","reason":"invalid value: invalid syntax"},` +
+           `{"in":"header","name":"X-Api-Key","reason":"required"},` +
+           `{"in":"cookie","name":"session","reason":"required"}]}`
+    if string(b) != exp {
+        t.Errorf("unexpected details %s", b)
+    }
+}
+
+func TestMatrixParams(t *testing.T) {
+    type MD struct {
+        Name  string   `cmux:"name"`
+        Color string   `matrix:"color"`
+        Year  int      `matrix:"year,default=2024"`
+        Opts  []string `matrix:"opt"`
+    }
+    m := Mux{}
+    var got MD
+    m.HandleFunc("/cars/{name}/info", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            got = *req.Metadata
+            return nil
+        }, nil),
+    )
+    test := func(url string, expCode int) {
+        req, err := http.NewRequest("GET", url, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        got = MD{}
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s: expected %d, got %d %s", url, expCode, rec.Code, rBody(rec.Body))
+        }
+    }
+    /* matched literally unless enabled */
+    test("/cars/volvo;color=red/info", 200)
+    if got.Name != "volvo;color=red" || got.Color != "" {
+        t.Errorf("unexpected binding %+v", got)
+    }
+    m.EnableMatrixParams(true)
+    test("/cars/volvo;color=red;opt=a;opt=b/info;year=2020", 200)
+    if got.Name != "volvo" || got.Color != "red" || got.Year != 2020 || !reflect.DeepEqual(got.Opts, []string{"a", "b"}) {
+        t.Errorf("unexpected binding %+v", got)
+    }
+    test("/cars/v%C3%B6lvo;color=d%C3%BCn%3Bkel/info", 200)
+    if got.Name != "völvo" || got.Color != "dün;kel" || got.Year != 2024 {
+        t.Errorf("unexpected binding %+v", got)
+    }
+    test("/cars/volvo/info;year=x", 400)
+}
+
+func TestWithMeta(t *testing.T) {
+    type MD struct {
+        ID     int    `cmux:"id"`
+        Region string
+        Limit  int
+        tags   []string
+    }
+    m := Mux{}
+    md := MD{Limit: 10}
+    get := func(req *Request[EmptyBody, *MD]) error {
+        return Bypass(fmt.Sprintf("%d %s %d %v", req.Metadata.ID, req.Metadata.Region, req.Metadata.Limit, req.Metadata.tags))
+    }
+    eu := &MD{Region: "eu", ID: 1, tags: []string{"x"}}
+    m.HandleFunc("/eu/{id}", &md, Get(get, nil, WithMeta(eu)))
+    m.HandleFunc("/us/{id}", &md, Get(get, nil, WithMeta(&MD{Region: "us", Limit: 20})))
+    m.HandleFunc("/any/{id}", &md, Get(get, nil))
+    type FlatMD struct {
+        ID     int    `cmux:"id"`
+        Region string
+    }
+    m.HandleFunc("/flat/{id}", &FlatMD{}, Get(func(req *Request[EmptyBody, *FlatMD]) error {
+        return Bypass(fmt.Sprintf("%d %s", req.Metadata.ID, req.Metadata.Region))
+    }, nil, WithMeta(&FlatMD{Region: "ap", ID: 1})))
+    /* the fields are copied when WithMeta is called */
+    eu.Region = "changed"
+    for _, test := range []struct{ path, exp string }{
+        {"/eu/5", `"5 eu 10 [x]"`},
+        {"/us/6", `"6 us 20 []"`},
+        {"/any/7", `"7  10 []"`},
+        {"/flat/8", `"8 ap"`},
+    } {
+        req, err := http.NewRequest("GET", test.path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            continue
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if body := strings.TrimSpace(rBody(rec.Body)); body != test.exp {
+            t.Errorf("%s: expected %q, got %q", test.path, test.exp, body)
+        }
+    }
+}
+
+func TestMetadataSnapshot(t *testing.T) {
+    type Service struct {
+        Name string
+    }
+    type Limits struct {
+        Max [2]int
+        Per map[string]int
+    }
+    type MD struct {
+        Name   string
+        Svc    *Service
+        Scopes []string
+        Perms  map[string][]string
+        Limits Limits
+    }
+    svc := &Service{"users"}
+    md := &MD{
+        Name:   "a",
+        Svc:    svc,
+        Scopes: []string{"read"},
+        Perms:  map[string][]string{"admin": {"write"}},
+        Limits: Limits{[2]int{1, 2}, map[string]int{"get": 3}},
+    }
+    m := Mux{}
+    served := 0
+    m.HandleFunc("/users", md, Get(func(req *Request[EmptyBody, *MD]) error {
+        g := req.Metadata
+        if g.Name != "a" || g.Svc != svc || !reflect.DeepEqual(g.Scopes, []string{"read"}) ||
+           !reflect.DeepEqual(g.Perms, map[string][]string{"admin": {"write"}}) ||
+           g.Limits.Max != [2]int{1, 2} || g.Limits.Per["get"] != 3 {
+            t.Errorf("unexpected metadata %+v", *g)
+        }
+        /* mutations by handlers must not leak into later requests */
+        g.Scopes[0] = "mutated"
+        g.Perms["admin"][0] = "mutated"
+        g.Limits.Per["get"] = 0
+        served++
+        return nil
+    }, nil))
+    /* nor may changes by the caller after registration */
+    md.Name = "b"
+    md.Scopes[0] = "changed"
+    md.Perms["admin"] = nil
+    md.Limits.Per["get"] = 4
+    for i := 0; i < 2; i++ {
+        req, err := http.NewRequest("GET", "/users", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        m.ServeHTTP(httptest.NewRecorder(), req)
+    }
+    if served != 2 {
+        t.Errorf("expected 2 requests, got %d", served)
+    }
+}
+
+func TestRequestValues(t *testing.T) {
+    type MD struct{}
+    userKey := NewKey[string]("user")
+    countKey := NewKey[int]("count")
+    m := Mux{}
+    var afterUser string
+    var afterCount int
+    m.HandleFunc("/profile", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            user, ok := userKey.Get(req.Values)
+            if !ok {
+                t.Errorf("missing user")
+            }
+            n, _ := countKey.Get(req.Values)
+            countKey.Set(req.Values, n + 1)
+            return Bypass(user)
+        }, nil,
+            Before(func(w http.ResponseWriter, r *http.Request, md *MD) error {
+                userKey.Set(RequestValues(r), r.Header.Get("X-User"))
+                countKey.Set(RequestValues(r), 1)
+                return nil
+            }),
+            After(func(oc *Outcome) {
+                afterUser, _ = userKey.Get(RequestValues(oc.Request))
+                afterCount, _ = countKey.Get(RequestValues(oc.Request))
+            }),
+        ),
+    )
+    for _, user := range []string{"alice", "bob"} {
+        req, err := http.NewRequest("GET", "/profile", nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        req.Header.Set("X-User", user)
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if body := strings.TrimSpace(rBody(rec.Body)); body != `"` + user + `"` {
+            t.Errorf("unexpected body %s", body)
+        }
+        if afterUser != user || afterCount != 2 {
+            t.Errorf("unexpected values in After hook: %q %d", afterUser, afterCount)
+        }
+    }
+    if _, ok := userKey.Get(RequestValues(httptest.NewRequest("GET", "/", nil))); ok {
+        t.Errorf("unexpected value outside of a mux")
+    }
+    /* nil values of interface types are set */
+    errKey := NewKey[error]("err")
+    var v Values
+    errKey.Set(&v, nil)
+    if err, ok := errKey.Get(&v); !ok || err != nil {
+        t.Errorf("unexpected nil value %v %v", err, ok)
+    }
+}
+
+func TestRoutePattern(t *testing.T) {
+    type MD struct {
+        ID int `cmux:"id"`
+    }
+    m := Mux{}
+    var buf bytes.Buffer
+    m.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+    var before, handler, after string
+    m.HandleFunc("/users/{id}/orders", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            handler = req.Pattern()
+            return nil
+        }, nil,
+            Before(func(w http.ResponseWriter, r *http.Request, md *MD) error {
+                before = RoutePattern(r)
+                return nil
+            }),
+            After(func(oc *Outcome) {
+                after = oc.Pattern
+            }),
+        ),
+    )
+    req, err := http.NewRequest("GET", "/users/12/orders", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    m.ServeHTTP(httptest.NewRecorder(), req)
+    exp := "/users/{id}/orders"
+    if before != exp || handler != exp || after != exp {
+        t.Errorf("unexpected patterns %q %q %q", before, handler, after)
+    }
+    if !strings.Contains(buf.String(), "pattern=/users/{id}/orders") {
+        t.Errorf("missing pattern in log: %s", buf.String())
+    }
+    if RoutePattern(req) != "" {
+        t.Errorf("unexpected pattern outside of a mux")
+    }
+}
+
+type testUser struct {
+    Name string `json:"name"`
+}
+
+type testUserMD struct {
+    ID int
+}
+
+type testUserController struct {
+    users map[int]testUser
+}
+
+func (c *testUserController) Get(req *Request[EmptyBody, *testUserMD]) error {
+    return Bypass(len(c.users))
+}
+
+func (c *testUserController) Post(req *Request[testUser, *testUserMD]) error {
+    c.users[len(c.users) + 1] = req.Body
+    return Bypass(len(c.users))
+}
+
+func (c *testUserController) GetByID(req *Request[EmptyBody, *testUserMD]) error {
+    u, ok := c.users[req.Metadata.ID]
+    if !ok {
+        return ErrNotFound
+    }
+    return Bypass(u)
+}
+
+func (c *testUserController) DeleteByID(req *Request[EmptyBody, *testUserMD]) error {
+    delete(c.users, req.Metadata.ID)
+    return nil
+}
+
+func (c *testUserController) Helper() {}
+
+func TestHandleController(t *testing.T) {
+    c := &testUserController{users: map[int]testUser{}}
+    m := Mux{}
+    m.HandleController("/users", c)
+    m.Group("/v2").HandleController("/users/", c)
+    test := func(method, path, body string, expCode int, expBody string) {
+        req, err := http.NewRequest(method, path, strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s %s: expected %d, got %d %s", method, path, expCode, rec.Code, rBody(rec.Body))
+            return
+        }
+        if got := strings.TrimSpace(rBody(rec.Body)); expBody != "" && got != expBody {
+            t.Errorf("%s %s: expected %s, got %s", method, path, expBody, got)
+        }
+    }
+    test("GET", "/users", "", 200, "0")
+    test("POST", "/users", `{"name":"alice"}`, 200, "1")
+    test("POST", "/users", `{"name":`, 400, "")
+    test("GET", "/users/1", "", 200, `{"name":"alice"}`)
+    test("GET", "/v2/users/1", "", 200, `{"name":"alice"}`)
+    test("DELETE", "/v2/users/1", "", 200, "")
+    test("GET", "/users/1", "", 404, "")
+    test("PUT", "/users/1", "{}", 405, "")
+    var methods []string
+    for _, ri := range m.Routes() {
+        if ri.Pattern == "/users/{id}" {
+            methods = append(methods, ri.Method)
+            if exp := "*cmux.testUserController." + map[string]string{"GET": "GetByID", "DELETE": "DeleteByID"}[ri.Method]; ri.Handler != exp {
+                t.Errorf("expected handler %s, got %s", exp, ri.Handler)
+            }
+        }
+    }
+    slices.Sort(methods)
+    if !reflect.DeepEqual(methods, []string{"DELETE", "GET"}) {
+        t.Errorf("unexpected methods %v", methods)
+    }
+}
+
+type testStore struct {
+    mu     sync.Mutex
+    nextID int
+    items  map[int]testUser
+}
+
+func (s *testStore) List(ctx context.Context) ([]testUser, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var items []testUser
+    for id := 1; id <= s.nextID; id++ {
+        if item, ok := s.items[id]; ok {
+            items = append(items, item)
+        }
+    }
+    return items, nil
+}
+
+func (s *testStore) Create(ctx context.Context, item testUser) (testUser, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if item.Name == "" {
+        return item, HTTPError("missing name", http.StatusUnprocessableEntity)
+    }
+    s.nextID++
+    s.items[s.nextID] = item
+    return item, nil
+}
+
+func (s *testStore) Get(ctx context.Context, id int) (testUser, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    item, ok := s.items[id]
+    if !ok {
+        return item, ErrNotFound
+    }
+    return item, nil
+}
+
+func (s *testStore) Update(ctx context.Context, id int, item testUser) (testUser, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.items[id]; !ok {
+        return item, ErrNotFound
+    }
+    s.items[id] = item
+    return item, nil
+}
+
+func (s *testStore) Delete(ctx context.Context, id int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.items, id)
+    return nil
+}
+
+func TestResource(t *testing.T) {
+    m := Mux{}
+    Resource(m.Group("/api"), "/users", &testStore{items: map[int]testUser{}})
+    test := func(method, path, body string, expCode int, expBody string) {
+        req, err := http.NewRequest(method, path, strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s %s: expected %d, got %d %s", method, path, expCode, rec.Code, rBody(rec.Body))
+            return
+        }
+        if got := strings.TrimSpace(rBody(rec.Body)); got != expBody {
+            t.Errorf("%s %s: expected %s, got %s", method, path, expBody, got)
+        }
+    }
+    test("GET", "/api/users", "", 200, "[]")
+    test("POST", "/api/users", `{"name":"alice"}`, 201, `{"name":"alice"}`)
+    test("POST", "/api/users", `{}`, 422, `{"error":"missing name"}`)
+    test("POST", "/api/users", `{"name":"bob"}`, 201, `{"name":"bob"}`)
+    test("GET", "/api/users", "", 200, `[{"name":"alice"},{"name":"bob"}]`)
+    test("PUT", "/api/users/2", `{"name":"carol"}`, 200, `{"name":"carol"}`)
+    test("GET", "/api/users/2", "", 200, `{"name":"carol"}`)
+    test("PUT", "/api/users/3", `{"name":"dave"}`, 404, `{"error":"Not Found","code":"not_found"}`)
+    test("DELETE", "/api/users/1", "", 204, "")
+    test("GET", "/api/users/1", "", 404, `{"error":"Not Found","code":"not_found"}`)
+    test("GET", "/api/users/x", "", 404, "404 page not found")
+}
+
+type testGreetRequest struct {
+    Name string `json:"name"`
+}
+
+type testGreeting struct {
+    Message string `json:"message"`
+}
+
+type testGreeter struct{}
+
+func (testGreeter) Greet(ctx context.Context, in *testGreetRequest) (*testGreeting, error) {
+    if in.Name == "" {
+        return nil, HTTPError("missing name", http.StatusBadRequest)
+    }
+    return &testGreeting{"hello " + in.Name}, nil
+}
+
+func (testGreeter) Ping(ctx context.Context, in *EmptyBody) (*testGreeting, error) {
+    return &testGreeting{"pong"}, nil
+}
+
+func (testGreeter) Helper(name string) string {
+    return name
+}
+
+func TestHandleService(t *testing.T) {
+    m := Mux{}
+    m.HandleService("/greet.v1.Greeter", testGreeter{})
+    m.HandleFunc("/unary", nil, Unary(testGreeter{}.Greet))
+    test := func(method, path, body string, expCode int, expBody string) {
+        req, err := http.NewRequest(method, path, strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s %s: expected %d, got %d %s", method, path, expCode, rec.Code, rBody(rec.Body))
+            return
+        }
+        if got := strings.TrimSpace(rBody(rec.Body)); expBody != "" && got != expBody {
+            t.Errorf("%s %s: expected %s, got %s", method, path, expBody, got)
+        }
+    }
+    test("POST", "/greet.v1.Greeter/Greet", `{"name":"alice"}`, 200, `{"message":"hello alice"}`)
+    test("POST", "/greet.v1.Greeter/Greet", ``, 400, `{"error":"missing name"}`)
+    test("POST", "/greet.v1.Greeter/Greet", `{"name":`, 400, "")
+    test("POST", "/greet.v1.Greeter/Ping", ``, 200, `{"message":"pong"}`)
+    test("GET", "/greet.v1.Greeter/Ping", ``, 405, "")
+    test("POST", "/greet.v1.Greeter/Helper", ``, 404, "")
+    test("POST", "/unary", `{"name":"bob"}`, 200, `{"message":"hello bob"}`)
+}
+
+func TestGraphQL(t *testing.T) {
+    exec := GraphQLExecutorFunc(func(ctx context.Context, req *GraphQLRequest) (*GraphQLResponse, error) {
+        if req.Query == "{ fail }" {
+            return nil, ErrForbidden
+        }
+        return &GraphQLResponse{Data: map[string]any{"query": req.Query, "vars": req.Variables}}, nil
+    })
+    m := Mux{}
+    var op string
+    m.HandleFunc("/graphql", nil, GraphQL(exec, After(func(oc *Outcome) {
+        op = GraphQLOperation(oc.Request)
+    })))
+    test := func(method, path, ctype, body string, expCode int, expBody string) {
+        req, err := http.NewRequest(method, path, strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        if ctype != "" {
+            req.Header.Set("Content-Type", ctype)
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s %s: expected %d, got %d %s", method, path, expCode, rec.Code, rBody(rec.Body))
+            return
+        }
+        if got := strings.TrimSpace(rBody(rec.Body)); expBody != "" && got != expBody {
+            t.Errorf("%s %s: expected %s, got %s", method, path, expBody, got)
+        }
+    }
+    test("POST", "/graphql", "application/json", `{"query":"query Users { users }","operationName":"Users","variables":{"a":1}}`,
+         200, `{"data":{"query":"query Users { users }","vars":{"a":1}}}`)
+    if op != "Users" {
+        t.Errorf("unexpected operation %q", op)
+    }
+    test("POST", "/graphql", "application/graphql", `{ users }`, 200, `{"data":{"query":"{ users }","vars":null}}`)
+    test("GET", "/graphql?query=" + url.QueryEscape("{ users }") + "&variables=" + url.QueryEscape(`{"a":2}`), "", "",
+         200, `{"data":{"query":"{ users }","vars":{"a":2}}}`)
+    test("GET", "/graphql?query=" + url.QueryEscape("mutation { del }"), "", "", 405, "")
+    test("GET", "/graphql?query=x&variables=%7B", "", "", 400, "")
+    test("POST", "/graphql", "", `{}`, 400, "")
+    test("POST", "/graphql", "", `{"query":"{ fail }"}`, 403, "")
+
+    /* automatic persisted queries */
+    query := "{ users }"
+    sum := sha256.Sum256([]byte(query))
+    ext := `{"persistedQuery":{"version":1,"sha256Hash":"` + hex.EncodeToString(sum[:]) + `"}}`
+    test("POST", "/graphql", "", `{"extensions":` + ext + `}`,
+         200, `{"errors":[{"message":"PersistedQueryNotFound","extensions":{"code":"PERSISTED_QUERY_NOT_FOUND"}}]}`)
+    test("POST", "/graphql", "", `{"query":"{ other }","extensions":` + ext + `}`, 400, "")
+    test("POST", "/graphql", "", `{"query":"{ users }","extensions":` + ext + `}`, 200, `{"data":{"query":"{ users }","vars":null}}`)
+    test("GET", "/graphql?extensions=" + url.QueryEscape(ext), "", "", 200, `{"data":{"query":"{ users }","vars":null}}`)
+}
+
+func TestGraphQLOperationType(t *testing.T) {
+    for _, test := range []struct{ query, name, exp string }{
+        {"{ users }", "", "query"},
+        {"mutation { del }", "", "mutation"},
+        {"# mutation\nquery Q { a }", "", "query"},
+        {`query A { a(s: "mutation B { }") } mutation B { b }`, "B", "mutation"},
+        {"query A { a } subscription S { s }", "S", "subscription"},
+        {"query A { a }", "B", ""},
+        {"fragment F on Mutation { id } mutation { deleteAll }", "", "mutation"},
+        {"fragment F on mutation { id } { users }", "", "query"},
+    } {
+        if got := graphQLOperationType(test.query, test.name); got != test.exp {
+            t.Errorf("%q %q: expected %q, got %q", test.query, test.name, test.exp, got)
+        }
+    }
+}
+
+func TestJSONRPC(t *testing.T) {
+    rpc := NewJSONRPC()
+    HandleRPC(rpc, "sum", func(ctx context.Context, params []int) (int, error) {
+        sum := 0
+        for _, n := range params {
+            sum += n
+        }
+        return sum, nil
+    })
+    HandleRPC(rpc, "user", func(ctx context.Context, params struct{ ID int `json:"id"` }) (*testUser, error) {
+        switch params.ID {
+        case 1:
+            return &testUser{"alice"}, nil
+        case 2:
+            return nil, &JSONRPCError{Code: 1, Message: "suspended"}
+        case 3:
+            return nil, ErrForbidden
+        }
+        return nil, errors.New("db failure")
+    })
+    notified := 0
+    HandleRPC(rpc, "notify", func(ctx context.Context, params any) (any, error) {
+        notified++
+        return nil, nil
+    })
+    m := Mux{}
+    m.HandleFunc("/rpc", nil, rpc.Handler(Before(func(w http.ResponseWriter, r *http.Request, md any) error {
+        if r.Header.Get("Authorization") == "" {
+            return ErrUnauthorized
+        }
+        return nil
+    })))
+    test := func(body string, expCode int, expBody string) {
+        req, err := http.NewRequest("POST", "/rpc", strings.NewReader(body))
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        if expCode != 401 {
+            req.Header.Set("Authorization", "x")
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s: expected %d, got %d %s", body, expCode, rec.Code, rBody(rec.Body))
+            return
+        }
+        if got := strings.TrimSpace(rBody(rec.Body)); expBody != "" && got != expBody {
+            t.Errorf("%s: expected %s, got %s", body, expBody, got)
+        }
+    }
+    test(`{"jsonrpc":"2.0","method":"sum","params":[1,2,3],"id":1}`, 200, `{"jsonrpc":"2.0","result":6,"id":1}`)
+    test(`{"jsonrpc":"2.0","method":"sum","params":[1],"id":1}`, 401, "")
+    test(`{"jsonrpc":"2.0","method":"user","params":{"id":1},"id":"a"}`, 200,
+         `{"jsonrpc":"2.0","result":{"name":"alice"},"id":"a"}`)
+    test(`{"jsonrpc":"2.0","method":"user","params":{"id":2},"id":2}`, 200,
+         `{"jsonrpc":"2.0","error":{"code":1,"message":"suspended"},"id":2}`)
+    test(`{"jsonrpc":"2.0","method":"user","params":{"id":3},"id":3}`, 200,
+         `{"jsonrpc":"2.0","error":{"code":-32000,"message":"Forbidden","data":{"code":"forbidden"}},"id":3}`)
+    test(`{"jsonrpc":"2.0","method":"user","params":{"id":4},"id":4}`, 200,
+         `{"jsonrpc":"2.0","error":{"code":-32603,"message":"internal error"},"id":4}`)
+    test(`{"jsonrpc":"2.0","method":"user","params":{"id":"x"},"id":5}`, 200,
+         `{"jsonrpc":"2.0","error":{"code":-32602,"message":"invalid params",` +
+         `"data":"json: cannot unmarshal string into Go struct field .id of type int"},"id":5}`)
+    test(`{"jsonrpc":"2.0","method":"nope","id":6}`, 200,
+         `{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not found"},"id":6}`)
+    test(`{"jsonrpc":"2.0","method":1,"id":7}`, 200,
+         `{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request"},"id":null}`)
+    test(`{"jsonrpc":"2.0",`, 200, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`)
+    test(`[]`, 200, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request"},"id":null}`)
+    test(`{"jsonrpc":"2.0","method":"notify"}`, 204, "")
+    test(`[{"jsonrpc":"2.0","method":"sum","params":[1],"id":1},{"jsonrpc":"2.0","method":"notify"},1,` +
+         `{"jsonrpc":"2.0","method":"sum","params":[2],"id":2}]`, 200,
+         `[{"jsonrpc":"2.0","result":1,"id":1},{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request"},"id":null},` +
+         `{"jsonrpc":"2.0","result":2,"id":2}]`)
+    if notified != 2 {
+        t.Errorf("expected 2 notifications, got %d", notified)
+    }
+}
+
+func TestLongPoll(t *testing.T) {
+    type MD struct{}
+    events := make(chan string, 1)
+    wait := func(req *Request[EmptyBody, *MD]) error {
+        select {
+        case ev := <-events:
+            return Bypass(ev)
+        case <-req.Context.Done():
+            return req.Context.Err()
+        }
+    }
+    m := Mux{}
+    m.HandleFunc("/poll", &MD{}, Get(LongPoll(wait, 50 * time.Millisecond), nil))
+    m.HandleFunc("/beat", &MD{}, Get(LongPollHeartbeat(wait, 80 * time.Millisecond, 20 * time.Millisecond), nil))
+    test := func(path string, expCode int, expBody string) {
+        req, err := http.NewRequest("GET", path, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s: expected %d, got %d", path, expCode, rec.Code)
+        }
+        body := rBody(rec.Body)
+        if strings.TrimSpace(body) != expBody {
+            t.Errorf("%s: expected %q, got %q", path, expBody, body)
+        }
+        if path == "/beat" && !strings.HasPrefix(body, "\n") {
+            t.Errorf("missing heartbeat in %q", body)
+        }
+    }
+    events <- "ev1"
+    test("/poll", 200, `"ev1"`)
+    test("/poll", 204, "")
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        events <- "ev2"
+    }()
+    test("/beat", 200, `"ev2"`)
+    test("/beat", 200, "null")
+
+    m.HandleFunc("/panic", &MD{}, Get(LongPollHeartbeat(func(req *Request[EmptyBody, *MD]) error {
+        panic("boom")
+    }, 80 * time.Millisecond, 20 * time.Millisecond), nil))
+    test("/panic", 500, `{"error":"internal server error"}`)
+
+    /* errors after a heartbeat abort the response */
+    m.HandleFunc("/fail", &MD{}, Get(LongPollHeartbeat(func(req *Request[EmptyBody, *MD]) error {
+        time.Sleep(50 * time.Millisecond)
+        return ErrNotFound
+    }, 80 * time.Millisecond, 20 * time.Millisecond), nil))
+    req, err := http.NewRequest("GET", "/fail", nil)
+    if err != nil {
+        t.Errorf("http.NewRequest failed: %v", err)
+        return
+    }
+    rec := httptest.NewRecorder()
+    func() {
+        defer func() {
+            if p := recover(); p != http.ErrAbortHandler {
+                t.Errorf("expected the response to be aborted, got %v", p)
+            }
+        }()
+        m.ServeHTTP(rec, req)
+    }()
+    if rec.Code != 200 || strings.TrimSpace(rBody(rec.Body)) != "" {
+        t.Errorf("unexpected response %d %q", rec.Code, rBody(rec.Body))
+    }
+}
+
+func TestAsync(t *testing.T) {
+    type MD struct {
+        Name string `cmux:"name"`
+        Seen map[string]int
+    }
+    m := Mux{}
+    m.HandleJobs("/jobs")
+    var mu sync.Mutex
+    attempts := map[string]int{}
+    m.HandleFunc("/reports/{name}", &MD{},
+        Post(func(req *Request[testUser, *MD]) error {
+            mu.Lock()
+            attempts[req.Metadata.Name]++
+            n := attempts[req.Metadata.Name]
+            mu.Unlock()
+            if JobID(req.HTTPReq) == "" {
+                t.Errorf("missing job ID")
+            }
+            /* each attempt gets a copy of the maps of the metadata */
+            if req.Metadata.Seen["attempt"]++; req.Metadata.Seen["attempt"] != 1 {
+                t.Errorf("metadata shared between attempts")
+            }
+            switch req.Metadata.Name {
+            case "flaky":
+                if n < 3 {
+                    return errors.New("temporary failure")
+                }
+            case "panic":
+                panic("boom")
+            case "invalid":
+                return ErrUnprocessable
+            }
+            return Bypass(map[string]string{"report": req.Metadata.Name, "for": req.Body.Name})
+        }, nil, AsyncWith(AsyncConfig{Retries: 2, Backoff: time.Millisecond}),
+            Before(func(w http.ResponseWriter, r *http.Request, md *MD) error {
+                md.Seen = map[string]int{}
+                return nil
+            })),
+    )
+    do := func(method, path, body string, expCode int) (*httptest.ResponseRecorder, Job) {
+        req, err := http.NewRequest(method, path, strings.NewReader(body))
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s %s: expected %d, got %d %s", method, path, expCode, rec.Code, rBody(rec.Body))
+        }
+        var job Job
+        json.Unmarshal(rec.Body.Bytes(), &job)
+        return rec, job
+    }
+    wait := func(loc string) Job {
+        for i := 0; i < 200; i++ {
+            _, job := do("GET", loc, "", 200)
+            if job.Status == JobSucceeded || job.Status == JobFailed {
+                return job
+            }
+            time.Sleep(5 * time.Millisecond)
+        }
+        t.Fatalf("job %s did not finish", loc)
+        return Job{}
+    }
+    for _, test := range []struct {
+        name      string
+        status    JobStatus
+        code      int
+        attempts  int
+        result    string
+    }{
+        {"ok", JobSucceeded, 200, 1, `{"for":"alice","report":"ok"}`},
+        {"flaky", JobSucceeded, 200, 3, `{"for":"alice","report":"flaky"}`},
+        {"panic", JobFailed, 500, 3, ``},
+        {"invalid", JobFailed, 422, 1, `{"error":"Unprocessable Entity","code":"unprocessable"}`},
+    } {
+        rec, job := do("POST", "/reports/" + test.name, `{"name":"alice"}`, 202)
+        loc := rec.Header().Get("Location")
+        if job.ID == "" || job.Status != JobPending || loc != "/jobs/" + job.ID {
+            t.Errorf("%s: unexpected job %+v at %q", test.name, job, loc)
+            continue
+        }
+        job = wait(loc)
+        if job.Status != test.status || job.Code != test.code || job.Attempts != test.attempts ||
+           string(job.Result) != test.result {
+            t.Errorf("%s: unexpected job %+v %s", test.name, job, job.Result)
+        }
+    }
+    do("GET", "/jobs/unknown", "", 404)
+}
+
+type testJobStore struct {
+    mu   sync.Mutex
+    jobs map[string]Job
+    puts int
+}
+
+func (s *testJobStore) PutJob(ctx context.Context, job Job) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.jobs[job.ID] = job
+    s.puts++
+    return nil
+}
+
+func (s *testJobStore) GetJob(ctx context.Context, id string) (Job, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    job, ok := s.jobs[id]
+    if !ok {
+        return Job{}, ErrNotFound
+    }
+    return job, nil
+}
+
+func (s *testJobStore) DeleteJob(ctx context.Context, id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.jobs, id)
+    return nil
+}
+
+func TestJobStore(t *testing.T) {
+    type Report struct {
+        Name string `json:"name"`
+    }
+    m := Mux{}
+    store := &testJobStore{jobs: map[string]Job{}}
+    m.SetJobStore(store)
+    release := make(chan struct{})
+    m.HandleFunc("/reports", nil,
+        Post(func(req *Request[EmptyBody, any]) error {
+            <-release
+            return Bypass(Report{Name: "monthly"})
+        }, nil, Async()),
+    )
+    req, err := http.NewRequest("POST", "/reports", strings.NewReader("{}"))
+    if err != nil {
+        t.Fatalf("http.NewRequest failed: %v", err)
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    loc := rec.Header().Get("Location")
+    if rec.Code != 202 || !strings.HasPrefix(loc, DefaultJobsPath + "/") {
+        t.Fatalf("expected 202 with a job location, got %d %q", rec.Code, loc)
+    }
+    get := func() (*httptest.ResponseRecorder, Job) {
+        req, err := http.NewRequest("GET", loc, nil)
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != 200 {
+            t.Fatalf("expected 200, got %d %s", rec.Code, rBody(rec.Body))
+        }
+        var job Job
+        if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+            t.Fatalf("invalid job: %v", err)
+        }
+        return rec, job
+    }
+    rec, job := get()
+    if job.Status.Done() || rec.Header().Get("Retry-After") == "" {
+        t.Errorf("expected unfinished job with Retry-After, got %+v %v", job, rec.Header())
+    }
+    if _, err := JobResult[Report](job); err == nil {
+        t.Errorf("expected error for unfinished job")
+    }
+    close(release)
+    for i := 0; i < 200 && !job.Status.Done(); i++ {
+        time.Sleep(5 * time.Millisecond)
+        rec, job = get()
+    }
+    report, err := JobResult[Report](job)
+    if err != nil || report.Name != "monthly" || rec.Header().Get("Retry-After") != "" {
+        t.Errorf("unexpected result %+v %v %v", report, err, rec.Header())
+    }
+    store.mu.Lock()
+    if store.puts != 3 {
+        t.Errorf("expected 3 stored job updates, got %d", store.puts)
+    }
+    store.mu.Unlock()
+}
+
+func TestProxy(t *testing.T) {
+    var mu sync.Mutex
+    calls := map[string]int{}
+    upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        calls[r.URL.Path]++
+        n := calls[r.URL.Path]
+        mu.Unlock()
+        body, _ := io.ReadAll(r.Body)
+        switch r.URL.Path {
+        case "/flaky":
+            if n < 3 {
+                w.WriteHeader(http.StatusServiceUnavailable)
+                return
+            }
+        case "/slow":
+            if n == 1 {
+                select {
+                case <-time.After(2 * time.Second):
+                case <-r.Context().Done():
+                    return
+                }
+            }
+        }
+        fmt.Fprintf(w, "%s %s %d %s", r.Method, r.URL.RequestURI(), n, body)
+    }))
+    defer upstream.Close()
+    m := Mux{}
+    m.HandleFunc("/", nil, Proxy(upstream.URL,
+        ProxyRetry(RetryPolicy{Backoff: time.Millisecond}), ProxyHedge(20 * time.Millisecond, 1)))
+    for _, test := range []struct {
+        method  string
+        path    string
+        body    string
+        expCode int
+        expBody string
+    }{
+        {"GET", "/hello?a=1", "", 200, "GET /hello?a=1 1 "},
+        {"PUT", "/flaky", "data", 200, "PUT /flaky 3 data"},
+        {"POST", "/flaky", "data", 503, ""}, /* not idempotent */
+        {"GET", "/slow", "", 200, "GET /slow 2 "},
+    } {
+        if test.method == "POST" {
+            mu.Lock()
+            calls["/flaky"] = 0
+            mu.Unlock()
+        }
+        req, err := http.NewRequest(test.method, test.path, strings.NewReader(test.body))
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        rec := httptest.NewRecorder()
+        start := time.Now()
+        m.ServeHTTP(rec, req)
+        if rec.Code != test.expCode || rBody(rec.Body) != test.expBody {
+            t.Errorf("%s %s: expected %d %q, got %d %q", test.method, test.path,
+                     test.expCode, test.expBody, rec.Code, rBody(rec.Body))
+        }
+        if time.Since(start) > time.Second {
+            t.Errorf("%s %s: request was not hedged", test.method, test.path)
+        }
+    }
+    m.HandleFunc("/down/", nil, Proxy("http://127.0.0.1:1", ProxyRetry(RetryPolicy{Backoff: time.Millisecond})))
+    req, err := http.NewRequest("GET", "/down/x", nil)
+    if err != nil {
+        t.Fatalf("http.NewRequest failed: %v", err)
+    }
+    rec := httptest.NewRecorder()
+    m.ServeHTTP(rec, req)
+    if rec.Code != http.StatusBadGateway {
+        t.Errorf("expected 502, got %d", rec.Code)
+    }
+}
+
+func TestClientCert(t *testing.T) {
+    type MD struct {
+        Client *ClientIdentity
+    }
+    m := Mux{}
+    g := m.Group("/internal", RequireClientCert(ClientCertPolicy{
+        SANs: []string{"spiffe://example.org/ns/*"},
+        OUs:  []string{"payments"},
+    }))
+    g.HandleFunc("/whoami", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass(req.Metadata.Client)
+        }, nil),
+    )
+    spiffe, _ := url.Parse("spiffe://example.org/ns/billing")
+    cert := func(ou string) *tls.ConnectionState {
+        return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{
+            Subject: pkix.Name{CommonName: "billing", OrganizationalUnit: []string{ou}},
+            URIs:    []*url.URL{spiffe},
+        }}}}
+    }
+    for _, test := range []struct {
+        state   *tls.ConnectionState
+        expCode int
+        expBody string
+    }{
+        {nil, 401, ""},
+        {&tls.ConnectionState{}, 401, ""},
+        {cert("marketing"), 403, ""},
+        {cert("payments"), 200,
+         `{"common_name":"billing","organizational_units":["payments"],"sans":["spiffe://example.org/ns/billing"]}`},
+    } {
+        req := httptest.NewRequest("GET", "/internal/whoami", nil)
+        req.TLS = test.state
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != test.expCode {
+            t.Errorf("expected %d, got %d %s", test.expCode, rec.Code, rBody(rec.Body))
+        } else if test.expBody != "" && strings.TrimSpace(rBody(rec.Body)) != test.expBody {
+            t.Errorf("unexpected identity %s", rBody(rec.Body))
+        }
+    }
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+    m := Mux{}
+    m.HandleFunc("/ping", nil,
+        Get(func(req *Request[EmptyBody, any]) error {
+            return Bypass("pong")
+        }, nil),
+    )
+    path := filepath.Join(t.TempDir(), "cmux.sock")
+    ctx, cancel := context.WithCancel(context.Background())
+    errc := make(chan error, 1)
+    go func() {
+        errc <- m.ListenAndServeUnix(ctx, path, 0600)
+    }()
+    client := &http.Client{Transport: &http.Transport{
+        DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+            return (&net.Dialer{}).DialContext(ctx, "unix", path)
+        },
+    }}
+    var res *http.Response
+    var err error
+    for i := 0; i < 100; i++ {
+        if res, err = client.Get("http://unix/ping"); err == nil {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if err != nil {
+        t.Fatalf("request failed: %v", err)
+    }
+    if body := strings.TrimSpace(rBody(res.Body)); body != `"pong"` {
+        t.Errorf("unexpected body %s", body)
+    }
+    res.Body.Close()
+    if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+        t.Errorf("unexpected socket permissions %v %v", fi, err)
+    }
+    cancel()
+    if err := <-errc; err != nil {
+        t.Errorf("expected graceful shutdown, got %v", err)
+    }
+    if _, err := os.Stat(path); !os.IsNotExist(err) {
+        t.Errorf("expected socket to be removed, got %v", err)
+    }
+}
+
+func TestSystemdListeners(t *testing.T) {
+    if ls, err := activatedListeners("", "", "", 3); ls != nil || err != nil {
+        t.Errorf("expected no listeners, got %v %v", ls, err)
+    }
+    if ls, err := activatedListeners("1", "1", "", 3); ls != nil || err != nil {
+        t.Errorf("expected no listeners for another process, got %v %v", ls, err)
+    }
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen failed: %v", err)
+    }
+    defer l.Close()
+    f, err := l.(*net.TCPListener).File()
+    if err != nil {
+        t.Fatalf("File failed: %v", err)
+    }
+    pid := strconv.Itoa(os.Getpid())
+    ls, err := activatedListeners(pid, "1", "http", int(f.Fd()))
+    /*
+     * activatedListeners took ownership of the descriptor and closed it,
+     * close f now rather than letting its finalizer close the descriptor
+     * again once its number has been reused by another test
+     */
+    f.Close()
+    if err != nil || len(ls) != 1 {
+        t.Fatalf("expected a listener, got %v %v", ls, err)
+    }
+    defer ls[0].Close()
+    if ls[0].Addr().String() != l.Addr().String() {
+        t.Errorf("expected listener on %s, got %s", l.Addr(), ls[0].Addr())
+    }
+    if _, err := activatedListeners(pid, "x", "", 3); err == nil {
+        t.Errorf("expected error for invalid LISTEN_FDS")
+    }
+}
+
+/* writeTestCert writes a self-signed certificate for 127.0.0.1 */
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf("ecdsa.GenerateKey failed: %v", err)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatalf("x509.CreateCertificate failed: %v", err)
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatalf("x509.MarshalECPrivateKey failed: %v", err)
+    }
+    dir := t.TempDir()
+    certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+    os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+    os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+    return certFile, keyFile
+}
+
+/* freeAddr returns a local address with a free port */
+func freeAddr(t *testing.T) string {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen failed: %v", err)
+    }
+    defer l.Close()
+    return l.Addr().String()
+}
+
+type testHTTP3Server struct {
+    port   string
+    fail   error
+    closed chan struct{}
+}
+
+func (s *testHTTP3Server) ListenAndServeTLS(certFile, keyFile string) error {
+    if s.fail != nil {
+        return s.fail
+    }
+    <-s.closed
+    return http.ErrServerClosed
+}
+
+func (s *testHTTP3Server) SetQUICHeaders(hdr http.Header) error {
+    hdr.Set("Alt-Svc", `h3=":` + s.port + `"; ma=2592000`)
+    return nil
+}
+
+func (s *testHTTP3Server) Close() error {
+    close(s.closed)
+    return nil
+}
+
+func TestHTTP3(t *testing.T) {
+    certFile, keyFile := writeTestCert(t)
+    addr := freeAddr(t)
+    _, port, _ := net.SplitHostPort(addr)
+    m := Mux{}
+    m.HandleFunc("/ping", nil,
+        Get(func(req *Request[EmptyBody, any]) error {
+            return Bypass("pong")
+        }, nil),
+    )
+    entered, release := make(chan struct{}), make(chan struct{})
+    m.HandleFunc("/slow", nil,
+        Get(func(req *Request[EmptyBody, any]) error {
+            close(entered)
+            <-release
+            return nil
+        }, nil),
+    )
+    h3 := &testHTTP3Server{port: port, closed: make(chan struct{})}
+    m.SetHTTP3Server(h3)
+    ctx, cancel := context.WithCancel(context.Background())
+    errc := make(chan error, 1)
+    go func() {
+        errc <- m.ListenAndServeTLS(ctx, addr, certFile, keyFile)
+    }()
+    client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+    var res *http.Response
+    var err error
+    for i := 0; i < 100; i++ {
+        if res, err = client.Get("https://" + addr + "/ping"); err == nil {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if err != nil {
+        t.Fatalf("request failed: %v", err)
+    }
+    res.Body.Close()
+    if alt := res.Header.Get("Alt-Svc"); alt != `h3=":` + port + `"; ma=2592000` || res.StatusCode != 200 {
+        t.Errorf("unexpected response %d with Alt-Svc %q", res.StatusCode, alt)
+    }
+    /* an HTTP/3 request in flight delays closing the HTTP/3 server */
+    req, err := http.NewRequest("GET", "/slow", nil)
+    if err != nil {
+        t.Fatalf("http.NewRequest failed: %v", err)
+    }
+    req.ProtoMajor = 3
+    go m.ServeHTTP(httptest.NewRecorder(), req)
+    <-entered
+    cancel()
+    time.Sleep(50 * time.Millisecond)
+    select {
+    case <-h3.closed:
+        t.Errorf("HTTP/3 server closed with a request in flight")
+    default:
+    }
+    close(release)
+    if err := <-errc; err != nil {
+        t.Errorf("expected graceful shutdown, got %v", err)
+    }
+    select {
+    case <-h3.closed:
+    default:
+        t.Errorf("expected HTTP/3 server to be closed")
+    }
+
+    failing := errors.New("udp port in use")
+    m.SetHTTP3Server(&testHTTP3Server{fail: failing, closed: make(chan struct{})})
+    if err := m.ListenAndServeTLS(context.Background(), freeAddr(t), certFile, keyFile); err != failing {
+        t.Errorf("expected HTTP/3 error, got %v", err)
+    }
+}
+
+func TestH2C(t *testing.T) {
+    m := Mux{}
+    m.EnableH2C(true)
+    m.HandleFunc("/proto", nil,
+        Get(func(req *Request[EmptyBody, any]) error {
+            return Bypass(req.HTTPReq.Proto)
+        }, nil),
+    )
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen failed: %v", err)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    errc := make(chan error, 1)
+    go func() {
+        errc <- m.Serve(ctx, l)
+    }()
+    for _, test := range []struct {
+        h2c      bool
+        expProto string
+    }{
+        {true, `"HTTP/2.0"`},
+        {false, `"HTTP/1.1"`},
+    } {
+        protocols := new(http.Protocols)
+        protocols.SetHTTP1(!test.h2c)
+        protocols.SetUnencryptedHTTP2(test.h2c)
+        client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+        res, err := client.Get("http://" + l.Addr().String() + "/proto")
+        if err != nil {
+            t.Fatalf("request failed: %v", err)
+        }
+        if body := strings.TrimSpace(rBody(res.Body)); body != test.expProto {
+            t.Errorf("expected %s, got %s", test.expProto, body)
+        }
+        res.Body.Close()
+        client.CloseIdleConnections()
+    }
+    cancel()
+    if err := <-errc; err != nil {
+        t.Errorf("expected graceful shutdown, got %v", err)
+    }
+}
+
+func TestFunctionHandler(t *testing.T) {
+    type MD struct {
+        ID string `cmux:"id"`
+    }
+    m := Mux{}
+    m.HandleFunc("/files/{id}", &MD{},
+        Put(func(req *Request[[]byte, *MD]) error {
+            return Bypass(fmt.Sprintf("%s %x", req.Metadata.ID, req.Body))
+        }, nil),
+    )
+    m.HandleFunc("/health", nil,
+        Get(func(req *Request[EmptyBody, any]) error {
+            return Bypass("ok")
+        }, nil),
+    )
+    h := m.FunctionHandler("/api/")
+    for _, test := range []struct {
+        method  string
+        path    string
+        body    string
+        expCode int
+        expBody string
+    }{
+        {"PUT", "/api/files/a%2Fb", "\x00\xff", 200, `"a/b 00ff"`},
+        {"GET", "/api/health", "", 200, `"ok"`},
+        {"PUT", "/files/x", "", 200, `"x "`},
+        {"PUT", "/apifiles/x", "", 404, ""},
+    } {
+        req, err := http.NewRequest(test.method, test.path, strings.NewReader(test.body))
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        if rec.Code != test.expCode || test.expBody != "" && strings.TrimSpace(rBody(rec.Body)) != test.expBody {
+            t.Errorf("%s %s: expected %d %s, got %d %s", test.method, test.path,
+                     test.expCode, test.expBody, rec.Code, rBody(rec.Body))
+        }
+    }
+
+    if err := m.ServeAzureFunctions(context.Background(), "/api"); err == nil {
+        t.Errorf("expected error without FUNCTIONS_CUSTOMHANDLER_PORT")
+    }
+    _, port, _ := net.SplitHostPort(freeAddr(t))
+    t.Setenv("FUNCTIONS_CUSTOMHANDLER_PORT", port)
+    ctx, cancel := context.WithCancel(context.Background())
+    errc := make(chan error, 1)
+    go func() {
+        errc <- m.ServeAzureFunctions(ctx, "/api")
+    }()
+    var res *http.Response
+    var err error
+    for i := 0; i < 100; i++ {
+        if res, err = http.Get("http://127.0.0.1:" + port + "/api/health"); err == nil {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if err != nil {
+        t.Fatalf("request failed: %v", err)
+    }
+    if body := strings.TrimSpace(rBody(res.Body)); body != `"ok"` {
+        t.Errorf("unexpected body %s", body)
+    }
+    res.Body.Close()
+    cancel()
+    if err := <-errc; err != nil {
+        t.Errorf("expected graceful shutdown, got %v", err)
+    }
+}
+
+func TestServeFCGI(t *testing.T) {
+    type MD struct {
+        ID string `cmux:"id"`
+    }
+    m := Mux{}
+    m.HandleFunc("/users/{id}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            return Bypass(req.Metadata.ID)
+        }, nil),
+    )
+    for _, test := range []struct {
+        scriptName string
+        path       string
+        expCode    int
+        expBody    string
+    }{
+        {"/app", "/app/users/a%2Fb", 200, `"a/b"`},
+        {"/app/", "/app/users/1", 200, `"1"`},
+        {"", "/users/2", 200, `"2"`},
+        {"/app", "/users/3", 200, `"3"`},
+        {"/app", "/app", 404, ""},
+    } {
+        h := m.gatewayHandler(func(_ *http.Request, key string) string {
+            if key == "SCRIPT_NAME" {
+                return test.scriptName
+            }
+            return ""
+        })
+        req, err := http.NewRequest("GET", test.path, nil)
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        if rec.Code != test.expCode || test.expBody != "" && strings.TrimSpace(rBody(rec.Body)) != test.expBody {
+            t.Errorf("%s %s: expected %d %s, got %d %s", test.scriptName, test.path,
+                     test.expCode, test.expBody, rec.Code, rBody(rec.Body))
+        }
+    }
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen failed: %v", err)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    errc := make(chan error, 1)
+    go func() {
+        errc <- m.ServeFCGI(ctx, l)
+    }()
+    cancel()
+    if err := <-errc; err != nil {
+        t.Errorf("expected graceful shutdown, got %v", err)
+    }
+}
+
+func TestEnablePprof(t *testing.T) {
+    m := Mux{}
+    authorize := func(r *http.Request) error {
+        if r.Header.Get("X-Debug-Token") != "secret" {
+            return errors.New("missing token")
+        }
+        return nil
+    }
+    m.EnablePprof("/internal/pprof", authorize)
+    m.EnableExpvar("/internal/vars", authorize)
+    for _, test := range []struct {
+        path     string
+        token    string
+        expCode  int
+        contains string
+    }{
+        {"/internal/pprof/", "", 403, ""},
+        {"/internal/pprof/", "secret", 200, "goroutine"},
+        {"/internal/pprof/goroutine?debug=1", "secret", 200, "goroutine profile"},
+        {"/internal/pprof/cmdline", "secret", 200, os.Args[0]},
+        {"/internal/vars", "", 403, ""},
+        {"/internal/vars", "secret", 200, `"memstats"`},
+    } {
+        req, err := http.NewRequest("GET", test.path, nil)
+        if err != nil {
+            t.Fatalf("http.NewRequest failed: %v", err)
+        }
+        req.Header.Set("X-Debug-Token", test.token)
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if body := rBody(rec.Body); rec.Code != test.expCode || !strings.Contains(body, test.contains) {
+            t.Errorf("%s: expected %d containing %q, got %d %.200s", test.path, test.expCode, test.contains, rec.Code, body)
+        }
+    }
+}
+
+func TestValidate(t *testing.T) {
+    type UserMD struct {
+        ID int `cmux:"id"`
+    }
+    type ItemMD struct {
+        Name string `cmux:"name"`
+        ID   int    `cmux:"id"`
+    }
+    type PostMD struct {
+        Org  string `cmux:"org"`
+        ID   int    `cmux:"id"`
+    }
+    get := Get(func(req *Request[EmptyBody, any]) error { return nil }, nil)
+    m := Mux{}
+    m.HandleFunc("/users/me", nil, get)
+    m.HandleFunc("/users/{id}", &UserMD{}, get)
+    if problems := m.Validate(); len(problems) != 0 {
+        t.Errorf("expected no problems, got %v", problems)
+    }
+    m.HandleFunc("/items/{name}", &ItemMD{}, get)
+    m.HandleFunc("/items/{id}", &ItemMD{}, get)
+    m.HandleFunc("/users/{id}/posts", &PostMD{}, get)
+    var got []string
+    for _, p := range m.Validate() {
+        got = append(got, p.String())
+    }
+    exp := []string{
+        `ambiguous /items/{id}: {name} and {id} both match "1"`,
+        `unreachable /items/{id}: requests such as "/items/1" are matched by /items/{name}`,
+        `missing_field /users/{id}/posts: path variable {id} is stored in the field of another metadata type than *cmux.PostMD`,
+        `unused_field /users/{id}/posts: field Org of *cmux.PostMD is tagged as path variable {org}, which no pattern references`,
+    }
+    if !slices.Equal(got, exp) {
+        t.Errorf("unexpected problems:\n%s", strings.Join(got, "\n"))
+    }
+}
+
+func TestPathDefaults(t *testing.T) {
+    type MD struct {
+        Name string `cmux:"name,required"`
+        Page int    `path:"page,default=1"`
+        ID   int    `path:"id,required"`
+        Q    string `query:"q,required"`
+    }
+    m := Mux{}
+    var got MD
+    h := func(req *Request[EmptyBody, *MD]) error {
+        got = *req.Metadata
+        return nil
+    }
+    m.HandleFunc("/users/{name}", &MD{}, Get(h, nil))
+    m.HandleFunc("/pages/{page}", &MD{}, Get(h, nil))
+    m.HandleFunc("/items/{id}", &MD{}, Get(h, nil))
+    test := func(url string, expCode int) string {
+        req, err := http.NewRequest("GET", url, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return ""
+        }
+        got = MD{}
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s: expected %d, got %d %s", url, expCode, rec.Code, rBody(rec.Body))
+        }
+        return rBody(rec.Body)
+    }
+    test("/users/alice?q=x", 200)
+    if got.Name != "alice" {
+        t.Errorf("unexpected binding %+v", got)
+    }
+    body := test("/users/", 400)
+    if !strings.Contains(body, `{"in":"path","name":"name","reason":"required"},{"in":"query","name":"q","reason":"required"}`) {
+        t.Errorf("expected missing fields to be listed, got %s", body)
+    }
+    test("/pages/?q=x", 200)
+    if got.Page != 1 {
+        t.Errorf("expected default page, got %+v", got)
+    }
+    test("/pages/4?q=x", 200)
+    if got.Page != 4 {
+        t.Errorf("unexpected page %+v", got)
+    }
+    /* zero values of required variables are present */
+    test("/items/0?q=x", 200)
+}
+
+func TestOneOf(t *testing.T) {
+    type MD struct {
+        Status string   `cmux:"status,oneof=active|archived"`
+        Sort   string   `query:"sort,oneof=name|date,default=name"`
+        Fields []string `query:"fields,oneof=id|name|email"`
+        ID     string
+    }
+    m := Mux{}
+    var got MD
+    m.HandleFunc("/users/{status}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            got = *req.Metadata
+            return nil
+        }, nil),
+    )
+    m.HandleFunc("/users/{id}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            got = *req.Metadata
+            return nil
+        }, nil),
+    )
+    test := func(url string, expCode int) {
+        req, err := http.NewRequest("GET", url, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        got = MD{}
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s: expected %d, got %d %s", url, expCode, rec.Code, rBody(rec.Body))
+        }
+    }
+    test("/users/archived?fields=id,email", 200)
+    if got.Status != "archived" || got.Sort != "name" || !reflect.DeepEqual(got.Fields, []string{"id", "email"}) {
+        t.Errorf("unexpected binding %+v", got)
+    }
+    test("/users/u123", 200)
+    if got.Status != "" || got.ID != "u123" {
+        t.Errorf("expected fall through to {id}, got %+v", got)
+    }
+    test("/users/active?sort=size", 400)
+    test("/users/active?fields=id,password", 400)
+}
+
+type testOrderID uint32
+
+type testTag struct {
+    parts []string
+}
+
+func TestRegisterPathType(t *testing.T) {
+    RegisterPathType(func(s string) (testOrderID, error) {
+        n, err := strconv.ParseUint(strings.TrimPrefix(s, "ord_"), 10, 32)
+        if err != nil || !strings.HasPrefix(s, "ord_") {
+            return 0, errors.New("invalid order id")
+        }
+        return testOrderID(n), nil
+    })
+    RegisterPathType(func(s string) (testTag, error) {
+        return testTag{strings.Split(s, ":")}, nil
+    })
+    type FlatMD struct {
+        Order testOrderID
+        Name  string
+    }
+    type MD struct {
+        Order *testOrderID
+        Tag   testTag
+        Ref   testOrderID `query:"ref"`
+    }
+    m := Mux{}
+    var flat FlatMD
+    var got MD
+    m.HandleFunc("/orders/{order}", &FlatMD{Name: "x"},
+        Get(func(req *Request[EmptyBody, *FlatMD]) error {
+            flat = *req.Metadata
+            return nil
+        }, nil),
+    )
+    m.HandleFunc("/tagged/{order}/{tag}", &MD{},
+        Get(func(req *Request[EmptyBody, *MD]) error {
+            got = *req.Metadata
+            return nil
+        }, nil),
+    )
+    test := func(url string, expCode int) {
+        req, err := http.NewRequest("GET", url, nil)
+        if err != nil {
+            t.Errorf("http.NewRequest failed: %v", err)
+            return
+        }
+        rec := httptest.NewRecorder()
+        m.ServeHTTP(rec, req)
+        if rec.Code != expCode {
+            t.Errorf("%s: expected %d, got %d %s", url, expCode, rec.Code, rBody(rec.Body))
+        }
+    }
+    for _, safe := range []bool{false, true} {
+        m.SetSafeMetadata(safe)
+        test("/orders/ord_42", 200)
+        if flat.Order != 42 || flat.Name != "x" {
+            t.Errorf("unexpected binding %+v", flat)
+        }
+        test("/orders/42", 404)
+        test("/tagged/ord_7/a:b?ref=ord_9", 200)
+        if got.Order == nil || *got.Order != 7 || !reflect.DeepEqual(got.Tag.parts, []string{"a", "b"}) || got.Ref != 9 {
+            t.Errorf("unexpected binding %+v", got)
+        }
+        test("/tagged/ord_7/a?ref=9", 400)
+    }
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "encoding/json"
+    "io"
+    "iter"
+    "net/http"
+    "time"
+)
+
+// streamBody is implemented by body types reading the request body
+// themselves rather than having it decoded up front.
+type streamBody interface {
+    setBody(r io.Reader)
+}
+
+// NDJSON is a request body of newline-delimited JSON values of type T.
+// The values are decoded lazily while iterating over Items:
+//
+//  cmux.Post(func(req *cmux.Request[cmux.NDJSON[Item], *Md]) error {
+//      for item, err := range req.Body.Items() {
+//          if err != nil {
+//              return cmux.WrapError(err, http.StatusBadRequest)
+//          }
+//          ...
+//      }
+//      return nil
+//  }, nil)
+type NDJSON[T any] struct {
+    r io.Reader
+}
+
+func (n *NDJSON[T]) setBody(r io.Reader) {
+    n.r = r
+}
+
+// Items iterates over the values of the body. Iteration stops after the
+// first error.
+func (n *NDJSON[T]) Items() iter.Seq2[T, error] {
+    return func(yield func(T, error) bool) {
+        if n.r == nil {
+            return
+        }
+        dec := json.NewDecoder(n.r)
+        for {
+            var v T
+            err := dec.Decode(&v)
+            if err == io.EOF {
+                return
+            } else if err != nil {
+                yield(v, err)
+                return
+            }
+            if !yield(v, nil) {
+                return
+            }
+        }
+    }
+}
+
+// NDJSONFlushInterval is how often streamed NDJSON responses are flushed
+// to the client.
+var NDJSONFlushInterval = 100 * time.Millisecond
+
+type ndjsonResponse[T any] struct {
+    seq iter.Seq[T]
+    ch  <-chan T
+}
+
+// StreamNDJSON returns an error that when returned in a MethodHandler
+// streams the values of seq as newline-delimited JSON, periodically
+// flushing the response.
+func StreamNDJSON[T any](seq iter.Seq[T]) error {
+    return &ndjsonResponse[T]{seq: seq}
+}
+
+// StreamNDJSONChan is like StreamNDJSON but streams the values received
+// from ch until it is closed or the client goes away.
+func StreamNDJSONChan[T any](ch <-chan T) error {
+    return &ndjsonResponse[T]{ch: ch}
+}
+
+func (nr *ndjsonResponse[T]) Error() string {
+    return "ndjson response not streamed"
+}
+
+func (nr *ndjsonResponse[T]) MarshalResponse(w http.ResponseWriter) error {
+    return nr.stream(w, nil)
+}
+
+func (nr *ndjsonResponse[T]) marshalRequest(w http.ResponseWriter, r *http.Request) error {
+    return nr.stream(w, r.Context())
+}
+
+/* stream writes the values until they run out or ctx, if any, is done. */
+func (nr *ndjsonResponse[T]) stream(w http.ResponseWriter, ctx context.Context) error {
+    var done <-chan struct{}
+    if ctx != nil {
+        done = ctx.Done()
+    }
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    w.WriteHeader(http.StatusOK)
+    rc := http.NewResponseController(w)
+    enc := json.NewEncoder(w)
+    if nr.seq != nil {
+        lastFlush := time.Now()
+        for v := range nr.seq {
+            select {
+            case <-done:
+                return ctx.Err()
+            default:
+            }
+            if err := enc.Encode(v); err != nil {
+                return err
+            }
+            if time.Since(lastFlush) >= NDJSONFlushInterval {
+                rc.Flush()
+                lastFlush = time.Now()
+            }
+        }
+        rc.Flush()
+        return nil
+    }
+    ticker := time.NewTicker(NDJSONFlushInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case v, ok := <-nr.ch:
+            if !ok {
+                rc.Flush()
+                return nil
+            }
+            if err := enc.Encode(v); err != nil {
+                return err
+            }
+        case <-ticker.C:
+            if err := rc.Flush(); err != nil && err != http.ErrNotSupported {
+                return err
+            }
+        case <-done:
+            return ctx.Err()
+        }
+    }
+}
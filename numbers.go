@@ -0,0 +1,130 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "encoding/json"
+    "reflect"
+    "strings"
+)
+
+// maxSafeInteger is the largest integer a float64, and thereby a JavaScript
+// number, can represent exactly.
+const maxSafeInteger = 1 << 53
+
+// SetSafeIntegers makes JSON responses encode integers that cannot be
+// represented exactly by JavaScript numbers (i.e. beyond ±2^53) as strings.
+// Request bodies will in turn accept numbers encoded as strings for all
+// numeric fields.
+func (mux *Mux) SetSafeIntegers(enable bool) {
+    mux.safeIntegers = enable
+}
+
+// SafeIntegers overrides Mux.SetSafeIntegers for a single route.
+func SafeIntegers(enable bool) RouteOption {
+    return func(o *routeOptions) {
+        o.safeIntegers = mkOptBool(enable)
+    }
+}
+
+// isUnsafeInteger reports whether n is an integer outside ±2^53.
+func isUnsafeInteger(n json.Number) bool {
+    str := strings.TrimPrefix(n.String(), "-")
+    if strings.ContainsAny(str, ".eE") {
+        return false
+    }
+    const maxSafeStr = "9007199254740992"
+    if len(str) != len(maxSafeStr) {
+        return len(str) > len(maxSafeStr)
+    }
+    return str > maxSafeStr
+}
+
+func reflectTypeOf(v any) reflect.Type {
+    t := reflect.TypeOf(v)
+    for t != nil && t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    return t
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// coerceNumericStrings walks the decoded JSON value v alongside the Go type t
+// it is going to be decoded into, and converts numeric strings destined
+// for numeric fields into numbers.
+func coerceNumericStrings(v any, t reflect.Type) any {
+    for t != nil && t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    if t == nil || reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+        return v
+    }
+    switch t.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+         reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+         reflect.Float32, reflect.Float64:
+        if str, ok := v.(string); ok {
+            n := json.Number(strings.TrimSpace(str))
+            if _, err := n.Float64(); err == nil {
+                return n
+            }
+        }
+    case reflect.Slice, reflect.Array:
+        if arr, ok := v.([]any); ok {
+            for i := range arr {
+                arr[i] = coerceNumericStrings(arr[i], t.Elem())
+            }
+        }
+    case reflect.Map:
+        if obj, ok := v.(map[string]any); ok {
+            for k := range obj {
+                obj[k] = coerceNumericStrings(obj[k], t.Elem())
+            }
+        }
+    case reflect.Struct:
+        obj, ok := v.(map[string]any)
+        if !ok {
+            break
+        }
+        fields := jsonFieldTypes(t)
+        for k := range obj {
+            if ft, ok := fields[k]; ok {
+                obj[k] = coerceNumericStrings(obj[k], ft)
+            } else if ft, ok := fields[strings.ToLower(k)]; ok {
+                obj[k] = coerceNumericStrings(obj[k], ft)
+            }
+        }
+    }
+    return v
+}
+
+// jsonFieldTypes maps the JSON names of a struct's fields to their types,
+// both as is and lower-cased (encoding/json matches keys case-insensitively).
+// Fields using the ",string" option are left out as they expect strings anyway.
+func jsonFieldTypes(t reflect.Type) map[string]reflect.Type {
+    fields := map[string]reflect.Type{}
+    for _, f := range reflect.VisibleFields(t) {
+        if !f.IsExported() || (f.Anonymous && f.Tag.Get("json") == "") {
+            continue
+        }
+        name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+        if name == "-" && opts == "" {
+            continue
+        }
+        if strings.Contains(opts, "string") {
+            continue
+        }
+        if name == "" {
+            name = f.Name
+        }
+        if _, ok := fields[name]; !ok {
+            fields[name] = f.Type
+        }
+        if _, ok := fields[strings.ToLower(name)]; !ok {
+            fields[strings.ToLower(name)] = f.Type
+        }
+    }
+    return fields
+}
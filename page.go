@@ -0,0 +1,117 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "net/http"
+    "net/url"
+    "strconv"
+)
+
+// Page is a metadata mixin binding the limit, offset and cursor query
+// parameters of list endpoints. The metadata template sets the default
+// and maximum limits:
+//
+//  type ListMd struct {
+//      cmux.Page
+//  }
+//  m.HandleFunc("/users", &ListMd{Page: cmux.Page{Limit: 20, MaxLimit: 100}}, ...)
+//
+// Requests exceeding MaxLimit or using negative offsets are rejected with
+// 400 Bad Request.
+type Page struct {
+    Limit    int
+    MaxLimit int /* 0 means unbounded */
+    Offset   int
+    Cursor   string
+}
+
+func (p *Page) BindQuery(q url.Values) error {
+    if v := q.Get("limit"); v != "" {
+        limit, err := strconv.Atoi(v)
+        if err != nil || limit < 1 || (p.MaxLimit > 0 && limit > p.MaxLimit) {
+            if err == nil {
+                err = errors.New("limit out of bounds")
+            }
+            return invalidParam("limit", err).WithDetail("max", p.MaxLimit)
+        }
+        p.Limit = limit
+    }
+    if v := q.Get("offset"); v != "" {
+        offset, err := strconv.Atoi(v)
+        if err != nil || offset < 0 {
+            if err == nil {
+                err = errors.New("negative offset")
+            }
+            return invalidParam("offset", err)
+        }
+        p.Offset = offset
+    }
+    p.Cursor = q.Get("cursor")
+    return nil
+}
+
+// Paginated is a page of a list response:
+//
+//  {"items": [...], "next_cursor": "...", "total": 42}
+//
+// Returning it from a handler also sets a Link header with the next and
+// previous pages, based on NextCursor or, for offset based pagination, the
+// Page the items were listed with.
+type Paginated[T any] struct {
+    Items      []T    `json:"items"`
+    NextCursor string `json:"next_cursor,omitempty"`
+    Total      *int   `json:"total,omitempty"`
+    Page       Page   `json:"-"`
+}
+
+func (p *Paginated[T]) HTTPRespond() (any, error) {
+    if p.Items == nil {
+        p.Items = []T{}
+    }
+    return p, nil
+}
+
+func (p *Paginated[T]) Error() string {
+    return "not filtered"
+}
+
+func (p *Paginated[T]) links(w http.ResponseWriter, r *http.Request) {
+    link := func(set func(q url.Values), rel string) string {
+        u := *r.URL
+        q := u.Query()
+        set(q)
+        u.RawQuery = q.Encode()
+        return "<" + u.RequestURI() + `>; rel="` + rel + `"`
+    }
+    var links []string
+    if p.NextCursor != "" {
+        links = append(links, link(func(q url.Values) {
+            q.Set("cursor", p.NextCursor)
+        }, "next"))
+    } else if limit := p.Page.Limit; limit > 0 {
+        next := p.Page.Offset + limit
+        if (p.Total != nil && next < *p.Total) || (p.Total == nil && len(p.Items) == limit) {
+            links = append(links, link(func(q url.Values) {
+                q.Set("offset", strconv.Itoa(next))
+                q.Set("limit", strconv.Itoa(limit))
+            }, "next"))
+        }
+        if p.Page.Offset > 0 {
+            links = append(links, link(func(q url.Values) {
+                q.Set("offset", strconv.Itoa(max(p.Page.Offset - limit, 0)))
+                q.Set("limit", strconv.Itoa(limit))
+            }, "prev"))
+        }
+    }
+    for _, l := range links {
+        w.Header().Add("Link", l)
+    }
+}
+
+/* linker is implemented by response bodies setting Link headers */
+type linker interface {
+    links(w http.ResponseWriter, r *http.Request)
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "encoding/json"
+    "reflect"
+    "sort"
+    "strings"
+)
+
+// Patchable wraps a request body, recording which JSON fields were present
+// in the request. This lets PATCH handlers distinguish fields that were
+// omitted from fields explicitly set to their zero value, e.g.
+//
+//  cmux.Patch(func(req *cmux.Request[cmux.Patchable[User], *Md]) error {
+//      if req.Body.Has("email") {
+//          user.Email = req.Body.Value.Email
+//      }
+//      ...
+//  }, nil)
+type Patchable[T any] struct {
+    Value  T
+    fields map[string]struct{}
+    opts   DecodeOptions
+}
+
+/* decodeOptioner is implemented by bodies decoding themselves using the
+ * decoding options of the route */
+type decodeOptioner interface {
+    setDecodeOptions(opts DecodeOptions)
+}
+
+func (p *Patchable[T]) setDecodeOptions(opts DecodeOptions) {
+    p.opts = opts
+}
+
+func (p *Patchable[T]) UnmarshalJSON(b []byte) error {
+    dec := json.NewDecoder(bytes.NewReader(b))
+    if p.opts.DisallowUnknownFields {
+        dec.DisallowUnknownFields()
+    }
+    if p.opts.UseNumber {
+        dec.UseNumber()
+    }
+    if err := dec.Decode(&p.Value); err != nil {
+        return err
+    }
+    p.fields = map[string]struct{}{}
+    return recordFields("", b, reflect.TypeFor[T](), p.fields)
+}
+
+// Has reports whether the JSON field was present in the request. Fields are
+// specified by their JSON names, and fields of nested objects using dots,
+// e.g. "address.city".
+func (p *Patchable[T]) Has(field string) bool {
+    _, ok := p.fields[field]
+    return ok
+}
+
+// Fields returns the sorted paths of all fields present in the request.
+func (p *Patchable[T]) Fields() []string {
+    fields := make([]string, 0, len(p.fields))
+    for f := range p.fields {
+        fields = append(fields, f)
+    }
+    sort.Strings(fields)
+    return fields
+}
+
+/* recordFields records the paths of the fields of the JSON object b which
+ * is decoded into t. Keys are recorded by the JSON names of the struct
+ * fields they match, case-insensitively as encoding/json matches them, and
+ * keys matching no field are left out. */
+func recordFields(prefix string, b []byte, t reflect.Type, fields map[string]struct{}) error {
+    b = bytes.TrimSpace(b)
+    if len(b) == 0 || b[0] != '{' {
+        return nil
+    }
+    for t != nil && t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    var obj map[string]json.RawMessage
+    if err := json.Unmarshal(b, &obj); err != nil {
+        return err
+    }
+    for k, v := range obj {
+        name, ft := k, reflect.Type(nil)
+        switch {
+        case t == nil || t.Kind() == reflect.Interface:
+        case t.Kind() == reflect.Map:
+            ft = t.Elem()
+        case t.Kind() == reflect.Struct:
+            sf, ok := jsonField(t, k)
+            if !ok {
+                continue
+            }
+            name, ft = sf.name, t.FieldByIndex(sf.index).Type
+        default:
+            continue
+        }
+        fields[prefix + name] = struct{}{}
+        if err := recordFields(prefix + name + ".", v, ft, fields); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/* jsonField returns the field of the struct type t which encoding/json
+ * decodes the key into, preferring an exact match */
+func jsonField(t reflect.Type, key string) (structField, bool) {
+    fields := fieldsOf(t)
+    for _, sf := range fields {
+        if sf.name == key {
+            return sf, true
+        }
+    }
+    for _, sf := range fields {
+        if strings.EqualFold(sf.name, key) {
+            return sf, true
+        }
+    }
+    return structField{}, false
+}
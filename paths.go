@@ -0,0 +1,240 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "net/http"
+    "net/url"
+    "strings"
+)
+
+// EncodedSlashes is the policy for percent-encoded slashes (%2F) in
+// request paths, see Mux.SetEncodedSlashes.
+type EncodedSlashes uint8
+
+const(
+    // EncodedSlashKeep matches %2F as a slash within the path segment,
+    // e.g. "/files/a%2Fb" matches "/files/{name}" with name "a/b".
+    EncodedSlashKeep EncodedSlashes = iota
+    // EncodedSlashSplit treats %2F as a path separator, e.g.
+    // "/files/a%2Fb" matches "/files/a/b".
+    EncodedSlashSplit
+    // EncodedSlashReject responds 400 Bad Request to paths containing %2F.
+    EncodedSlashReject
+)
+
+// SetEncodedSlashes sets how percent-encoded slashes in request paths are
+// matched. The default is EncodedSlashKeep.
+func (mux *Mux) SetEncodedSlashes(policy EncodedSlashes) {
+    mux.encodedSlashes = policy
+}
+
+var errEncodedSlash = errors.New("encoded slash in path")
+
+// splitPath splits the path of u into its percent-decoded segments,
+// without the leading empty segment. If matrix is non-nil, matrix
+// parameters such as ";color=red" are removed from the segments and added
+// to it. Paths are only rejected with errEncodedSlash or an invalid escape
+// error.
+func (mux *Mux) splitPath(u *url.URL, matrix url.Values) ([]string, error) {
+    /* RawPath is only set when the path contains unusual escapes */
+    if u.RawPath == "" || mux.encodedSlashes == EncodedSlashSplit {
+        dirs := strings.Split(u.Path, "/")[1:]
+        if matrix != nil {
+            for i, dir := range dirs {
+                dirs[i], _ = cutMatrix(dir, matrix, false)
+            }
+        }
+        return dirs, nil
+    }
+    raw := u.EscapedPath()
+    if mux.encodedSlashes == EncodedSlashReject &&
+       (strings.Contains(raw, "%2F") || strings.Contains(raw, "%2f")) {
+        return nil, errEncodedSlash
+    }
+    dirs := strings.Split(raw, "/")[1:]
+    for i, dir := range dirs {
+        if matrix != nil {
+            var err error
+            if dir, err = cutMatrix(dir, matrix, true); err != nil {
+                return nil, err
+            }
+        }
+        if !strings.Contains(dir, "%") {
+            dirs[i] = dir
+            continue
+        }
+        dec, err := url.PathUnescape(dir)
+        if err != nil {
+            return nil, err
+        }
+        dirs[i] = dec
+    }
+    return dirs, nil
+}
+
+// EnableMatrixParams makes the mux remove matrix parameters, e.g.
+// ";color=red;year=2020" of "/cars;color=red;year=2020", from path
+// segments before matching. The parameters are bound to metadata fields
+// tagged e.g. `matrix:"color"`, which accept the same options as query
+// fields.
+func (mux *Mux) EnableMatrixParams(enable bool) {
+    mux.matrixParams = enable
+}
+
+/* cutMatrix removes the matrix parameters of dir, adding them to matrix */
+func cutMatrix(dir string, matrix url.Values, escaped bool) (string, error) {
+    dir, params, found := strings.Cut(dir, ";")
+    for found {
+        var param string
+        param, params, found = strings.Cut(params, ";")
+        key, value, _ := strings.Cut(param, "=")
+        if escaped {
+            var err error
+            if key, err = url.PathUnescape(key); err != nil {
+                return "", err
+            }
+            if value, err = url.PathUnescape(value); err != nil {
+                return "", err
+            }
+        }
+        if key != "" {
+            matrix.Add(key, value)
+        }
+    }
+    return dir, nil
+}
+
+// PathNormalization is the policy for request paths containing empty,
+// "." or ".." segments, see Mux.SetPathNormalization.
+type PathNormalization uint8
+
+const(
+    // NormalizeClean matches the cleaned path, collapsing double slashes
+    // and resolving "." and ".." segments, and rewrites the URL of the
+    // request accordingly so Before functions see the cleaned path too.
+    NormalizeClean PathNormalization = iota
+    // NormalizeRedirect redirects to the cleaned path with
+    // 301 Moved Permanently, or 308 Permanent Redirect for methods other
+    // than GET and HEAD.
+    NormalizeRedirect
+    // NormalizeReject responds 400 Bad Request to unclean paths.
+    NormalizeReject
+    // NormalizeOff matches paths as they are.
+    NormalizeOff
+)
+
+// SetPathNormalization sets how paths with empty, "." or ".." segments are
+// handled before matching. The default is NormalizeClean, which prevents
+// paths such as "/public/../admin" from bypassing checks on the path
+// prefix in Before functions.
+func (mux *Mux) SetPathNormalization(policy PathNormalization) {
+    mux.pathNorm = policy
+}
+
+// cleanDirs resolves the empty, "." and ".." segments of dirs, reporting
+// whether any were found. A trailing empty segment, i.e. a trailing
+// slash, is kept.
+func cleanDirs(dirs []string) ([]string, bool) {
+    unclean := false
+    for i, d := range dirs {
+        if d == "." || d == ".." || (d == "" && i < len(dirs) - 1) {
+            unclean = true
+            break
+        }
+    }
+    if !unclean {
+        return dirs, false
+    }
+    clean := make([]string, 0, len(dirs))
+    for i, d := range dirs {
+        switch d {
+        case "..":
+            if len(clean) > 0 {
+                clean = clean[:len(clean) - 1]
+            }
+        case ".", "":
+        default:
+            clean = append(clean, d)
+            continue
+        }
+        if i == len(dirs) - 1 {
+            /* the path ends at a directory */
+            clean = append(clean, "")
+        }
+    }
+    if len(clean) == 0 {
+        clean = append(clean, "")
+    }
+    return clean, true
+}
+
+/* escapeDirs joins decoded path segments to an escaped path */
+func escapeDirs(dirs []string) string {
+    var b strings.Builder
+    for _, d := range dirs {
+        b.WriteByte('/')
+        b.WriteString(url.PathEscape(d))
+    }
+    return b.String()
+}
+
+// cleanPath applies the path normalization policy of the mux to the
+// segments dirs of the path of a request with the specified method. It
+// returns the segments to match, whether they differ from dirs and the
+// status to respond with instead of matching them, if any.
+func (mux *Mux) cleanPath(dirs []string, method string) ([]string, bool, int) {
+    if mux.pathNorm == NormalizeOff {
+        return dirs, false, 0
+    }
+    clean, unclean := cleanDirs(dirs)
+    if !unclean {
+        return dirs, false, 0
+    }
+    switch mux.pathNorm {
+    case NormalizeReject:
+        return nil, true, http.StatusBadRequest
+    case NormalizeRedirect:
+        if method != http.MethodGet && method != http.MethodHead {
+            return clean, true, http.StatusPermanentRedirect
+        }
+        return clean, true, http.StatusMovedPermanently
+    }
+    return clean, true, 0
+}
+
+// normalize applies the path normalization policy of the mux to the
+// segments dirs of the path of r. It returns the segments to match or
+// false if it has responded to the request.
+func (mux *Mux) normalize(w http.ResponseWriter, r *http.Request, dirs []string) ([]string, bool) {
+    clean, unclean, status := mux.cleanPath(dirs, r.Method)
+    switch status {
+    case http.StatusBadRequest:
+        http.Error(w, mux.localize(r, "invalid_path", "unclean path"), http.StatusBadRequest)
+        return nil, false
+    case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+        loc := escapeDirs(clean)
+        if r.URL.RawQuery != "" {
+            loc += "?" + r.URL.RawQuery
+        }
+        http.Redirect(w, r, loc, status)
+        return nil, false
+    }
+    if !unclean {
+        return dirs, true
+    }
+    u := *r.URL /* the URL is shared with the caller's request */
+    r.URL = &u
+    r.URL.Path = "/" + strings.Join(clean, "/")
+    r.URL.RawPath = ""
+    for _, d := range clean {
+        if strings.Contains(d, "/") {
+            /* keep encoded slashes encoded */
+            r.URL.RawPath = escapeDirs(clean)
+            break
+        }
+    }
+    return clean, true
+}
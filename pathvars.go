@@ -4,10 +4,13 @@
 
 package cmux
 import(
+    "errors"
     "log"
     "reflect"
+    "slices"
     "strconv"
     "strings"
+    "sync"
     "unsafe"
 )
 
@@ -16,16 +19,24 @@ type PathParser interface {
 }
 
 type pathFieldParser struct {
-    Fn              func(string) (unsafe.Pointer, error)
+    Fn              func(string) (unsafe.Pointer, error) /* nil for unsupported types */
+    Custom          bool /* Fn was registered using RegisterPathType */
     Type            reflect.Type
     Offset          uintptr
     Size            uintptr
+    Index           []int
 }
 
 type mdPatch struct {
     Source  unsafe.Pointer
     Offset  uintptr /* offset in metatdata struct */
     Size    uintptr
+    Custom  bool /* Source points to a value of the field's type */
+    Label   string /* the name of the path variable */
+    Raw     string /* the matched segment without prefix and suffix */
+
+    /* for reflection-based metadata copies only: */
+    Index   []int
 }
 
 func parseString(str string) (unsafe.Pointer, error) {
@@ -54,6 +65,23 @@ func getParseUint(bitSize int) func (string) (unsafe.Pointer, error) {
 
 var mdTypeMap = map[reflect.Type]map[string]pathFieldParser{}
 
+var pathTypes sync.Map /* reflect.Type -> func(string) (unsafe.Pointer, error) */
+
+// RegisterPathType registers parse as the parser of path variables, query
+// parameters, headers and cookies bound to metadata fields of type T or *T,
+// e.g. for prefixed IDs or ULIDs. Values failing to parse do not match the
+// route when used as path variables. Types must be registered before
+// routes using them.
+func RegisterPathType[T any](parse func(string) (T, error)) {
+    pathTypes.Store(reflect.TypeFor[T](), func(str string) (unsafe.Pointer, error) {
+        v, err := parse(str)
+        if err != nil {
+            return nil, err
+        }
+        return unsafe.Pointer(&v), nil
+    })
+}
+
 func parseStruct(md any) map[string]pathFieldParser {
     mdType := reflect.TypeOf(md)
     if p, ok := mdTypeMap[mdType]; ok {
@@ -68,16 +96,38 @@ func parseStruct(md any) map[string]pathFieldParser {
     }
     p := map[string]pathFieldParser{}
     for _, f := range reflect.VisibleFields(mdType) {
-        tag := f.Tag.Get("cmux")
+        tag, opts := pathTag(f)
         if tag == "-" {
             continue
         } else if tag == "" {
+            if boundElsewhere(f) {
+                continue
+            }
             if tag = strings.ToLower(f.Name); tag == "" {
                 continue
             }
         }
+        offset, ok := fieldOffset(mdType, f.Index)
+        if !ok {
+            /* promoted through an embedded pointer, cannot be patched */
+            continue
+        }
+        kind := f.Type.Kind()
+        if kind == reflect.Pointer {
+            /* pointer fields are allocated and set when matched */
+            kind = f.Type.Elem().Kind()
+        }
         var fn func(string)(unsafe.Pointer, error)
-        switch f.Type.Kind() {
+        elemType := f.Type
+        if elemType.Kind() == reflect.Pointer {
+            elemType = elemType.Elem()
+        }
+        custom := false
+        if parse, ok := pathTypes.Load(elemType); ok {
+            fn, custom = parse.(func(string) (unsafe.Pointer, error)), true
+            kind = reflect.Invalid
+        }
+        switch kind {
         case reflect.String:
             fn = parseString
         case reflect.Uint:
@@ -100,17 +150,111 @@ func parseStruct(md any) map[string]pathFieldParser {
             fn = getParseInt(16)
         case reflect.Int8:
             fn = getParseInt(8)
-        default:
-            log.Fatalln("unsupported kind: " + f.Type.Kind().String())
         }
-        if p[tag].Fn != nil  {
+        if opts.oneof != nil && fn != nil {
+            oneof, parse := opts.oneof, fn
+            /* other values fail to match, falling through to other routes */
+            fn = func(str string) (unsafe.Pointer, error) {
+                if !slices.Contains(oneof, str) {
+                    return nil, errNotOneOf(oneof)
+                }
+                return parse(str)
+            }
+        }
+        if opts.dflt != nil && fn != nil {
+            dflt, parse := *opts.dflt, fn
+            if _, err := parse(dflt); err != nil {
+                log.Fatalf("invalid default %q of field %s in struct %s", dflt, f.Name, mdType)
+            }
+            /* empty segments, e.g. of "/users/", take the default */
+            fn = func(str string) (unsafe.Pointer, error) {
+                if str == "" {
+                    str = dflt
+                }
+                return parse(str)
+            }
+        }
+        if _, exists := p[tag]; exists  {
             log.Fatalln("multiple struct fields matching path variable \"" + tag + "\" in struct " + mdType.String())
         }
         p[tag] = pathFieldParser{
             Fn:     fn,
-            Offset: f.Offset,
+            Custom: custom,
+            Type:   f.Type,
+            Offset: offset,
             Size:   f.Type.Size(),
+            Index:  f.Index,
         }
     }
     return p
 }
+
+/* pathOptions are the options of a `cmux` or `path` tag */
+type pathOptions struct {
+    required bool
+    dflt     *string
+    oneof    []string /* allowed values */
+}
+
+// pathTag returns the path variable name and options of the tags of f,
+// e.g. `cmux:"name,required"`, `path:"page,default=1"` or
+// `cmux:"status,oneof=active|archived"`. The default value must be the
+// last option.
+func pathTag(f reflect.StructField) (string, pathOptions) {
+    tag, ok := f.Tag.Lookup("cmux")
+    if !ok {
+        /* `path:"name"` is an alias of `cmux:"name"` */
+        tag = f.Tag.Get("path")
+    }
+    name, rem, _ := strings.Cut(tag, ",")
+    var opts pathOptions
+    for rem != "" {
+        var opt string
+        if strings.HasPrefix(rem, "default=") {
+            opt, rem = rem, ""
+        } else {
+            opt, rem, _ = strings.Cut(rem, ",")
+        }
+        switch {
+        case opt == "required":
+            opts.required = true
+        case strings.HasPrefix(opt, "default="):
+            dflt := strings.TrimPrefix(opt, "default=")
+            opts.dflt = &dflt
+        case strings.HasPrefix(opt, "oneof="):
+            opts.oneof = strings.Split(strings.TrimPrefix(opt, "oneof="), "|")
+        default:
+            log.Fatalf("unknown path option %s of field %s", opt, f.Name)
+        }
+    }
+    return name, opts
+}
+
+func errNotOneOf(oneof []string) error {
+    return errors.New("must be one of " + strings.Join(oneof, ", "))
+}
+
+/* boundElsewhere reports whether f is bound from another part of the request */
+func boundElsewhere(f reflect.StructField) bool {
+    for _, src := range []string{"query", "header", "cookie", "matrix"} {
+        if _, ok := f.Tag.Lookup(src); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// fieldOffset returns the offset of the field with the specified index
+// sequence relative to the start of the struct t.
+func fieldOffset(t reflect.Type, index []int) (uintptr, bool) {
+    var offset uintptr
+    for i, idx := range index {
+        f := t.Field(idx)
+        offset += f.Offset
+        t = f.Type
+        if i < len(index) - 1 && t.Kind() != reflect.Struct {
+            return 0, false
+        }
+    }
+    return offset, true
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "reflect"
+    "sync"
+    "unsafe"
+)
+
+// mdBuf is a per-request copy of a route's metadata struct.
+type mdBuf struct {
+    ptr unsafe.Pointer /* points to the struct md points to */
+    md  any
+}
+
+func (n *node) newMdBuf() *mdBuf {
+    rv := reflect.New(n.metadataType.Elem())
+    return &mdBuf{
+        ptr: rv.UnsafePointer(),
+        md:  rv.Interface(),
+    }
+}
+
+var patchPool = sync.Pool{
+    New: func() any {
+        patches := make([]mdPatch, 0, 8)
+        return &patches
+    },
+}
+
+// EnableMetadataPooling makes the mux reuse the per-request metadata copies
+// between requests instead of allocating a new copy for each request.
+// When enabled, handlers and Before functions must not retain the metadata
+// pointer after they have returned.
+func (mux *Mux) EnableMetadataPooling(enable bool) {
+    mux.poolMetadata = enable
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "expvar"
+    "net/http"
+    "net/http/pprof"
+    "strings"
+)
+
+// EnablePprof serves the profiles of net/http/pprof below prefix, e.g.
+// "/debug/pprof/", without registering them with http.DefaultServeMux. The
+// index of the profiles is served at prefix. Every request must be accepted
+// by authorize, like for EnableAdmin. The routes are exempt from drain
+// rejection, so profiles can be taken while the mux is shutting down.
+func (mux *Mux) EnablePprof(prefix string, authorize func(*http.Request) error) {
+    if authorize == nil {
+        panic("cmux: EnablePprof requires an authorizer")
+    }
+    prefix = strings.TrimSuffix(prefix, "/") + "/"
+    mux.HandleFunc(prefix, nil, rawHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch name := strings.TrimPrefix(r.URL.Path, prefix); name {
+        case "":
+            /* the index links to the profiles relative to prefix */
+            pprof.Index(w, r)
+        case "cmdline":
+            pprof.Cmdline(w, r)
+        case "profile":
+            pprof.Profile(w, r)
+        case "symbol":
+            pprof.Symbol(w, r)
+        case "trace":
+            pprof.Trace(w, r)
+        default:
+            pprof.Handler(name).ServeHTTP(w, r)
+        }
+    }), drainExempt(), Internal(), Tag("cmux-debug"), authorizer(authorize)))
+}
+
+// EnableExpvar serves the variables published using expvar as JSON at path,
+// e.g. "/debug/vars", without registering them with http.DefaultServeMux.
+// Every request must be accepted by authorize, like for EnableAdmin.
+func (mux *Mux) EnableExpvar(path string, authorize func(*http.Request) error) {
+    if authorize == nil {
+        panic("cmux: EnableExpvar requires an authorizer")
+    }
+    mux.HandleFunc(path, nil, rawHandler(expvar.Handler(), drainExempt(), Internal(), Tag("cmux-debug"), authorizer(authorize)))
+}
+
+/* rawHandler serves requests of any method using h */
+func rawHandler(h http.Handler, opts ...RouteOption) MethodHandler {
+    mh := newMethodHandler(anyMethod, func(w http.ResponseWriter, r *http.Request, _ any, _ *reqState) error {
+        h.ServeHTTP(w, r)
+        return nil
+    }, nil, opts)
+    mh.fnName = "net/http.Handler"
+    return mh
+}
@@ -0,0 +1,306 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "context"
+    "io"
+    "log"
+    "log/slog"
+    "net/http"
+    "net/http/httputil"
+    "net/url"
+    "sync"
+    "time"
+)
+
+/* retryBudgetReserve is the number of retries allowed regardless of the budget */
+const retryBudgetReserve = 10
+
+// Proxy creates a method handler forwarding requests of any method to the
+// upstream base URL, e.g. "http://users.internal:8080", keeping the path
+// and query of the request:
+//
+//  m.HandleFunc("/users/", nil, cmux.Proxy("http://users.internal:8080",
+//      cmux.ProxyRetry(cmux.RetryPolicy{}), cmux.ProxyHedge(50 * time.Millisecond, 1)))
+//
+// The X-Forwarded headers are set on the proxied requests. Upstreams failing
+// to respond are responded to with 502 Bad Gateway. Requests of idempotent
+// methods can be retried and hedged, see ProxyRetry and ProxyHedge, in which
+// case their bodies are read into memory.
+func Proxy(upstream string, opts ...RouteOption) MethodHandler {
+    target, err := url.Parse(upstream)
+    if err != nil || target.Scheme == "" || target.Host == "" {
+        log.Fatalf("invalid proxy upstream %q", upstream)
+    }
+    mh := newMethodHandler(anyMethod, getProxyHandler(target), nil, opts)
+    mh.fnName = "Proxy"
+    return mh
+}
+
+// RetryPolicy configures the retries of proxied requests, see ProxyRetry.
+type RetryPolicy struct {
+    Attempts int           /* including the first attempt, default 3 */
+    Backoff  time.Duration /* before the first retry, doubling for every further retry, default 100ms */
+    // Budget is the number of retries allowed per request on average,
+    // default 0.2, keeping retries from overloading a failing upstream.
+    // A reserve of 10 retries is allowed regardless of the budget.
+    Budget   float64
+}
+
+type retryPolicy struct {
+    RetryPolicy
+    mutex  sync.Mutex
+    tokens float64
+}
+
+// ProxyRetry retries requests of idempotent methods proxied by Proxy when
+// the upstream fails to respond or responds with 502 Bad Gateway or 503
+// Service Unavailable. The retry budget is shared by all routes the option
+// is passed to.
+func ProxyRetry(p RetryPolicy) RouteOption {
+    if p.Attempts <= 0 {
+        p.Attempts = 3
+    }
+    if p.Backoff <= 0 {
+        p.Backoff = 100 * time.Millisecond
+    }
+    if p.Budget <= 0 {
+        p.Budget = 0.2
+    }
+    rp := &retryPolicy{RetryPolicy: p, tokens: retryBudgetReserve}
+    return func(o *routeOptions) {
+        o.retry = rp
+    }
+}
+
+/* deposit adds the share of retries earned by a request to the budget */
+func (p *retryPolicy) deposit() {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.tokens = min(p.tokens + p.Budget, retryBudgetReserve)
+}
+
+/* withdraw reports whether the budget allows a retry, consuming it */
+func (p *retryPolicy) withdraw() bool {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    if p.tokens < 1 {
+        return false
+    }
+    p.tokens--
+    return true
+}
+
+type hedgePolicy struct {
+    delay time.Duration
+    max   int
+}
+
+// ProxyHedge sends up to max additional copies of requests of idempotent
+// methods proxied by Proxy, one every delay while no response has been
+// received, and responds with the first response that is not a failure.
+// The other requests are canceled. Hedging reduces tail latency at the
+// cost of load on the upstream, so delay is typically set to the 95th
+// percentile latency of the upstream.
+func ProxyHedge(delay time.Duration, max int) RouteOption {
+    return func(o *routeOptions) {
+        o.hedge = &hedgePolicy{delay: delay, max: max}
+    }
+}
+
+func getProxyHandler(target *url.URL) handleFnType {
+    return func(w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState) error {
+        t := &proxyTransport{
+            rs:    rs,
+            base:  http.DefaultTransport,
+            retry: rs.mh.opts.retry,
+            hedge: rs.mh.opts.hedge,
+        }
+        if t.resilient(httpReq.Method) && httpReq.ContentLength != 0 {
+            /* retried and hedged requests are sent more than once */
+            raw, err := rs.readBody(httpReq)
+            if err != nil {
+                return err
+            }
+            httpReq.GetBody = func() (io.ReadCloser, error) {
+                return io.NopCloser(bytes.NewReader(raw)), nil
+            }
+        }
+        var proxyErr error
+        rp := &httputil.ReverseProxy{
+            Rewrite: func(pr *httputil.ProxyRequest) {
+                pr.SetURL(target)
+                pr.SetXForwarded()
+            },
+            Transport: t,
+            ErrorHandler: func(_ http.ResponseWriter, _ *http.Request, err error) {
+                proxyErr = err
+            },
+        }
+        rp.ServeHTTP(w, httpReq)
+        if proxyErr != nil {
+            return &codeResponder{code: http.StatusBadGateway, error: proxyErr}
+        }
+        return nil
+    }
+}
+
+/* proxyTransport retries and hedges the requests of a route */
+type proxyTransport struct {
+    rs    *reqState
+    base  http.RoundTripper
+    retry *retryPolicy
+    hedge *hedgePolicy
+}
+
+func (t *proxyTransport) resilient(method string) bool {
+    if t.retry == nil && t.hedge == nil {
+        return false
+    }
+    switch method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+        return true
+    }
+    return false
+}
+
+/* retryable reports whether the outcome of a proxied request is a failure */
+func retryable(res *http.Response, err error) bool {
+    return err != nil || res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if !t.resilient(req.Method) {
+        return t.base.RoundTrip(req)
+    }
+    if t.retry == nil {
+        return t.hedged(req)
+    }
+    t.retry.deposit()
+    backoff := t.retry.Backoff
+    for attempt := 1; ; attempt++ {
+        res, err := t.hedged(req)
+        if !retryable(res, err) || attempt >= t.retry.Attempts || req.Context().Err() != nil || !t.retry.withdraw() {
+            return res, err
+        }
+        attrs := []slog.Attr{slog.Int("attempt", attempt)}
+        if err != nil {
+            attrs = append(attrs, slog.Any("error", err))
+        } else {
+            attrs = append(attrs, slog.Int("status", res.StatusCode))
+            res.Body.Close()
+        }
+        t.rs.mux.log(req, slog.LevelWarn, "proxied request failed, retrying", attrs...)
+        select {
+        case <-time.After(backoff):
+        case <-req.Context().Done():
+            return nil, req.Context().Err()
+        }
+        backoff *= 2
+    }
+}
+
+type hedgeResult struct {
+    i      int /* the index of the request */
+    res    *http.Response
+    err    error
+    cancel context.CancelFunc
+}
+
+/* hedged sends req, hedging it if configured */
+func (t *proxyTransport) hedged(req *http.Request) (*http.Response, error) {
+    if t.hedge == nil {
+        return t.send(req, req.Context())
+    }
+    results := make(chan hedgeResult, t.hedge.max + 1)
+    var cancels []context.CancelFunc
+    launch := func() {
+        ctx, cancel := context.WithCancel(req.Context())
+        i := len(cancels)
+        cancels = append(cancels, cancel)
+        go func() {
+            res, err := t.send(req, ctx)
+            results <- hedgeResult{i, res, err, cancel}
+        }()
+    }
+    launch()
+    pending := 1
+    timer := time.NewTimer(t.hedge.delay)
+    defer timer.Stop()
+    var last hedgeResult
+    for {
+        select {
+        case <-timer.C:
+            if len(cancels) <= t.hedge.max {
+                launch()
+                pending++
+                timer.Reset(t.hedge.delay)
+            }
+            continue
+        case last = <-results:
+            pending--
+        }
+        if retryable(last.res, last.err) && len(cancels) <= t.hedge.max {
+            /* hedge right away rather than waiting for a failing upstream */
+            last.discard()
+            launch()
+            pending++
+            continue
+        }
+        if retryable(last.res, last.err) && pending > 0 {
+            last.discard()
+            continue
+        }
+        break
+    }
+    for i, cancel := range cancels {
+        if last.res == nil || i != last.i {
+            cancel()
+        }
+    }
+    go func() {
+        /* cancel and drain the slower requests */
+        for ; pending > 0; pending-- {
+            (<-results).discard()
+        }
+    }()
+    if last.res != nil {
+        last.res.Body = &cancelBody{ReadCloser: last.res.Body, cancel: last.cancel}
+    }
+    return last.res, last.err
+}
+
+func (hr hedgeResult) discard() {
+    if hr.res != nil {
+        hr.res.Body.Close()
+    }
+    hr.cancel()
+}
+
+/* cancelBody cancels the request of a hedged response once it is read */
+type cancelBody struct {
+    io.ReadCloser
+    cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+    err := b.ReadCloser.Close()
+    b.cancel()
+    return err
+}
+
+/* send sends a copy of req with the context ctx */
+func (t *proxyTransport) send(req *http.Request, ctx context.Context) (*http.Response, error) {
+    out := req.Clone(ctx)
+    if req.GetBody != nil && req.Body != nil && req.Body != http.NoBody {
+        body, err := req.GetBody()
+        if err != nil {
+            return nil, err
+        }
+        out.Body = body
+    }
+    return t.base.RoundTrip(out)
+}
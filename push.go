@@ -0,0 +1,30 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "net/http"
+)
+
+// Push initiates an HTTP/2 server push of the resource at target, e.g.
+// "/static/app.css". http.ErrNotSupported is returned if the connection
+// does not support server push.
+func (req *Request[T, M]) Push(target string) error {
+    pusher, ok := req.ResponseWriter.(http.Pusher)
+    if !ok {
+        return http.ErrNotSupported
+    }
+    return pusher.Push(target, nil)
+}
+
+// EarlyHints sends a 103 Early Hints informational response with the
+// specified Link header values, e.g. "</static/app.css>; rel=preload; as=style",
+// letting clients preload assets while the final response is prepared.
+// The Link headers are included in the final response as well.
+func (req *Request[T, M]) EarlyHints(links ...string) {
+    for _, link := range links {
+        req.ResponseWriter.Header().Add("Link", link)
+    }
+    req.ResponseWriter.WriteHeader(http.StatusEarlyHints)
+}
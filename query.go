@@ -0,0 +1,120 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "net/url"
+    "slices"
+    "sort"
+    "strings"
+)
+
+// SortField is a field to sort by.
+type SortField struct {
+    Field string
+    Desc  bool
+}
+
+// Sort is a metadata field type binding sort orders such as
+// ?sort=-created_at,name, where a leading minus sorts in descending order.
+// Fields must be listed in the allow tag of the metadata field:
+//
+//  type ListMd struct {
+//      Sort   cmux.Sort   `allow:"created_at,name"`
+//      Filter cmux.Filter `allow:"status,price"`
+//  }
+//
+// The parameter name defaults to "sort" and can be changed using the
+// query tag.
+type Sort []SortField
+
+// FilterCond is a condition on a field, e.g. filter[price][gte]=10 is
+// FilterCond{Field: "price", Op: "gte", Value: "10"}.
+type FilterCond struct {
+    Field string
+    Op    string /* eq, ne, gt, gte, lt, lte or in */
+    Value string
+}
+
+// Filter is a metadata field type binding filter conditions such as
+// ?filter[status]=active&filter[price][lt]=100. Conditions without an
+// operator use "eq". Fields must be listed in the allow tag, see Sort.
+// The parameter name defaults to "filter" and can be changed using the
+// query tag.
+type Filter []FilterCond
+
+var filterOps = []string{"eq", "ne", "gt", "gte", "lt", "lte", "in"}
+
+// Get returns the value of the "eq" condition on field, if any.
+func (f Filter) Get(field string) (string, bool) {
+    for _, c := range f {
+        if c.Field == field && c.Op == "eq" {
+            return c.Value, true
+        }
+    }
+    return "", false
+}
+
+func parseSort(param string, values []string, allow []string) (Sort, error) {
+    var s Sort
+    for _, v := range values {
+        for _, part := range strings.Split(v, ",") {
+            if part = strings.TrimSpace(part); part == "" {
+                continue
+            }
+            sf := SortField{Field: part}
+            if name, ok := strings.CutPrefix(part, "-"); ok {
+                sf = SortField{Field: name, Desc: true}
+            } else if name, ok := strings.CutPrefix(part, "+"); ok {
+                sf.Field = name
+            }
+            if !slices.Contains(allow, sf.Field) {
+                return nil, invalidParam(param, errors.New("cannot sort by " + sf.Field)).
+                    WithDetail("allowed", allow)
+            }
+            s = append(s, sf)
+        }
+    }
+    return s, nil
+}
+
+func parseFilter(param string, q url.Values, allow []string) (Filter, error) {
+    keys := make([]string, 0, len(q))
+    for k := range q {
+        keys = append(keys, k)
+    }
+    /* deterministic order of conditions */
+    sort.Strings(keys)
+    var f Filter
+    for _, key := range keys {
+        rest, ok := strings.CutPrefix(key, param + "[")
+        if !ok {
+            continue
+        }
+        field, rest, ok := strings.Cut(rest, "]")
+        if !ok {
+            return nil, invalidParam(key, errors.New("malformed filter"))
+        }
+        op := "eq"
+        if rest != "" {
+            if !strings.HasPrefix(rest, "[") || !strings.HasSuffix(rest, "]") {
+                return nil, invalidParam(key, errors.New("malformed filter"))
+            }
+            op = rest[1:len(rest) - 1]
+        }
+        if !slices.Contains(allow, field) {
+            return nil, invalidParam(key, errors.New("cannot filter by " + field)).
+                WithDetail("allowed", allow)
+        }
+        if !slices.Contains(filterOps, op) {
+            return nil, invalidParam(key, errors.New("unknown filter operator " + op)).
+                WithDetail("operators", filterOps)
+        }
+        for _, v := range q[key] {
+            f = append(f, FilterCond{Field: field, Op: op, Value: v})
+        }
+    }
+    return f, nil
+}
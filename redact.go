@@ -0,0 +1,200 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "slices"
+    "strconv"
+    "strings"
+)
+
+// Redaction configures how secrets are removed from everything the mux
+// writes for debugging: log records, debug traces, decode error details
+// and the errors reported by the admin endpoint. Redacted values are
+// replaced by "[REDACTED]". Nil lists use the defaults, empty lists redact
+// nothing.
+type Redaction struct {
+    // Headers lists the headers whose values are redacted, by default
+    // Authorization, Proxy-Authorization, Cookie, Set-Cookie, X-API-Key
+    // and X-CSRF-Token.
+    Headers      []string
+    // AllowHeaders, if not nil, lists the only headers whose values are
+    // kept, all other headers are redacted.
+    AllowHeaders []string
+    // Fields lists the JSON object keys whose values are redacted in
+    // bodies, by default password, secret and token. Keys match at any
+    // depth, while dotted paths such as "card.number" or "cards.*.cvc"
+    // match from the root, "*" matching any key or array index.
+    Fields       []string
+    // QueryParams lists the query parameters whose values are redacted in
+    // URLs, by default access_token, api_key, password, secret, signature
+    // and token.
+    QueryParams  []string
+}
+
+var(
+    defaultRedactHeaders     = []string{"Authorization", "Proxy-Authorization",
+                                        "Cookie", "Set-Cookie", "X-API-Key", "X-CSRF-Token"}
+    defaultRedactFields      = []string{"password", "secret", "token"}
+    defaultRedactQueryParams = []string{"access_token", "api_key", "password", "secret", "signature", "token"}
+)
+
+const redacted = "[REDACTED]"
+
+// SetRedaction sets the redaction rules applied to the debug and log output
+// of the mux. The defaults, used until SetRedaction is called, redact
+// well-known credential headers, fields and query parameters.
+func (mux *Mux) SetRedaction(red Redaction) {
+    if red.Headers == nil {
+        red.Headers = defaultRedactHeaders
+    }
+    if red.Fields == nil {
+        red.Fields = defaultRedactFields
+    }
+    if red.QueryParams == nil {
+        red.QueryParams = defaultRedactQueryParams
+    }
+    mux.redact = &red
+}
+
+var defaultRedaction = Redaction{
+    Headers:     defaultRedactHeaders,
+    Fields:      defaultRedactFields,
+    QueryParams: defaultRedactQueryParams,
+}
+
+func (mux *Mux) redaction() *Redaction {
+    if mux.redact != nil {
+        return mux.redact
+    }
+    return &defaultRedaction
+}
+
+func (red *Redaction) header(h http.Header) http.Header {
+    c := h.Clone()
+    for name := range c {
+        if red.AllowHeaders != nil && !containsFold(red.AllowHeaders, name) || containsFold(red.Headers, name) {
+            c[name] = []string{redacted}
+        }
+    }
+    return c
+}
+
+/* url returns u with the values of the redacted query parameters replaced */
+func (red *Redaction) url(u *url.URL) string {
+    if u.RawQuery == "" || len(red.QueryParams) == 0 {
+        return u.String()
+    }
+    c := *u
+    c.RawQuery = redactParams(c.RawQuery, func(name string) bool {
+        return containsFold(red.QueryParams, name)
+    })
+    return c.String()
+}
+
+/* redactParams replaces the values of the URL-encoded parameters of raw
+ * whose names match */
+func redactParams(raw string, match func(name string) bool) string {
+    params := strings.Split(raw, "&")
+    for i, p := range params {
+        name, _, _ := strings.Cut(p, "=")
+        if unescaped, err := url.QueryUnescape(name); err == nil && match(unescaped) {
+            params[i] = name + "=" + redacted
+        }
+    }
+    return strings.Join(params, "&")
+}
+
+/* body returns b with the values of the redacted fields replaced. Bodies
+ * which are not valid JSON, such as forms or bodies cut short, have their
+ * redacted form fields replaced and are dropped entirely if they mention
+ * a redacted JSON field. */
+func (red *Redaction) body(b []byte) string {
+    if len(b) == 0 {
+        return ""
+    }
+    if len(red.Fields) == 0 {
+        return string(b)
+    }
+    var v any
+    if json.Unmarshal(b, &v) != nil {
+        return red.snippet(redactParams(string(b), func(name string) bool {
+            return red.field([]string{name})
+        }))
+    }
+    out, err := json.Marshal(red.value(v, nil))
+    if err != nil {
+        return redacted
+    }
+    return string(out)
+}
+
+func (red *Redaction) value(v any, path []string) any {
+    switch v := v.(type) {
+    case map[string]any:
+        for k, e := range v {
+            if p := append(path, k); red.field(p) {
+                v[k] = redacted
+            } else {
+                v[k] = red.value(e, p)
+            }
+        }
+    case []any:
+        for i, e := range v {
+            v[i] = red.value(e, append(path, strconv.Itoa(i)))
+        }
+    }
+    return v
+}
+
+// field reports whether the value at path, the keys and array indices
+// from the root, is redacted.
+func (red *Redaction) field(path []string) bool {
+    if len(path) == 0 {
+        return false
+    }
+    for _, f := range red.Fields {
+        if !strings.Contains(f, ".") {
+            if strings.EqualFold(f, path[len(path) - 1]) {
+                return true
+            }
+            continue
+        }
+        if matchPath(strings.Split(f, "."), path) {
+            return true
+        }
+    }
+    return false
+}
+
+func matchPath(segs, path []string) bool {
+    if len(segs) != len(path) {
+        return false
+    }
+    for i, s := range segs {
+        if s != "*" && !strings.EqualFold(s, path[i]) {
+            return false
+        }
+    }
+    return true
+}
+
+// snippet returns s, a part of a body which may not be valid JSON, or
+// "[REDACTED]" if it mentions a redacted field.
+func (red *Redaction) snippet(s string) string {
+    for _, f := range red.Fields {
+        segs := strings.Split(f, ".")
+        if key := segs[len(segs) - 1]; key != "*" && strings.Contains(strings.ToLower(s), `"` + strings.ToLower(key) + `"`) {
+            return redacted
+        }
+    }
+    return s
+}
+
+func containsFold(list []string, s string) bool {
+    return slices.ContainsFunc(list, func(e string) bool { return strings.EqualFold(e, s) })
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "net/http"
+    "strings"
+)
+
+// ResourceStore is implemented by stores of items of type T identified by
+// IDs of type ID, see Resource. Errors are responded to like errors
+// returned by handlers, so stores can e.g. return ErrNotFound for unknown
+// IDs.
+type ResourceStore[T any, ID any] interface {
+    List(ctx context.Context) ([]T, error)
+    Create(ctx context.Context, item T) (T, error)
+    Get(ctx context.Context, id ID) (T, error)
+    Update(ctx context.Context, id ID, item T) (T, error)
+    Delete(ctx context.Context, id ID) error
+}
+
+/* handleFuncer is implemented by Mux and Group */
+type handleFuncer interface {
+    HandleFunc(path string, metadata any, mhs ...MethodHandler)
+}
+
+// ResourceMd is the metadata of the routes registered by Resource.
+type ResourceMd[ID any] struct {
+    ID ID `cmux:"id"`
+}
+
+// Resource registers CRUD routes for the items of store at path on mux,
+// which is a *Mux or a *Group, e.g. for path "/users":
+//
+//  GET    /users       store.List, responding 200 OK with the items
+//  POST   /users       store.Create, responding 201 Created with the item
+//  GET    /users/{id}  store.Get, responding 200 OK with the item
+//  PUT    /users/{id}  store.Update, responding 200 OK with the item
+//  DELETE /users/{id}  store.Delete, responding 204 No Content
+//
+// ID must be a type supported by path variables. The options apply to all
+// the routes, where Before functions receive a *ResourceMd[ID].
+func Resource[T any, ID any](mux handleFuncer, path string, store ResourceStore[T, ID], opts ...RouteOption) {
+    type Md = *ResourceMd[ID]
+    mux.HandleFunc(path, &ResourceMd[ID]{},
+        Get(func(req *Request[EmptyBody, Md]) error {
+            items, err := store.List(req.Context)
+            if err != nil {
+                return err
+            }
+            if items == nil {
+                items = []T{}
+            }
+            return Bypass(items)
+        }, nil, opts...),
+        Post(func(req *Request[T, Md]) error {
+            item, err := store.Create(req.Context, req.Body)
+            if err != nil {
+                return err
+            }
+            return &created{item}
+        }, nil, opts...),
+    )
+    mux.HandleFunc(strings.TrimSuffix(path, "/") + "/{id}", &ResourceMd[ID]{},
+        Get(func(req *Request[EmptyBody, Md]) error {
+            item, err := store.Get(req.Context, req.Metadata.ID)
+            if err != nil {
+                return err
+            }
+            return Bypass(item)
+        }, nil, opts...),
+        Put(func(req *Request[T, Md]) error {
+            item, err := store.Update(req.Context, req.Metadata.ID, req.Body)
+            if err != nil {
+                return err
+            }
+            return Bypass(item)
+        }, nil, opts...),
+        Delete(func(req *Request[EmptyBody, Md]) error {
+            if err := store.Delete(req.Context, req.Metadata.ID); err != nil {
+                return err
+            }
+            return NoContent()
+        }, nil, opts...),
+    )
+}
+
+/* created responds 201 Created with the created item */
+type created struct {
+    item any
+}
+
+func (c *created) HTTPError() (int, any) {
+    return http.StatusCreated, c.item
+}
+
+func (c *created) Error() string {
+    return "created"
+}
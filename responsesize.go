@@ -0,0 +1,87 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "errors"
+    "log/slog"
+    "net/http"
+)
+
+// MaxResponseSize limits the size of response bodies of a single route,
+// overriding Mux.SetMaxResponseSize.
+func MaxResponseSize(n int64) RouteOption {
+    return func(o *routeOptions) {
+        o.maxResponseSize = &n
+    }
+}
+
+// SetMaxResponseSize limits the size of all response bodies, keeping
+// accidentally enormous responses from reaching clients. Encoded responses
+// exceeding the limit are replaced by 500 Internal Server Error, while
+// streamed responses, whose status has already been sent, are truncated.
+// Both are logged as errors. Encoded responses are checked once encoded,
+// so the limit does not bound the memory used to encode them. Zero means
+// no limit.
+func (mux *Mux) SetMaxResponseSize(n int64) {
+    mux.maxResponseSize = n
+}
+
+func (mux *Mux) maxResponseSizeFor(mh *MethodHandler) int64 {
+    if mh != nil && mh.opts.maxResponseSize != nil {
+        return *mh.opts.maxResponseSize
+    }
+    return mux.maxResponseSize
+}
+
+var errResponseTooLarge = errors.New("response too large")
+
+// limitedResponseWriter truncates streamed responses exceeding the limit,
+// failing the writes beyond it.
+type limitedResponseWriter struct {
+    http.ResponseWriter
+    limit    int64
+    written  int64
+    exceeded bool
+}
+
+func (lw *limitedResponseWriter) Write(b []byte) (int, error) {
+    if lw.exceeded {
+        return 0, errResponseTooLarge
+    }
+    if rest := lw.limit - lw.written; int64(len(b)) > rest {
+        lw.exceeded = true
+        n, err := lw.ResponseWriter.Write(b[:rest])
+        lw.written += int64(n)
+        if err == nil {
+            err = errResponseTooLarge
+        }
+        return n, err
+    }
+    n, err := lw.ResponseWriter.Write(b)
+    lw.written += int64(n)
+    return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (lw *limitedResponseWriter) Unwrap() http.ResponseWriter {
+    return lw.ResponseWriter
+}
+
+func (lw *limitedResponseWriter) logExceeded(mux *Mux, r *http.Request) {
+    if lw.exceeded {
+        mux.log(r, slog.LevelError, "response truncated", slog.Int64("limit", lw.limit))
+    }
+}
+
+// encodeBounded encodes out unless its encoding exceeds limit, in which
+// case the error is logged and the response replaced by an error.
+func (mux *Mux) encodeBounded(r *http.Request, mh *MethodHandler, code int, out any, limit int64) (int, []byte, error) {
+    b, err := mux.marshalJSON(r, mh, mux.filterFields(r, mh, code, out))
+    if err == nil && int64(len(b)) > limit {
+        mux.log(r, slog.LevelError, "response too large", slog.Int64("limit", limit), slog.Int("status", code))
+        return http.StatusInternalServerError, []byte(`{"error":"response too large"}` + "\n"), nil
+    }
+    return code, b, err
+}
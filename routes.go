@@ -0,0 +1,92 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "sort"
+)
+
+// RouteInfo describes a registered route.
+type RouteInfo struct {
+    Method  string
+    Pattern string
+    Handler string /* the name of the handler function */
+    Tags    []string
+    // Summary and Description are set using Doc.
+    Summary     string
+    Description string
+    Deprecated  bool
+    Examples    []RouteExample
+    Internal    bool /* see Internal */
+    // Breaker is the state of the circuit breaker of the route, if any.
+    Breaker *BreakerState
+}
+
+// Routes returns the routes registered on the mux sorted by pattern and
+// method.
+func (mux *Mux) Routes() []RouteInfo {
+    var routes []RouteInfo
+    if root := mux.tree.Load(); root != nil {
+        root.routes(&routes)
+    }
+    sort.Slice(routes, func(i, j int) bool {
+        if routes[i].Pattern != routes[j].Pattern {
+            return routes[i].Pattern < routes[j].Pattern
+        }
+        return routes[i].Method < routes[j].Method
+    })
+    return routes
+}
+
+// methodHandler returns the handler of n for method, falling back to the
+// handler registered using Any.
+func (n *node) methodHandler(method string) *MethodHandler {
+    if mh := n.methodHandlers[method]; mh != nil {
+        return mh
+    }
+    return n.methodHandlers[anyMethod]
+}
+
+// each calls fn for each method handler in the tree rooted at n.
+func (n *node) each(fn func(*MethodHandler)) {
+    for _, mh := range n.methodHandlers {
+        if len(mh.variants) == 0 {
+            fn(mh)
+        }
+        for _, v := range mh.variants {
+            fn(v)
+        }
+    }
+    for _, c := range n.m {
+        c.each(fn)
+    }
+    for _, fm := range n.matchers {
+        fm.Node.each(fn)
+    }
+}
+
+func (n *node) routes(acc *[]RouteInfo) {
+    n.each(func(mh *MethodHandler) {
+        *acc = append(*acc, routeInfo(mh))
+    })
+}
+
+func routeInfo(mh *MethodHandler) RouteInfo {
+    ri := RouteInfo{
+        Method:  mh.method,
+        Pattern: mh.pattern,
+        Handler: getFunctionName(mh),
+        Tags:    mh.opts.tags,
+        Summary:     mh.opts.summary,
+        Description: mh.opts.description,
+        Deprecated:  mh.opts.deprecated,
+        Examples:    mh.opts.examples,
+        Internal:    mh.opts.internal,
+    }
+    if mh.opts.breaker != nil {
+        state := mh.opts.breaker.State()
+        ri.Breaker = &state
+    }
+    return ri
+}
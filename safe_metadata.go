@@ -0,0 +1,9 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+//go:build cmux_safe_metadata
+
+package cmux
+
+const defaultSafeMetadata = true
@@ -0,0 +1,236 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "errors"
+    "io/fs"
+    "net"
+    "net/http"
+    "os"
+    "time"
+)
+
+// EnableDrainRejection makes the mux reject new requests with
+// 503 Service Unavailable while it is shutting down, except for requests
+// to the readiness route. Load balancers are then expected to retry the
+// request on another instance.
+func (mux *Mux) EnableDrainRejection(enable bool) {
+    mux.drainReject = enable
+}
+
+// SetShutdownTimeout sets how long ListenAndServe waits for in-flight
+// requests to finish when shutting down. The default is 30 seconds.
+func (mux *Mux) SetShutdownTimeout(d time.Duration) {
+    mux.shutdownTimeout = d
+}
+
+// Draining reports whether Shutdown has been called.
+func (mux *Mux) Draining() bool {
+    return mux.draining.Load()
+}
+
+// Shutdown marks the mux as draining and waits until all in-flight requests
+// have been handled or ctx is done. While draining, responses carry a
+// "Connection: close" header, the readiness route responds
+// 503 Service Unavailable and, if enabled using EnableDrainRejection, new
+// requests are rejected.
+func (mux *Mux) Shutdown(ctx context.Context) error {
+    mux.draining.Store(true)
+    ticker := time.NewTicker(10 * time.Millisecond)
+    defer ticker.Stop()
+    for mux.inFlight.Load() > 0 {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-ticker.C:
+        }
+    }
+    return nil
+}
+
+// HandleReadiness registers a readiness route at path, responding
+// 200 {"status":"ready"} or, once the mux is draining,
+// 503 {"status":"draining"}. The options are applied to the route, e.g.
+// Internal to serve it only on an internal port.
+func (mux *Mux) HandleReadiness(path string, opts ...RouteOption) {
+    mux.HandleFunc(path, nil,
+        Get(func(req *Request[EmptyBody, any]) error {
+            if mux.Draining() {
+                return readiness("draining")
+            }
+            return readiness("ready")
+        }, nil, append([]RouteOption{drainExempt()}, opts...)...),
+    )
+}
+
+type readiness string
+
+func (s readiness) Error() string {
+    return string(s)
+}
+
+func (s readiness) HTTPError() (int, any) {
+    code := http.StatusOK
+    if s != "ready" {
+        code = http.StatusServiceUnavailable
+    }
+    return code, struct{Status string `json:"status"`}{string(s)}
+}
+
+var errDrainRejected = &codeResponder{
+    code:  http.StatusServiceUnavailable,
+    error: errors.New("server shutting down"),
+    key:   "shutting_down",
+}
+
+func drainExempt() RouteOption {
+    return func(o *routeOptions) {
+        o.drainExempt = true
+    }
+}
+
+// checkDraining prepares responses sent while the mux is draining.
+func (rs *reqState) checkDraining(w http.ResponseWriter) error {
+    if !rs.mux.draining.Load() || rs.mh.opts.drainExempt {
+        return nil
+    }
+    w.Header().Set("Connection", "close")
+    if rs.mux.drainReject {
+        return errDrainRejected
+    }
+    return nil
+}
+
+// ListenAndServe serves the mux on addr until ctx is done, after which the
+// mux is shut down gracefully, e.g.
+//
+//  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+//  defer stop()
+//  log.Fatal(m.ListenAndServe(ctx, ":8080"))
+//
+// It returns nil after a graceful shutdown.
+func (mux *Mux) ListenAndServe(ctx context.Context, addr string) error {
+    srv := mux.cleartextServer(addr)
+    return mux.serveUntilDone(ctx, srv, srv.ListenAndServe)
+}
+
+// EnableH2C makes ListenAndServe, ListenAndServeUnix, ListenAndServeSystemd
+// and Serve accept HTTP/2 without TLS, i.e. h2c with prior knowledge, along
+// with HTTP/1.1, e.g. for internal traffic from load balancers terminating
+// TLS. It must be called before serving requests.
+func (mux *Mux) EnableH2C(enable bool) {
+    mux.h2c = enable
+}
+
+/* cleartextServer creates the server of the helpers serving without TLS */
+func (mux *Mux) cleartextServer(addr string) *http.Server {
+    srv := &http.Server{Addr: addr, Handler: mux}
+    if mux.h2c {
+        srv.Protocols = new(http.Protocols)
+        srv.Protocols.SetHTTP1(true)
+        srv.Protocols.SetUnencryptedHTTP2(true)
+    }
+    return srv
+}
+
+// ListenAndServeTLS is like ListenAndServe but serves HTTPS, and HTTP/3 if
+// an HTTP/3 server has been set using SetHTTP3Server.
+func (mux *Mux) ListenAndServeTLS(ctx context.Context, addr, certFile, keyFile string) error {
+    srv := &http.Server{Addr: addr, Handler: mux}
+    if mux.http3 == nil {
+        return mux.serveUntilDone(ctx, srv, func() error {
+            return srv.ListenAndServeTLS(certFile, keyFile)
+        })
+    }
+    srv.Handler = mux.altSvcHandler()
+    return mux.serveUntilDone(ctx, srv, func() error {
+        return mux.serveHTTP3(srv, certFile, keyFile)
+    })
+}
+
+// ListenAndServeUnix is like ListenAndServe but serves on the Unix domain
+// socket at path, e.g. behind a local reverse proxy. A stale socket left at
+// path by a previous process is replaced, and the permissions of the socket
+// are set to perm, e.g. 0660 to allow the group of the process. The socket
+// is removed after the shutdown.
+func (mux *Mux) ListenAndServeUnix(ctx context.Context, path string, perm fs.FileMode) error {
+    if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+        os.Remove(path)
+    }
+    l, err := net.Listen("unix", path)
+    if err != nil {
+        return err
+    }
+    if err := os.Chmod(path, perm); err != nil {
+        l.Close()
+        return err
+    }
+    return mux.Serve(ctx, l)
+}
+
+// Serve is like ListenAndServe but serves on the specified listeners, e.g.
+// those returned by SystemdListeners. The listeners must not use TLS.
+func (mux *Mux) Serve(ctx context.Context, listeners ...net.Listener) error {
+    if len(listeners) == 0 {
+        return errors.New("cmux: no listeners to serve on")
+    }
+    srv := mux.cleartextServer("")
+    return mux.serveUntilDone(ctx, srv, func() error {
+        errc := make(chan error, len(listeners))
+        for _, l := range listeners {
+            go func() {
+                errc <- srv.Serve(l)
+            }()
+        }
+        err := <-errc
+        if err != http.ErrServerClosed {
+            /* stop serving on the other listeners */
+            srv.Close()
+        }
+        for range listeners[1:] {
+            <-errc
+        }
+        return err
+    })
+}
+
+func (mux *Mux) serveUntilDone(ctx context.Context, srv *http.Server, serve func() error) error {
+    errc := make(chan error, 1)
+    go func() {
+        errc <- serve()
+    }()
+    select {
+    case err := <-errc:
+        return err
+    case <-ctx.Done():
+    }
+    shutdownCtx, cancel := mux.shutdownContext()
+    defer cancel()
+    /* stop accepting connections while draining the requests in flight,
+     * draining alone never finishes under steady traffic */
+    drainc := make(chan error, 1)
+    go func() {
+        drainc <- mux.Shutdown(shutdownCtx)
+    }()
+    err := srv.Shutdown(shutdownCtx)
+    drainErr := <-drainc
+    if err != nil {
+        return err
+    }
+    if err := <-errc; err != nil && err != http.ErrServerClosed {
+        return err
+    }
+    return drainErr
+}
+
+/* shutdownContext limits the duration of a graceful shutdown */
+func (mux *Mux) shutdownContext() (context.Context, context.CancelFunc) {
+    timeout := mux.shutdownTimeout
+    if timeout <= 0 {
+        timeout = 30 * time.Second
+    }
+    return context.WithTimeout(context.Background(), timeout)
+}
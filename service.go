@@ -0,0 +1,107 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "reflect"
+    "runtime"
+    "strings"
+)
+
+var contextType = reflect.TypeFor[context.Context]()
+
+// Unary creates a POST method handler for a unary RPC method taking and
+// returning JSON messages, e.g.
+//
+//  m.HandleFunc("/users.v1.UserService/GetUser", nil, cmux.Unary(svc.GetUser))
+//
+// where GetUser is a func(context.Context, *GetUserRequest) (*User, error).
+// Requests without a body are passed a zero-valued message. Errors are
+// responded to like errors returned by handlers.
+func Unary[In any, Out any](fn func(context.Context, *In) (*Out, error), opts ...RouteOption) MethodHandler {
+    handle := func(req *Request[In, any]) error {
+        out, err := fn(req.Context, &req.Body)
+        if err != nil {
+            return err
+        }
+        return Bypass(out)
+    }
+    mh := newMethodHandler(http.MethodPost, getHandler(handle, nil, true), nil, opts)
+    mh.fnName = runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+    return mh
+}
+
+// HandleService registers the unary RPC methods of service as POST
+// endpoints at the path followed by the method name, giving a Twirp or
+// Connect-like workflow, e.g. for
+//
+//  m.HandleService("/users.v1.UserService", &UserService{})
+//
+// the method GetUser is served at "/users.v1.UserService/GetUser". Methods
+// of the form func(context.Context, *In) (*Out, error) are registered as if
+// using Unary, and other methods are ignored. The options apply to all the
+// methods.
+func (mux *Mux) HandleService(path string, service any, opts ...RouteOption) {
+    for _, sr := range serviceRoutes(path, service, opts) {
+        mux.HandleFunc(sr.path, nil, sr.mh)
+    }
+}
+
+// HandleService registers the methods of service at the path prefixed by
+// the group prefix, see Mux.HandleService.
+func (g *Group) HandleService(path string, service any, opts ...RouteOption) {
+    for _, sr := range serviceRoutes(path, service, opts) {
+        g.HandleFunc(sr.path, nil, sr.mh)
+    }
+}
+
+type serviceRoute struct {
+    path string
+    mh   MethodHandler
+}
+
+func serviceRoutes(path string, service any, opts []RouteOption) []serviceRoute {
+    sv := reflect.ValueOf(service)
+    var routes []serviceRoute
+    for i := 0; i < sv.NumMethod(); i++ {
+        fn, m := sv.Method(i), sv.Type().Method(i)
+        if !isUnary(fn.Type()) {
+            continue
+        }
+        mh := newMethodHandler(http.MethodPost, getUnaryHandler(fn), nil, opts)
+        mh.fnName = fmt.Sprintf("%T.%s", service, m.Name)
+        routes = append(routes, serviceRoute{strings.TrimSuffix(path, "/") + "/" + m.Name, mh})
+    }
+    if len(routes) == 0 {
+        log.Fatalf("%T has no methods of the form func(context.Context, *In) (*Out, error)", service)
+    }
+    return routes
+}
+
+/* isUnary reports whether t is a func(context.Context, *In) (*Out, error) */
+func isUnary(t reflect.Type) bool {
+    return t.NumIn() == 2 && t.In(0) == contextType && t.In(1).Kind() == reflect.Pointer &&
+           t.NumOut() == 2 && t.Out(0).Kind() == reflect.Pointer && t.Out(1) == errorType
+}
+
+func getUnaryHandler(fn reflect.Value) handleFnType {
+    inType := fn.Type().In(1).Elem()
+    return func(w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState) error {
+        in := reflect.New(inType)
+        if httpReq.ContentLength != 0 {
+            if err := rs.decodeBody(httpReq.Body, in.Interface()); err != nil {
+                return err
+            }
+        }
+        res := fn.Call([]reflect.Value{reflect.ValueOf(httpReq.Context()), in})
+        if err, _ := res[1].Interface().(error); err != nil {
+            return err
+        }
+        return Bypass(res[0].Interface())
+    }
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+var ErrNoURLSecret = errors.New("cmux: no URL secret set")
+
+/* the query parameters added to signed URLs */
+const(
+    expiresParam   = "expires"
+    signatureParam = "signature"
+)
+
+// SetURLSecret sets the secret used to sign URLs, see SignURL, which should
+// be at least 32 random bytes.
+func (mux *Mux) SetURLSecret(secret []byte) {
+    h := hmac.New(sha256.New, secret)
+    h.Write([]byte("cmux url signing"))
+    mux.urlKey = h.Sum(nil)
+}
+
+// SignURL returns target, a path with an optional query such as
+// "/files/42?name=report.pdf", with an expiry time and a signature added to
+// the query, so requests using the method and the returned URL are
+// accepted by routes using RequireSignedURL until ttl has passed, e.g. to
+// hand out download and upload links. target must be the path as requested
+// by clients, including any prefix stripped before the mux.
+func (mux *Mux) SignURL(method, target string, ttl time.Duration) (string, error) {
+    if mux.urlKey == nil {
+        return "", ErrNoURLSecret
+    }
+    u, err := url.Parse(target)
+    if err != nil {
+        return "", err
+    }
+    q := u.Query()
+    q.Del(signatureParam)
+    q.Set(expiresParam, strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+    q.Set(signatureParam, mux.urlSignature(method, u.EscapedPath(), q))
+    u.RawQuery = q.Encode()
+    return u.String(), nil
+}
+
+/* urlSignature signs the method, path and query but the signature of a URL */
+func (mux *Mux) urlSignature(method, path string, q url.Values) string {
+    signed := url.Values{}
+    for k, v := range q {
+        if k != signatureParam {
+            signed[k] = v
+        }
+    }
+    h := hmac.New(sha256.New, mux.urlKey)
+    h.Write([]byte(method + "\n" + path + "\n" + signed.Encode()))
+    return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// RequireSignedURL rejects requests to a route unless their URL was signed
+// using SignURL for the method of the request and has not expired, before
+// the handler runs. Rejected requests are responded to with 403 Forbidden.
+func RequireSignedURL() RouteOption {
+    return func(o *routeOptions) {
+        o.before = append(o.before, func(w http.ResponseWriter, r *http.Request, _ any) error {
+            rs := requestState(r.Context())
+            if rs == nil || rs.mux.urlKey == nil {
+                return ErrNoURLSecret
+            }
+            return rs.mux.verifyURL(r)
+        })
+    }
+}
+
+func (mux *Mux) verifyURL(r *http.Request) error {
+    /* verify the URL as requested, before any path rewriting */
+    u := r.URL
+    if r.RequestURI != "" {
+        if parsed, err := url.ParseRequestURI(r.RequestURI); err == nil {
+            u = parsed
+        }
+    }
+    q := u.Query()
+    sig, expires := q.Get(signatureParam), q.Get(expiresParam)
+    if sig == "" || expires == "" {
+        return ErrForbidden.WithMessage("unsigned URL")
+    }
+    if !hmac.Equal([]byte(sig), []byte(mux.urlSignature(r.Method, u.EscapedPath(), q))) {
+        return ErrForbidden.WithMessage("invalid URL signature")
+    }
+    if exp, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() > exp {
+        return ErrForbidden.WithMessage("expired URL")
+    }
+    return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "errors"
+    "io"
+    "mime"
+    "net/http"
+)
+
+// StreamRequest is passed to streaming method handlers instead of Request.
+// Rather than being decoded, the request body is exposed as a reader,
+// allowing large uploads to be processed without holding them in memory.
+type StreamRequest[M any] struct {
+    // Body is limited to the maximum body size of the route, reading beyond
+    // it fails with an *http.MaxBytesError.
+    Body          io.Reader
+    // ContentType is the media type of the body without parameters,
+    // e.g. "image/png".
+    ContentType   string
+    // ContentLength is the length of the body or -1 if unknown.
+    ContentLength int64
+    Metadata      M
+    Context       context.Context
+
+    /* Underlying native golang request / responsewriter: */
+    HTTPReq *http.Request
+    ResponseWriter http.ResponseWriter
+}
+
+// MaxBodySize limits the size of request bodies of a single route,
+// overriding Mux.SetMaxBodySize.
+func MaxBodySize(n int64) RouteOption {
+    return func(o *routeOptions) {
+        o.maxBodySize = &n
+    }
+}
+
+// SetMaxBodySize limits the size of all request bodies. Requests exceeding
+// the limit are rejected with 413 Request Entity Too Large. Zero means no limit.
+func (mux *Mux) SetMaxBodySize(n int64) {
+    mux.maxBodySize = n
+}
+
+func (rs *reqState) maxBodySize() int64 {
+    if rs.mh.opts.maxBodySize != nil {
+        return *rs.mh.opts.maxBodySize
+    }
+    return rs.mux.maxBodySize
+}
+
+var errBodyTooLarge = &codeResponder{
+    code:  http.StatusRequestEntityTooLarge,
+    error: errors.New("request body too large"),
+    key:   "body_too_large",
+}
+
+// limitBody applies the maximum body size of the route to r, failing
+// early if the announced content length exceeds it.
+func (rs *reqState) limitBody(w http.ResponseWriter, r *http.Request) error {
+    limit := rs.maxBodySize()
+    if limit <= 0 {
+        return nil
+    }
+    if r.ContentLength > limit {
+        return errBodyTooLarge
+    }
+    r.Body = http.MaxBytesReader(w, r.Body, limit)
+    return nil
+}
+
+func getStreamHandler[M any](fn func(*StreamRequest[M]) error) handleFnType {
+    return func(w http.ResponseWriter, httpReq *http.Request, md any, rs *reqState) error {
+        req := StreamRequest[M]{
+            Body:           httpReq.Body,
+            ContentLength:  httpReq.ContentLength,
+            Context:        httpReq.Context(),
+            HTTPReq:        httpReq,
+            ResponseWriter: w,
+        }
+        if ct := httpReq.Header.Get("Content-Type"); ct != "" {
+            if mt, _, err := mime.ParseMediaType(ct); err == nil {
+                req.ContentType = mt
+            } else {
+                req.ContentType = ct
+            }
+        }
+        if md != nil {
+            var ok bool
+            if req.Metadata, ok = md.(M); !ok {
+                return &codeResponder{
+                    code:  http.StatusInternalServerError,
+                    error: errors.New("unexpected metadata type"),
+                }
+            }
+        }
+        return fn(&req)
+    }
+}
+
+// Handle POST HTTP method requests streaming the request body.
+func PostStream[M any](fn func(*StreamRequest[M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("POST", getStreamHandler(fn), data, opts)
+}
+
+// Handle PUT HTTP method requests streaming the request body.
+func PutStream[M any](fn func(*StreamRequest[M]) error, data any, opts ...RouteOption) MethodHandler {
+    return newMethodHandler("PUT", getStreamHandler(fn), data, opts)
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+)
+
+/* sdListenFDsStart is the first file descriptor passed by systemd */
+const sdListenFDsStart = 3
+
+// SystemdListeners returns the listeners passed to the process by systemd
+// socket activation, i.e. according to the LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES environment variables, which are unset so that child
+// processes do not inherit them. It returns no listeners if the process
+// was not socket activated.
+func SystemdListeners() ([]net.Listener, error) {
+    pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+    os.Unsetenv("LISTEN_PID")
+    os.Unsetenv("LISTEN_FDS")
+    os.Unsetenv("LISTEN_FDNAMES")
+    return activatedListeners(pid, fds, names, sdListenFDsStart)
+}
+
+func activatedListeners(pid, fds, names string, start int) ([]net.Listener, error) {
+    if pid == "" || fds == "" {
+        return nil, nil
+    }
+    if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+        /* the variables were meant for another process */
+        return nil, nil
+    }
+    n, err := strconv.Atoi(fds)
+    if err != nil || n < 0 {
+        return nil, fmt.Errorf("cmux: invalid LISTEN_FDS %q", fds)
+    }
+    fdNames := strings.Split(names, ":")
+    listeners := make([]net.Listener, 0, n)
+    for i := 0; i < n; i++ {
+        name := "LISTEN_FD_" + strconv.Itoa(start + i)
+        if i < len(fdNames) && fdNames[i] != "" {
+            name = fdNames[i]
+        }
+        f := os.NewFile(uintptr(start + i), name)
+        /* FileListener duplicates the descriptor */
+        l, err := net.FileListener(f)
+        f.Close()
+        if err != nil {
+            for _, l := range listeners {
+                l.Close()
+            }
+            return nil, fmt.Errorf("cmux: socket %s is not a listener: %w", name, err)
+        }
+        listeners = append(listeners, l)
+    }
+    return listeners, nil
+}
+
+// ListenAndServeSystemd is like ListenAndServe but serves on the sockets
+// passed by systemd socket activation, see SystemdListeners, e.g. using a
+// socket unit containing
+//
+//  [Socket]
+//  ListenStream=/run/app.sock
+//
+// It fails if the process was not socket activated.
+func (mux *Mux) ListenAndServeSystemd(ctx context.Context) error {
+    listeners, err := SystemdListeners()
+    if err != nil {
+        return err
+    }
+    if len(listeners) == 0 {
+        return errors.New("cmux: the process was not socket activated")
+    }
+    return mux.Serve(ctx, listeners...)
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "math"
+    "net"
+    "net/http"
+    "reflect"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// TenantID is the tenant of a request, see SetTenants. Metadata fields of
+// type TenantID are bound to the tenant of the request.
+type TenantID string
+
+var tenantIDType = reflect.TypeFor[TenantID]()
+
+// TenantOptions configures how the tenant of a request is resolved. Exactly
+// one of Domain, Header and PathPrefix must be set.
+type TenantOptions struct {
+    // Domain resolves the tenant from the subdomain of the Host header,
+    // e.g. "example.com" resolves "acme.example.com" to acme. Hosts not
+    // directly below Domain have no tenant.
+    Domain     string
+    // Header resolves the tenant from a request header, e.g. "X-Tenant-ID".
+    Header     string
+    // PathPrefix resolves the tenant from the first path segment, routing
+    // the request by the rest of the path, e.g. "/acme/users" is routed
+    // as "/users" for tenant acme.
+    PathPrefix bool
+    // Validate, if set, is called with every resolved tenant before the
+    // request is routed. Errors are responded to like handler errors,
+    // e.g. ErrNotFound for unknown tenants.
+    Validate   func(r *http.Request, tenant TenantID) error
+    // Required rejects requests without a tenant with 404 Not Found.
+    Required   bool
+}
+
+// SetTenants makes the mux resolve the tenant of every request before
+// routing it. The tenant is returned by Tenant, bound to metadata fields
+// of type TenantID, included in log records and audit events and used to
+// key TenantRateLimit.
+func (mux *Mux) SetTenants(opts TenantOptions) {
+    n := 0
+    for _, set := range []bool{opts.Domain != "", opts.Header != "", opts.PathPrefix} {
+        if set {
+            n++
+        }
+    }
+    if n != 1 {
+        panic("cmux: exactly one of Domain, Header and PathPrefix must be set")
+    }
+    opts.Domain = strings.ToLower(strings.TrimPrefix(opts.Domain, "."))
+    mux.tenants = &opts
+}
+
+// Tenant returns the tenant of a request served by a mux, or an empty
+// string if it has none, see SetTenants.
+func Tenant(r *http.Request) TenantID {
+    if rs := requestState(r.Context()); rs != nil {
+        return rs.tenant
+    }
+    return ""
+}
+
+// resolveTenant sets the tenant of the request, stripping it from the path
+// of r if it is resolved from the path prefix.
+func (rs *reqState) resolveTenant(r *http.Request) error {
+    opts := rs.mux.tenants
+    var tenant string
+    switch {
+    case opts.Domain != "":
+        host := strings.ToLower(r.Host)
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        if sub, ok := strings.CutSuffix(host, "." + opts.Domain); ok && !strings.Contains(sub, ".") {
+            tenant = sub
+        }
+    case opts.Header != "":
+        tenant = r.Header.Get(opts.Header)
+    case opts.PathPrefix:
+        seg, rest, _ := strings.Cut(r.URL.Path[1:], "/")
+        if seg != "" {
+            tenant = seg
+            u := *r.URL
+            u.Path, u.RawPath = "/" + rest, ""
+            if esc := r.URL.EscapedPath(); strings.HasPrefix(esc, "/") {
+                if _, escRest, ok := strings.Cut(esc[1:], "/"); ok {
+                    u.RawPath = "/" + escRest
+                }
+            }
+            r.URL = &u
+        }
+    }
+    if tenant == "" {
+        if opts.Required {
+            return ErrNotFound
+        }
+        return nil
+    }
+    rs.tenant = TenantID(tenant)
+    if opts.Validate != nil {
+        return opts.Validate(r, rs.tenant)
+    }
+    return nil
+}
+
+// RateLimit is the rate of requests accepted by TenantRateLimit.
+type RateLimit struct {
+    Rate  float64 /* requests per second, 0 accepts no requests */
+    Burst int     /* requests accepted at once, default the rate rounded up */
+}
+
+// TenantRateLimit limits the rate of requests of each tenant using a token
+// bucket, rejecting excess requests with 429 Too Many Requests and a
+// Retry-After header. The limit of a tenant is returned by limit, e.g.
+// depending on its plan, and is shared by all routes the option is passed
+// to, e.g. all routes of a group. Requests without a tenant share a limit.
+func TenantRateLimit(limit func(tenant TenantID) RateLimit) RouteOption {
+    rl := &rateLimiter{limit: limit, buckets: map[TenantID]*bucket{}, now: time.Now}
+    return func(o *routeOptions) {
+        o.before = append(o.before, func(w http.ResponseWriter, r *http.Request, _ any) error {
+            if wait := rl.take(Tenant(r)); wait > 0 {
+                w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+                return ErrTooManyRequests
+            }
+            return nil
+        })
+    }
+}
+
+func (l RateLimit) burst() float64 {
+    if l.Burst > 0 {
+        return float64(l.Burst)
+    }
+    return max(math.Ceil(l.Rate), 1)
+}
+
+/* maxIdleBuckets is the number of buckets kept before full buckets are dropped */
+const maxIdleBuckets = 4096
+
+type rateLimiter struct {
+    limit   func(TenantID) RateLimit
+    mutex   sync.Mutex
+    buckets map[TenantID]*bucket
+    now     func() time.Time
+}
+
+type bucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// take takes a token from the bucket of tenant, returning how long to wait
+// for a token if there is none.
+func (rl *rateLimiter) take(tenant TenantID) time.Duration {
+    limit := rl.limit(tenant)
+    if limit.Rate <= 0 {
+        return time.Hour
+    }
+    burst := limit.burst()
+    now := rl.now()
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+    b := rl.buckets[tenant]
+    if b == nil {
+        if len(rl.buckets) >= maxIdleBuckets {
+            rl.sweep(now)
+        }
+        b = &bucket{tokens: burst, last: now}
+        rl.buckets[tenant] = b
+    }
+    b.tokens = min(b.tokens + now.Sub(b.last).Seconds() * limit.Rate, burst)
+    b.last = now
+    if b.tokens >= 1 {
+        b.tokens--
+        return 0
+    }
+    return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+/* sweep drops the buckets that have been refilled, as they equal new buckets */
+func (rl *rateLimiter) sweep(now time.Time) {
+    for tenant, b := range rl.buckets {
+        limit := rl.limit(tenant)
+        if b.tokens + now.Sub(b.last).Seconds() * limit.Rate >= limit.burst() {
+            delete(rl.buckets, tenant)
+        }
+    }
+}
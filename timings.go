@@ -0,0 +1,121 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "fmt"
+    "io"
+    "sort"
+    "sync/atomic"
+    "time"
+)
+
+/* latency buckets double from 100µs, the last bucket catches the rest */
+const(
+    histBase    = 100 * time.Microsecond
+    histBuckets = 20
+)
+
+type histogram struct {
+    counts [histBuckets + 1]atomic.Uint64
+    sum    atomic.Int64 /* nanoseconds */
+}
+
+func (h *histogram) observe(d time.Duration) {
+    i := 0
+    for bound := histBase; i < histBuckets && d > bound; bound *= 2 {
+        i++
+    }
+    h.counts[i].Add(1)
+    h.sum.Add(int64(d))
+}
+
+// HistogramBucket counts the requests taking at most UpperBound and more
+// than the bound of the previous bucket. The last bucket has no upper bound.
+type HistogramBucket struct {
+    UpperBound time.Duration `json:"le"`
+    Count      uint64        `json:"count"`
+}
+
+// TimingStats summarizes the latencies of a route. Percentiles are
+// estimated using the upper bounds of the histogram buckets.
+type TimingStats struct {
+    Count   uint64            `json:"count"`
+    Mean    float64           `json:"mean_ms"`
+    P50     float64           `json:"p50_ms"`
+    P90     float64           `json:"p90_ms"`
+    P99     float64           `json:"p99_ms"`
+    Buckets []HistogramBucket `json:"buckets"`
+}
+
+func (h *histogram) stats() TimingStats {
+    var ts TimingStats
+    bound := histBase
+    for i := range h.counts {
+        b := HistogramBucket{Count: h.counts[i].Load()}
+        if i < histBuckets {
+            b.UpperBound = bound
+            bound *= 2
+        }
+        ts.Count += b.Count
+        ts.Buckets = append(ts.Buckets, b)
+    }
+    if ts.Count == 0 {
+        return ts
+    }
+    ts.Mean = float64(h.sum.Load()) / float64(ts.Count) / float64(time.Millisecond)
+    pct := func(p uint64) float64 {
+        target := (ts.Count * p + 99) / 100
+        var acc uint64
+        for _, b := range ts.Buckets {
+            if acc += b.Count; acc >= target {
+                if b.UpperBound == 0 {
+                    /* overflow bucket, report its lower bound */
+                    return float64(histBase << (histBuckets - 1)) / float64(time.Millisecond)
+                }
+                return float64(b.UpperBound) / float64(time.Millisecond)
+            }
+        }
+        return 0
+    }
+    ts.P50, ts.P90, ts.P99 = pct(50), pct(90), pct(99)
+    return ts
+}
+
+// EnableTimingHistograms aggregates the latencies of each route in a
+// histogram, retrievable using TimingHistograms and DumpTimings. Unlike
+// EnableDebugTimings nothing is logged per request, and the overhead is a
+// few atomic additions per request.
+func (mux *Mux) EnableTimingHistograms(enable bool) {
+    mux.timingHists.Store(enable)
+}
+
+// TimingHistograms returns the latency statistics of each route that has
+// served requests, keyed by method and pattern, e.g. "GET /users/{id}".
+func (mux *Mux) TimingHistograms() map[string]TimingStats {
+    stats := map[string]TimingStats{}
+    if root := mux.tree.Load(); root != nil {
+        root.each(func(mh *MethodHandler) {
+            if ts := mh.hist.stats(); ts.Count > 0 {
+                stats[mh.method + " " + mh.pattern] = ts
+            }
+        })
+    }
+    return stats
+}
+
+// DumpTimings writes the latency percentiles of each route to w.
+func (mux *Mux) DumpTimings(w io.Writer) {
+    stats := mux.TimingHistograms()
+    keys := make([]string, 0, len(stats))
+    for k := range stats {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        ts := stats[k]
+        fmt.Fprintf(w, "%s count=%d mean=%.3fms p50=%.3fms p90=%.3fms p99=%.3fms\n",
+                    k, ts.Count, ts.Mean, ts.P50, ts.P90, ts.P99)
+    }
+}
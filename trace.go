@@ -0,0 +1,234 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "context"
+    "encoding/json"
+    "io"
+    "log/slog"
+    "math/rand/v2"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+)
+
+// DebugRecord is a trace of a single request recorded in debug mode.
+// Headers and bodies are redacted and truncated according to the
+// DebugOptions of the mux.
+type DebugRecord struct {
+    Time           time.Time     `json:"time"`
+    Method         string        `json:"method"`
+    URL            string        `json:"url"`
+    Pattern        string        `json:"pattern,omitempty"`
+    RequestHeader  http.Header   `json:"request_header,omitempty"`
+    RequestBody    string        `json:"request_body,omitempty"`
+    Status         int           `json:"status"`
+    ResponseHeader http.Header   `json:"response_header,omitempty"`
+    ResponseBody   string        `json:"response_body,omitempty"`
+    Duration       time.Duration `json:"duration"`
+    Err            string        `json:"error,omitempty"`
+}
+
+// DebugSink receives the records of traced requests. Implementations must
+// be safe for concurrent use.
+type DebugSink interface {
+    Record(rec *DebugRecord)
+}
+
+// DebugSinkFunc adapts a function to the DebugSink interface.
+type DebugSinkFunc func(rec *DebugRecord)
+
+func (fn DebugSinkFunc) Record(rec *DebugRecord) {
+    fn(rec)
+}
+
+type writerSink struct {
+    mutex sync.Mutex
+    w     io.Writer
+}
+
+// WriterSink writes debug records to w as JSON lines.
+func WriterSink(w io.Writer) DebugSink {
+    return &writerSink{w: w}
+}
+
+func (s *writerSink) Record(rec *DebugRecord) {
+    b, err := json.Marshal(rec)
+    if err != nil {
+        return
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.w.Write(append(b, '\n'))
+}
+
+// SlogSink logs debug records to logger at debug level.
+func SlogSink(logger *slog.Logger) DebugSink {
+    return DebugSinkFunc(func(rec *DebugRecord) {
+        logger.LogAttrs(context.Background(), slog.LevelDebug, "request",
+            slog.String("method", rec.Method),
+            slog.String("url", rec.URL),
+            slog.String("pattern", rec.Pattern),
+            slog.Any("request_header", rec.RequestHeader),
+            slog.String("request_body", rec.RequestBody),
+            slog.Int("status", rec.Status),
+            slog.Any("response_header", rec.ResponseHeader),
+            slog.String("response_body", rec.ResponseBody),
+            slog.Duration("duration", rec.Duration),
+            slog.String("error", rec.Err),
+        )
+    })
+}
+
+// RingSink keeps the most recent debug records in memory.
+type RingSink struct {
+    mutex   sync.Mutex
+    records ring[DebugRecord]
+}
+
+// NewRingSink creates a RingSink keeping the last size records.
+func NewRingSink(size int) *RingSink {
+    return &RingSink{records: newRing[DebugRecord](size)}
+}
+
+func (s *RingSink) Record(rec *DebugRecord) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.records.add(*rec)
+}
+
+// Records returns the kept records, oldest first.
+func (s *RingSink) Records() []DebugRecord {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.records.all()
+}
+
+// DebugOptions configures the request traces recorded in debug mode.
+type DebugOptions struct {
+    Sink          DebugSink /* default WriterSink(os.Stderr) */
+    SampleRate    float64   /* share of requests traced, 0 traces all */
+    // RedactHeaders and RedactFields override the Headers and Fields of
+    // the Redaction of the mux for traces, see SetRedaction.
+    RedactHeaders []string
+    RedactFields  []string
+    MaxBodySize   int /* bytes of each body kept, default 4096 */
+}
+
+// SetDebugOptions enables debug mode with the specified options.
+func (mux *Mux) SetDebugOptions(opts DebugOptions) {
+    if opts.Sink == nil {
+        opts.Sink = WriterSink(os.Stderr)
+    }
+    if opts.MaxBodySize <= 0 {
+        opts.MaxBodySize = 4096
+    }
+    mux.debugOpts.Store(&opts)
+}
+
+/* trace records a sampled request while it is served */
+type trace struct {
+    opts    *DebugOptions
+    red     *Redaction
+    rec     DebugRecord
+    reqBody []byte
+    reqTee  *limitedBuffer /* the request body as read, if not read ahead */
+    resBody *limitedBuffer
+}
+
+func (mux *Mux) startTrace(w *responseWriter, r *http.Request) *trace {
+    opts := mux.debugOpts.Load()
+    if opts == nil || (opts.SampleRate > 0 && rand.Float64() >= opts.SampleRate) {
+        return nil
+    }
+    red := *mux.redaction()
+    if opts.RedactHeaders != nil {
+        red.Headers = opts.RedactHeaders
+    }
+    if opts.RedactFields != nil {
+        red.Fields = opts.RedactFields
+    }
+    t := &trace{
+        opts: opts,
+        red:  &red,
+        rec:  DebugRecord{
+            Time:          time.Now(),
+            Method:        r.Method,
+            URL:           red.url(r.URL),
+            RequestHeader: red.header(r.Header),
+        },
+        resBody: &limitedBuffer{limit: opts.MaxBodySize},
+    }
+    if expectsContinue(r) && r.ContentLength != 0 {
+        /* reading ahead would send 100 Continue before the checks of
+         * ExpectContinue, so record the body as it is read instead */
+        t.reqTee = &limitedBuffer{limit: opts.MaxBodySize}
+        r.Body = struct{
+            io.Reader
+            io.Closer
+        }{io.TeeReader(r.Body, t.reqTee), r.Body}
+    } else {
+        /* peek at the body, leaving it intact for the handler */
+        head, _ := io.ReadAll(io.LimitReader(r.Body, int64(opts.MaxBodySize)))
+        t.reqBody = head
+        r.Body = struct{
+            io.Reader
+            io.Closer
+        }{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+    }
+    w.ResponseWriter = &teeWriter{ResponseWriter: w.ResponseWriter, tee: t.resBody}
+    return t
+}
+
+func (t *trace) finish(rs *reqState, w *responseWriter, r *http.Request, err error) {
+    oc := rs.outcome(w, r, err)
+    t.rec.Pattern = oc.Pattern
+    t.rec.Status = oc.Status
+    t.rec.Duration = oc.Duration
+    if err != nil {
+        t.rec.Err = err.Error()
+    }
+    if t.reqTee != nil {
+        t.reqBody = t.reqTee.Bytes()
+    }
+    t.rec.RequestBody = t.red.body(t.reqBody)
+    t.rec.ResponseHeader = t.red.header(w.Header())
+    t.rec.ResponseBody = t.red.body(t.resBody.Bytes())
+    t.opts.Sink.Record(&t.rec)
+}
+
+/* limitedBuffer keeps the first limit bytes written to it */
+type limitedBuffer struct {
+    bytes.Buffer
+    limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+    if n := b.limit - b.Len(); n > 0 {
+        b.Buffer.Write(p[:min(n, len(p))])
+    }
+    return len(p), nil
+}
+
+/* teeWriter copies the body of a response to tee */
+type teeWriter struct {
+    http.ResponseWriter
+    tee io.Writer
+}
+
+func (tw *teeWriter) Write(b []byte) (int, error) {
+    tw.tee.Write(b)
+    return tw.ResponseWriter.Write(b)
+}
+
+func (tw *teeWriter) Flush() {
+    http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+func (tw *teeWriter) Unwrap() http.ResponseWriter {
+    return tw.ResponseWriter
+}
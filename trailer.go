@@ -0,0 +1,51 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "net/http"
+)
+
+// Trailers writes the HTTP trailers of a response, which are sent after the
+// body, e.g. the checksum or record count of a streamed export.
+type Trailers struct {
+    w http.ResponseWriter
+}
+
+// DeclareTrailers announces the names of the trailers of a response in the
+// Trailer header, which must happen before the response is written, and
+// returns a Trailers setting them on w, e.g.
+//
+//  t := cmux.DeclareTrailers(req.ResponseWriter, "X-Record-Count")
+//  return cmux.StreamNDJSON(func(yield func(Record) bool) {
+//      n := 0
+//      for r := range records {
+//          if !yield(r) {
+//              return
+//          }
+//          n++
+//      }
+//      t.Set("X-Record-Count", strconv.Itoa(n))
+//  })
+//
+// Trailers are only sent with chunked HTTP/1.1 and with HTTP/2 responses,
+// which the server uses for responses declaring trailers.
+func DeclareTrailers(w http.ResponseWriter, names ...string) *Trailers {
+    for _, name := range names {
+        w.Header().Add("Trailer", http.CanonicalHeaderKey(name))
+    }
+    return &Trailers{w}
+}
+
+// Set sets a trailer, replacing any value set before. It must be called
+// before the handler returns, and may be called for trailers that have
+// not been declared, which some clients ignore.
+func (t *Trailers) Set(name, value string) {
+    t.w.Header().Set(http.TrailerPrefix + name, value)
+}
+
+// Add adds a value to a trailer.
+func (t *Trailers) Add(name, value string) {
+    t.w.Header().Add(http.TrailerPrefix + name, value)
+}
@@ -0,0 +1,250 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "fmt"
+    "reflect"
+    "slices"
+    "sort"
+    "strings"
+)
+
+// ProblemKind is the kind of a Problem.
+type ProblemKind string
+
+const(
+    // ProblemAmbiguous is reported for path variables of the same path
+    // section accepting the same values, so the route matching a request
+    // depends on the order of registration.
+    ProblemAmbiguous   ProblemKind = "ambiguous"
+    // ProblemUnreachable is reported for routes whose requests are matched
+    // by a route registered earlier.
+    ProblemUnreachable ProblemKind = "unreachable"
+    // ProblemUnusedField is reported for metadata fields tagged as path
+    // variables which no pattern using the metadata type references.
+    ProblemUnusedField ProblemKind = "unused_field"
+    // ProblemMissingField is reported for path variables not stored in the
+    // corresponding field of the metadata of a route, which happens when
+    // routes sharing a path variable use different metadata types.
+    ProblemMissingField ProblemKind = "missing_field"
+)
+
+// Problem is an issue of the route table found by Validate.
+type Problem struct {
+    Kind    ProblemKind `json:"kind"`
+    Pattern string      `json:"pattern"`
+    Message string      `json:"message"`
+}
+
+func (p Problem) String() string {
+    return string(p.Kind) + " " + p.Pattern + ": " + p.Message
+}
+
+// Validate checks the route table for ambiguous path variables, routes
+// shadowed by routes registered earlier, metadata fields tagged as path
+// variables but never referenced and path variables not stored in the
+// metadata of their routes. It can be called in tests or at startup, e.g.
+//
+//  for _, p := range m.Validate() {
+//      log.Println(p)
+//  }
+//
+// Routes are checked by matching a sample path for every route, so path
+// variables of custom types are only checked if they accept a sample value
+// such as "1" or "x".
+func (mux *Mux) Validate() []Problem {
+    root := mux.tree.Load()
+    if root == nil {
+        return nil
+    }
+    v := &validator{
+        root:     root,
+        labels:   map[reflect.Type]map[string]bool{},
+        patterns: map[reflect.Type]string{},
+    }
+    v.walk(root, "", nil, nil, true)
+    v.unusedFields()
+    sort.Slice(v.problems, func(i, j int) bool {
+        a, b := v.problems[i], v.problems[j]
+        if a.Pattern != b.Pattern {
+            return a.Pattern < b.Pattern
+        }
+        if a.Kind != b.Kind {
+            return a.Kind < b.Kind
+        }
+        return a.Message < b.Message
+    })
+    return v.problems
+}
+
+type validator struct {
+    root     *node
+    problems []Problem
+    labels   map[reflect.Type]map[string]bool /* the path variables referenced per metadata type */
+    patterns map[reflect.Type]string /* a pattern using each metadata type */
+}
+
+func (v *validator) report(kind ProblemKind, pattern, format string, args ...any) {
+    v.problems = append(v.problems, Problem{kind, pattern, fmt.Sprintf(format, args...)})
+}
+
+// walk checks the routes of the tree rooted at n, which is reached by
+// pattern through the matchers on the path and, if sampled, is matched by
+// the sample dirs.
+func (v *validator) walk(n *node, pattern string, matchers []fmtMatcher, sample []string, sampled bool) {
+    if len(n.methodHandlers) > 0 {
+        v.checkRoute(n, matchers, sample, sampled)
+    }
+    for i, m := range n.matchers {
+        candidates := sampleCandidates(m)
+        for _, prev := range n.matchers[:i] {
+            for _, val := range candidates {
+                if seg := m.Prefix + val + m.Suffix; acceptsSegment(m, seg) && acceptsSegment(prev, seg) {
+                    v.report(ProblemAmbiguous, pattern + "/" + matcherPattern(m),
+                             "{%s} and {%s} both match %q", prev.Label, m.Label, seg)
+                    break
+                }
+            }
+        }
+        seg, ok := sampleSegment(m, candidates, n, n.matchers[:i])
+        v.walk(m.Node, pattern + "/" + matcherPattern(m), append(slices.Clip(matchers), m),
+               append(slices.Clip(sample), seg), sampled && ok)
+    }
+    for dir, c := range n.m {
+        v.walk(c, pattern + "/" + dir, matchers, append(slices.Clip(sample), dir), sampled)
+    }
+}
+
+func (v *validator) checkRoute(n *node, matchers []fmtMatcher, sample []string, sampled bool) {
+    pattern := routePattern(n)
+    if n.metadataType != nil {
+        labels := v.labels[n.metadataType]
+        if labels == nil {
+            labels = map[string]bool{}
+            v.labels[n.metadataType] = labels
+            v.patterns[n.metadataType] = pattern
+        }
+        parsers := parseStruct(n.metadata)
+        for _, m := range matchers {
+            labels[m.Label] = true
+            p, ok := parsers[m.Label]
+            if !ok {
+                v.report(ProblemMissingField, pattern, "%s has no field for path variable {%s}",
+                         n.metadataType, m.Label)
+            } else if p.Offset != m.FieldParser.Offset || p.Type != m.FieldParser.Type {
+                v.report(ProblemMissingField, pattern,
+                         "path variable {%s} is stored in the field of another metadata type than %s",
+                         m.Label, n.metadataType)
+            }
+        }
+    }
+    if !sampled {
+        return
+    }
+    if match, _, _, _ := v.root.matchDir(sample, nil); match != n && match != nil {
+        v.report(ProblemUnreachable, pattern, "requests such as %q are matched by %s",
+                 "/" + strings.Join(sample, "/"), routePattern(match))
+    }
+}
+
+/* routePattern returns the pattern of the route of n as registered */
+func routePattern(n *node) string {
+    for _, mh := range n.methodHandlers {
+        return mh.pattern
+    }
+    return ""
+}
+
+/* unusedFields reports tagged path variable fields no pattern references */
+func (v *validator) unusedFields() {
+    for t, labels := range v.labels {
+        for _, f := range reflect.VisibleFields(t.Elem()) {
+            name, _ := pathTag(f)
+            if name == "" || name == "-" || labels[name] {
+                continue
+            }
+            v.report(ProblemUnusedField, v.patterns[t], "field %s of %s is tagged as path variable {%s}, which no pattern references",
+                     f.Name, t, name)
+        }
+    }
+}
+
+func matcherPattern(m fmtMatcher) string {
+    return m.Prefix + "{" + m.Label + "}" + m.Suffix
+}
+
+/* sampleValues are tried as values of path variables when sampling routes */
+var sampleValues = []string{"1", "x", "true", "00000000-0000-0000-0000-000000000000", "2000-01-01"}
+
+// sampleCandidates returns the values tried as samples of the path
+// variable of m, preferring the allowed and default values of the field of
+// the metadata of a route below m.
+func sampleCandidates(m fmtMatcher) []string {
+    t := routeMetadataType(m.Node)
+    if t == nil {
+        return sampleValues
+    }
+    for _, f := range reflect.VisibleFields(t.Elem()) {
+        name, opts := pathTag(f)
+        if name != m.Label && (name != "" || strings.ToLower(f.Name) != m.Label) {
+            continue
+        }
+        if opts.oneof != nil {
+            return opts.oneof
+        } else if opts.dflt != nil {
+            return append([]string{*opts.dflt}, sampleValues...)
+        }
+        break
+    }
+    return sampleValues
+}
+
+// sampleSegment returns a path section matched by m, preferably one that
+// is not matched by the static dirs of n or the matchers preceding m.
+func sampleSegment(m fmtMatcher, candidates []string, n *node, prev []fmtMatcher) (string, bool) {
+    var fallback string
+    for _, val := range candidates {
+        seg := m.Prefix + val + m.Suffix
+        if !acceptsSegment(m, seg) {
+            continue
+        }
+        _, static := n.m[seg]
+        if !static && !slices.ContainsFunc(prev, func(p fmtMatcher) bool { return acceptsSegment(p, seg) }) {
+            return seg, true
+        }
+        if fallback == "" {
+            fallback = seg
+        }
+    }
+    return fallback, fallback != ""
+}
+
+/* routeMetadataType returns the metadata type of the first route at or below n */
+func routeMetadataType(n *node) reflect.Type {
+    if n.metadataType != nil {
+        return n.metadataType
+    }
+    for _, c := range n.m {
+        if t := routeMetadataType(c); t != nil {
+            return t
+        }
+    }
+    for _, m := range n.matchers {
+        if t := routeMetadataType(m.Node); t != nil {
+            return t
+        }
+    }
+    return nil
+}
+
+/* acceptsSegment reports whether m matches the path section seg */
+func acceptsSegment(m fmtMatcher, seg string) bool {
+    if !strings.HasPrefix(seg, m.Prefix) || !strings.HasSuffix(seg[len(m.Prefix):], m.Suffix) ||
+       m.FieldParser.Fn == nil {
+        return false
+    }
+    _, err := m.FieldParser.Fn(seg[len(m.Prefix):len(seg) - len(m.Suffix)])
+    return err == nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "net/http"
+    "slices"
+    "sync"
+)
+
+// Values is a per-request scratch space for passing data between Before
+// functions, handlers and After hooks without wrapping the request context
+// for every value. Values are read and written using typed keys, e.g.
+//
+//  var userKey = cmux.NewKey[*User]("user")
+//
+//  func authenticate(w http.ResponseWriter, r *http.Request, md *Md) error {
+//      userKey.Set(cmux.RequestValues(r), lookupUser(r))
+//      return nil
+//  }
+//
+//  func GetProfile(req *cmux.Request[cmux.EmptyBody, *Md]) error {
+//      user, _ := userKey.Get(req.Values)
+//      ...
+//  }
+//
+// Values is safe for concurrent use. Its storage is reused between
+// requests, so it must not be used after the After hooks of the request
+// have returned.
+type Values struct {
+    mu      sync.Mutex
+    entries *[]valueEntry /* from valuesPool, allocated on first Set */
+}
+
+type valueEntry struct {
+    key any
+    val any
+}
+
+var valuesPool = sync.Pool{
+    New: func() any {
+        entries := make([]valueEntry, 0, 4)
+        return &entries
+    },
+}
+
+// Key identifies a value of type T in Values. Keys are compared by
+// identity, so two keys created with the same name are distinct.
+type Key[T any] struct {
+    name string
+}
+
+// NewKey creates a key for values of type T. The name is only used for
+// debugging.
+func NewKey[T any](name string) *Key[T] {
+    return &Key[T]{name}
+}
+
+func (k *Key[T]) String() string {
+    return k.name
+}
+
+// Set sets the value of k in v.
+func (k *Key[T]) Set(v *Values, val T) {
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    if v.entries == nil {
+        v.entries = valuesPool.Get().(*[]valueEntry)
+    }
+    for i := range *v.entries {
+        if (*v.entries)[i].key == k {
+            (*v.entries)[i].val = val
+            return
+        }
+    }
+    *v.entries = append(*v.entries, valueEntry{k, val})
+}
+
+// Get returns the value of k in v, if any. v may be nil.
+func (k *Key[T]) Get(v *Values) (T, bool) {
+    var zero T
+    if v == nil {
+        return zero, false
+    }
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    if v.entries == nil {
+        return zero, false
+    }
+    for _, e := range *v.entries {
+        if e.key == k {
+            /* a nil interface value does not assert to T */
+            val, _ := e.val.(T)
+            return val, true
+        }
+    }
+    return zero, false
+}
+
+// Delete removes the value of k from v.
+func (k *Key[T]) Delete(v *Values) {
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    if v.entries == nil {
+        return
+    }
+    *v.entries = slices.DeleteFunc(*v.entries, func(e valueEntry) bool { return e.key == k })
+}
+
+// RequestValues returns the scratch space of a request served by a mux, or
+// nil for other requests. It is the same as Request.Values of the handler.
+func RequestValues(r *http.Request) *Values {
+    if rs := requestState(r.Context()); rs != nil {
+        return &rs.values
+    }
+    return nil
+}
+
+/* release returns the storage of v to the pool at the end of a request */
+func (v *Values) release() {
+    v.mu.Lock()
+    defer v.mu.Unlock()
+    if v.entries != nil {
+        clear(*v.entries)
+        *v.entries = (*v.entries)[:0]
+        valuesPool.Put(v.entries)
+        v.entries = nil
+    }
+}
@@ -0,0 +1,135 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "math/rand/v2"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+)
+
+type headerMatcher struct {
+    name  string
+    value string
+}
+
+// MatchHeader makes a handler only serve requests whose header name
+// contains value, allowing several handlers for the same path and method
+// to be passed to HandleFunc, e.g. for versioning through the Accept
+// header:
+//
+//  m.HandleFunc("/users", &Md{},
+//      cmux.Get(GetUsersV2, nil, cmux.MatchHeader("Accept", "application/vnd.myapi.v2+json")),
+//      cmux.Get(GetUsers, nil),
+//  )
+//
+// Header values are compared case-insensitively to each element of
+// comma-separated header lists, ignoring parameters such as ";q=0.9".
+// Handlers with header matchers are tried in the order they are passed
+// and before handlers without. Requests matching no handler are responded
+// to with 406 Not Acceptable.
+func MatchHeader(name, value string) RouteOption {
+    return func(o *routeOptions) {
+        o.headers = append(o.headers, headerMatcher{http.CanonicalHeaderKey(name), value})
+    }
+}
+
+func (hm *headerMatcher) matches(r *http.Request) bool {
+    for _, line := range r.Header.Values(hm.name) {
+        for _, elem := range strings.Split(line, ",") {
+            elem, _, _ = strings.Cut(elem, ";")
+            if strings.EqualFold(strings.TrimSpace(elem), hm.value) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Canary makes a handler serve the given percentage of the requests of a
+// route, the rest being served by the other handlers for the same method,
+// e.g. for gradually rolling out a new implementation:
+//
+//  m.HandleFunc("/users", &Md{},
+//      cmux.Get(GetUsersV2, nil, cmux.Canary(5)),
+//      cmux.Get(GetUsers, nil),
+//  )
+//
+// Clients can force the choice using an "X-Canary: true" or
+// "X-Canary: false" header. Outcome.Variant reports which handler served
+// a request.
+func Canary(percent float64) RouteOption {
+    return func(o *routeOptions) {
+        o.canary = percent
+    }
+}
+
+/* conditional reports whether the handler only serves some requests */
+func (mh *MethodHandler) conditional() bool {
+    return len(mh.opts.headers) > 0 || mh.opts.canary > 0
+}
+
+func (mh *MethodHandler) accepts(r *http.Request) bool {
+    for i := range mh.opts.headers {
+        if !mh.opts.headers[i].matches(r) {
+            return false
+        }
+    }
+    if mh.opts.canary > 0 {
+        if force, err := strconv.ParseBool(r.Header.Get("X-Canary")); err == nil {
+            return force
+        }
+        return rand.Float64() * 100 < mh.opts.canary
+    }
+    return true
+}
+
+// addVariant registers v as an alternative to the handler mh for the
+// same method.
+func (mh *MethodHandler) addVariant(v *MethodHandler) {
+    if len(mh.variants) == 0 {
+        mh.variants = []*MethodHandler{mh}
+    }
+    mh.variants = append(mh.variants, v)
+    /* conditional handlers first, in the order passed */
+    slices.SortStableFunc(mh.variants, func(a, b *MethodHandler) int {
+        if a.conditional() == b.conditional() {
+            return 0
+        } else if a.conditional() {
+            return -1
+        }
+        return 1
+    })
+}
+
+// selectVariant returns the handler of mh or its variants serving r, or
+// nil if none does. The matched header names are added to the Vary header.
+func (mh *MethodHandler) selectVariant(w http.ResponseWriter, r *http.Request) *MethodHandler {
+    variants := mh.variants
+    if len(variants) == 0 {
+        if !mh.conditional() {
+            return mh
+        }
+        variants = []*MethodHandler{mh}
+    }
+    var vary []string
+    for _, v := range variants {
+        for _, hm := range v.opts.headers {
+            if !slices.Contains(vary, hm.name) {
+                vary = append(vary, hm.name)
+            }
+        }
+    }
+    for _, name := range vary {
+        w.Header().Add("Vary", name)
+    }
+    for _, v := range variants {
+        if v.accepts(r) {
+            return v
+        }
+    }
+    return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "net/http"
+    "strings"
+)
+
+// ErrInvalidSignature is responded with 403 Forbidden when a body verifier
+// rejects a request body.
+var ErrInvalidSignature = errors.New("invalid body signature")
+
+// BodyVerifier verifies the raw body of a request, e.g. by checking an HMAC
+// signature sent in a request header.
+type BodyVerifier func(raw []byte, r *http.Request) error
+
+// VerifyBody runs verifiers over the raw request body before it is decoded,
+// e.g. to check webhook signatures. The handler still receives the typed
+// body. A rejected request is responded to with 403 Forbidden, unless the
+// verifier returns an error implementing HTTPErrorResponder.
+func VerifyBody(verifiers ...BodyVerifier) RouteOption {
+    return func(o *routeOptions) {
+        o.verifiers = append(o.verifiers, verifiers...)
+    }
+}
+
+// HMACSHA256 returns a BodyVerifier checking a hex encoded HMAC-SHA256 of
+// the body sent in the specified header after an optional prefix, e.g.
+// HMACSHA256("X-Hub-Signature-256", "sha256=", secret) for GitHub webhooks.
+func HMACSHA256(header, prefix string, secret []byte) BodyVerifier {
+    return func(raw []byte, r *http.Request) error {
+        sig, ok := strings.CutPrefix(r.Header.Get(header), prefix)
+        if !ok {
+            return ErrInvalidSignature
+        }
+        expected, err := hex.DecodeString(sig)
+        if err != nil {
+            return ErrInvalidSignature
+        }
+        mac := hmac.New(sha256.New, secret)
+        mac.Write(raw)
+        if !hmac.Equal(mac.Sum(nil), expected) {
+            return ErrInvalidSignature
+        }
+        return nil
+    }
+}
+
+// readBody reads the whole request body and replaces it with an in-memory
+// copy, so it can still be decoded by the handler.
+func (rs *reqState) readBody(r *http.Request) ([]byte, error) {
+    if rs.rawBody != nil {
+        return rs.rawBody, nil
+    }
+    raw, err := io.ReadAll(r.Body)
+    if err != nil {
+        var mbe *http.MaxBytesError
+        if errors.As(err, &mbe) {
+            return nil, err
+        }
+        return nil, &codeResponder{
+            code:  http.StatusBadRequest,
+            error: err,
+        }
+    }
+    if raw == nil {
+        raw = []byte{}
+    }
+    rs.rawBody = raw
+    r.Body = io.NopCloser(bytes.NewReader(raw))
+    return raw, nil
+}
+
+// KeepRawBody makes the raw request body available as Request.RawBody
+// alongside the decoded body, e.g. for audit logging or hashing.
+func KeepRawBody() RouteOption {
+    return func(o *routeOptions) {
+        o.keepRawBody = true
+    }
+}
+
+func (rs *reqState) verifyBody(r *http.Request) error {
+    if len(rs.mh.opts.verifiers) == 0 {
+        if rs.mh.opts.keepRawBody {
+            _, err := rs.readBody(r)
+            return err
+        }
+        return nil
+    }
+    raw, err := rs.readBody(r)
+    if err != nil {
+        return err
+    }
+    for _, verify := range rs.mh.opts.verifiers {
+        if err := verify(raw, r); err != nil {
+            var her HTTPErrorResponder
+            if errors.As(err, &her) {
+                return err
+            }
+            return &codeResponder{
+                code:  http.StatusForbidden,
+                error: ErrInvalidSignature,
+                key:   "invalid_signature",
+            }
+        }
+    }
+    return nil
+}
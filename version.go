@@ -0,0 +1,184 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "net/http"
+    "slices"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Version is a route group below the path prefix of an API version, e.g.
+// "/v1", see Mux.Version.
+type Version struct {
+    group       *Group
+    name        string
+    deprecation *Deprecation
+}
+
+// Deprecation describes the deprecation of an API version.
+type Deprecation struct {
+    // Since is when the version was deprecated, sent in the Deprecation
+    // header. If zero, the Deprecation header is "true".
+    Since  time.Time
+    // Sunset, if not zero, is when the version will be removed, sent in
+    // the Sunset header.
+    Sunset time.Time
+    // Link, if set, is a URL documenting the deprecation, e.g. a migration
+    // guide, sent in a Link header with the relation "deprecation".
+    Link   string
+}
+
+// Version returns the route group of the API version name below the path
+// prefix "/" + name, e.g.
+//
+//  v1, v2 := m.Version("v1"), m.Version("v2")
+//  v1.HandleFunc("/users/{id}", &Md{}, cmux.Get(GetUserV1, nil))
+//  v2.HandleFunc("/users/{id}", &Md{}, cmux.Get(GetUser, nil))
+//
+// Calling Version again with the same name returns the same group, and the
+// options are only applied when the version is created. Versions should
+// be created from the oldest to the newest, see VersionReport.
+func (mux *Mux) Version(name string, opts ...RouteOption) *Version {
+    mux.mutex.Lock()
+    defer mux.mutex.Unlock()
+    for _, v := range mux.versions {
+        if v.name == name {
+            return v
+        }
+    }
+    v := &Version{name: name}
+    v.group = mux.Group("/" + name, append(slices.Clip(opts), v.deprecationHeaders())...)
+    mux.versions = append(mux.versions, v)
+    return v
+}
+
+// HandleFunc registers the method handlers at the path prefixed by the
+// version prefix, see Mux.HandleFunc.
+func (v *Version) HandleFunc(path string, metadata any, mhs ...MethodHandler) {
+    v.group.HandleFunc(path, metadata, mhs...)
+}
+
+// Group creates a route group below the version prefix inheriting the
+// options of the version.
+func (v *Version) Group(prefix string, opts ...RouteOption) *Group {
+    return v.group.Group(prefix, opts...)
+}
+
+// Deprecate marks the version as deprecated, adding Deprecation, Sunset
+// and Link headers to the responses of its routes. It must be called
+// before the mux serves requests.
+func (v *Version) Deprecate(d Deprecation) {
+    v.deprecation = &d
+}
+
+func (v *Version) deprecationHeaders() RouteOption {
+    return func(o *routeOptions) {
+        o.before = append(o.before, func(w http.ResponseWriter, r *http.Request, _ any) error {
+            d := v.deprecation
+            if d == nil {
+                return nil
+            }
+            h := w.Header()
+            if d.Since.IsZero() {
+                h.Set("Deprecation", "true")
+            } else {
+                h.Set("Deprecation", "@" + strconv.FormatInt(d.Since.Unix(), 10))
+            }
+            if !d.Sunset.IsZero() {
+                h.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+            }
+            if d.Link != "" {
+                h.Add("Link", "<" + d.Link + `>; rel="deprecation"`)
+            }
+            return nil
+        })
+    }
+}
+
+// VersionedRoute is a route missing from the newest API version.
+type VersionedRoute struct {
+    Method   string
+    // Path is the pattern of the route without the version prefix, e.g.
+    // "/users/{id}".
+    Path     string
+    // Versions are the versions serving the route, oldest first.
+    Versions []string
+}
+
+// VersionReport returns the routes which exist only in older API versions,
+// i.e. not in the version created last, e.g. to check that a new version
+// covers the endpoints of the versions it replaces. Routes are compared by
+// method and path, ignoring the names of path variables.
+func (mux *Mux) VersionReport() []VersionedRoute {
+    mux.mutex.Lock()
+    versions := slices.Clone(mux.versions)
+    mux.mutex.Unlock()
+    if len(versions) < 2 {
+        return nil
+    }
+    type routeKey struct {
+        method, path string
+    }
+    found := map[routeKey]*VersionedRoute{}
+    inNewest := map[routeKey]bool{}
+    var keys []routeKey
+    for _, ri := range mux.Routes() {
+        for i, v := range versions {
+            path, ok := strings.CutPrefix(ri.Pattern, "/" + v.name)
+            if !ok || path != "" && path[0] != '/' {
+                continue
+            }
+            k := routeKey{ri.Method, anonymizePattern(path)}
+            if i == len(versions) - 1 {
+                inNewest[k] = true
+                continue
+            }
+            vr := found[k]
+            if vr == nil {
+                vr = &VersionedRoute{Method: ri.Method, Path: path}
+                found[k] = vr
+                keys = append(keys, k)
+            }
+            vr.Versions = append(vr.Versions, v.name)
+        }
+    }
+    var report []VersionedRoute
+    for _, k := range keys {
+        if inNewest[k] {
+            continue
+        }
+        vr := found[k]
+        slices.SortFunc(vr.Versions, func(a, b string) int {
+            return slices.IndexFunc(versions, func(v *Version) bool { return v.name == a }) -
+                   slices.IndexFunc(versions, func(v *Version) bool { return v.name == b })
+        })
+        report = append(report, *vr)
+    }
+    sort.Slice(report, func(i, j int) bool {
+        if report[i].Path != report[j].Path {
+            return report[i].Path < report[j].Path
+        }
+        return report[i].Method < report[j].Method
+    })
+    return report
+}
+
+/* anonymizePattern removes the names of the path variables of a pattern */
+func anonymizePattern(pattern string) string {
+    var b strings.Builder
+    for {
+        start := strings.IndexByte(pattern, '{')
+        end := strings.IndexByte(pattern[max(start, 0):], '}')
+        if start < 0 || end < 0 {
+            b.WriteString(pattern)
+            return b.String()
+        }
+        b.WriteString(pattern[:start] + "{}")
+        pattern = pattern[start + end + 1:]
+    }
+}
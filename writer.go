@@ -0,0 +1,189 @@
+// Copyright 2024 Christian Thorseth Blach. All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package cmux
+import(
+    "bufio"
+    "errors"
+    "io"
+    "io/fs"
+    "net"
+    "net/http"
+    "os"
+)
+
+// ResponseRecorder is implemented by the http.ResponseWriter the mux passes
+// to Before functions and handlers, letting logging and metrics middleware
+// observe the response:
+//
+//  if rec, ok := w.(cmux.ResponseRecorder); ok {
+//      log.Println(rec.Status(), rec.BytesWritten())
+//  }
+//
+// The writer also supports http.Flusher, http.Hijacker, http.Pusher and
+// io.ReaderFrom when the underlying writer does, as well as
+// http.ResponseController.
+type ResponseRecorder interface {
+    http.ResponseWriter
+    // Status returns the status code written, or 0 if nothing is written yet.
+    Status() int
+    // BytesWritten returns the number of body bytes written.
+    BytesWritten() int64
+    // ClientAborted reports whether writing the response failed, typically
+    // because the client went away. Further writes fail with ErrClientAborted.
+    ClientAborted() bool
+}
+
+// ErrClientAborted is returned when writing to a response that has
+// previously failed to be written, typically because the client went away.
+var ErrClientAborted = errors.New("client aborted the request")
+
+// responseWriter wraps the http.ResponseWriter of a request, keeping track
+// of whether the response has been written to.
+//
+// Once a handler has written the header or body through req.ResponseWriter,
+// the mux does not encode anything returned by the handler, as the response
+// is already on its way to the client. Unexpected errors are still logged.
+type responseWriter struct {
+    http.ResponseWriter
+    wroteHeader bool
+    status      int
+    bytes       int64
+    writeErr    error
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+    if rw.wroteHeader {
+        return
+    }
+    if code >= 200 {
+        rw.wroteHeader = true
+        rw.status = code
+    }
+    rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+    if rw.writeErr != nil {
+        return 0, ErrClientAborted
+    }
+    rw.WriteHeader(http.StatusOK)
+    n, err := rw.ResponseWriter.Write(b)
+    rw.bytes += int64(n)
+    if err != nil {
+        rw.writeErr = err
+    }
+    return n, err
+}
+
+func (rw *responseWriter) Status() int {
+    return rw.status
+}
+
+func (rw *responseWriter) BytesWritten() int64 {
+    return rw.bytes
+}
+
+func (rw *responseWriter) ClientAborted() bool {
+    return rw.writeErr != nil
+}
+
+func (rw *responseWriter) Flush() {
+    rw.WriteHeader(http.StatusOK)
+    http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+    if err == nil {
+        rw.wroteHeader = true
+        rw.status = http.StatusSwitchingProtocols
+    }
+    return conn, brw, err
+}
+
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+    if pusher, ok := rw.ResponseWriter.(http.Pusher); ok {
+        return pusher.Push(target, opts)
+    }
+    return http.ErrNotSupported
+}
+
+/* writerOnly hides the ReadFrom method of a writer from io.Copy */
+type writerOnly struct {
+    io.Writer
+}
+
+func (rw *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+    if rw.writeErr != nil {
+        return 0, ErrClientAborted
+    }
+    rw.WriteHeader(http.StatusOK)
+    rf, ok := rw.ResponseWriter.(io.ReaderFrom)
+    if !ok {
+        /* rw.Write records the errors writing the response */
+        return io.Copy(writerOnly{rw}, r)
+    }
+    /* only errors writing the response are attributed to the client,
+     * errors reading r are returned as they are */
+    var sr *sourceReader
+    src := r
+    if !isFile(r) {
+        /* files are passed as they are, so the connection can send them
+         * using sendfile, and are told apart by their *fs.PathErrors */
+        sr = &sourceReader{Reader: r}
+        src = sr
+    }
+    n, err := rf.ReadFrom(src)
+    rw.bytes += n
+    var pe *fs.PathError
+    switch {
+    case err == nil:
+    case sr != nil && sr.err != nil:
+        return n, sr.err
+    case sr != nil || !errors.As(err, &pe):
+        rw.writeErr = err
+    }
+    return n, err
+}
+
+/* sourceReader records the error of reading the source of ReadFrom */
+type sourceReader struct {
+    io.Reader
+    err error
+}
+
+func (sr *sourceReader) Read(p []byte) (int, error) {
+    n, err := sr.Reader.Read(p)
+    if err != nil && err != io.EOF {
+        sr.err = err
+    }
+    return n, err
+}
+
+/* isFile reports whether r reads a file, as done by http.ServeContent */
+func isFile(r io.Reader) bool {
+    if lr, ok := r.(*io.LimitedReader); ok {
+        r = lr.R
+    }
+    _, ok := r.(*os.File)
+    return ok
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+    return rw.ResponseWriter
+}
+
+// clientAborted reports whether writing to w has failed.
+func clientAborted(w http.ResponseWriter) bool {
+    rw, ok := w.(*responseWriter)
+    return ok && rw.writeErr != nil
+}
+
+// written reports whether the response header of w has been written.
+func written(w http.ResponseWriter) bool {
+    rw, ok := w.(*responseWriter)
+    return ok && rw.wroteHeader
+}